@@ -0,0 +1,87 @@
+// Package audit records requests refused for authentication or
+// authorization, so brute-force attempts and misconfigured agents can be
+// reviewed. Every event is logged under the "audit" component and, when a
+// sink is set, also stored as a document.
+package audit
+
+import (
+	"context"
+	"time"
+
+	"auth-proxy/logging"
+)
+
+// Event is a request refused with 401 or 403.
+type Event struct {
+	Time       time.Time
+	Status     int
+	Reason     string
+	RemoteAddr string
+	Method     string
+	Path       string
+	UserAgent  string
+	// Subject and AccountID identify the credential when it could be read,
+	// even if it was not valid.
+	Subject   string
+	AccountID string
+}
+
+// Sink stores audit events as documents. storage.LogStorage implementations
+// satisfy it.
+type Sink interface {
+	StoreLogs(ctx context.Context, accountID string, logs []map[string]interface{}) error
+}
+
+// sink is set once at startup through SetSink.
+var sink Sink
+
+// SetSink makes Record also store events in s; nil only logs them.
+func SetSink(s Sink) {
+	sink = s
+}
+
+// Record logs event and stores it in the sink, if one is set. The request
+// ID ctx carries is recorded with it.
+func Record(ctx context.Context, event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	logging.Audit.WarnContext(ctx, "request rejected",
+		"status", event.Status,
+		"reason", event.Reason,
+		"remote_addr", event.RemoteAddr,
+		"method", event.Method,
+		"path", event.Path,
+		"user_agent", event.UserAgent,
+		"subject", event.Subject,
+		"account_id", event.AccountID,
+	)
+	if sink == nil {
+		return
+	}
+
+	document := map[string]interface{}{
+		"@timestamp":  event.Time.UTC().Format(time.RFC3339Nano),
+		"event":       "request_rejected",
+		"status":      event.Status,
+		"reason":      event.Reason,
+		"remote_addr": event.RemoteAddr,
+		"method":      event.Method,
+		"path":        event.Path,
+		"user_agent":  event.UserAgent,
+	}
+	if event.Subject != "" {
+		document["subject"] = event.Subject
+	}
+	if event.AccountID != "" {
+		document["account_id"] = event.AccountID
+	}
+	if requestID := logging.RequestID(ctx); requestID != "" {
+		document["request_id"] = requestID
+	}
+	// The response is written whether or not the event is stored, so the
+	// client disconnecting must not drop it.
+	if err := sink.StoreLogs(context.WithoutCancel(ctx), event.AccountID, []map[string]interface{}{document}); err != nil {
+		logging.Audit.WarnContext(ctx, "failed to store audit event", "reason", event.Reason, "error", err)
+	}
+}
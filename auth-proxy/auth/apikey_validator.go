@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// APIKeyValidator authenticates static API keys, for agents that cannot
+// manage JWTs. Keys are held only as SHA-256 digests.
+type APIKeyValidator struct {
+	accounts map[[sha256.Size]byte]int64
+}
+
+// NewAPIKeyValidator builds a validator from a map of API key to account ID.
+func NewAPIKeyValidator(keys map[string]string) (*APIKeyValidator, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("at least one API key must be provided")
+	}
+
+	accounts := make(map[[sha256.Size]byte]int64, len(keys))
+	for key, account := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("API keys must not be empty")
+		}
+		accountID, err := strconv.ParseInt(account, 10, 64)
+		if err != nil || accountID <= 0 {
+			return nil, fmt.Errorf("invalid account ID %q for API key", account)
+		}
+		accounts[sha256.Sum256([]byte(key))] = accountID
+	}
+	return &APIKeyValidator{accounts: accounts}, nil
+}
+
+// LoadAPIKeys reads a JSON object of API key to account ID from path.
+func LoadAPIKeys(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API keys file: %w", err)
+	}
+	var keys map[string]string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse API keys file: %w", err)
+	}
+	return keys, nil
+}
+
+// Validate looks up the account the API key belongs to.
+func (v *APIKeyValidator) Validate(ctx context.Context, key string) (*Claims, error) {
+	accountID, ok := v.accounts[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, fmt.Errorf("unknown API key")
+	}
+	return &Claims{AccountID: accountID, Subject: "api-key"}, nil
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CachedValidator remembers successfully validated tokens so repeated requests
+// from the same agent skip signature verification. Entries are evicted least
+// recently used first and never outlive the token's exp claim or ttl,
+// whichever comes first. Cached tokens are still checked against the
+// revocation list on every request, so revoking a token takes effect at the
+// list's next reload rather than when its entry expires.
+type CachedValidator struct {
+	next        Validator
+	size        int
+	ttl         time.Duration
+	revocations RevocationList
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[[sha256.Size]byte]*list.Element
+}
+
+type cachedClaims struct {
+	key     [sha256.Size]byte
+	claims  *Claims
+	expires time.Time
+}
+
+// NewCachedValidator caches the tokens next accepts. revocations, when not
+// nil, is consulted for cached tokens too.
+func NewCachedValidator(next Validator, size int, ttl time.Duration, revocations RevocationList) *CachedValidator {
+	return &CachedValidator{
+		next:        next,
+		size:        size,
+		ttl:         ttl,
+		revocations: revocations,
+		order:       list.New(),
+		entries:     make(map[[sha256.Size]byte]*list.Element, size),
+	}
+}
+
+func (c *CachedValidator) Validate(ctx context.Context, token string) (*Claims, error) {
+	key := sha256.Sum256([]byte(token))
+	if claims, ok := c.get(key); ok {
+		if c.revocations != nil && isRevoked(c.revocations, claims, hex.EncodeToString(key[:])) {
+			c.remove(key)
+			return nil, fmt.Errorf("token has been revoked")
+		}
+		return claims, nil
+	}
+
+	claims, err := c.next.Validate(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	c.put(key, claims)
+	return claims, nil
+}
+
+// ValidateCertificate passes client certificates straight through; the TLS
+// handshake has already done the expensive work.
+func (c *CachedValidator) ValidateCertificate(ctx context.Context, cert *x509.Certificate) (*Claims, error) {
+	certValidator, ok := c.next.(CertificateValidator)
+	if !ok {
+		return nil, fmt.Errorf("client certificates are not accepted")
+	}
+	return certValidator.ValidateCertificate(ctx, cert)
+}
+
+// ValidateSignature passes signed requests straight through, since every
+// body is different.
+func (c *CachedValidator) ValidateSignature(ctx context.Context, req SignedRequest) (*Claims, error) {
+	signatureValidator, ok := c.next.(SignatureValidator)
+	if !ok {
+		return nil, fmt.Errorf("signed requests are not accepted")
+	}
+	return signatureValidator.ValidateSignature(ctx, req)
+}
+
+func (c *CachedValidator) get(key [sha256.Size]byte) (*Claims, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cachedClaims)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.claims, true
+}
+
+func (c *CachedValidator) remove(key [sha256.Size]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+func (c *CachedValidator) put(key [sha256.Size]byte, claims *Claims) {
+	expires := time.Now().Add(c.ttl)
+	if claims.ExpiresAt != 0 {
+		if exp := time.Unix(claims.ExpiresAt, 0); exp.Before(expires) {
+			expires = exp
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = &cachedClaims{key: key, claims: claims, expires: expires}
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cachedClaims{key: key, claims: claims, expires: expires})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedClaims).key)
+	}
+}
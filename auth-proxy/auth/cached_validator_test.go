@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// countingValidator accepts every token as account 1 with the token as
+// its jti, counting the calls.
+type countingValidator struct {
+	calls int
+}
+
+func (v *countingValidator) Validate(ctx context.Context, token string) (*Claims, error) {
+	v.calls++
+	if token == "bad" {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return &Claims{AccountID: 1, ID: token}, nil
+}
+
+func TestCachedValidatorCaches(t *testing.T) {
+	next := &countingValidator{}
+	c := NewCachedValidator(next, 10, time.Minute, nil)
+	for i := 0; i < 3; i++ {
+		if _, err := c.Validate(context.Background(), "token"); err != nil {
+			t.Fatalf("Validate() error = %v", err)
+		}
+	}
+	if next.calls != 1 {
+		t.Errorf("next validator called %d times, want 1", next.calls)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Validate(context.Background(), "bad"); err == nil {
+			t.Fatal("Validate(bad) succeeded")
+		}
+	}
+	if next.calls != 3 {
+		t.Errorf("next validator called %d times, want failures not to be cached", next.calls)
+	}
+}
+
+func TestCachedValidatorChecksRevocationsOnHits(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry string
+	}{
+		{"jti", "jti:token"},
+		{"hash", "sha256:" + TokenHash("token")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revocations := &revocationSet{entries: map[string]struct{}{}}
+			next := &countingValidator{}
+			c := NewCachedValidator(next, 10, time.Hour, revocations)
+			if _, err := c.Validate(context.Background(), "token"); err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+
+			revocations.replace(map[string]struct{}{tt.entry: {}})
+			if _, err := c.Validate(context.Background(), "token"); err == nil {
+				t.Fatal("cached token accepted after it was revoked")
+			}
+			if next.calls != 1 {
+				t.Errorf("next validator called %d times, want the revocation found without it", next.calls)
+			}
+		})
+	}
+}
+
+func TestCachedValidatorEvictsLeastRecentlyUsed(t *testing.T) {
+	next := &countingValidator{}
+	c := NewCachedValidator(next, 2, time.Hour, nil)
+	for _, token := range []string{"a", "b", "a", "c", "a", "b"} {
+		if _, err := c.Validate(context.Background(), token); err != nil {
+			t.Fatalf("Validate(%s) error = %v", token, err)
+		}
+	}
+	// a stays cached throughout; b is evicted by c and validated again.
+	if next.calls != 4 {
+		t.Errorf("next validator called %d times, want 4", next.calls)
+	}
+}
+
+func TestCachedValidatorHonoursExpiry(t *testing.T) {
+	next := &countingValidator{}
+	c := NewCachedValidator(next, 10, time.Hour, nil)
+	key := [32]byte{}
+	c.put(key, &Claims{AccountID: 1, ExpiresAt: time.Now().Add(-time.Second).Unix()})
+	if _, ok := c.get(key); ok {
+		t.Error("expired claims returned from the cache")
+	}
+}
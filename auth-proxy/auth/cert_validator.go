@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CertificateValidator is implemented by validators that authenticate a
+// verified TLS client certificate rather than a token.
+type CertificateValidator interface {
+	ValidateCertificate(ctx context.Context, cert *x509.Certificate) (*Claims, error)
+}
+
+// CertValidator derives the account ID from a client certificate that the
+// TLS stack has already verified against the configured CA.
+type CertValidator struct {
+	// source is "ou" to read the first numeric OrganizationalUnit, or "uri"
+	// to read a URI SAN beginning with uriPrefix.
+	source    string
+	uriPrefix string
+}
+
+func NewCertValidator(source, uriPrefix string) (*CertValidator, error) {
+	switch source {
+	case "ou":
+	case "uri":
+		if uriPrefix == "" {
+			return nil, fmt.Errorf("a URI SAN prefix is required to read the account from a URI SAN")
+		}
+	default:
+		return nil, fmt.Errorf("unknown certificate account source %q", source)
+	}
+	return &CertValidator{source: source, uriPrefix: uriPrefix}, nil
+}
+
+// Validate always fails: this validator only accepts client certificates.
+func (v *CertValidator) Validate(ctx context.Context, token string) (*Claims, error) {
+	return nil, fmt.Errorf("client certificate required")
+}
+
+func (v *CertValidator) ValidateCertificate(ctx context.Context, cert *x509.Certificate) (*Claims, error) {
+	var account string
+	switch v.source {
+	case "ou":
+		if len(cert.Subject.OrganizationalUnit) > 0 {
+			account = cert.Subject.OrganizationalUnit[0]
+		}
+	case "uri":
+		for _, uri := range cert.URIs {
+			if s := uri.String(); strings.HasPrefix(s, v.uriPrefix) {
+				account = strings.TrimPrefix(s, v.uriPrefix)
+				break
+			}
+		}
+	}
+
+	accountID, err := strconv.ParseInt(account, 10, 64)
+	if err != nil || accountID <= 0 {
+		return nil, fmt.Errorf("client certificate does not carry an account ID")
+	}
+	return &Claims{
+		AccountID: accountID,
+		Issuer:    cert.Issuer.CommonName,
+		Subject:   cert.Subject.CommonName,
+	}, nil
+}
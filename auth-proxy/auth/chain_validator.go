@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+)
+
+// ChainValidator accepts a credential if any of its validators accepts it,
+// so a route can take, for example, either a JWT or an API key.
+type ChainValidator []Validator
+
+func (c ChainValidator) Validate(ctx context.Context, token string) (*Claims, error) {
+	err := fmt.Errorf("no validators configured")
+	for _, validator := range c {
+		var claims *Claims
+		if claims, err = validator.Validate(ctx, token); err == nil {
+			return claims, nil
+		}
+	}
+	return nil, err
+}
+
+// ValidateCertificate accepts cert if any validator in the chain that handles
+// client certificates accepts it.
+func (c ChainValidator) ValidateCertificate(ctx context.Context, cert *x509.Certificate) (*Claims, error) {
+	err := fmt.Errorf("no certificate validators configured")
+	for _, validator := range c {
+		certValidator, ok := validator.(CertificateValidator)
+		if !ok {
+			continue
+		}
+		var claims *Claims
+		if claims, err = certValidator.ValidateCertificate(ctx, cert); err == nil {
+			return claims, nil
+		}
+	}
+	return nil, err
+}
+
+// ValidateSignature accepts req if any validator in the chain that handles
+// signed requests accepts it.
+func (c ChainValidator) ValidateSignature(ctx context.Context, req SignedRequest) (*Claims, error) {
+	err := fmt.Errorf("no signature validators configured")
+	for _, validator := range c {
+		signatureValidator, ok := validator.(SignatureValidator)
+		if !ok {
+			continue
+		}
+		var claims *Claims
+		if claims, err = signatureValidator.ValidateSignature(ctx, req); err == nil {
+			return claims, nil
+		}
+	}
+	return nil, err
+}
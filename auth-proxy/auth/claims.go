@@ -1,18 +1,168 @@
 package auth
 
-import "fmt"
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// accountIDFormat is the fmt verb used to render account IDs. It is set once
+// at startup through SetAccountIDFormat, before anything reads it, and is
+// not guarded for concurrent use.
+var accountIDFormat = "%d"
+
+// Scopes understood by the proxy's routes. ScopeAdmin satisfies any scope.
+const (
+	ScopeLogsWrite = "logs:write"
+	ScopeLogsRead  = "logs:read"
+	ScopeAdmin     = "admin"
+)
+
+// defaultScopes are granted to credentials that carry no scope claim, such as
+// API keys, client certificates and tokens issued before scopes existed. It is
+// set once at startup through SetDefaultScopes.
+var defaultScopes = []string{ScopeLogsWrite}
 
 type Claims struct {
 	AccountID int64  `json:"accountId"`
+	ID        string `json:"jti,omitempty"`
+	// RootID is the jti of the token a chain of refreshed tokens started
+	// from, so revoking that token revokes the whole chain.
+	RootID    string `json:"rjti,omitempty"`
 	Issuer    string `json:"iss,omitempty"`
 	Subject   string `json:"sub,omitempty"`
 	IssuedAt  int64  `json:"iat,omitempty"`
 	ExpiresAt int64  `json:"exp,omitempty"`
+	// Scopes is nil when the credential carried no scope claim.
+	Scopes []string `json:"scope,omitempty"`
 }
 
 func (c *Claims) GetAccountID() string {
 	if c.AccountID != 0 {
-		return fmt.Sprintf("%d", c.AccountID)
+		return FormatAccountID(c.AccountID)
 	}
 	return ""
 }
+
+// FormatAccountID renders accountID the way GetAccountID does, so settings
+// keyed by the numeric account ID can be matched against it.
+func FormatAccountID(accountID int64) string {
+	return fmt.Sprintf(accountIDFormat, accountID)
+}
+
+// HasScope reports whether the credential grants scope, falling back to the
+// default scopes when it carried none.
+func (c *Claims) HasScope(scope string) bool {
+	scopes := c.Scopes
+	if scopes == nil {
+		scopes = defaultScopes
+	}
+	for _, s := range scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// SetDefaultScopes changes the scopes granted to credentials without a scope
+// claim. An empty list makes such credentials unusable on scoped routes.
+func SetDefaultScopes(scopes []string) {
+	defaultScopes = append([]string{}, scopes...)
+}
+
+// SetAccountIDFormat changes how GetAccountID renders account IDs, e.g.
+// "%010d" for zero-padding or "acct-%d" for a prefix. The format must hold
+// exactly one %d verb, with optional flags and width; a rejected format
+// leaves the current one in place. It must be called once at startup, before any request is served:
+// it changes a global without locking, and changing it later would store
+// an account's logs under two names.
+func SetAccountIDFormat(format string) error {
+	verbs := strings.ReplaceAll(format, "%%", "")
+	if strings.Count(verbs, "%") != 1 {
+		return fmt.Errorf("account ID format %q must contain exactly one verb", format)
+	}
+	// Other verbs that take an integer, such as %c or %q, do not render
+	// it as a number.
+	if !decimalVerb.MatchString(verbs) {
+		return fmt.Errorf("account ID format %q must use a %%d verb", format)
+	}
+	accountIDFormat = format
+	return nil
+}
+
+// decimalVerb matches a %d verb with optional flags and width.
+var decimalVerb = regexp.MustCompile(`%[-+ 0]*[0-9]*d`)
+
+// UnverifiedClaims returns the subject and account ID of a JWT without
+// checking its signature or expiry, or nil when token is not a JWT. It is
+// only for describing rejected credentials in audit events and must never
+// authorize anything.
+func UnverifiedClaims(token string) *Claims {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+	var raw struct {
+		Subject   string         `json:"sub"`
+		AccountID accountIDClaim `json:"accountId"`
+	}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil
+	}
+	return &Claims{Subject: raw.Subject, AccountID: int64(raw.AccountID)}
+}
+
+// accountIDClaim decodes an accountId claim encoded as a JSON integer, a
+// float with no fractional part, or a numeric string.
+type accountIDClaim int64
+
+func (a *accountIDClaim) UnmarshalJSON(data []byte) error {
+	raw := strings.TrimSpace(string(data))
+	if raw == "null" {
+		return nil
+	}
+	if strings.HasPrefix(raw, `"`) {
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return err
+		}
+		raw = strings.TrimSpace(raw)
+	}
+
+	if id, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		*a = accountIDClaim(id)
+		return nil
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil || f != math.Trunc(f) || math.Abs(f) > math.MaxInt64 {
+		return fmt.Errorf("accountId %s is not an integer", data)
+	}
+	*a = accountIDClaim(f)
+	return nil
+}
+
+// scopeClaim decodes the OAuth2 space-delimited "scope" string as well as the
+// JSON array form some issuers put in "scp".
+type scopeClaim []string
+
+func (s *scopeClaim) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*s = list
+		return nil
+	}
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("scope %s is neither a string nor a list", data)
+	}
+	*s = strings.Fields(raw)
+	return nil
+}
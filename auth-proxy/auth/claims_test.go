@@ -0,0 +1,59 @@
+package auth
+
+import "testing"
+
+func TestSetAccountIDFormat(t *testing.T) {
+	t.Cleanup(func() { SetAccountIDFormat("%d") })
+
+	tests := []struct {
+		format  string
+		want    string
+		wantErr bool
+	}{
+		{format: "%d", want: "42"},
+		{format: "%010d", want: "0000000042"},
+		{format: "acct-%d", want: "acct-42"},
+		{format: "100%%-%d", want: "100%-42"},
+		{format: "acct", wantErr: true},
+		{format: "%d-%d", wantErr: true},
+		{format: "%s", wantErr: true},
+		{format: "%d%%", want: "42%"},
+		{format: "%x", wantErr: true},
+		{format: "%c", wantErr: true},
+		{format: "%q", wantErr: true},
+		{format: "%%", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			if err := SetAccountIDFormat("%d"); err != nil {
+				t.Fatalf("SetAccountIDFormat(%%d) error = %v", err)
+			}
+			err := SetAccountIDFormat(tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetAccountIDFormat(%q) error = %v, want error %v", tt.format, err, tt.wantErr)
+			}
+			want := tt.want
+			if tt.wantErr {
+				// A rejected format leaves the previous one in place.
+				want = "42"
+			}
+			claims := &Claims{AccountID: 42}
+			if got := claims.GetAccountID(); got != want {
+				t.Errorf("GetAccountID() = %q, want %q", got, want)
+			}
+			if got := FormatAccountID(42); got != want {
+				t.Errorf("FormatAccountID(42) = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestGetAccountIDWithoutAccount(t *testing.T) {
+	if err := SetAccountIDFormat("acct-%d"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetAccountIDFormat("%d") })
+	if got := (&Claims{}).GetAccountID(); got != "" {
+		t.Errorf("GetAccountID() = %q, want empty for claims without an account", got)
+	}
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignedRequest is the part of an HMAC-signed request that is authenticated.
+type SignedRequest struct {
+	AccountID string
+	// Timestamp is the signing time in Unix seconds.
+	Timestamp string
+	// Signature is the hex HMAC-SHA256 of Timestamp + "." + Body, optionally
+	// prefixed with "sha256=".
+	Signature string
+	Body      []byte
+}
+
+// SignatureValidator is implemented by validators that authenticate a signed
+// request body rather than a token.
+type SignatureValidator interface {
+	ValidateSignature(ctx context.Context, req SignedRequest) (*Claims, error)
+}
+
+// HMACValidator verifies requests signed with a secret shared per account,
+// for agents that cannot hold a JWT. Signatures older or newer than maxSkew
+// are rejected so captured requests go stale quickly.
+type HMACValidator struct {
+	secrets map[int64][]byte
+	maxSkew time.Duration
+}
+
+// NewHMACValidator builds a validator from a map of account ID to secret.
+func NewHMACValidator(secrets map[string]string, maxSkew time.Duration) (*HMACValidator, error) {
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("at least one HMAC secret must be provided")
+	}
+
+	byAccount := make(map[int64][]byte, len(secrets))
+	for account, secret := range secrets {
+		accountID, err := strconv.ParseInt(account, 10, 64)
+		if err != nil || accountID <= 0 {
+			return nil, fmt.Errorf("invalid account ID %q for HMAC secret", account)
+		}
+		if secret == "" {
+			return nil, fmt.Errorf("HMAC secret for account %s must not be empty", account)
+		}
+		byAccount[accountID] = []byte(secret)
+	}
+	return &HMACValidator{secrets: byAccount, maxSkew: maxSkew}, nil
+}
+
+// Validate always fails: this validator only accepts signed requests.
+func (v *HMACValidator) Validate(ctx context.Context, token string) (*Claims, error) {
+	return nil, fmt.Errorf("signed request required")
+}
+
+func (v *HMACValidator) ValidateSignature(ctx context.Context, req SignedRequest) (*Claims, error) {
+	accountID, err := strconv.ParseInt(req.AccountID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid account ID %q", req.AccountID)
+	}
+	secret, ok := v.secrets[accountID]
+	if !ok {
+		return nil, fmt.Errorf("no HMAC secret for account %d", accountID)
+	}
+
+	timestamp, err := strconv.ParseInt(req.Timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature timestamp %q", req.Timestamp)
+	}
+	signedAt := time.Unix(timestamp, 0)
+	if skew := time.Since(signedAt); skew > v.maxSkew || skew < -v.maxSkew {
+		return nil, fmt.Errorf("signature timestamp outside the allowed window")
+	}
+
+	signature, err := hex.DecodeString(strings.TrimPrefix(req.Signature, "sha256="))
+	if err != nil {
+		return nil, fmt.Errorf("signature is not hex encoded")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(req.Timestamp))
+	mac.Write([]byte("."))
+	mac.Write(req.Body)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("signature mismatch")
+	}
+
+	return &Claims{AccountID: accountID, Subject: "hmac", IssuedAt: timestamp}, nil
+}
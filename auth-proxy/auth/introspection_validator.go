@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxIntrospectionCacheEntries bounds the cache so a flood of distinct tokens
+// cannot grow it without limit.
+const maxIntrospectionCacheEntries = 10000
+
+// IntrospectionOptions configures an IntrospectionValidator.
+type IntrospectionOptions struct {
+	URL          string
+	ClientID     string
+	ClientSecret string
+	Timeout      time.Duration
+	// CacheTTL is how long an active result is reused. It is never longer
+	// than the token's own expiry. Zero disables caching.
+	CacheTTL time.Duration
+	// AccountClaim is the response member holding the account ID.
+	AccountClaim string
+}
+
+// IntrospectionValidator validates opaque or JWT access tokens by asking an
+// RFC 7662 introspection endpoint, so the proxy can sit behind an existing IdP.
+type IntrospectionValidator struct {
+	opts   IntrospectionOptions
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]introspectionResult
+}
+
+type introspectionResult struct {
+	claims  *Claims
+	expires time.Time
+}
+
+func NewIntrospectionValidator(opts IntrospectionOptions) (*IntrospectionValidator, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("introspection URL must be provided")
+	}
+	if opts.AccountClaim == "" {
+		opts.AccountClaim = "accountId"
+	}
+	return &IntrospectionValidator{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+		cache:  make(map[[sha256.Size]byte]introspectionResult),
+	}, nil
+}
+
+func (v *IntrospectionValidator) Validate(ctx context.Context, token string) (*Claims, error) {
+	key := sha256.Sum256([]byte(token))
+	if claims, ok := v.cached(key); ok {
+		return claims, nil
+	}
+
+	claims, err := v.introspect(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	v.store(key, claims)
+	return claims, nil
+}
+
+func (v *IntrospectionValidator) introspect(ctx context.Context, token string) (*Claims, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.opts.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build introspection request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if v.opts.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(v.opts.ClientID), url.QueryEscape(v.opts.ClientSecret))
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("introspection request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint returned status %d", resp.StatusCode)
+	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode introspection response: %w", err)
+	}
+	if active, _ := body["active"].(bool); !active {
+		return nil, fmt.Errorf("token is not active")
+	}
+
+	accountID, ok := accountIDFromClaim(body[v.opts.AccountClaim])
+	if !ok {
+		return nil, fmt.Errorf("%s not found in introspection response", v.opts.AccountClaim)
+	}
+
+	claims := &Claims{AccountID: accountID}
+	claims.Issuer, _ = body["iss"].(string)
+	claims.Subject, _ = body["sub"].(string)
+	claims.ID, _ = body["jti"].(string)
+	if scope, ok := body["scope"].(string); ok {
+		claims.Scopes = strings.Fields(scope)
+	}
+	if iat, ok := body["iat"].(float64); ok {
+		claims.IssuedAt = int64(iat)
+	}
+	if exp, ok := body["exp"].(float64); ok {
+		claims.ExpiresAt = int64(exp)
+	}
+	return claims, nil
+}
+
+func (v *IntrospectionValidator) cached(key [sha256.Size]byte) (*Claims, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	result, ok := v.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(result.expires) {
+		delete(v.cache, key)
+		return nil, false
+	}
+	return result.claims, true
+}
+
+func (v *IntrospectionValidator) store(key [sha256.Size]byte, claims *Claims) {
+	if v.opts.CacheTTL <= 0 {
+		return
+	}
+	expires := time.Now().Add(v.opts.CacheTTL)
+	if claims.ExpiresAt != 0 {
+		if exp := time.Unix(claims.ExpiresAt, 0); exp.Before(expires) {
+			expires = exp
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.cache) >= maxIntrospectionCacheEntries {
+		now := time.Now()
+		for k, result := range v.cache {
+			if now.After(result.expires) {
+				delete(v.cache, k)
+			}
+		}
+		if len(v.cache) >= maxIntrospectionCacheEntries {
+			return
+		}
+	}
+	v.cache[key] = introspectionResult{claims: claims, expires: expires}
+}
+
+// accountIDFromClaim accepts an account ID encoded as a JSON number or a
+// numeric string.
+func accountIDFromClaim(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case float64:
+		if v > 0 && v == float64(int64(v)) {
+			return int64(v), true
+		}
+	case string:
+		if id, err := strconv.ParseInt(v, 10, 64); err == nil && id > 0 {
+			return id, true
+		}
+	}
+	return 0, false
+}
@@ -2,47 +2,85 @@ package auth
 
 import (
 	"context"
-	"crypto/rsa"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// DefaultAlgorithms are the signing algorithms accepted when none are configured.
+var DefaultAlgorithms = []string{"RS256", "RS384", "RS512"}
+
+// ValidatorOptions tunes which tokens a JWTValidator accepts.
+type ValidatorOptions struct {
+	// Algorithms is the allow-list of JWS "alg" values, e.g. RS256, ES256,
+	// ES384 or EdDSA. Defaults to DefaultAlgorithms.
+	Algorithms []string
+	// Revocations, when set, is consulted for every token after its
+	// signature has been verified.
+	Revocations RevocationList
+	// Issuer and Audience, when non-empty, must match the token's iss and
+	// aud claims.
+	Issuer   string
+	Audience string
+	// Leeway tolerates clock skew between the signer and the proxy when
+	// checking exp, nbf and iat.
+	Leeway time.Duration
+}
+
 type JWTValidator struct {
-	publicKey *rsa.PublicKey
+	keys        KeySet
+	parser      *jwt.Parser
+	revocations RevocationList
 }
 
-func NewJWTValidator(publicKeyPEM string) (*JWTValidator, error) {
-	if publicKeyPEM == "" {
-		return nil, fmt.Errorf("public key must be provided")
+func NewJWTValidator(keys KeySet, options ValidatorOptions) (*JWTValidator, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("key set must be provided")
+	}
+	if len(options.Algorithms) == 0 {
+		options.Algorithms = DefaultAlgorithms
+	}
+	for _, alg := range options.Algorithms {
+		if jwt.GetSigningMethod(alg) == nil || alg == "none" || strings.HasPrefix(alg, "HS") {
+			return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+		}
 	}
 
-	pemBytes := normalizePEM(publicKeyPEM)
-	publicKey, err := jwt.ParseRSAPublicKeyFromPEM(pemBytes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	parserOptions := []jwt.ParserOption{jwt.WithValidMethods(options.Algorithms)}
+	if options.Issuer != "" {
+		parserOptions = append(parserOptions, jwt.WithIssuer(options.Issuer))
+	}
+	if options.Audience != "" {
+		parserOptions = append(parserOptions, jwt.WithAudience(options.Audience))
+	}
+	if options.Leeway > 0 {
+		parserOptions = append(parserOptions, jwt.WithLeeway(options.Leeway))
 	}
 
-	return &JWTValidator{publicKey: publicKey}, nil
+	return &JWTValidator{
+		keys:        keys,
+		parser:      jwt.NewParser(parserOptions...),
+		revocations: options.Revocations,
+	}, nil
 }
 
-// Validate parses and validates a JWT token using RSA signature verification.
-// It extracts the accountId claim and returns it along with issuer and subject.
+// Validate parses and validates a JWT token, verifying its signature with one
+// of the configured public keys and an allow-listed algorithm.
+// It extracts the accountId claim and returns it along with issuer, subject
+// and scopes.
 func (v *JWTValidator) Validate(ctx context.Context, tokenString string) (*Claims, error) {
 	type CustomClaims struct {
-		AccountID int64 `json:"accountId"`
+		AccountID accountIDClaim `json:"accountId"`
+		Scope     scopeClaim     `json:"scope"`
+		Scp       scopeClaim     `json:"scp"`
+		RootID    string         `json:"rjti"`
 		jwt.RegisteredClaims
 	}
 
-	// Parse token with RSA signature verification
-	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Verify the signing method is RSA
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return v.publicKey, nil
-	})
+	// The parser rejects any alg outside the allow-list before the key is used.
+	token, err := v.parser.ParseWithClaims(tokenString, &CustomClaims{}, v.verificationKey)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse token: %w", err)
@@ -59,15 +97,51 @@ func (v *JWTValidator) Validate(ctx context.Context, tokenString string) (*Claim
 	}
 
 	// Validate accountId exists
-	if customClaims.AccountID == 0 {
+	if customClaims.AccountID <= 0 {
 		return nil, fmt.Errorf("accountId not found in token")
 	}
 
-	return &Claims{
-		AccountID: customClaims.AccountID,
+	claims := &Claims{
+		AccountID: int64(customClaims.AccountID),
+		ID:        customClaims.ID,
+		RootID:    customClaims.RootID,
 		Issuer:    customClaims.Issuer,
 		Subject:   customClaims.Subject,
-	}, nil
+	}
+	if v.revocations != nil && isRevoked(v.revocations, claims, TokenHash(tokenString)) {
+		return nil, fmt.Errorf("token has been revoked")
+	}
+	if customClaims.Scope != nil {
+		claims.Scopes = customClaims.Scope
+	} else if customClaims.Scp != nil {
+		claims.Scopes = customClaims.Scp
+	}
+	if customClaims.IssuedAt != nil {
+		claims.IssuedAt = customClaims.IssuedAt.Unix()
+	}
+	if customClaims.ExpiresAt != nil {
+		claims.ExpiresAt = customClaims.ExpiresAt.Unix()
+	}
+	return claims, nil
+}
+
+// verificationKey picks the keys matching the token's kid header, or every
+// known key when the token carries no kid.
+func (v *JWTValidator) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	keys := v.keys.Keys(kid)
+	switch len(keys) {
+	case 0:
+		return nil, fmt.Errorf("no verification key for kid %q", kid)
+	case 1:
+		return keys[0], nil
+	}
+
+	set := jwt.VerificationKeySet{Keys: make([]jwt.VerificationKey, len(keys))}
+	for i, key := range keys {
+		set.Keys[i] = key
+	}
+	return set, nil
 }
 
 func normalizePEM(s string) []byte {
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"crypto"
+	"fmt"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// KeySet provides the public keys a token may be verified with.
+type KeySet interface {
+	// Keys returns the candidate verification keys for kid. An empty kid
+	// returns every known key.
+	Keys(kid string) []crypto.PublicKey
+}
+
+// staticKeySet holds keys configured at startup, indexed by kid. Keys
+// configured without a kid are stored under "".
+type staticKeySet struct {
+	byKid   map[string]crypto.PublicKey
+	unnamed []crypto.PublicKey
+	all     []crypto.PublicKey
+}
+
+// NewPEMKeySet parses RSA, ECDSA or Ed25519 public keys in PEM form keyed by kid, tolerating
+// the quoting and escaped newlines that env files tend to introduce. A key
+// with an empty kid is used for tokens whose kid does not match any other key.
+func NewPEMKeySet(pems map[string]string) (KeySet, error) {
+	if len(pems) == 0 {
+		return nil, fmt.Errorf("public key must be provided")
+	}
+
+	set := &staticKeySet{byKid: make(map[string]crypto.PublicKey)}
+	for kid, publicKeyPEM := range pems {
+		if publicKeyPEM == "" {
+			return nil, fmt.Errorf("public key for kid %q is empty", kid)
+		}
+		publicKey, err := parsePublicKeyPEM(normalizePEM(publicKeyPEM))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key %q: %w", kid, err)
+		}
+
+		set.all = append(set.all, publicKey)
+		if kid == "" {
+			set.unnamed = append(set.unnamed, publicKey)
+		} else {
+			set.byKid[kid] = publicKey
+		}
+	}
+	return set, nil
+}
+
+// Keys selects the key registered for kid. Tokens without a kid are tried
+// against every key.
+func (s *staticKeySet) Keys(kid string) []crypto.PublicKey {
+	if kid == "" {
+		return s.all
+	}
+	if key, ok := s.byKid[kid]; ok {
+		return []crypto.PublicKey{key}
+	}
+	return s.unnamed
+}
+
+// multiKeySet merges several key sets, e.g. a static key and a JWKS endpoint.
+type multiKeySet []KeySet
+
+// CombineKeySets returns a key set that consults each of sets in order.
+func CombineKeySets(sets ...KeySet) KeySet {
+	if len(sets) == 1 {
+		return sets[0]
+	}
+	return multiKeySet(sets)
+}
+
+func (m multiKeySet) Keys(kid string) []crypto.PublicKey {
+	var keys []crypto.PublicKey
+	for _, set := range m {
+		keys = append(keys, set.Keys(kid)...)
+	}
+	return keys
+}
+
+// ReloadableKeySet is a PEM key set whose keys can be replaced at runtime,
+// e.g. when they are refreshed from a secret store.
+type ReloadableKeySet struct {
+	mu  sync.RWMutex
+	set KeySet
+}
+
+// NewReloadableKeySet parses pems as NewPEMKeySet does.
+func NewReloadableKeySet(pems map[string]string) (*ReloadableKeySet, error) {
+	set, err := NewPEMKeySet(pems)
+	if err != nil {
+		return nil, err
+	}
+	return &ReloadableKeySet{set: set}, nil
+}
+
+// Set replaces every key. The previous keys stay in use if pems is invalid.
+func (r *ReloadableKeySet) Set(pems map[string]string) error {
+	set, err := NewPEMKeySet(pems)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.set = set
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *ReloadableKeySet) Keys(kid string) []crypto.PublicKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.set.Keys(kid)
+}
+
+// parsePublicKeyPEM accepts any public key type supported for verification.
+func parsePublicKeyPEM(pemBytes []byte) (crypto.PublicKey, error) {
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(pemBytes); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(pemBytes); err == nil {
+		return key, nil
+	}
+	key, err := jwt.ParseEdPublicKeyFromPEM(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("not an RSA, ECDSA or Ed25519 public key")
+	}
+	return key, nil
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RevocationList reports whether a token has been revoked, either by its jti
+// claim or by the SHA-256 of the whole token.
+type RevocationList interface {
+	IsRevoked(jti, tokenHash string) bool
+}
+
+// isRevoked reports whether claims, verified from a token with the hex
+// SHA-256 tokenHash, were revoked themselves or through the token their
+// refresh chain started from.
+func isRevoked(revocations RevocationList, claims *Claims, tokenHash string) bool {
+	if revocations.IsRevoked(claims.ID, tokenHash) {
+		return true
+	}
+	return claims.RootID != "" && revocations.IsRevoked(claims.RootID, "")
+}
+
+// TokenHash returns the hex SHA-256 of a raw token, the form revocation
+// entries use for tokens that carry no jti.
+func TokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// revocationSet is an in-memory snapshot that is swapped wholesale on reload.
+type revocationSet struct {
+	mu      sync.RWMutex
+	entries map[string]struct{}
+}
+
+func (s *revocationSet) IsRevoked(jti, tokenHash string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if jti != "" {
+		if _, ok := s.entries["jti:"+jti]; ok {
+			return true
+		}
+	}
+	_, ok := s.entries["sha256:"+tokenHash]
+	return ok
+}
+
+func (s *revocationSet) replace(entries map[string]struct{}) {
+	s.mu.Lock()
+	s.entries = entries
+	s.mu.Unlock()
+}
+
+// reloadEvery calls load on every tick and swaps in the result, keeping the
+// previous snapshot if loading fails.
+func (s *revocationSet) reloadEvery(interval time.Duration, source string, load func() (map[string]struct{}, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		entries, err := load()
+		if err != nil {
+			logger.Warn("failed to reload revocation list, keeping previous entries", "source", source, "error", err)
+			continue
+		}
+		s.replace(entries)
+	}
+}
+
+// NewFileRevocationList loads revoked tokens from path, one entry per line in
+// the form "jti:<id>" or "sha256:<hex>". Blank lines and lines starting with #
+// are ignored. The file is reloaded every interval.
+func NewFileRevocationList(path string, interval time.Duration) (RevocationList, error) {
+	load := func() (map[string]struct{}, error) {
+		return loadRevocationFile(path)
+	}
+	entries, err := load()
+	if err != nil {
+		return nil, err
+	}
+	set := &revocationSet{entries: entries}
+	go set.reloadEvery(interval, path, load)
+	return set, nil
+}
+
+func loadRevocationFile(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open revocation list: %w", err)
+	}
+	defer f.Close()
+
+	entries := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "jti:") && !strings.HasPrefix(line, "sha256:") {
+			return nil, fmt.Errorf("invalid revocation entry %q", line)
+		}
+		entries[line] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read revocation list: %w", err)
+	}
+	return entries, nil
+}
+
+// NewRedisRevocationList loads revoked tokens from the Redis set key, using
+// the same entry format as the file list, and reloads it every interval.
+func NewRedisRevocationList(redisURL, key string, interval time.Duration) (RevocationList, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	client := redis.NewClient(opts)
+
+	load := func() (map[string]struct{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		members, err := client.SMembers(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		entries := make(map[string]struct{}, len(members))
+		for _, member := range members {
+			entries[member] = struct{}{}
+		}
+		return entries, nil
+	}
+	entries, err := load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load revocation list from Redis: %w", err)
+	}
+	set := &revocationSet{entries: entries}
+	go set.reloadEvery(interval, "redis", load)
+	return set, nil
+}
@@ -0,0 +1,214 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TenantStatus reports whether an account has been suspended or offboarded,
+// so its credentials stop working before they expire.
+type TenantStatus interface {
+	Suspended(ctx context.Context, accountID int64) bool
+}
+
+// suspendedSet is an in-memory snapshot of suspended accounts that is
+// swapped wholesale on reload.
+type suspendedSet struct {
+	mu       sync.RWMutex
+	accounts map[int64]struct{}
+}
+
+func (s *suspendedSet) Suspended(ctx context.Context, accountID int64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.accounts[accountID]
+	return ok
+}
+
+// reloadEvery calls load on every tick and swaps in the result, keeping the
+// previous snapshot if loading fails.
+func (s *suspendedSet) reloadEvery(interval time.Duration, source string, load func() (map[int64]struct{}, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		accounts, err := load()
+		if err != nil {
+			logger.Warn("failed to reload suspended accounts, keeping previous list", "source", source, "error", err)
+			continue
+		}
+		s.mu.Lock()
+		s.accounts = accounts
+		s.mu.Unlock()
+	}
+}
+
+// NewFileTenantStatus reads suspended account IDs from path, one per line.
+// Blank lines and lines starting with # are ignored. The file is reloaded
+// every interval.
+func NewFileTenantStatus(path string, interval time.Duration) (TenantStatus, error) {
+	load := func() (map[int64]struct{}, error) {
+		return loadSuspendedFile(path)
+	}
+	accounts, err := load()
+	if err != nil {
+		return nil, err
+	}
+	set := &suspendedSet{accounts: accounts}
+	go set.reloadEvery(interval, path, load)
+	return set, nil
+}
+
+func loadSuspendedFile(path string) (map[int64]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open suspended accounts file: %w", err)
+	}
+	defer f.Close()
+
+	accounts := make(map[int64]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		accountID, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid account ID %q in suspended accounts file", line)
+		}
+		accounts[accountID] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read suspended accounts file: %w", err)
+	}
+	return accounts, nil
+}
+
+// NewRedisTenantStatus loads suspended account IDs from the Redis set key and
+// reloads it every interval.
+func NewRedisTenantStatus(redisURL, key string, interval time.Duration) (TenantStatus, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+	client := redis.NewClient(opts)
+
+	load := func() (map[int64]struct{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		members, err := client.SMembers(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		accounts := make(map[int64]struct{}, len(members))
+		for _, member := range members {
+			accountID, err := strconv.ParseInt(member, 10, 64)
+			if err != nil {
+				logger.Warn("ignoring invalid suspended account in Redis", "member", member)
+				continue
+			}
+			accounts[accountID] = struct{}{}
+		}
+		return accounts, nil
+	}
+	accounts, err := load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load suspended accounts from Redis: %w", err)
+	}
+	set := &suspendedSet{accounts: accounts}
+	go set.reloadEvery(interval, "redis", load)
+	return set, nil
+}
+
+// HTTPTenantStatus looks accounts up in a tenant service. The URL template's
+// {accountId} placeholder is replaced with the account ID, and the service
+// answers {"status": "..."}; any status other than "active" blocks the
+// account, while 404 means the service does not track it. Answers are cached
+// for ttl. When the service is unreachable the last known answer is used, and
+// unknown accounts are let through so an outage does not stop ingestion.
+type HTTPTenantStatus struct {
+	urlTemplate string
+	ttl         time.Duration
+	client      *http.Client
+
+	mu    sync.Mutex
+	cache map[int64]tenantStatusResult
+}
+
+type tenantStatusResult struct {
+	suspended bool
+	expires   time.Time
+}
+
+func NewHTTPTenantStatus(urlTemplate string, ttl, timeout time.Duration) (*HTTPTenantStatus, error) {
+	if !strings.Contains(urlTemplate, "{accountId}") {
+		return nil, fmt.Errorf("tenant status URL must contain {accountId}")
+	}
+	return &HTTPTenantStatus{
+		urlTemplate: urlTemplate,
+		ttl:         ttl,
+		client:      &http.Client{Timeout: timeout},
+		cache:       make(map[int64]tenantStatusResult),
+	}, nil
+}
+
+func (t *HTTPTenantStatus) Suspended(ctx context.Context, accountID int64) bool {
+	t.mu.Lock()
+	cached, ok := t.cache[accountID]
+	t.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.suspended
+	}
+
+	suspended, err := t.lookup(ctx, accountID)
+	if err != nil {
+		logger.WarnContext(ctx, "failed to look up account status, using last known status", "account_id", FormatAccountID(accountID), "error", err)
+		return cached.suspended
+	}
+
+	t.mu.Lock()
+	t.cache[accountID] = tenantStatusResult{suspended: suspended, expires: time.Now().Add(t.ttl)}
+	t.mu.Unlock()
+	return suspended
+}
+
+func (t *HTTPTenantStatus) lookup(ctx context.Context, accountID int64) (bool, error) {
+	target := strings.ReplaceAll(t.urlTemplate, "{accountId}", url.PathEscape(strconv.FormatInt(accountID, 10)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to build tenant status request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("tenant status request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("tenant status endpoint returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return false, fmt.Errorf("failed to decode tenant status response: %w", err)
+	}
+	return body.Status != "active", nil
+}
@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TokenIssuer signs short-lived tokens that carry over the account, subject
+// and scopes of an already authenticated caller, so agents can rotate their
+// credentials without a long-lived JWT.
+type TokenIssuer struct {
+	kid      string
+	issuer   string
+	audience string
+	maxTTL   time.Duration
+
+	mu     sync.RWMutex
+	key    crypto.Signer
+	method jwt.SigningMethod
+	// previous is the public half of the key replaced by the last SetKey,
+	// kept so tokens issued just before a rotation stay valid.
+	previous crypto.PublicKey
+}
+
+// IssuedToken is a freshly signed token and its expiry.
+type IssuedToken struct {
+	Token     string
+	ExpiresAt time.Time
+}
+
+// NewTokenIssuer signs with an RSA, ECDSA (P-256/P-384) or Ed25519 private
+// key in PEM form. Tokens are stamped with kid, issuer and audience and never
+// live longer than maxTTL.
+func NewTokenIssuer(keyPEM []byte, kid, issuer, audience string, maxTTL time.Duration) (*TokenIssuer, error) {
+	key, method, err := parseSigningKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenIssuer{
+		kid:      kid,
+		issuer:   issuer,
+		audience: audience,
+		maxTTL:   maxTTL,
+		key:      key,
+		method:   method,
+	}, nil
+}
+
+// LoadTokenIssuer is NewTokenIssuer for a key read from the file at path.
+func LoadTokenIssuer(path, kid, issuer, audience string, maxTTL time.Duration) (*TokenIssuer, error) {
+	keyPEM, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token signing key: %w", err)
+	}
+	return NewTokenIssuer(keyPEM, kid, issuer, audience, maxTTL)
+}
+
+// SetKey replaces the signing key, e.g. after it was rotated in a secret
+// store. The new key must use the same algorithm so the validator's
+// allow-list keeps matching.
+func (i *TokenIssuer) SetKey(keyPEM []byte) error {
+	key, method, err := parseSigningKey(keyPEM)
+	if err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if method != i.method {
+		return fmt.Errorf("new signing key uses %s, want %s", method.Alg(), i.method.Alg())
+	}
+	i.previous = i.key.Public()
+	i.key = key
+	return nil
+}
+
+func parseSigningKey(keyPEM []byte) (crypto.Signer, jwt.SigningMethod, error) {
+	key, err := parsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse token signing key: %w", err)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return key, jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve.Params().Name {
+		case "P-256":
+			return key, jwt.SigningMethodES256, nil
+		case "P-384":
+			return key, jwt.SigningMethodES384, nil
+		}
+		return nil, nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		return key, jwt.SigningMethodEdDSA, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported private key type %T", key)
+}
+
+// Algorithm returns the JWS alg of issued tokens.
+func (i *TokenIssuer) Algorithm() string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.method.Alg()
+}
+
+// MaxTTL returns the longest lifetime an issued token may have.
+func (i *TokenIssuer) MaxTTL() time.Duration {
+	return i.maxTTL
+}
+
+// Keys makes the issuer a KeySet for its own public keys, so the tokens it
+// signs are accepted by the JWT validator.
+func (i *TokenIssuer) Keys(kid string) []crypto.PublicKey {
+	if kid == "" || kid == i.kid {
+		i.mu.RLock()
+		defer i.mu.RUnlock()
+		if i.previous != nil {
+			return []crypto.PublicKey{i.key.Public(), i.previous}
+		}
+		return []crypto.PublicKey{i.key.Public()}
+	}
+	return nil
+}
+
+// Issue signs a token for claims that expires after ttl, capped at the
+// issuer's maximum. A non-positive ttl uses the maximum. When claims come
+// from an expiring token, the new token expires no later than it, so tokens
+// cannot be refreshed past the lifetime of the first; and it carries the
+// jti the chain started from as rjti, so revoking that jti revokes it.
+func (i *TokenIssuer) Issue(claims *Claims, ttl time.Duration) (*IssuedToken, error) {
+	if ttl <= 0 || ttl > i.maxTTL {
+		ttl = i.maxTTL
+	}
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return nil, fmt.Errorf("failed to generate token ID: %w", err)
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	if claims.ExpiresAt > 0 {
+		if parentExpiry := time.Unix(claims.ExpiresAt, 0); parentExpiry.Before(expiresAt) {
+			expiresAt = parentExpiry
+		}
+	}
+	tokenClaims := jwt.MapClaims{
+		"accountId": claims.AccountID,
+		"jti":       hex.EncodeToString(jti),
+		"iat":       now.Unix(),
+		"nbf":       now.Unix(),
+		"exp":       expiresAt.Unix(),
+	}
+	if claims.Subject != "" {
+		tokenClaims["sub"] = claims.Subject
+	}
+	if rootID := claims.RootID; rootID != "" {
+		tokenClaims["rjti"] = rootID
+	} else if claims.ID != "" {
+		tokenClaims["rjti"] = claims.ID
+	}
+	if claims.Scopes != nil {
+		tokenClaims["scope"] = strings.Join(claims.Scopes, " ")
+	}
+	if i.issuer != "" {
+		tokenClaims["iss"] = i.issuer
+	}
+	if i.audience != "" {
+		tokenClaims["aud"] = i.audience
+	}
+
+	i.mu.RLock()
+	token := jwt.NewWithClaims(i.method, tokenClaims)
+	if i.kid != "" {
+		token.Header["kid"] = i.kid
+	}
+	signed, err := token.SignedString(i.key)
+	i.mu.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign token: %w", err)
+	}
+	return &IssuedToken{Token: signed, ExpiresAt: expiresAt}, nil
+}
+
+// parsePrivateKeyPEM accepts PKCS#8, PKCS#1 RSA and SEC 1 EC private keys.
+func parsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+)
+
+func newTestIssuer(t *testing.T, maxTTL time.Duration) *TokenIssuer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, err := NewTokenIssuer(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), "test", "", "", maxTTL)
+	if err != nil {
+		t.Fatalf("NewTokenIssuer() error = %v", err)
+	}
+	return issuer
+}
+
+func TestIssueCapsExpiryAtParent(t *testing.T) {
+	issuer := newTestIssuer(t, time.Hour)
+	parentExpiry := time.Now().Add(10 * time.Minute).Unix()
+
+	issued, err := issuer.Issue(&Claims{AccountID: 1, ID: "parent", ExpiresAt: parentExpiry}, 0)
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	if issued.ExpiresAt.Unix() != parentExpiry {
+		t.Errorf("refreshed token expires at %v, want the parent's %v", issued.ExpiresAt.Unix(), parentExpiry)
+	}
+
+	issued, err = issuer.Issue(&Claims{AccountID: 1}, 5*time.Minute)
+	if err != nil {
+		t.Fatalf("Issue() error = %v", err)
+	}
+	if ttl := time.Until(issued.ExpiresAt); ttl > 5*time.Minute || ttl < 4*time.Minute {
+		t.Errorf("token from a non-expiring credential lives %v, want the requested 5m", ttl)
+	}
+}
+
+func TestRevokingRootRevokesRefreshedTokens(t *testing.T) {
+	issuer := newTestIssuer(t, time.Hour)
+	revocations := &revocationSet{entries: map[string]struct{}{}}
+	validator, err := NewJWTValidator(issuer, ValidatorOptions{Algorithms: []string{"EdDSA"}, Revocations: revocations})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	root := &Claims{AccountID: 1, ID: "root", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	child, err := issuer.Issue(root, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	childClaims, err := validator.Validate(ctx, child.Token)
+	if err != nil {
+		t.Fatalf("Validate(child) error = %v", err)
+	}
+	if childClaims.RootID != "root" {
+		t.Errorf("child rjti = %q, want root", childClaims.RootID)
+	}
+	grandchild, err := issuer.Issue(childClaims, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grandchildClaims, err := validator.Validate(ctx, grandchild.Token)
+	if err != nil {
+		t.Fatalf("Validate(grandchild) error = %v", err)
+	}
+	if grandchildClaims.RootID != "root" {
+		t.Errorf("grandchild rjti = %q, want the chain's root", grandchildClaims.RootID)
+	}
+
+	revocations.replace(map[string]struct{}{"jti:root": {}})
+	for name, token := range map[string]string{"child": child.Token, "grandchild": grandchild.Token} {
+		if _, err := validator.Validate(ctx, token); err == nil {
+			t.Errorf("Validate(%s) succeeded after its root was revoked", name)
+		}
+	}
+}
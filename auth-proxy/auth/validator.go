@@ -1,6 +1,12 @@
 package auth
 
-import "context"
+import (
+	"context"
+
+	"auth-proxy/logging"
+)
+
+var logger = logging.Component("auth")
 
 type Validator interface {
 	Validate(ctx context.Context, token string) (*Claims, error)
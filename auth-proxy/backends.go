@@ -0,0 +1,440 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+
+	"auth-proxy/config"
+	"auth-proxy/filesink"
+	"auth-proxy/kafka"
+	"auth-proxy/sigv4"
+	"auth-proxy/storage"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// newStorage returns the configured storage destinations. A single
+// required destination is used directly; otherwise batches are teed to all
+// of them.
+func newStorage(cfg *config.Config) (storage.LogStorage, error) {
+	configured := cfg.StorageDestinations()
+	if len(configured) == 1 {
+		return newBackend(cfg, configured[0].Backend)
+	}
+
+	destinations := make([]storage.Destination, 0, len(configured))
+	for _, destination := range configured {
+		backend, err := newBackend(cfg, destination.Backend)
+		if err != nil {
+			return nil, fmt.Errorf("storage destination %s: %w", destination.Backend, err)
+		}
+		destinations = append(destinations, storage.Destination{
+			Name:     destination.Backend,
+			Storage:  backend,
+			Optional: destination.Optional,
+		})
+	}
+	return storage.NewMultiStorage(destinations...)
+}
+
+// newBackend connects one storage backend. OpenSearch is written through
+// the Elasticsearch client at ELASTICSEARCH_URL.
+func newBackend(cfg *config.Config, backend string) (storage.LogStorage, error) {
+	switch backend {
+	case "elasticsearch", "opensearch":
+		return newClusterStorage(cfg, backend == "opensearch")
+	case "s3":
+		creds, err := sigv4.CredentialsFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		s3, err := storage.NewS3Storage(storage.S3Config{
+			Bucket:           cfg.S3Bucket,
+			Region:           cfg.S3Region,
+			Endpoint:         cfg.S3Endpoint,
+			Prefix:           cfg.S3Prefix,
+			FlushBytes:       cfg.S3FlushBytes,
+			FlushInterval:    cfg.S3FlushInterval,
+			MaxBufferedBytes: cfg.S3MaxBufferedBytes,
+			Credentials:      creds,
+		})
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("storing logs in S3", "bucket", cfg.S3Bucket)
+		return s3, nil
+	case "clickhouse":
+		clickHouse, err := storage.NewClickHouseStorage(storage.ClickHouseConfig{
+			URL:             cfg.ClickHouseURL,
+			Database:        cfg.ClickHouseDatabase,
+			Table:           cfg.ClickHouseTable,
+			Username:        cfg.ClickHouseUsername,
+			Password:        cfg.ClickHousePassword,
+			CreateTable:     cfg.ClickHouseCreateTable,
+			BatchRows:       cfg.ClickHouseBatchRows,
+			FlushInterval:   cfg.ClickHouseFlushInterval,
+			MaxBufferedRows: cfg.ClickHouseMaxBufferedRows,
+		})
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("storing logs in ClickHouse", "table", cfg.ClickHouseDatabase+"."+cfg.ClickHouseTable)
+		return clickHouse, nil
+	case "loki":
+		labels := cfg.LokiLabels
+		if labels == nil {
+			labels = storage.DefaultLokiLabels
+		}
+		loki, err := storage.NewLokiStorage(storage.LokiConfig{
+			URL:          cfg.LokiURL,
+			TenantHeader: cfg.LokiTenantHeader,
+			Labels:       labels,
+			Username:     cfg.LokiUsername,
+			Password:     cfg.LokiPassword,
+		})
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("pushing logs to Loki", "url", cfg.LokiURL)
+		return loki, nil
+	case "kafka":
+		opts := kafka.Options{
+			Brokers:       cfg.KafkaProducerBrokers,
+			SASLMechanism: cfg.KafkaSASLMechanism,
+			SASLUsername:  cfg.KafkaSASLUsername,
+			SASLPassword:  cfg.KafkaSASLPassword,
+		}
+		if cfg.KafkaTLS {
+			tlsConfig, err := kafka.TLSConfig(cfg.KafkaTLSCAFile)
+			if err != nil {
+				return nil, err
+			}
+			opts.TLS = tlsConfig
+		}
+		producer, err := kafka.NewProducer(opts)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("publishing logs to Kafka", "topic", cfg.KafkaProducerTopic)
+		return storage.NewKafkaStorage(producer, cfg.KafkaProducerTopic, cfg.KafkaProducerAccountHeader)
+	case "file":
+		file, err := storage.NewFileStorage(filesink.Config{
+			Dir:       cfg.FileStorageDir,
+			Prefix:    "logs",
+			MaxBytes:  cfg.FileStorageMaxBytes,
+			MaxAge:    cfg.FileStorageMaxAge,
+			Manifest:  cfg.SinkManifest,
+			Compress:  cfg.FileStorageCompress,
+			Retention: cfg.FileStorageRetention,
+		})
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("writing logs to files", "dir", cfg.FileStorageDir)
+		return file, nil
+	case "memory":
+		slog.Info("keeping the most recent log entries in memory", "capacity", cfg.MemoryStorageCapacity)
+		return storage.NewMemoryStorage(cfg.MemoryStorageCapacity), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", backend)
+}
+
+// newClusterStorage connects to ELASTICSEARCH_URL and, when configured, a
+// standby cluster that takes over while the primary is unhealthy. With a
+// standby, an unreachable primary does not stop startup. Accounts with a
+// dedicated cluster are routed to it.
+func newClusterStorage(cfg *config.Config, openSearch bool) (storage.LogStorage, error) {
+	if cfg.InsecureSkipVerify {
+		slog.Warn("INSECURE_SKIP_VERIFY is set, cluster certificates are not verified")
+	}
+	deadLetters, err := newDeadLetterQueue(cfg)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := newSharedClusterStorage(cfg, openSearch, deadLetters)
+	if err != nil || len(cfg.TenantElasticsearchURLs) == 0 {
+		return shared, err
+	}
+
+	// Accounts on the same cluster with the same credentials share a client
+	// and bulk indexer, and so also the lifecycle policy.
+	clusters := make(map[[2]string]*storage.ElasticsearchStorage)
+	policies := make(map[[2]string]*storage.LifecyclePolicy)
+	tenants := make(map[int64]*storage.ElasticsearchStorage, len(cfg.TenantElasticsearchURLs))
+	for accountID, clusterURL := range cfg.TenantElasticsearchURLs {
+		// The account IDs were validated by config.Load.
+		numericID, _ := strconv.ParseInt(accountID, 10, 64)
+		apiKey := cfg.TenantElasticsearchAPIKeys[accountID]
+		key := [2]string{clusterURL, apiKey}
+		policy := lifecyclePolicy(cfg, accountID)
+		if shared, ok := policies[key]; ok && !reflect.DeepEqual(shared, policy) {
+			return nil, fmt.Errorf("accounts on the dedicated cluster of account %s have different ILM overrides", accountID)
+		}
+		policies[key] = policy
+		if _, ok := clusters[key]; !ok {
+			dedicated, err := newElasticsearchStorage(cfg, elasticsearch.Config{
+				Addresses: []string{clusterURL},
+				APIKey:    apiKey,
+			}, openSearch, policy, deadLetters)
+			if dedicated == nil {
+				return nil, fmt.Errorf("cluster of account %s: %w", accountID, err)
+			}
+			if err != nil {
+				slog.Warn("dedicated cluster is not reachable", "account_id", accountID, "error", err)
+			}
+			clusters[key] = dedicated
+		}
+		tenants[numericID] = clusters[key]
+	}
+	slog.Info("routing accounts to dedicated clusters", "accounts", len(tenants), "clusters", len(clusters))
+	return storage.NewTenantRoutedStorage(shared, tenants), nil
+}
+
+// newDeadLetterQueue returns the file storage failed documents are written
+// to, shared by every cluster, or nil when DEAD_LETTER_DIR is not set.
+func newDeadLetterQueue(cfg *config.Config) (storage.LogStorage, error) {
+	if cfg.DeadLetterDir == "" {
+		return nil, nil
+	}
+	deadLetters, err := storage.NewFileStorage(filesink.Config{
+		Dir:       cfg.DeadLetterDir,
+		Prefix:    "dead-letter",
+		MaxBytes:  cfg.DeadLetterMaxBytes,
+		MaxAge:    time.Hour,
+		Manifest:  cfg.SinkManifest,
+		Retention: cfg.DeadLetterRetention,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dead-letter queue: %w", err)
+	}
+	return deadLetters, nil
+}
+
+// primaryClusterConfig returns the client settings of the primary cluster,
+// at ELASTICSEARCH_URL or ELASTICSEARCH_CLOUD_ID.
+func primaryClusterConfig(cfg *config.Config) elasticsearch.Config {
+	primaryConfig := elasticsearch.Config{
+		Addresses: []string{cfg.ElasticsearchURL},
+		Username:  cfg.ElasticsearchUsername,
+		Password:  cfg.ElasticsearchPassword,
+		APIKey:    cfg.ElasticsearchAPIKey,
+	}
+	if cfg.ElasticsearchCloudID != "" {
+		primaryConfig.Addresses = nil
+		primaryConfig.CloudID = cfg.ElasticsearchCloudID
+	}
+	return primaryConfig
+}
+
+func newSharedClusterStorage(cfg *config.Config, openSearch bool, deadLetters storage.LogStorage) (storage.LogStorage, error) {
+	policy := lifecyclePolicy(cfg, "")
+	primary, err := newElasticsearchStorage(cfg, primaryClusterConfig(cfg), openSearch, policy, deadLetters)
+	if cfg.ElasticsearchSecondaryURL == "" || primary == nil {
+		if err != nil {
+			return nil, err
+		}
+		return primary, nil
+	}
+	primaryDown := err != nil
+	if primaryDown {
+		slog.Warn("primary cluster is not reachable, starting on the secondary cluster", "error", err)
+	}
+
+	secondary, err := newElasticsearchStorage(cfg, elasticsearch.Config{
+		Addresses: []string{cfg.ElasticsearchSecondaryURL},
+		Username:  cfg.ElasticsearchUsername,
+		Password:  cfg.ElasticsearchPassword,
+		APIKey:    cfg.ElasticsearchAPIKey,
+	}, openSearch, policy, deadLetters)
+	if secondary == nil {
+		return nil, fmt.Errorf("secondary cluster: %w", err)
+	}
+	if err != nil {
+		if primaryDown {
+			return nil, fmt.Errorf("secondary cluster: %w", err)
+		}
+		slog.Warn("secondary cluster is not reachable", "error", err)
+	}
+	return storage.NewFailoverStorage(primary, secondary, storage.FailoverConfig{
+		CheckInterval: cfg.FailoverCheckInterval,
+		FailoverAfter: cfg.FailoverThreshold,
+		FailbackAfter: cfg.FailbackThreshold,
+	}, primaryDown), nil
+}
+
+// lifecyclePolicy returns the ILM policy of the shared clusters, or of the
+// dedicated cluster of accountID, or nil when ILM is off. With indices per
+// account, the shared policy carries the overrides of the accounts without
+// a dedicated cluster.
+func lifecyclePolicy(cfg *config.Config, accountID string) *storage.LifecyclePolicy {
+	if !cfg.ILMPolicy {
+		return nil
+	}
+	policy := accountLifecyclePolicy(cfg, accountID)
+	if accountID != "" || !cfg.IndexPerAccount {
+		return policy
+	}
+	for _, overrides := range []map[string]string{cfg.TenantILMWarmAfter, cfg.TenantILMDeleteAfter} {
+		for overridden := range overrides {
+			if _, dedicated := cfg.TenantElasticsearchURLs[overridden]; dedicated {
+				continue
+			}
+			if policy.Accounts == nil {
+				policy.Accounts = make(map[int64]*storage.LifecyclePolicy)
+			}
+			// The account IDs were validated by config.Load.
+			accountID, _ := strconv.ParseInt(overridden, 10, 64)
+			accountPolicy := accountLifecyclePolicy(cfg, overridden)
+			accountPolicy.Name = "logs-containers-" + strconv.FormatInt(accountID, 10)
+			policy.Accounts[accountID] = accountPolicy
+		}
+	}
+	return policy
+}
+
+func accountLifecyclePolicy(cfg *config.Config, accountID string) *storage.LifecyclePolicy {
+	policy := &storage.LifecyclePolicy{
+		Name:            "logs-containers",
+		RolloverMaxAge:  cfg.ILMRolloverMaxAge,
+		RolloverMaxSize: cfg.ILMRolloverMaxSize,
+		WarmAfter:       cfg.ILMWarmAfter,
+		DeleteAfter:     cfg.ILMDeleteAfter,
+	}
+	// The overrides were validated by config.Load.
+	if value, ok := cfg.TenantILMWarmAfter[accountID]; ok {
+		policy.WarmAfter, _ = time.ParseDuration(value)
+	}
+	if value, ok := cfg.TenantILMDeleteAfter[accountID]; ok {
+		policy.DeleteAfter, _ = time.ParseDuration(value)
+	}
+	return policy
+}
+
+// newElasticsearchStorage connects to the cluster described by esConfig
+// over a transport with the configured TLS settings. When the cluster cannot
+// be reached, the storage is still returned alongside the error.
+func newElasticsearchStorage(cfg *config.Config, esConfig elasticsearch.Config, openSearch bool, policy *storage.LifecyclePolicy, deadLetters storage.LogStorage) (*storage.ElasticsearchStorage, error) {
+	transport, err := clusterTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	esConfig.Transport = transport
+	esConfig.CompressRequestBody = cfg.CompressRequests
+	esConfig.CompressRequestBodyLevel = cfg.CompressionLevel
+	esConfig.PoolCompressor = cfg.CompressRequests
+
+	product := "Elasticsearch"
+	if openSearch {
+		product = "OpenSearch"
+		esConfig.Transport = storage.OpenSearchTransport(transport)
+	}
+	address := "Elastic Cloud"
+	if len(esConfig.Addresses) > 0 {
+		address = redactURL(esConfig.Addresses[0])
+	}
+
+	// Initialize Elasticsearch client
+	elasticsearchClient, err := elasticsearch.NewClient(esConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Elasticsearch client: %w", err)
+	}
+	es := storage.NewElasticsearchStorage(elasticsearchClient, cfg, policy, deadLetters)
+
+	// Verify connection to Elasticsearch
+	response, err := elasticsearchClient.Info()
+	if err != nil {
+		return es, fmt.Errorf("failed to connect to %s at %s: %w", product, address, err)
+	}
+	defer response.Body.Close()
+
+	if response.IsError() {
+		return es, fmt.Errorf("%s at %s returned error status: %s", product, address, response.Status())
+	}
+
+	slog.Info("connected to cluster", "product", product, "address", address)
+	return es, nil
+}
+
+// newAuditStorage returns storage writing audit events to AUDIT_INDEX on
+// the primary cluster.
+func newAuditStorage(cfg *config.Config) (*storage.AuditStorage, error) {
+	transport, err := clusterTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	esConfig := primaryClusterConfig(cfg)
+	esConfig.Transport = transport
+	if cfg.UsesBackend("opensearch") {
+		esConfig.Transport = storage.OpenSearchTransport(transport)
+	}
+	client, err := elasticsearch.NewClient(esConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Elasticsearch client: %w", err)
+	}
+	return storage.NewAuditStorage(client, cfg.AuditIndex, cfg.BulkFlushInterval, cfg.ShutdownTimeout)
+}
+
+// clusterDestination returns the Elasticsearch or OpenSearch storage among
+// the destinations of logStorage, so documents meant for the cluster alone
+// are not teed to the others.
+func clusterDestination(logStorage storage.LogStorage) storage.LogStorage {
+	multi, ok := logStorage.(*storage.MultiStorage)
+	if !ok {
+		return logStorage
+	}
+	for _, backend := range []string{"elasticsearch", "opensearch"} {
+		if destination := multi.Destination(backend); destination != nil {
+			return destination
+		}
+	}
+	return logStorage
+}
+
+// clusterTransport returns the HTTP transport for cluster connections,
+// trusting ELASTICSEARCH_CA_FILE and presenting the client certificate when
+// they are configured.
+func clusterTransport(cfg *config.Config) (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.ElasticsearchCAFile != "" {
+		caPEM, err := os.ReadFile(cfg.ElasticsearchCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Elasticsearch CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in Elasticsearch CA file")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.ElasticsearchClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ElasticsearchClientCertFile, cfg.ElasticsearchClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Elasticsearch client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// redactURL hides the password of a cluster URL for logging.
+func redactURL(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return "<invalid URL>"
+	}
+	return parsed.Redacted()
+}
@@ -0,0 +1,88 @@
+// Command keygen writes a private/public key pair in PEM form for signing and
+// verifying ingestion tokens.
+//
+//	go run ./cmd/keygen -alg ES256 -out ./keys
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	alg := flag.String("alg", "RS256", "key algorithm: RS256, ES256, ES384 or EdDSA")
+	out := flag.String("out", ".", "directory to write private_key.pem and public_key.pem to")
+	bits := flag.Int("bits", 2048, "RSA key size in bits")
+	flag.Parse()
+
+	private, public, err := generate(*alg, *bits)
+	if err != nil {
+		log.Fatalf("Failed to generate key: %v", err)
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		log.Fatalf("Failed to encode private key: %v", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		log.Fatalf("Failed to encode public key: %v", err)
+	}
+
+	if err := writePEM(filepath.Join(*out, "private_key.pem"), "PRIVATE KEY", privateDER, 0o600); err != nil {
+		log.Fatalf("Failed to write private key: %v", err)
+	}
+	if err := writePEM(filepath.Join(*out, "public_key.pem"), "PUBLIC KEY", publicDER, 0o644); err != nil {
+		log.Fatalf("Failed to write public key: %v", err)
+	}
+	log.Printf("Wrote %s key pair to %s", *alg, *out)
+}
+
+func generate(alg string, bits int) (crypto.Signer, crypto.PublicKey, error) {
+	switch alg {
+	case "RS256", "RS384", "RS512":
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &key.PublicKey, nil
+	case "ES256", "ES384":
+		curve := elliptic.P256()
+		if alg == "ES384" {
+			curve = elliptic.P384()
+		}
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &key.PublicKey, nil
+	case "EdDSA":
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return private, public, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+}
+
+func writePEM(path, blockType string, der []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+}
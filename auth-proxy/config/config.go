@@ -1,23 +1,911 @@
 package config
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Config holds the application configuration
 type Config struct {
-	Port             string
-	ElasticsearchURL string
-	JWTPublicKey     string
+	// Port is the HTTP port, or "off" to serve HTTP only on UnixSocket.
+	Port string
+	// UnixSocket is a Unix socket path HTTP is also served on, with TLS
+	// when the port has it, for agents on the same host. UnixSocketMode is
+	// its octal file mode.
+	UnixSocket     string
+	UnixSocketMode string
+	// ShutdownTimeout bounds how long SIGTERM or SIGINT waits for in-flight
+	// requests to finish and for storage to flush what it has queued.
+	ShutdownTimeout time.Duration
+	// ReusePort opens every listener with SO_REUSEPORT, so a restarted
+	// proxy can bind its ports while the old one drains after SIGTERM.
+	ReusePort bool
+	// RequestTimeout is the deadline of every HTTP request's context, so
+	// storage gives up on a slow enqueue before the write timeout.
+	RequestTimeout time.Duration
+	// HTTP* tune the HTTP server; a zero HTTPReadHeaderTimeout uses
+	// HTTPReadTimeout. H2C serves HTTP/2 on plaintext listeners, which TLS
+	// listeners always do, and HTTP2MaxConcurrentStreams caps the streams
+	// of one HTTP/2 connection.
+	HTTPReadTimeout           time.Duration
+	HTTPReadHeaderTimeout     time.Duration
+	HTTPWriteTimeout          time.Duration
+	HTTPIdleTimeout           time.Duration
+	HTTPMaxHeaderBytes        int
+	H2C                       bool
+	HTTP2MaxConcurrentStreams int
+	ElasticsearchURL          string
+	// ElasticsearchCloudID addresses an Elastic Cloud deployment instead of
+	// ElasticsearchURL. Clusters authenticate with ElasticsearchAPIKey or
+	// ElasticsearchUsername and ElasticsearchPassword.
+	ElasticsearchCloudID  string
+	ElasticsearchUsername string
+	ElasticsearchPassword string
+	ElasticsearchAPIKey   string
+	// ElasticsearchCAFile verifies cluster certificates instead of the system
+	// roots, and ElasticsearchClientCertFile and ElasticsearchClientKeyFile
+	// authenticate the proxy with a client certificate. InsecureSkipVerify
+	// disables verification of cluster certificates.
+	ElasticsearchCAFile         string
+	ElasticsearchClientCertFile string
+	ElasticsearchClientKeyFile  string
+	InsecureSkipVerify          bool
+	// ElasticsearchSecondaryURL is a standby cluster that takes traffic after
+	// the primary fails FailoverThreshold consecutive health checks, run
+	// every FailoverCheckInterval, until it passes FailbackThreshold of them.
+	ElasticsearchSecondaryURL string
+	FailoverCheckInterval     time.Duration
+	FailoverThreshold         int
+	FailbackThreshold         int
+	// TenantElasticsearchURLs maps a numeric account ID, whatever
+	// ACCOUNT_ID_FORMAT is, to a dedicated cluster its logs are written to
+	// instead, read from TENANT_ELASTICSEARCH_URLS as a JSON object. Basic
+	// auth credentials go in the URL's user info, and
+	// TenantElasticsearchAPIKeys maps an account ID to an API key for its
+	// cluster instead.
+	TenantElasticsearchURLs    map[string]string
+	TenantElasticsearchAPIKeys map[string]string
+	// GRPCPort serves the OTLP gRPC LogsService when set.
+	GRPCPort string
+	// ForwardPort serves the Fluentd forward protocol when set.
+	ForwardPort string
+	// ForwardSharedKeys maps an account ID to the shared key its Fluentd or
+	// Fluent Bit agents authenticate with. Without it, each forward message
+	// must carry a token in its "token" option.
+	ForwardSharedKeys map[string]string
+	// ForwardHostname is the server name sent in forward handshakes; it
+	// defaults to the OS hostname.
+	ForwardHostname string
+	// SyslogPort serves syslog over TCP and UDP when set.
+	SyslogPort string
+	// SyslogSourceAccounts maps an account ID to the comma-separated CIDRs
+	// or IPs its syslog senders use. Senders presenting a client
+	// certificate are attributed by the certificate instead.
+	SyslogSourceAccounts map[string]string
+	// SyslogMaxMessageBytes caps the size of one syslog message.
+	SyslogMaxMessageBytes int
+	// GELFPort serves GELF over TCP and UDP when set.
+	GELFPort string
+	// GELFSourceAccounts attributes GELF senders to accounts like
+	// SyslogSourceAccounts does for syslog.
+	GELFSourceAccounts map[string]string
+	// GELFMaxMessageBytes caps the size of one GELF message after
+	// reassembly and decompression.
+	GELFMaxMessageBytes int
+
+	// HTTPIngest serves the HTTP ingestion endpoints. Disable it to ingest
+	// only from Kafka or the other listeners; /health and admin routes stay.
+	HTTPIngest bool
+	// KafkaBrokers enables consuming log batches from Kafka when set.
+	KafkaBrokers []string
+	KafkaGroupID string
+	// KafkaTopics lists the topics to consume, or regular expressions when
+	// KafkaTopicPattern is set.
+	KafkaTopics       []string
+	KafkaTopicPattern bool
+	// KafkaTLS enables TLS to the brokers, verified against KafkaTLSCAFile
+	// when set and the system roots otherwise.
+	KafkaTLS           bool
+	KafkaTLSCAFile     string
+	KafkaSASLMechanism string
+	KafkaSASLUsername  string
+	KafkaSASLPassword  string
+	// KafkaTokenHeader names the record header carrying a token, checked by
+	// the configured validator like an HTTP bearer token.
+	KafkaTokenHeader string
+	// KafkaAccountHeader, when set, names a record header whose account ID
+	// is trusted as is for records without a token. Only enable it when
+	// producers are authenticated by Kafka itself.
+	KafkaAccountHeader string
+	// KafkaProducerBrokers receive logs through the "kafka" storage backend,
+	// sharing the Kafka TLS and SASL settings. KafkaProducerTopic is a
+	// template where {account} and {container} are replaced, and the
+	// account ID is sent in the KafkaProducerAccountHeader header.
+	KafkaProducerBrokers       []string
+	KafkaProducerTopic         string
+	KafkaProducerAccountHeader string
+
+	// AuthMethods lists the credentials accepted on /logs: "jwt", "apikey",
+	// "mtls", "introspection", "hmac".
+	AuthMethods []string
+	// RouteAuthMethods narrows the credentials accepted on an HTTP ingest
+	// route to some of AuthMethods, keyed by one of IngestRoutes. Routes not
+	// listed accept every method in AuthMethods.
+	RouteAuthMethods map[string][]string
+	// APIKeys maps a static API key to an account ID. Keys can also be read
+	// from the JSON file at APIKeysFile.
+	APIKeys     map[string]string
+	APIKeysFile string
+
+	// HMACSecrets maps an account ID to the secret its requests are signed
+	// with. Signatures older than HMACMaxSkew are rejected.
+	HMACSecrets map[string]string
+	HMACMaxSkew time.Duration
+
+	// DebugPort serves pprof profiles and expvar variables, behind
+	// AdminToken, when set.
+	DebugPort string
+
+	// AdminToken is the bearer token for /admin routes. Admin routes are
+	// disabled when it is empty.
+	AdminToken string
+
+	// AuditIndex, such as "akto-audit", is the index on the primary cluster
+	// that audit events of requests refused with 401 or 403 are written to.
+	// They are only logged when it is empty.
+	AuditIndex string
+
+	// SelfMonitoring ships the proxy's own log records at the info level or
+	// above, at most SelfMonitoringRate per second, into SelfMonitoringIndex
+	// on the primary cluster through the same bulk indexer as ingested logs.
+	// Other STORAGE_DESTINATIONS do not receive them.
+	SelfMonitoring      bool
+	SelfMonitoringIndex string
+	SelfMonitoringRate  int
+
+	// Metrics serves Prometheus metrics on /metrics. With MetricsToken set,
+	// scrapes of /metrics and /stats must send it as a bearer token.
+	Metrics      bool
+	MetricsToken string
+	// MetricsMaxAccounts caps how many accounts get per-account metric
+	// labels; later accounts are counted under "other".
+	MetricsMaxAccounts int
+	// StatsLogInterval is how often the bulk indexer counters are logged;
+	// zero disables the logging.
+	StatsLogInterval time.Duration
+
+	// LogLevel is the lowest level logged: debug, info, warn or error.
+	// LogFormat is "text" for logfmt-style lines or "json".
+	LogLevel  string
+	LogFormat string
+	// AccessLogFormat is "json" or "text" for one access log line per HTTP
+	// request on stdout, or "off". AccessLogLogsSampleRate is the fraction
+	// of /logs requests logged; failed requests are always logged.
+	AccessLogFormat         string
+	AccessLogLogsSampleRate float64
+
+	// Tracing exports OpenTelemetry spans of the ingest path over OTLP/gRPC,
+	// configured by the standard OTEL_EXPORTER_OTLP_* and
+	// OTEL_TRACES_SAMPLER* variables.
+	Tracing bool
+
+	// NotifyWebhookURL receives alerts, as generic JSON or a Slack message
+	// per NotifyFormat, when the share of documents failing to index over a
+	// NotifyInterval reaches NotifyFailureRate, when the circuit breaker
+	// opens, and when DEAD_LETTER_DIR grows past NotifyDeadLetterBytes. A
+	// zero threshold disables its alert.
+	NotifyWebhookURL      string
+	NotifyFormat          string
+	NotifyInterval        time.Duration
+	NotifyFailureRate     float64
+	NotifyDeadLetterBytes int64
+
+	// TLSCertFile and TLSKeyFile make the server listen with HTTPS.
+	// TLSMinVersion is the oldest protocol accepted: "1.2" or "1.3".
+	TLSCertFile   string
+	TLSKeyFile    string
+	TLSMinVersion string
+	// MTLSCAFile is the CA bundle client certificates are verified against,
+	// and MTLSCRLFile the PEM or DER revocation lists of those CAs. Both are
+	// reloaded every MTLSRefreshInterval. MTLSRequired rejects ingestion
+	// requests without a verified client certificate, even when they carry
+	// a valid token.
+	MTLSCAFile          string
+	MTLSCRLFile         string
+	MTLSRefreshInterval time.Duration
+	MTLSRequired        bool
+	// MTLSAccountSource selects where the account ID is read from a client
+	// certificate: "ou" or "uri" (a URI SAN starting with MTLSURIPrefix).
+	MTLSAccountSource string
+	MTLSURIPrefix     string
+
+	// Introspection* configure validation against an RFC 7662 endpoint.
+	IntrospectionURL          string
+	IntrospectionClientID     string
+	IntrospectionClientSecret string
+	IntrospectionTimeout      time.Duration
+	IntrospectionCacheTTL     time.Duration
+	IntrospectionAccountClaim string
+
+	JWTPublicKey string
+	// JWTPublicKeys maps a kid to a PEM public key, for tokens issued by more
+	// than one signer. It is read from JWT_PUBLIC_KEYS as a JSON object.
+	JWTPublicKeys map[string]string
+
+	// JWKSURL, when set, is fetched for verification keys in addition to
+	// RSA_PUBLIC_KEY and refreshed every JWKSRefreshInterval.
+	JWKSURL             string
+	JWKSRefreshInterval time.Duration
+	// JWTAlgorithms is the allow-list of token signing algorithms.
+	JWTAlgorithms []string
+	// JWTIssuer and JWTAudience are enforced against iss and aud when set.
+	JWTIssuer   string
+	JWTAudience string
+
+	// SecretsBackend is "vault" or "aws" to read keys from a secret store.
+	// JWTPublicKeySecret and TokenSigningKeySecret are references into it,
+	// e.g. "secret/data/akto/jwt#public_key" for Vault or
+	// "akto/jwt#public_key" for AWS Secrets Manager, refreshed every
+	// SecretsRefreshInterval.
+	SecretsBackend         string
+	VaultAddr              string
+	VaultToken             string
+	VaultNamespace         string
+	AWSRegion              string
+	JWTPublicKeySecret     string
+	TokenSigningKeySecret  string
+	SecretsRefreshInterval time.Duration
+
+	// JWTLeeway tolerates clock skew when checking exp, nbf and iat.
+	JWTLeeway time.Duration
+
+	// TokenSigningKeyFile enables /token/refresh, which signs short-lived
+	// tokens with this private key under TokenSigningKid. Issued tokens live
+	// at most TokenMaxTTL.
+	TokenSigningKeyFile string
+	TokenSigningKid     string
+	TokenMaxTTL         time.Duration
+
+	// RevocationFile or RevocationRedisURL/RevocationRedisKey point at the
+	// list of revoked tokens, reloaded every RevocationReloadInterval.
+	RevocationFile           string
+	RevocationRedisURL       string
+	RevocationRedisKey       string
+	RevocationReloadInterval time.Duration
+
+	// DefaultScopes are granted to credentials that carry no scope claim.
+	DefaultScopes []string
+
+	// TenantIPAllowlists maps an account ID to the comma-separated CIDRs its
+	// requests may come from. Accounts without an entry are unrestricted. A
+	// network may only be listed for one account.
+	TenantIPAllowlists map[string]string
+	// TrustedProxies are the CIDRs whose X-Forwarded-For header is trusted
+	// when resolving the client address.
+	TrustedProxies []string
+	// ProxyProtocol makes every TCP listener read the PROXY protocol header
+	// a load balancer sends with the client address. Only peers in
+	// ProxyProtocolSources send it, or every peer when that is empty.
+	ProxyProtocol        bool
+	ProxyProtocolSources []string
+
+	// ReplayProtection rejects repeated requests: "off", "jti" (each token is
+	// single use) or "nonce" (each request carries a unique X-Akto-Nonce).
+	// Identifiers are remembered for ReplayWindow, up to ReplayCacheSize;
+	// requests with new identifiers are refused with 503 while it is full.
+	ReplayProtection string
+	ReplayWindow     time.Duration
+	ReplayCacheSize  int
+
+	// PolicyFile is a Rego module evaluated for every ingest request;
+	// PolicyQuery selects the boolean rule that allows it.
+	PolicyFile  string
+	PolicyQuery string
+
+	// AuthzWebhookURL, when set, is asked to allow every ingest request.
+	// Decisions are cached for AuthzWebhookCacheTTL.
+	AuthzWebhookURL      string
+	AuthzWebhookTimeout  time.Duration
+	AuthzWebhookCacheTTL time.Duration
+
+	// TenantStatusFile, TenantStatusRedisURL or TenantStatusURL name the
+	// source of suspended accounts. The file and Redis set list account IDs
+	// and are reloaded every TenantStatusRefreshInterval; the URL is a
+	// template containing {accountId} whose answers are cached that long.
+	TenantStatusFile            string
+	TenantStatusRedisURL        string
+	TenantStatusRedisKey        string
+	TenantStatusURL             string
+	TenantStatusRefreshInterval time.Duration
+
+	// TokenCacheSize is the number of validated tokens remembered so repeat
+	// requests skip verification. Zero, the default, disables the cache.
+	// Cached tokens are still checked against the revocation list.
+	TokenCacheSize int
+	// TokenCacheTTL caps how long a validated token is remembered.
+	TokenCacheTTL time.Duration
+
+	// MaxDecompressedBytes caps the size a gzip or zstd request body may
+	// expand to.
+	MaxDecompressedBytes int64
+	// MaxBodyBytes caps the size of an ingestion request body as sent.
+	// TenantMaxBodyBytes maps an account ID to a cap that replaces it.
+	MaxBodyBytes       int64
+	TenantMaxBodyBytes map[string]string
+	// MaxBatchEntries caps the entries stored per request; zero disables the
+	// cap. BatchLimitMode is "reject" to refuse larger batches or "split" to
+	// store them in chunks of MaxBatchEntries.
+	MaxBatchEntries int
+	BatchLimitMode  string
+	// StreamChunkEntries is how many entries of a JSON array posted to /logs
+	// are decoded before being stored, so large batches are never held in
+	// memory whole. Zero, the default, decodes every batch whole first, so a
+	// batch is stored entirely or not at all.
+	StreamChunkEntries int
+	// SyncIngest makes /logs wait until Elasticsearch has indexed every
+	// entry and answer with per-entry results, as ?wait=true does for a
+	// single request. A request waits at most SyncIngestTimeout, which is
+	// also how long _bulk requests wait for the item results they answer
+	// with.
+	SyncIngest        bool
+	SyncIngestTimeout time.Duration
+
+	// HealthDetail switches /health to the cached, dependency-aware response.
+	HealthDetail bool
+	// HealthRefreshInterval is how often the cached health result is refreshed.
+	HealthRefreshInterval time.Duration
+
+	// SinkManifest makes file-backed sinks (dead-letter, audit, file storage) keep a
+	// SHA-256 manifest of their rotated files.
+	SinkManifest bool
+
+	// SampleReservoirSize is the number of example documents kept per index
+	// for /admin/samples, the most recent ones. Zero disables sampling.
+	SampleReservoirSize int
+	// SampleMaxBytes caps the memory held by samples across all indices.
+	SampleMaxBytes int64
+
+	// EnqueueMaxRetries is how many times adding a log to the bulk indexer is
+	// retried before the batch is failed.
+	EnqueueMaxRetries int
+	// EnqueueRetryBackoff is the initial delay between enqueue retries; it
+	// doubles after every attempt.
+	EnqueueRetryBackoff time.Duration
+
+	// AccountIDFormat is the fmt verb used to render the token account ID,
+	// e.g. "%010d" or "acct-%d".
+	AccountIDFormat string
+
+	// SubAccountField is the dotted path of a log field promoted into
+	// sub_account_id, e.g. "kubernetes.labels.account". Empty disables it.
+	SubAccountField string
+
+	// BulkWorkers is how many bulk requests each indexer sends concurrently,
+	// or 0 for one per CPU. Up to as many documents are queued per indexer
+	// while the workers are busy. A worker flushes once it holds
+	// BulkFlushBytes or BulkFlushInterval has passed.
+	BulkWorkers       int
+	BulkFlushBytes    int
+	BulkFlushInterval time.Duration
+	// BulkRetryAttempts is how many times a document Elasticsearch rejects
+	// with 429 or 503 is sent again, after a jittered backoff that starts
+	// at BulkRetryBackoff and doubles. Zero drops it at once.
+	BulkRetryAttempts int
+	BulkRetryBackoff  time.Duration
+	// AdaptiveWorkers scales the bulk workers between MinBulkWorkers and
+	// MaxBulkWorkers (zero for twice BulkWorkers) every WorkerScaleInterval:
+	// down when bulk requests take longer than TargetBulkLatency or items
+	// are rejected with 429, up while logs queue faster than they flush.
+	AdaptiveWorkers     bool
+	MinBulkWorkers      int
+	MaxBulkWorkers      int
+	WorkerScaleInterval time.Duration
+	TargetBulkLatency   time.Duration
+	// CircuitBreaker sheds ingestion with 503 once Elasticsearch fails
+	// CircuitBreakerThreshold consecutive health checks or bulk stores,
+	// checked every CircuitBreakerInterval. After CircuitBreakerOpenFor the
+	// cluster is probed, and ingestion resumes once it answers.
+	CircuitBreaker          bool
+	CircuitBreakerThreshold int
+	CircuitBreakerInterval  time.Duration
+	CircuitBreakerOpenFor   time.Duration
+	// MaxQueuedDocs and MaxQueuedBytes bound what the bulk indexer holds in
+	// memory; zero is unlimited. Batches arriving while either is reached
+	// are rejected with 429, asking clients to retry after
+	// QueueFullRetryAfter.
+	MaxQueuedDocs       int
+	MaxQueuedBytes      int
+	QueueFullRetryAfter time.Duration
+	// WALDir enables a write-ahead log there: accepted batches are written
+	// to segments of WALSegmentBytes, fsynced with WALSync, and fed to
+	// storage from disk, so batches accepted during an outage are stored
+	// once it ends. Batches are rejected with 429 while the log holds
+	// WALMaxBytes; zero is unlimited.
+	WALDir          string
+	WALSegmentBytes int64
+	WALMaxBytes     int64
+	WALSync         bool
+
+	// CompressRequests gzips request bodies sent to Elasticsearch, such as
+	// bulk requests, at CompressionLevel (-1 for the gzip default, 1 to 9).
+	// Responses are compressed by the cluster regardless.
+	CompressRequests bool
+	CompressionLevel int
+
+	// AdaptiveFlushBytes halves the bulk flush size whenever Elasticsearch
+	// answers 413 and grows it back once requests stop being rejected.
+	AdaptiveFlushBytes bool
+	// MinFlushBytes is the floor the flush size is never reduced below.
+	MinFlushBytes int
+	// FlushRecoveryInterval is how long the flush size must go without a 413
+	// before it is doubled again.
+	FlushRecoveryInterval time.Duration
+
+	// ClientVersioning maps a per-log _version field onto an external
+	// document version so the highest version wins in Elasticsearch. Only
+	// logs with a document ID can be versioned; others are skipped.
+	ClientVersioning bool
+
+	// ContentHashIDs gives logs without an _id or doc_id field a document ID
+	// hashed from their content and account, so retried batches are not
+	// stored twice. Identical lines sent in one batch are then stored once.
+	ContentHashIDs bool
+
+	// InstallIndexTemplate installs or upgrades the logs index template at
+	// startup. It defaults to DataStreams: a plain index template outranks
+	// Elasticsearch's built-in logs-*-* data stream template, which
+	// logs-containers-<name> otherwise matches, so new indices would be
+	// created as plain indices and existing data streams would roll over
+	// without a data stream template. To manage the template of a cluster
+	// that already holds logs-containers data streams, set ES_DATA_STREAMS
+	// as well; to move to plain indices, reindex the data streams first.
+	InstallIndexTemplate bool
+
+	// DataStreams writes logs to logs-containers-<name> data streams, which
+	// roll over their backing indices, instead of plain indices.
+	DataStreams bool
+
+	// IndexRotation is "daily" or "weekly" to append the UTC date, e.g.
+	// -2024.06.01, to plain index names so old logs are dropped by deleting
+	// whole indices. "none" keeps one index per container.
+	IndexRotation string
+
+	// IndexPattern is a Go template that names the index of each log, e.g.
+	// logs-{{.AccountID}}-{{.Container}}-{{.Date}}, with the fields of
+	// storage.IndexNameData. It replaces logs-containers-<container> and
+	// IndexRotation, and must start with a fixed prefix so the index
+	// template only covers log indices.
+	IndexPattern string
+
+	// IndexPerAccount names indices logs-containers-<account>-<container>
+	// so each account's logs can be secured, retained and deleted as whole
+	// indices.
+	IndexPerAccount bool
+
+	// IndexRouteFields lists dotted log fields, such as
+	// kubernetes.namespace_name or kubernetes.labels.app, in order of
+	// precedence. The first one present is inserted before the container in
+	// the index name, e.g. logs-containers-<namespace>-<container>, and is
+	// {{.Route}} in IndexPattern.
+	IndexRouteFields []string
+
+	// IngestPipeline is the Elasticsearch ingest pipeline logs are indexed
+	// through. ContainerPipelines and TenantPipelines map a container name
+	// or numeric account ID to a pipeline that replaces it; a container's
+	// wins over its account's. "_none" skips the index's default pipeline.
+	IngestPipeline     string
+	ContainerPipelines map[string]string
+	TenantPipelines    map[string]string
+
+	// ILMPolicy creates the logs-containers ILM policy at startup and
+	// attaches it to the index template. Indices move to the warm phase
+	// after ILMWarmAfter and are deleted after ILMDeleteAfter; zero skips
+	// the phase. Deletion needs DataStreams or dated index names, since it
+	// would otherwise drop a container's whole index. Data streams roll over at ILMRolloverMaxAge or when a
+	// primary shard reaches ILMRolloverMaxSize, e.g. "50gb".
+	ILMPolicy          bool
+	ILMRolloverMaxAge  time.Duration
+	ILMRolloverMaxSize string
+	ILMWarmAfter       time.Duration
+	ILMDeleteAfter     time.Duration
+	// TenantILMWarmAfter and TenantILMDeleteAfter map a numeric account ID
+	// to a duration such as "72h" that replaces ILMWarmAfter or
+	// ILMDeleteAfter in the policy of the account's dedicated cluster, or of
+	// its own indices with IndexPerAccount.
+	TenantILMWarmAfter   map[string]string
+	TenantILMDeleteAfter map[string]string
+
+	// StorageBackend is "elasticsearch", "opensearch", "s3", "clickhouse",
+	// "loki", "kafka", "file" or "memory". OpenSearch is reached at
+	// ElasticsearchURL. With S3Archive set, batches are also archived to S3
+	// as an optional destination.
+	StorageBackend string
+	S3Archive      bool
+	// StorageDestinationList, read from STORAGE_DESTINATIONS, replaces
+	// StorageBackend and S3Archive with backends that every batch is
+	// written to, e.g. "elasticsearch,s3:optional". A batch fails when a
+	// destination fails unless it is marked optional.
+	StorageDestinationList []string
+	// S3Bucket and S3Region locate the archive; S3Endpoint addresses an
+	// S3-compatible service instead of AWS. Objects are written under
+	// S3Prefix/<account>/<date>/<container>/.
+	S3Bucket   string
+	S3Region   string
+	S3Endpoint string
+	S3Prefix   string
+	// S3FlushBytes and S3FlushInterval bound how much and how long a
+	// partition is buffered before it is uploaded as one object.
+	S3FlushBytes    int
+	S3FlushInterval time.Duration
+	// S3MaxBufferedBytes bounds the logs held in memory awaiting upload.
+	S3MaxBufferedBytes int64
+
+	// ClickHouseURL is the HTTP interface the "clickhouse" storage backend
+	// inserts through. ClickHouseCreateTable creates
+	// ClickHouseDatabase.ClickHouseTable at startup.
+	ClickHouseURL         string
+	ClickHouseDatabase    string
+	ClickHouseTable       string
+	ClickHouseUsername    string
+	ClickHousePassword    string
+	ClickHouseCreateTable bool
+	// ClickHouseBatchRows and ClickHouseFlushInterval bound how many rows
+	// and how long logs are buffered before an insert.
+	ClickHouseBatchRows     int
+	ClickHouseFlushInterval time.Duration
+	// ClickHouseMaxBufferedRows bounds the rows held in memory.
+	ClickHouseMaxBufferedRows int
+
+	// LokiURL is the Loki instance the "loki" storage backend pushes to. The token account ID is sent in LokiTenantHeader, and
+	// LokiLabels maps stream labels to dotted log field paths; it is read
+	// from LOKI_LABELS as a JSON object and defaults to Kubernetes metadata.
+	LokiURL          string
+	LokiTenantHeader string
+	LokiLabels       map[string]string
+	LokiUsername     string
+	LokiPassword     string
+
+	// FileStorageDir receives NDJSON files from the "file" storage backend.
+	// Files rotate at FileStorageMaxBytes or FileStorageMaxAge, are
+	// gzip-compressed when FileStorageCompress is set and deleted after
+	// FileStorageRetention. SinkManifest applies to them too.
+	FileStorageDir       string
+	FileStorageMaxBytes  int64
+	FileStorageMaxAge    time.Duration
+	FileStorageCompress  bool
+	FileStorageRetention time.Duration
+	// DeadLetterDir receives NDJSON files of documents Elasticsearch did not
+	// store, with the failure reason. Files rotate at DeadLetterMaxBytes or
+	// hourly and are deleted after DeadLetterRetention. SinkManifest applies
+	// to them too.
+	DeadLetterDir       string
+	DeadLetterMaxBytes  int64
+	DeadLetterRetention time.Duration
+
+	// DevMode, set by the --dev flag or DEV_MODE, defaults StorageBackend to
+	// "memory" and serves the logs it keeps on /dev/logs without
+	// authentication. MemoryStorageCapacity is how many entries it keeps.
+	DevMode               bool
+	MemoryStorageCapacity int
 }
 
 // Load reads configuration from environment variables
 func Load() (*Config, error) {
+	publicKeys, err := getEnvJSONMap("JWT_PUBLIC_KEYS")
+	if err != nil {
+		return nil, err
+	}
+	apiKeys, err := getEnvJSONMap("API_KEYS")
+	if err != nil {
+		return nil, err
+	}
+	hmacSecrets, err := getEnvJSONMap("HMAC_SECRETS")
+	if err != nil {
+		return nil, err
+	}
+	ipAllowlists, err := getEnvJSONMap("TENANT_IP_ALLOWLISTS")
+	if err != nil {
+		return nil, err
+	}
+	forwardSharedKeys, err := getEnvJSONMap("FLUENT_FORWARD_SHARED_KEYS")
+	if err != nil {
+		return nil, err
+	}
+	syslogSourceAccounts, err := getEnvJSONMap("SYSLOG_SOURCE_ACCOUNTS")
+	if err != nil {
+		return nil, err
+	}
+	tenantMaxBodyBytes, err := getEnvJSONMap("TENANT_MAX_BODY_BYTES")
+	if err != nil {
+		return nil, err
+	}
+	lokiLabels, err := getEnvJSONMap("LOKI_LABELS")
+	if err != nil {
+		return nil, err
+	}
+	tenantElasticsearchURLs, err := getEnvJSONMap("TENANT_ELASTICSEARCH_URLS")
+	if err != nil {
+		return nil, err
+	}
+	tenantElasticsearchAPIKeys, err := getEnvJSONMap("TENANT_ELASTICSEARCH_API_KEYS")
+	if err != nil {
+		return nil, err
+	}
+	gelfSourceAccounts, err := getEnvJSONMap("GELF_SOURCE_ACCOUNTS")
+	if err != nil {
+		return nil, err
+	}
+	containerPipelines, err := getEnvJSONMap("CONTAINER_INGEST_PIPELINES")
+	if err != nil {
+		return nil, err
+	}
+	tenantPipelines, err := getEnvJSONMap("TENANT_INGEST_PIPELINES")
+	if err != nil {
+		return nil, err
+	}
+	tenantILMWarmAfter, err := getEnvJSONMap("TENANT_ILM_WARM_AFTER")
+	if err != nil {
+		return nil, err
+	}
+	tenantILMDeleteAfter, err := getEnvJSONMap("TENANT_ILM_DELETE_AFTER")
+	if err != nil {
+		return nil, err
+	}
+	routeAuthMethods, err := getEnvJSONMap("ROUTE_AUTH_METHODS")
+	if err != nil {
+		return nil, err
+	}
+
+	env := &envReader{}
+	devMode := env.Bool("DEV_MODE", false)
+	dataStreams := env.Bool("ES_DATA_STREAMS", false)
+	defaultStorageBackend := "elasticsearch"
+	if devMode {
+		defaultStorageBackend = "memory"
+	}
+
 	config := &Config{
-		Port:             getEnv("PORT", "9091"),
-		ElasticsearchURL: getEnv("ELASTICSEARCH_URL", "http://elasticsearch:9200"),
-		JWTPublicKey:     getEnv("RSA_PUBLIC_KEY", ""),
+		Port:                        getEnv("PORT", "9091"),
+		UnixSocket:                  getEnv("UNIX_SOCKET", ""),
+		UnixSocketMode:              getEnv("UNIX_SOCKET_MODE", "0660"),
+		ShutdownTimeout:             env.Duration("SHUTDOWN_TIMEOUT", 25*time.Second),
+		RequestTimeout:              env.Duration("REQUEST_TIMEOUT", 12*time.Second),
+		ReusePort:                   env.Bool("REUSE_PORT", false),
+		HTTPReadTimeout:             env.Duration("HTTP_READ_TIMEOUT", 15*time.Second),
+		HTTPReadHeaderTimeout:       env.Duration("HTTP_READ_HEADER_TIMEOUT", 0),
+		HTTPWriteTimeout:            env.Duration("HTTP_WRITE_TIMEOUT", 15*time.Second),
+		HTTPIdleTimeout:             env.Duration("HTTP_IDLE_TIMEOUT", 60*time.Second),
+		HTTPMaxHeaderBytes:          env.Int("HTTP_MAX_HEADER_BYTES", 1<<20),
+		H2C:                         env.Bool("HTTP_H2C", false),
+		HTTP2MaxConcurrentStreams:   env.Int("HTTP2_MAX_CONCURRENT_STREAMS", 250),
+		GRPCPort:                    getEnv("OTLP_GRPC_PORT", ""),
+		ForwardPort:                 getEnv("FLUENT_FORWARD_PORT", ""),
+		ForwardSharedKeys:           forwardSharedKeys,
+		ForwardHostname:             getEnv("FLUENT_FORWARD_HOSTNAME", ""),
+		SyslogPort:                  getEnv("SYSLOG_PORT", ""),
+		SyslogSourceAccounts:        syslogSourceAccounts,
+		SyslogMaxMessageBytes:       env.Int("SYSLOG_MAX_MESSAGE_BYTES", 64<<10),
+		GELFPort:                    getEnv("GELF_PORT", ""),
+		GELFSourceAccounts:          gelfSourceAccounts,
+		GELFMaxMessageBytes:         env.Int("GELF_MAX_MESSAGE_BYTES", 1<<20),
+		HTTPIngest:                  env.Bool("HTTP_INGEST", true),
+		KafkaBrokers:                getEnvList("KAFKA_BROKERS", nil),
+		KafkaGroupID:                getEnv("KAFKA_GROUP_ID", "akto-log-ingestion"),
+		KafkaTopics:                 getEnvList("KAFKA_TOPICS", nil),
+		KafkaTopicPattern:           env.Bool("KAFKA_TOPIC_PATTERN", false),
+		KafkaTLS:                    env.Bool("KAFKA_TLS", false),
+		KafkaTLSCAFile:              getEnv("KAFKA_TLS_CA_FILE", ""),
+		KafkaSASLMechanism:          getEnv("KAFKA_SASL_MECHANISM", ""),
+		KafkaSASLUsername:           getEnv("KAFKA_SASL_USERNAME", ""),
+		KafkaSASLPassword:           getEnv("KAFKA_SASL_PASSWORD", ""),
+		KafkaTokenHeader:            getEnv("KAFKA_TOKEN_HEADER", "authorization"),
+		KafkaAccountHeader:          getEnv("KAFKA_ACCOUNT_HEADER", ""),
+		KafkaProducerBrokers:        getEnvList("KAFKA_PRODUCER_BROKERS", nil),
+		KafkaProducerTopic:          getEnv("KAFKA_PRODUCER_TOPIC", "logs.{account}"),
+		KafkaProducerAccountHeader:  getEnv("KAFKA_PRODUCER_ACCOUNT_HEADER", "account_id"),
+		ElasticsearchURL:            getEnv("ELASTICSEARCH_URL", "http://elasticsearch:9200"),
+		ElasticsearchCloudID:        getEnv("ELASTICSEARCH_CLOUD_ID", ""),
+		ElasticsearchUsername:       getEnv("ELASTICSEARCH_USERNAME", ""),
+		ElasticsearchPassword:       getEnv("ELASTICSEARCH_PASSWORD", ""),
+		ElasticsearchAPIKey:         getEnv("ELASTICSEARCH_API_KEY", ""),
+		ElasticsearchCAFile:         getEnv("ELASTICSEARCH_CA_FILE", ""),
+		ElasticsearchClientCertFile: getEnv("ELASTICSEARCH_CLIENT_CERT_FILE", ""),
+		ElasticsearchClientKeyFile:  getEnv("ELASTICSEARCH_CLIENT_KEY_FILE", ""),
+		InsecureSkipVerify:          env.Bool("INSECURE_SKIP_VERIFY", false),
+		ElasticsearchSecondaryURL:   getEnv("ELASTICSEARCH_SECONDARY_URL", ""),
+		FailoverCheckInterval:       env.Duration("ES_FAILOVER_CHECK_INTERVAL", 10*time.Second),
+		FailoverThreshold:           env.Int("ES_FAILOVER_THRESHOLD", 3),
+		FailbackThreshold:           env.Int("ES_FAILBACK_THRESHOLD", 6),
+		TenantElasticsearchURLs:     tenantElasticsearchURLs,
+		TenantElasticsearchAPIKeys:  tenantElasticsearchAPIKeys,
+		AuthMethods:                 getEnvList("AUTH_METHODS", []string{"jwt"}),
+		RouteAuthMethods:            splitListValues(routeAuthMethods),
+		APIKeys:                     apiKeys,
+		APIKeysFile:                 getEnv("API_KEYS_FILE", ""),
+		HMACSecrets:                 hmacSecrets,
+		HMACMaxSkew:                 env.Duration("HMAC_MAX_SKEW", 5*time.Minute),
+		AdminToken:                  getEnv("ADMIN_TOKEN", ""),
+		AuditIndex:                  getEnv("AUDIT_INDEX", ""),
+		SelfMonitoring:              env.Bool("SELF_MONITORING", false),
+		SelfMonitoringIndex:         getEnv("SELF_MONITORING_INDEX", "logs-akto-ingestion"),
+		SelfMonitoringRate:          env.Int("SELF_MONITORING_RATE", 100),
+		DebugPort:                   getEnv("DEBUG_PORT", ""),
+		Metrics:                     env.Bool("METRICS", true),
+		MetricsToken:                getEnv("METRICS_TOKEN", ""),
+		MetricsMaxAccounts:          env.Int("METRICS_MAX_ACCOUNTS", 1000),
+		StatsLogInterval:            env.Duration("STATS_LOG_INTERVAL", time.Minute),
+		LogLevel:                    getEnv("LOG_LEVEL", "info"),
+		LogFormat:                   getEnv("LOG_FORMAT", "text"),
+		AccessLogFormat:             getEnv("ACCESS_LOG_FORMAT", "json"),
+		AccessLogLogsSampleRate:     env.Float("ACCESS_LOG_LOGS_SAMPLE_RATE", 1),
+		Tracing:                     env.Bool("TRACING", false),
+		NotifyWebhookURL:            getEnv("NOTIFY_WEBHOOK_URL", ""),
+		NotifyFormat:                getEnv("NOTIFY_FORMAT", "json"),
+		NotifyInterval:              env.Duration("NOTIFY_INTERVAL", time.Minute),
+		NotifyFailureRate:           env.Float("NOTIFY_FAILURE_RATE", 0.05),
+		NotifyDeadLetterBytes:       int64(env.Int("NOTIFY_DEAD_LETTER_BYTES", 100<<20)),
+		TLSCertFile:                 getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:                  getEnv("TLS_KEY_FILE", ""),
+		TLSMinVersion:               getEnv("TLS_MIN_VERSION", "1.2"),
+		MTLSCAFile:                  getEnv("MTLS_CA_FILE", ""),
+		MTLSCRLFile:                 getEnv("MTLS_CRL_FILE", ""),
+		MTLSRefreshInterval:         env.Duration("MTLS_REFRESH_INTERVAL", 5*time.Minute),
+		MTLSRequired:                env.Bool("MTLS_REQUIRED", false),
+		MTLSAccountSource:           getEnv("MTLS_ACCOUNT_SOURCE", "ou"),
+		MTLSURIPrefix:               getEnv("MTLS_URI_PREFIX", "akto://account/"),
+		IntrospectionURL:            getEnv("INTROSPECTION_URL", ""),
+		IntrospectionClientID:       getEnv("INTROSPECTION_CLIENT_ID", ""),
+		IntrospectionClientSecret:   getEnv("INTROSPECTION_CLIENT_SECRET", ""),
+		IntrospectionTimeout:        env.Duration("INTROSPECTION_TIMEOUT", 5*time.Second),
+		IntrospectionCacheTTL:       env.Duration("INTROSPECTION_CACHE_TTL", time.Minute),
+		IntrospectionAccountClaim:   getEnv("INTROSPECTION_ACCOUNT_CLAIM", "accountId"),
+		JWTPublicKey:                getEnv("RSA_PUBLIC_KEY", ""),
+		JWTPublicKeys:               publicKeys,
+		JWKSURL:                     getEnv("JWKS_URL", ""),
+		JWKSRefreshInterval:         env.Duration("JWKS_REFRESH_INTERVAL", 5*time.Minute),
+		JWTAlgorithms:               getEnvList("JWT_ALLOWED_ALGORITHMS", []string{"RS256", "RS384", "RS512"}),
+		JWTIssuer:                   getEnv("JWT_ISSUER", ""),
+		JWTAudience:                 getEnv("JWT_AUDIENCE", ""),
+		SecretsBackend:              getEnv("SECRETS_BACKEND", ""),
+		VaultAddr:                   getEnv("VAULT_ADDR", ""),
+		VaultToken:                  getEnv("VAULT_TOKEN", ""),
+		VaultNamespace:              getEnv("VAULT_NAMESPACE", ""),
+		AWSRegion:                   getEnv("AWS_REGION", ""),
+		JWTPublicKeySecret:          getEnv("JWT_PUBLIC_KEY_SECRET", ""),
+		TokenSigningKeySecret:       getEnv("TOKEN_SIGNING_KEY_SECRET", ""),
+		SecretsRefreshInterval:      env.Duration("SECRETS_REFRESH_INTERVAL", 5*time.Minute),
+		JWTLeeway:                   env.Duration("JWT_LEEWAY", 0),
+		TokenSigningKeyFile:         getEnv("TOKEN_SIGNING_KEY_FILE", ""),
+		TokenSigningKid:             getEnv("TOKEN_SIGNING_KID", "akto-proxy"),
+		TokenMaxTTL:                 env.Duration("TOKEN_MAX_TTL", time.Hour),
+		RevocationFile:              getEnv("REVOCATION_FILE", ""),
+		RevocationRedisURL:          getEnv("REVOCATION_REDIS_URL", ""),
+		RevocationRedisKey:          getEnv("REVOCATION_REDIS_KEY", "akto:revoked-tokens"),
+		RevocationReloadInterval:    env.Duration("REVOCATION_RELOAD_INTERVAL", time.Minute),
+		DefaultScopes:               getEnvList("DEFAULT_TOKEN_SCOPES", []string{"logs:write"}),
+		TenantIPAllowlists:          ipAllowlists,
+		TrustedProxies:              getEnvList("TRUSTED_PROXIES", nil),
+		ProxyProtocol:               env.Bool("PROXY_PROTOCOL", false),
+		ProxyProtocolSources:        getEnvList("PROXY_PROTOCOL_SOURCES", nil),
+		ReplayProtection:            getEnv("REPLAY_PROTECTION", "off"),
+		ReplayWindow:                env.Duration("REPLAY_WINDOW", 5*time.Minute),
+		ReplayCacheSize:             env.Int("REPLAY_CACHE_SIZE", 100000),
+		PolicyFile:                  getEnv("POLICY_FILE", ""),
+		PolicyQuery:                 getEnv("POLICY_QUERY", "data.akto.ingest.allow"),
+		AuthzWebhookURL:             getEnv("AUTHZ_WEBHOOK_URL", ""),
+		AuthzWebhookTimeout:         env.Duration("AUTHZ_WEBHOOK_TIMEOUT", 5*time.Second),
+		AuthzWebhookCacheTTL:        env.Duration("AUTHZ_WEBHOOK_CACHE_TTL", time.Minute),
+		TenantStatusFile:            getEnv("TENANT_STATUS_FILE", ""),
+		TenantStatusRedisURL:        getEnv("TENANT_STATUS_REDIS_URL", ""),
+		TenantStatusRedisKey:        getEnv("TENANT_STATUS_REDIS_KEY", "akto:suspended-accounts"),
+		TenantStatusURL:             getEnv("TENANT_STATUS_URL", ""),
+		TenantStatusRefreshInterval: env.Duration("TENANT_STATUS_REFRESH_INTERVAL", time.Minute),
+		TokenCacheSize:              env.Int("TOKEN_CACHE_SIZE", 0),
+		TokenCacheTTL:               env.Duration("TOKEN_CACHE_TTL", 5*time.Minute),
+		MaxDecompressedBytes:        int64(env.Int("MAX_DECOMPRESSED_BYTES", 64<<20)),
+		MaxBodyBytes:                int64(env.Int("MAX_BODY_BYTES", 16<<20)),
+		TenantMaxBodyBytes:          tenantMaxBodyBytes,
+		MaxBatchEntries:             env.Int("MAX_BATCH_ENTRIES", 0),
+		BatchLimitMode:              getEnv("BATCH_LIMIT_MODE", "reject"),
+		StreamChunkEntries:          env.Int("STREAM_CHUNK_ENTRIES", 0),
+		SyncIngest:                  env.Bool("SYNC_INGEST", false),
+		SyncIngestTimeout:           env.Duration("SYNC_INGEST_TIMEOUT", 10*time.Second),
+		HealthDetail:                env.Bool("HEALTH_DETAIL", false),
+		HealthRefreshInterval:       env.Duration("HEALTH_REFRESH_INTERVAL", 10*time.Second),
+		SinkManifest:                env.Bool("SINK_MANIFEST", false),
+		SampleReservoirSize:         env.Int("SAMPLE_RESERVOIR_SIZE", 0),
+		SampleMaxBytes:              int64(env.Int("SAMPLE_MAX_BYTES", 8<<20)),
+		EnqueueMaxRetries:           env.Int("ENQUEUE_MAX_RETRIES", 3),
+		EnqueueRetryBackoff:         env.Duration("ENQUEUE_RETRY_BACKOFF", 100*time.Millisecond),
+		AccountIDFormat:             getEnv("ACCOUNT_ID_FORMAT", "%d"),
+		SubAccountField:             getEnv("SUB_ACCOUNT_FIELD", ""),
+		BulkWorkers:                 env.Int("ES_BULK_WORKERS", 0),
+		BulkFlushBytes:              env.Int("ES_BULK_FLUSH_BYTES", 5<<20),
+		BulkFlushInterval:           env.Duration("ES_BULK_FLUSH_INTERVAL", 2*time.Second),
+		BulkRetryAttempts:           env.Int("ES_BULK_RETRY_ATTEMPTS", 3),
+		BulkRetryBackoff:            env.Duration("ES_BULK_RETRY_BACKOFF", time.Second),
+		AdaptiveWorkers:             env.Bool("ES_ADAPTIVE_WORKERS", false),
+		MinBulkWorkers:              env.Int("ES_MIN_BULK_WORKERS", 1),
+		MaxBulkWorkers:              env.Int("ES_MAX_BULK_WORKERS", 0),
+		WorkerScaleInterval:         env.Duration("ES_WORKER_SCALE_INTERVAL", 30*time.Second),
+		TargetBulkLatency:           env.Duration("ES_TARGET_BULK_LATENCY", 2*time.Second),
+		CircuitBreaker:              env.Bool("ES_CIRCUIT_BREAKER", false),
+		CircuitBreakerThreshold:     env.Int("ES_CIRCUIT_BREAKER_THRESHOLD", 5),
+		CircuitBreakerInterval:      env.Duration("ES_CIRCUIT_BREAKER_INTERVAL", 5*time.Second),
+		CircuitBreakerOpenFor:       env.Duration("ES_CIRCUIT_BREAKER_OPEN_FOR", 30*time.Second),
+		MaxQueuedDocs:               env.Int("ES_MAX_QUEUED_DOCS", 0),
+		MaxQueuedBytes:              env.Int("ES_MAX_QUEUED_BYTES", 0),
+		QueueFullRetryAfter:         env.Duration("ES_QUEUE_FULL_RETRY_AFTER", 5*time.Second),
+		WALDir:                      getEnv("WAL_DIR", ""),
+		WALSegmentBytes:             int64(env.Int("WAL_SEGMENT_BYTES", 64<<20)),
+		WALMaxBytes:                 int64(env.Int("WAL_MAX_BYTES", 1<<30)),
+		WALSync:                     env.Bool("WAL_SYNC", true),
+		CompressRequests:            env.Bool("ES_COMPRESS_REQUESTS", false),
+		CompressionLevel:            env.Int("ES_COMPRESSION_LEVEL", -1),
+		AdaptiveFlushBytes:          env.Bool("ES_ADAPTIVE_FLUSH_BYTES", true),
+		MinFlushBytes:               env.Int("ES_MIN_FLUSH_BYTES", 256<<10),
+		FlushRecoveryInterval:       env.Duration("ES_FLUSH_RECOVERY_INTERVAL", 5*time.Minute),
+		ClientVersioning:            env.Bool("CLIENT_VERSIONING", false),
+		ContentHashIDs:              env.Bool("ES_CONTENT_HASH_IDS", false),
+		InstallIndexTemplate:        env.Bool("ES_INSTALL_TEMPLATE", dataStreams),
+		DataStreams:                 dataStreams,
+		IndexRotation:               getEnv("ES_INDEX_ROTATION", "none"),
+		IndexPattern:                getEnv("ES_INDEX_PATTERN", ""),
+		IndexPerAccount:             env.Bool("ES_INDEX_PER_ACCOUNT", false),
+		IndexRouteFields:            getEnvList("ES_INDEX_ROUTE_FIELDS", nil),
+		IngestPipeline:              getEnv("ES_INGEST_PIPELINE", ""),
+		ContainerPipelines:          containerPipelines,
+		TenantPipelines:             tenantPipelines,
+		ILMPolicy:                   env.Bool("ES_ILM_POLICY", false),
+		ILMRolloverMaxAge:           env.Duration("ES_ILM_ROLLOVER_MAX_AGE", 24*time.Hour),
+		ILMRolloverMaxSize:          getEnv("ES_ILM_ROLLOVER_MAX_SIZE", "50gb"),
+		ILMWarmAfter:                env.Duration("ES_ILM_WARM_AFTER", 7*24*time.Hour),
+		ILMDeleteAfter:              env.Duration("ES_ILM_DELETE_AFTER", 30*24*time.Hour),
+		TenantILMWarmAfter:          tenantILMWarmAfter,
+		TenantILMDeleteAfter:        tenantILMDeleteAfter,
+		StorageBackend:              getEnv("STORAGE_BACKEND", defaultStorageBackend),
+		S3Archive:                   env.Bool("S3_ARCHIVE", false),
+		StorageDestinationList:      getEnvList("STORAGE_DESTINATIONS", nil),
+		S3Bucket:                    getEnv("S3_BUCKET", ""),
+		S3Region:                    getEnv("S3_REGION", os.Getenv("AWS_REGION")),
+		S3Endpoint:                  getEnv("S3_ENDPOINT", ""),
+		S3Prefix:                    getEnv("S3_PREFIX", "logs"),
+		S3FlushBytes:                env.Int("S3_FLUSH_BYTES", 8<<20),
+		S3FlushInterval:             env.Duration("S3_FLUSH_INTERVAL", 5*time.Minute),
+		S3MaxBufferedBytes:          int64(env.Int("S3_MAX_BUFFERED_BYTES", 256<<20)),
+		ClickHouseURL:               getEnv("CLICKHOUSE_URL", "http://clickhouse:8123"),
+		ClickHouseDatabase:          getEnv("CLICKHOUSE_DATABASE", "default"),
+		ClickHouseTable:             getEnv("CLICKHOUSE_TABLE", "logs"),
+		ClickHouseUsername:          getEnv("CLICKHOUSE_USERNAME", ""),
+		ClickHousePassword:          getEnv("CLICKHOUSE_PASSWORD", ""),
+		ClickHouseCreateTable:       env.Bool("CLICKHOUSE_CREATE_TABLE", true),
+		ClickHouseBatchRows:         env.Int("CLICKHOUSE_BATCH_ROWS", 5000),
+		ClickHouseFlushInterval:     env.Duration("CLICKHOUSE_FLUSH_INTERVAL", 5*time.Second),
+		ClickHouseMaxBufferedRows:   env.Int("CLICKHOUSE_MAX_BUFFERED_ROWS", 100000),
+		LokiURL:                     getEnv("LOKI_URL", "http://loki:3100"),
+		LokiTenantHeader:            getEnv("LOKI_TENANT_HEADER", "X-Scope-OrgID"),
+		LokiLabels:                  lokiLabels,
+		LokiUsername:                getEnv("LOKI_USERNAME", ""),
+		LokiPassword:                getEnv("LOKI_PASSWORD", ""),
+		FileStorageDir:              getEnv("FILE_STORAGE_DIR", ""),
+		FileStorageMaxBytes:         int64(env.Int("FILE_STORAGE_MAX_BYTES", 100<<20)),
+		FileStorageMaxAge:           env.Duration("FILE_STORAGE_MAX_AGE", time.Hour),
+		FileStorageCompress:         env.Bool("FILE_STORAGE_COMPRESS", true),
+		FileStorageRetention:        env.Duration("FILE_STORAGE_RETENTION", 7*24*time.Hour),
+		DeadLetterDir:               getEnv("DEAD_LETTER_DIR", ""),
+		DeadLetterMaxBytes:          int64(env.Int("DEAD_LETTER_MAX_BYTES", 100<<20)),
+		DeadLetterRetention:         env.Duration("DEAD_LETTER_RETENTION", 7*24*time.Hour),
+		DevMode:                     devMode,
+		MemoryStorageCapacity:       env.Int("MEMORY_STORAGE_CAPACITY", 10000),
+	}
+	if err := env.Err(); err != nil {
+		return nil, err
 	}
 	if err := config.Validate(); err != nil {
 		return nil, err
@@ -30,18 +918,660 @@ func (c *Config) Validate() error {
 	if c.Port == "" {
 		return fmt.Errorf("PORT is required")
 	}
-	if c.ElasticsearchURL == "" {
-		return fmt.Errorf("ELASTICSEARCH_URL is required")
+	if c.Port == "off" && c.UnixSocket == "" {
+		return fmt.Errorf("UNIX_SOCKET is required when PORT is off")
+	}
+	if _, err := strconv.ParseUint(c.UnixSocketMode, 8, 32); err != nil {
+		return fmt.Errorf("UNIX_SOCKET_MODE must be an octal file mode")
+	}
+	if c.GRPCPort != "" && c.GRPCPort == c.Port {
+		return fmt.Errorf("OTLP_GRPC_PORT must differ from PORT")
+	}
+	if c.ForwardPort != "" && (c.ForwardPort == c.Port || c.ForwardPort == c.GRPCPort) {
+		return fmt.Errorf("FLUENT_FORWARD_PORT must differ from PORT and OTLP_GRPC_PORT")
+	}
+	if c.SyslogPort != "" {
+		if c.SyslogPort == c.Port || c.SyslogPort == c.GRPCPort || c.SyslogPort == c.ForwardPort {
+			return fmt.Errorf("SYSLOG_PORT must differ from the other listener ports")
+		}
+		if len(c.SyslogSourceAccounts) == 0 && !c.AuthMethodEnabled("mtls") {
+			return fmt.Errorf("SYSLOG_SOURCE_ACCOUNTS or the mtls auth method is required for syslog")
+		}
+		if c.SyslogMaxMessageBytes <= 0 {
+			return fmt.Errorf("SYSLOG_MAX_MESSAGE_BYTES must be positive")
+		}
+	}
+	if c.GELFPort != "" {
+		if c.GELFPort == c.Port || c.GELFPort == c.GRPCPort || c.GELFPort == c.ForwardPort || c.GELFPort == c.SyslogPort {
+			return fmt.Errorf("GELF_PORT must differ from the other listener ports")
+		}
+		if len(c.GELFSourceAccounts) == 0 && !c.AuthMethodEnabled("mtls") {
+			return fmt.Errorf("GELF_SOURCE_ACCOUNTS or the mtls auth method is required for GELF")
+		}
+		if c.GELFMaxMessageBytes <= 0 {
+			return fmt.Errorf("GELF_MAX_MESSAGE_BYTES must be positive")
+		}
+	}
+	if c.NotifyWebhookURL != "" {
+		if c.NotifyFormat != "json" && c.NotifyFormat != "slack" {
+			return fmt.Errorf("NOTIFY_FORMAT must be json or slack, got %q", c.NotifyFormat)
+		}
+		if c.NotifyInterval <= 0 {
+			return fmt.Errorf("NOTIFY_INTERVAL must be positive")
+		}
+		if c.NotifyFailureRate < 0 || c.NotifyFailureRate > 1 {
+			return fmt.Errorf("NOTIFY_FAILURE_RATE must be between 0 and 1")
+		}
+		if c.NotifyDeadLetterBytes < 0 {
+			return fmt.Errorf("NOTIFY_DEAD_LETTER_BYTES must not be negative")
+		}
+	}
+	if c.AuditIndex != "" && !c.UsesBackend("elasticsearch") && !c.UsesBackend("opensearch") {
+		return fmt.Errorf("AUDIT_INDEX requires the elasticsearch or opensearch storage backend")
+	}
+	if c.SelfMonitoring {
+		if !c.UsesBackend("elasticsearch") && !c.UsesBackend("opensearch") {
+			return fmt.Errorf("SELF_MONITORING requires the elasticsearch or opensearch storage backend")
+		}
+		if c.SelfMonitoringIndex == "" {
+			return fmt.Errorf("SELF_MONITORING_INDEX must be set when SELF_MONITORING is enabled")
+		}
+		if c.SelfMonitoringRate <= 0 {
+			return fmt.Errorf("SELF_MONITORING_RATE must be positive")
+		}
+	}
+	if c.DebugPort != "" {
+		if c.DebugPort == c.Port || c.DebugPort == c.GRPCPort || c.DebugPort == c.ForwardPort || c.DebugPort == c.SyslogPort || c.DebugPort == c.GELFPort {
+			return fmt.Errorf("DEBUG_PORT must differ from the other listener ports")
+		}
+		if c.AdminToken == "" {
+			return fmt.Errorf("ADMIN_TOKEN is required for DEBUG_PORT")
+		}
+	}
+	if len(c.KafkaBrokers) > 0 || c.UsesBackend("kafka") {
+		switch strings.ToLower(c.KafkaSASLMechanism) {
+		case "":
+		case "plain", "scram-sha-256", "scram-sha-512":
+			if c.KafkaSASLUsername == "" {
+				return fmt.Errorf("KAFKA_SASL_USERNAME is required with KAFKA_SASL_MECHANISM")
+			}
+		default:
+			return fmt.Errorf("KAFKA_SASL_MECHANISM must be plain, scram-sha-256 or scram-sha-512")
+		}
+	}
+	if len(c.KafkaBrokers) > 0 {
+		if c.KafkaGroupID == "" || len(c.KafkaTopics) == 0 {
+			return fmt.Errorf("KAFKA_GROUP_ID and KAFKA_TOPICS are required when KAFKA_BROKERS is set")
+		}
+		if c.KafkaTokenHeader == "" && c.KafkaAccountHeader == "" {
+			return fmt.Errorf("KAFKA_TOKEN_HEADER or KAFKA_ACCOUNT_HEADER is required when KAFKA_BROKERS is set")
+		}
+	}
+	if c.ElasticsearchURL == "" && c.ElasticsearchCloudID == "" {
+		return fmt.Errorf("ELASTICSEARCH_URL or ELASTICSEARCH_CLOUD_ID is required")
+	}
+	if c.ElasticsearchAPIKey != "" && c.ElasticsearchUsername != "" {
+		return fmt.Errorf("ELASTICSEARCH_API_KEY and ELASTICSEARCH_USERNAME are mutually exclusive")
+	}
+	if (c.ElasticsearchClientCertFile == "") != (c.ElasticsearchClientKeyFile == "") {
+		return fmt.Errorf("ELASTICSEARCH_CLIENT_CERT_FILE and ELASTICSEARCH_CLIENT_KEY_FILE must be set together")
+	}
+	if c.DataStreams && c.ClientVersioning {
+		return fmt.Errorf("ES_DATA_STREAMS cannot be combined with CLIENT_VERSIONING: data streams reject external document versions")
+	}
+	switch c.IndexRotation {
+	case "none":
+	case "daily", "weekly":
+		if c.DataStreams {
+			return fmt.Errorf("ES_INDEX_ROTATION cannot be combined with ES_DATA_STREAMS, which roll over on their own")
+		}
+	default:
+		return fmt.Errorf("ES_INDEX_ROTATION must be none, daily or weekly")
+	}
+	if c.IndexPattern != "" {
+		if c.IndexRotation != "none" {
+			return fmt.Errorf("ES_INDEX_PATTERN cannot be combined with ES_INDEX_ROTATION; use {{.Date}} or {{.Week}} in the pattern")
+		}
+		if c.IndexPerAccount {
+			return fmt.Errorf("ES_INDEX_PATTERN cannot be combined with ES_INDEX_PER_ACCOUNT; use {{.AccountID}} in the pattern")
+		}
+		if strings.HasPrefix(c.IndexPattern, "{{") {
+			return fmt.Errorf("ES_INDEX_PATTERN must start with a fixed prefix such as logs-")
+		}
+	}
+	if c.ILMPolicy {
+		if err := c.validateILM(); err != nil {
+			return err
+		}
+	}
+	if c.ElasticsearchSecondaryURL != "" {
+		if c.ElasticsearchSecondaryURL == c.ElasticsearchURL {
+			return fmt.Errorf("ELASTICSEARCH_SECONDARY_URL must differ from ELASTICSEARCH_URL")
+		}
+		if c.FailoverCheckInterval <= 0 || c.FailoverThreshold <= 0 || c.FailbackThreshold <= 0 {
+			return fmt.Errorf("ES_FAILOVER_CHECK_INTERVAL, ES_FAILOVER_THRESHOLD and ES_FAILBACK_THRESHOLD must be positive")
+		}
+	}
+	for accountID := range c.TenantPipelines {
+		if _, err := strconv.ParseInt(accountID, 10, 64); err != nil {
+			return fmt.Errorf("TENANT_INGEST_PIPELINES has an invalid account ID %q: keys are numeric account IDs, not ACCOUNT_ID_FORMAT", accountID)
+		}
+	}
+	for accountID, clusterURL := range c.TenantElasticsearchURLs {
+		if _, err := strconv.ParseInt(accountID, 10, 64); err != nil {
+			return fmt.Errorf("TENANT_ELASTICSEARCH_URLS has an invalid account ID %q: keys are numeric account IDs, not ACCOUNT_ID_FORMAT", accountID)
+		}
+		if clusterURL == "" {
+			return fmt.Errorf("TENANT_ELASTICSEARCH_URLS has no URL for account %s", accountID)
+		}
+	}
+	for accountID := range c.TenantElasticsearchAPIKeys {
+		if _, ok := c.TenantElasticsearchURLs[accountID]; !ok {
+			return fmt.Errorf("TENANT_ELASTICSEARCH_API_KEYS account %s has no cluster in TENANT_ELASTICSEARCH_URLS", accountID)
+		}
+	}
+	if len(c.AuthMethods) == 0 {
+		return fmt.Errorf("AUTH_METHODS must not be empty")
+	}
+	for _, method := range c.AuthMethods {
+		switch method {
+		case "jwt", "apikey", "mtls", "introspection", "hmac":
+		default:
+			return fmt.Errorf("unknown auth method %q in AUTH_METHODS", method)
+		}
+	}
+	for route, methods := range c.RouteAuthMethods {
+		if !slices.Contains(IngestRoutes, route) {
+			return fmt.Errorf("unknown route %q in ROUTE_AUTH_METHODS, want one of %s", route, strings.Join(IngestRoutes, ", "))
+		}
+		if len(methods) == 0 {
+			return fmt.Errorf("ROUTE_AUTH_METHODS must list at least one method for %s", route)
+		}
+		for _, method := range methods {
+			if !c.AuthMethodEnabled(method) {
+				return fmt.Errorf("ROUTE_AUTH_METHODS method %q for %s is not enabled in AUTH_METHODS", method, route)
+			}
+		}
+	}
+	if c.AuthMethodEnabled("apikey") && len(c.APIKeys) == 0 && c.APIKeysFile == "" {
+		return fmt.Errorf("API_KEYS or API_KEYS_FILE must be provided when apikey auth is enabled")
+	}
+	if c.AuthMethodEnabled("hmac") && (len(c.HMACSecrets) == 0 || c.HMACMaxSkew <= 0) {
+		return fmt.Errorf("HMAC_SECRETS and a positive HMAC_MAX_SKEW are required when hmac auth is enabled")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if (c.MTLSRequired || c.MTLSCRLFile != "") && (c.TLSCertFile == "" || c.MTLSCAFile == "") {
+		return fmt.Errorf("TLS_CERT_FILE, TLS_KEY_FILE and MTLS_CA_FILE are required for MTLS_REQUIRED and MTLS_CRL_FILE")
+	}
+	if c.MTLSRefreshInterval <= 0 {
+		return fmt.Errorf("MTLS_REFRESH_INTERVAL must be positive")
+	}
+	if c.TLSMinVersion != "1.2" && c.TLSMinVersion != "1.3" {
+		return fmt.Errorf("TLS_MIN_VERSION must be 1.2 or 1.3")
 	}
-	if c.JWTPublicKey == "" {
-		return fmt.Errorf("RSA_PUBLIC_KEY must be provided")
+	if c.AuthMethodEnabled("introspection") && c.IntrospectionURL == "" {
+		return fmt.Errorf("INTROSPECTION_URL is required when introspection auth is enabled")
+	}
+	if c.AuthMethodEnabled("mtls") && (c.TLSCertFile == "" || c.MTLSCAFile == "") {
+		return fmt.Errorf("TLS_CERT_FILE, TLS_KEY_FILE and MTLS_CA_FILE are required when mtls auth is enabled")
+	}
+	if c.AuthMethodEnabled("jwt") && c.JWTPublicKey == "" && len(c.JWTPublicKeys) == 0 && c.JWKSURL == "" &&
+		c.JWTPublicKeySecret == "" && c.TokenSigningKeyFile == "" && c.TokenSigningKeySecret == "" {
+		return fmt.Errorf("RSA_PUBLIC_KEY, JWT_PUBLIC_KEYS, JWKS_URL, JWT_PUBLIC_KEY_SECRET or a token signing key must be provided")
+	}
+	switch c.SecretsBackend {
+	case "":
+		if c.JWTPublicKeySecret != "" || c.TokenSigningKeySecret != "" {
+			return fmt.Errorf("SECRETS_BACKEND is required to read JWT_PUBLIC_KEY_SECRET or TOKEN_SIGNING_KEY_SECRET")
+		}
+	case "vault":
+		if c.VaultAddr == "" || c.VaultToken == "" {
+			return fmt.Errorf("VAULT_ADDR and VAULT_TOKEN are required for the vault secrets backend")
+		}
+	case "aws":
+		if c.AWSRegion == "" {
+			return fmt.Errorf("AWS_REGION is required for the aws secrets backend")
+		}
+	default:
+		return fmt.Errorf("SECRETS_BACKEND must be vault or aws")
+	}
+	if c.SecretsBackend != "" && c.SecretsRefreshInterval <= 0 {
+		return fmt.Errorf("SECRETS_REFRESH_INTERVAL must be positive")
+	}
+	if c.TokenSigningKeyFile != "" && c.TokenSigningKeySecret != "" {
+		return fmt.Errorf("only one of TOKEN_SIGNING_KEY_FILE and TOKEN_SIGNING_KEY_SECRET may be set")
+	}
+	if c.JWKSURL != "" && c.JWKSRefreshInterval <= 0 {
+		return fmt.Errorf("JWKS_REFRESH_INTERVAL must be positive")
+	}
+	if c.JWTLeeway < 0 {
+		return fmt.Errorf("JWT_LEEWAY must not be negative")
+	}
+	if c.MetricsMaxAccounts < 0 {
+		return fmt.Errorf("METRICS_MAX_ACCOUNTS must not be negative")
+	}
+	switch c.AccessLogFormat {
+	case "json", "text", "off":
+	default:
+		return fmt.Errorf("ACCESS_LOG_FORMAT must be json, text or off, got %q", c.AccessLogFormat)
+	}
+	if c.AccessLogLogsSampleRate < 0 || c.AccessLogLogsSampleRate > 1 {
+		return fmt.Errorf("ACCESS_LOG_LOGS_SAMPLE_RATE must be between 0 and 1")
+	}
+	if (c.TokenSigningKeyFile != "" || c.TokenSigningKeySecret != "") && (!c.AuthMethodEnabled("jwt") || c.TokenMaxTTL <= 0) {
+		return fmt.Errorf("a token signing key requires jwt auth and a positive TOKEN_MAX_TTL")
+	}
+	if c.RevocationFile != "" && c.RevocationRedisURL != "" {
+		return fmt.Errorf("only one of REVOCATION_FILE and REVOCATION_REDIS_URL may be set")
+	}
+	if (c.RevocationFile != "" || c.RevocationRedisURL != "") && c.RevocationReloadInterval <= 0 {
+		return fmt.Errorf("REVOCATION_RELOAD_INTERVAL must be positive")
+	}
+	switch c.ReplayProtection {
+	case "off":
+	case "jti", "nonce":
+		if c.ReplayWindow <= 0 || c.ReplayCacheSize <= 0 {
+			return fmt.Errorf("REPLAY_WINDOW and REPLAY_CACHE_SIZE must be positive when replay protection is enabled")
+		}
+	default:
+		return fmt.Errorf("REPLAY_PROTECTION must be one of off, jti, nonce")
+	}
+	if c.AuthzWebhookURL != "" && c.AuthzWebhookTimeout <= 0 {
+		return fmt.Errorf("AUTHZ_WEBHOOK_TIMEOUT must be positive")
+	}
+	sources := 0
+	for _, source := range []string{c.TenantStatusFile, c.TenantStatusRedisURL, c.TenantStatusURL} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("only one of TENANT_STATUS_FILE, TENANT_STATUS_REDIS_URL and TENANT_STATUS_URL may be set")
+	}
+	if sources == 1 && c.TenantStatusRefreshInterval <= 0 {
+		return fmt.Errorf("TENANT_STATUS_REFRESH_INTERVAL must be positive")
+	}
+	if c.TokenCacheSize < 0 {
+		return fmt.Errorf("TOKEN_CACHE_SIZE must not be negative")
+	}
+	if c.TokenCacheSize > 0 && c.TokenCacheTTL <= 0 {
+		return fmt.Errorf("TOKEN_CACHE_TTL must be positive when the token cache is enabled")
+	}
+	if c.MaxDecompressedBytes <= 0 {
+		return fmt.Errorf("MAX_DECOMPRESSED_BYTES must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("SHUTDOWN_TIMEOUT must be positive")
+	}
+	if c.HTTPReadTimeout <= 0 || c.HTTPWriteTimeout <= 0 || c.HTTPIdleTimeout <= 0 {
+		return fmt.Errorf("HTTP_READ_TIMEOUT, HTTP_WRITE_TIMEOUT and HTTP_IDLE_TIMEOUT must be positive")
+	}
+	if c.HTTPReadHeaderTimeout < 0 {
+		return fmt.Errorf("HTTP_READ_HEADER_TIMEOUT must not be negative")
+	}
+	if c.HTTPMaxHeaderBytes <= 0 || c.HTTP2MaxConcurrentStreams <= 0 {
+		return fmt.Errorf("HTTP_MAX_HEADER_BYTES and HTTP2_MAX_CONCURRENT_STREAMS must be positive")
+	}
+	// The HTTP server's write timeout would cut off longer requests.
+	if c.RequestTimeout <= 0 || c.RequestTimeout >= c.HTTPWriteTimeout {
+		return fmt.Errorf("REQUEST_TIMEOUT must be positive and under HTTP_WRITE_TIMEOUT")
+	}
+	if c.MaxBodyBytes <= 0 {
+		return fmt.Errorf("MAX_BODY_BYTES must be positive")
+	}
+	if c.MaxBatchEntries < 0 {
+		return fmt.Errorf("MAX_BATCH_ENTRIES must not be negative")
+	}
+	if c.BatchLimitMode != "reject" && c.BatchLimitMode != "split" {
+		return fmt.Errorf("BATCH_LIMIT_MODE must be reject or split")
+	}
+	if c.StreamChunkEntries < 0 {
+		return fmt.Errorf("STREAM_CHUNK_ENTRIES must not be negative")
+	}
+	// The HTTP server's write timeout would cut off longer waits.
+	if c.SyncIngestTimeout <= 0 || c.SyncIngestTimeout >= c.HTTPWriteTimeout {
+		return fmt.Errorf("SYNC_INGEST_TIMEOUT must be positive and under HTTP_WRITE_TIMEOUT")
+	}
+	if c.HealthRefreshInterval <= 0 {
+		return fmt.Errorf("HEALTH_REFRESH_INTERVAL must be positive")
+	}
+	if c.SampleReservoirSize < 0 {
+		return fmt.Errorf("SAMPLE_RESERVOIR_SIZE must not be negative")
+	}
+	if c.SampleReservoirSize > 0 && c.SampleMaxBytes <= 0 {
+		return fmt.Errorf("SAMPLE_MAX_BYTES must be positive when sampling is enabled")
+	}
+	if c.EnqueueMaxRetries < 0 {
+		return fmt.Errorf("ENQUEUE_MAX_RETRIES must not be negative")
+	}
+	if c.BulkWorkers < 0 {
+		return fmt.Errorf("ES_BULK_WORKERS must not be negative")
+	}
+	if c.BulkFlushBytes <= 0 || c.BulkFlushInterval <= 0 {
+		return fmt.Errorf("ES_BULK_FLUSH_BYTES and ES_BULK_FLUSH_INTERVAL must be positive")
+	}
+	if c.BulkRetryAttempts < 0 || c.BulkRetryBackoff <= 0 {
+		return fmt.Errorf("ES_BULK_RETRY_ATTEMPTS must not be negative and ES_BULK_RETRY_BACKOFF must be positive")
+	}
+	if c.AdaptiveWorkers {
+		if c.MinBulkWorkers <= 0 || c.WorkerScaleInterval <= 0 || c.TargetBulkLatency <= 0 {
+			return fmt.Errorf("ES_MIN_BULK_WORKERS, ES_WORKER_SCALE_INTERVAL and ES_TARGET_BULK_LATENCY must be positive")
+		}
+		if c.MaxBulkWorkers != 0 && c.MaxBulkWorkers < c.MinBulkWorkers {
+			return fmt.Errorf("ES_MAX_BULK_WORKERS must not be below ES_MIN_BULK_WORKERS")
+		}
+	}
+	if c.CircuitBreaker && (c.CircuitBreakerThreshold <= 0 || c.CircuitBreakerInterval <= 0 || c.CircuitBreakerOpenFor <= 0) {
+		return fmt.Errorf("ES_CIRCUIT_BREAKER_THRESHOLD, ES_CIRCUIT_BREAKER_INTERVAL and ES_CIRCUIT_BREAKER_OPEN_FOR must be positive")
+	}
+	if c.MaxQueuedDocs < 0 || c.MaxQueuedBytes < 0 || c.QueueFullRetryAfter <= 0 {
+		return fmt.Errorf("ES_MAX_QUEUED_DOCS and ES_MAX_QUEUED_BYTES must not be negative and ES_QUEUE_FULL_RETRY_AFTER must be positive")
+	}
+	if c.DeadLetterDir != "" && (c.DeadLetterMaxBytes <= 0 || c.DeadLetterRetention < 0) {
+		return fmt.Errorf("DEAD_LETTER_MAX_BYTES must be positive and DEAD_LETTER_RETENTION must not be negative")
+	}
+	if c.WALDir != "" && (c.WALSegmentBytes <= 0 || c.WALMaxBytes < 0) {
+		return fmt.Errorf("WAL_SEGMENT_BYTES must be positive and WAL_MAX_BYTES must not be negative")
+	}
+	if c.CompressionLevel < -1 || c.CompressionLevel > 9 || c.CompressionLevel == 0 {
+		return fmt.Errorf("ES_COMPRESSION_LEVEL must be -1 or between 1 and 9")
+	}
+	if c.AdaptiveFlushBytes && (c.MinFlushBytes <= 0 || c.FlushRecoveryInterval <= 0) {
+		return fmt.Errorf("ES_MIN_FLUSH_BYTES and ES_FLUSH_RECOVERY_INTERVAL must be positive")
+	}
+	if c.AdaptiveFlushBytes && c.MinFlushBytes > c.BulkFlushBytes {
+		return fmt.Errorf("ES_MIN_FLUSH_BYTES must not exceed ES_BULK_FLUSH_BYTES")
+	}
+	if err := c.validateStorage(); err != nil {
+		return err
 	}
 	return nil
 }
 
+// StorageDestination is a backend logs are written to.
+type StorageDestination struct {
+	Backend  string
+	Optional bool
+}
+
+// StorageDestinations returns STORAGE_DESTINATIONS, or StorageBackend
+// followed by an optional S3 archive when it is not set.
+func (c *Config) StorageDestinations() []StorageDestination {
+	if len(c.StorageDestinationList) == 0 {
+		destinations := []StorageDestination{{Backend: c.StorageBackend}}
+		if c.S3Archive {
+			destinations = append(destinations, StorageDestination{Backend: "s3", Optional: true})
+		}
+		return destinations
+	}
+	destinations := make([]StorageDestination, 0, len(c.StorageDestinationList))
+	for _, item := range c.StorageDestinationList {
+		backend, modifier, _ := strings.Cut(item, ":")
+		destinations = append(destinations, StorageDestination{Backend: backend, Optional: modifier == "optional"})
+	}
+	return destinations
+}
+
+// UsesBackend reports whether logs are written to backend.
+func (c *Config) UsesBackend(backend string) bool {
+	for _, destination := range c.StorageDestinations() {
+		if destination.Backend == backend {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) validateStorage() error {
+	if len(c.StorageDestinationList) > 0 && c.S3Archive {
+		return fmt.Errorf("S3_ARCHIVE cannot be combined with STORAGE_DESTINATIONS; list s3:optional instead")
+	}
+	for _, item := range c.StorageDestinationList {
+		if _, modifier, ok := strings.Cut(item, ":"); ok && modifier != "optional" {
+			return fmt.Errorf("invalid STORAGE_DESTINATIONS entry %q, expected backend or backend:optional", item)
+		}
+	}
+
+	seen := make(map[string]bool)
+	required := false
+	for _, destination := range c.StorageDestinations() {
+		switch destination.Backend {
+		case "elasticsearch", "opensearch", "s3", "loki":
+		case "memory":
+			if c.MemoryStorageCapacity <= 0 {
+				return fmt.Errorf("MEMORY_STORAGE_CAPACITY must be positive")
+			}
+		case "file":
+			if c.FileStorageDir == "" {
+				return fmt.Errorf("FILE_STORAGE_DIR is required for the file storage backend")
+			}
+			if c.FileStorageMaxBytes <= 0 || c.FileStorageMaxAge <= 0 || c.FileStorageRetention < 0 {
+				return fmt.Errorf("FILE_STORAGE_MAX_BYTES and FILE_STORAGE_MAX_AGE must be positive and FILE_STORAGE_RETENTION not negative")
+			}
+		case "kafka":
+			if len(c.KafkaProducerBrokers) == 0 || c.KafkaProducerTopic == "" {
+				return fmt.Errorf("KAFKA_PRODUCER_BROKERS and KAFKA_PRODUCER_TOPIC are required for the kafka storage backend")
+			}
+		case "clickhouse":
+			if c.ClickHouseBatchRows <= 0 || c.ClickHouseFlushInterval <= 0 {
+				return fmt.Errorf("CLICKHOUSE_BATCH_ROWS and CLICKHOUSE_FLUSH_INTERVAL must be positive")
+			}
+			if c.ClickHouseMaxBufferedRows < c.ClickHouseBatchRows {
+				return fmt.Errorf("CLICKHOUSE_MAX_BUFFERED_ROWS must be at least CLICKHOUSE_BATCH_ROWS")
+			}
+		default:
+			return fmt.Errorf("storage backend %q must be elasticsearch, opensearch, s3, clickhouse, loki, kafka, file or memory", destination.Backend)
+		}
+		if seen[destination.Backend] {
+			return fmt.Errorf("storage backend %s is listed more than once", destination.Backend)
+		}
+		seen[destination.Backend] = true
+		required = required || !destination.Optional
+	}
+	if seen["elasticsearch"] && seen["opensearch"] {
+		return fmt.Errorf("elasticsearch and opensearch both use ELASTICSEARCH_URL and cannot be combined")
+	}
+	if !required {
+		return fmt.Errorf("at least one storage destination must not be optional")
+	}
+	if seen["s3"] {
+		if c.S3Bucket == "" || c.S3Region == "" {
+			return fmt.Errorf("S3_BUCKET and S3_REGION (or AWS_REGION) are required for the S3 archive")
+		}
+		if c.S3FlushBytes <= 0 || c.S3FlushInterval <= 0 || c.S3MaxBufferedBytes <= 0 {
+			return fmt.Errorf("S3_FLUSH_BYTES, S3_FLUSH_INTERVAL and S3_MAX_BUFFERED_BYTES must be positive")
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateILM() error {
+	if !c.InstallIndexTemplate {
+		return fmt.Errorf("ES_ILM_POLICY requires ES_INSTALL_TEMPLATE to attach the policy")
+	}
+	if c.UsesBackend("opensearch") {
+		return fmt.Errorf("ES_ILM_POLICY is not supported by OpenSearch, which manages indices with ISM")
+	}
+	if c.ILMWarmAfter < 0 || c.ILMDeleteAfter < 0 || c.ILMRolloverMaxAge < 0 {
+		return fmt.Errorf("ES_ILM_ROLLOVER_MAX_AGE, ES_ILM_WARM_AFTER and ES_ILM_DELETE_AFTER must not be negative")
+	}
+	if c.ILMWarmAfter > 0 && c.ILMDeleteAfter > 0 && c.ILMDeleteAfter <= c.ILMWarmAfter {
+		return fmt.Errorf("ES_ILM_DELETE_AFTER must be longer than ES_ILM_WARM_AFTER")
+	}
+	deletes := c.ILMDeleteAfter > 0
+	for key, overrides := range map[string]map[string]string{
+		"TENANT_ILM_WARM_AFTER":   c.TenantILMWarmAfter,
+		"TENANT_ILM_DELETE_AFTER": c.TenantILMDeleteAfter,
+	} {
+		for accountID, value := range overrides {
+			if _, err := strconv.ParseInt(accountID, 10, 64); err != nil {
+				return fmt.Errorf("%s has an invalid account ID %q: keys are numeric account IDs, not ACCOUNT_ID_FORMAT", key, accountID)
+			}
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return fmt.Errorf("%s has an invalid duration %q for account %s", key, value, accountID)
+			}
+			if key == "TENANT_ILM_DELETE_AFTER" && d > 0 {
+				deletes = true
+			}
+			if _, ok := c.TenantElasticsearchURLs[accountID]; !ok && !c.IndexPerAccount {
+				return fmt.Errorf("%s account %s needs a cluster in TENANT_ELASTICSEARCH_URLS or ES_INDEX_PER_ACCOUNT", key, accountID)
+			}
+		}
+	}
+	// The delete phase counts from index creation, so on an index that is
+	// never rotated it deletes every log the index has ever received.
+	if deletes && !c.DataStreams && !c.rotatesIndices() {
+		return fmt.Errorf("ES_ILM_DELETE_AFTER and TENANT_ILM_DELETE_AFTER need ES_DATA_STREAMS=true or ES_INDEX_ROTATION=daily or weekly; set ES_ILM_DELETE_AFTER=0 to keep plain indices")
+	}
+	return nil
+}
+
+// rotatesIndices reports whether plain index names change with the date.
+func (c *Config) rotatesIndices() bool {
+	if c.IndexPattern != "" {
+		return strings.Contains(c.IndexPattern, ".Date") || strings.Contains(c.IndexPattern, ".Week")
+	}
+	return c.IndexRotation == "daily" || c.IndexRotation == "weekly"
+}
+
+// IngestRoutes are the HTTP ingest routes RouteAuthMethods can narrow:
+// "logs" is /logs and /api/v1/logs, "bulk" /_bulk and the other
+// Elasticsearch paths, "otlp" /v1/logs, "hec" the Splunk HEC paths and
+// "loki" /loki/api/v1/push.
+var IngestRoutes = []string{"logs", "bulk", "otlp", "hec", "loki"}
+
+// AuthMethodsFor returns the credentials accepted on route, one of
+// IngestRoutes.
+func (c *Config) AuthMethodsFor(route string) []string {
+	if methods, ok := c.RouteAuthMethods[route]; ok {
+		return methods
+	}
+	return c.AuthMethods
+}
+
+// AuthMethodEnabled reports whether method is listed in AuthMethods.
+func (c *Config) AuthMethodEnabled(method string) bool {
+	for _, m := range c.AuthMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
 	return defaultValue
 }
+
+func getEnvList(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return splitList(value)
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// splitListValues splits every value of m as a comma-separated list.
+func splitListValues(m map[string]string) map[string][]string {
+	if m == nil {
+		return nil
+	}
+	lists := make(map[string][]string, len(m))
+	for key, value := range m {
+		lists[key] = splitList(value)
+	}
+	return lists
+}
+
+func getEnvJSONMap(key string) (map[string]string, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil, nil
+	}
+	var m map[string]string
+	if err := json.Unmarshal([]byte(value), &m); err != nil {
+		return nil, fmt.Errorf("%s must be a JSON object of strings: %w", key, err)
+	}
+	return m, nil
+}
+
+// envReader reads typed environment variables. A value that does not parse
+// is recorded instead of silently replaced by the default, so Load fails on
+// misconfiguration.
+type envReader struct {
+	errs []error
+}
+
+func (e *envReader) Bool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s must be true or false, got %q", key, value))
+		return defaultValue
+	}
+	return b
+}
+
+func (e *envReader) Int(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s must be an integer, got %q", key, value))
+		return defaultValue
+	}
+	return i
+}
+
+func (e *envReader) Float(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s must be a number, got %q", key, value))
+		return defaultValue
+	}
+	return f
+}
+
+func (e *envReader) Duration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("%s must be a duration such as 30s or 5m, got %q", key, value))
+		return defaultValue
+	}
+	return d
+}
+
+// Err returns the values that did not parse, or nil.
+func (e *envReader) Err() error {
+	return errors.Join(e.errs...)
+}
@@ -0,0 +1,225 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setMinimalEnv sets the variables Load requires, so each test only sets
+// what it checks.
+func setMinimalEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("RSA_PUBLIC_KEY", "test-key")
+}
+
+func TestLoadDefaults(t *testing.T) {
+	setMinimalEnv(t)
+	cfg, err := Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cfg.BulkFlushInterval != 2*time.Second {
+		t.Errorf("BulkFlushInterval = %v, want 2s", cfg.BulkFlushInterval)
+	}
+	if cfg.Port != "9091" {
+		t.Errorf("Port = %q, want 9091", cfg.Port)
+	}
+}
+
+func TestLoadRejectsMalformedValues(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+	}{
+		{"ES_BULK_FLUSH_INTERVAL", "5x"},
+		{"TOKEN_CACHE_TTL", "abc"},
+		{"ES_BULK_WORKERS", "four"},
+		{"WAL_SEGMENT_BYTES", "64MB"},
+		{"HTTP_H2C", "sometimes"},
+		{"ACCESS_LOG_LOGS_SAMPLE_RATE", "half"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			setMinimalEnv(t)
+			t.Setenv(tt.key, tt.value)
+			_, err := Load()
+			if err == nil {
+				t.Fatalf("Load() with %s=%q succeeded, want an error", tt.key, tt.value)
+			}
+			if !strings.Contains(err.Error(), tt.key) {
+				t.Errorf("Load() error = %v, want it to name %s", err, tt.key)
+			}
+		})
+	}
+}
+
+func TestLoadReportsEveryMalformedValue(t *testing.T) {
+	setMinimalEnv(t)
+	t.Setenv("ES_BULK_FLUSH_INTERVAL", "5x")
+	t.Setenv("ES_BULK_WORKERS", "four")
+	_, err := Load()
+	if err == nil {
+		t.Fatal("Load() succeeded, want an error")
+	}
+	for _, key := range []string{"ES_BULK_FLUSH_INTERVAL", "ES_BULK_WORKERS"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("Load() error = %v, want it to name %s", err, key)
+		}
+	}
+}
+
+func TestLoadInstallTemplateFollowsDataStreams(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want bool
+	}{
+		{"default", nil, false},
+		{"data streams", map[string]string{"ES_DATA_STREAMS": "true"}, true},
+		{"explicit", map[string]string{"ES_INSTALL_TEMPLATE": "true"}, true},
+		{"data streams opted out", map[string]string{"ES_DATA_STREAMS": "true", "ES_INSTALL_TEMPLATE": "false"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setMinimalEnv(t)
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			cfg, err := Load()
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if cfg.InstallIndexTemplate != tt.want {
+				t.Errorf("InstallIndexTemplate = %t, want %t", cfg.InstallIndexTemplate, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateILMDeletePhase(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"plain indices", nil, true},
+		{"plain indices without delete", map[string]string{"ES_ILM_DELETE_AFTER": "0"}, false},
+		{"data streams", map[string]string{"ES_DATA_STREAMS": "true"}, false},
+		{"daily rotation", map[string]string{"ES_INDEX_ROTATION": "daily"}, false},
+		{"weekly rotation", map[string]string{"ES_INDEX_ROTATION": "weekly"}, false},
+		{"dated pattern", map[string]string{"ES_INDEX_PATTERN": "logs-{{.Container}}-{{.Date}}"}, false},
+		{"undated pattern", map[string]string{"ES_INDEX_PATTERN": "logs-{{.Container}}"}, true},
+		{"tenant delete on plain indices", map[string]string{
+			"ES_ILM_DELETE_AFTER":     "0",
+			"ES_INDEX_PER_ACCOUNT":    "true",
+			"TENANT_ILM_DELETE_AFTER": `{"42":"72h"}`,
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setMinimalEnv(t)
+			t.Setenv("ES_ILM_POLICY", "true")
+			t.Setenv("ES_INSTALL_TEMPLATE", "true")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			_, err := Load()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Load() error = %v, want error = %t", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "DELETE_AFTER") {
+				t.Errorf("Load() error = %v, want it to name the delete phase", err)
+			}
+		})
+	}
+}
+
+func TestValidateTenantAccountIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		wantErr bool
+	}{
+		{"numeric cluster", "TENANT_ELASTICSEARCH_URLS", `{"42":"http://es-42:9200"}`, false},
+		{"formatted cluster", "TENANT_ELASTICSEARCH_URLS", `{"acct-42":"http://es-42:9200"}`, true},
+		{"numeric pipeline", "TENANT_INGEST_PIPELINES", `{"42":"tenant-pipeline"}`, false},
+		{"formatted pipeline", "TENANT_INGEST_PIPELINES", `{"acct-42":"tenant-pipeline"}`, true},
+		{"numeric ILM override", "TENANT_ILM_WARM_AFTER", `{"42":"72h"}`, false},
+		{"formatted ILM override", "TENANT_ILM_WARM_AFTER", `{"acct-42":"72h"}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setMinimalEnv(t)
+			// ILM overrides are only read with a policy, on indices per account.
+			t.Setenv("ES_ILM_POLICY", "true")
+			t.Setenv("ES_INSTALL_TEMPLATE", "true")
+			t.Setenv("ES_ILM_DELETE_AFTER", "0")
+			t.Setenv("ES_INDEX_PER_ACCOUNT", "true")
+			t.Setenv(tt.key, tt.value)
+			_, err := Load()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Load() with %s=%s error = %v, want error = %t", tt.key, tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateDebugPort(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{"with admin token", map[string]string{"DEBUG_PORT": "6060", "ADMIN_TOKEN": "secret"}, false},
+		{"without admin token", map[string]string{"DEBUG_PORT": "6060"}, true},
+		{"same as PORT", map[string]string{"DEBUG_PORT": "9091", "ADMIN_TOKEN": "secret"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setMinimalEnv(t)
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			_, err := Load()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Load() error = %v, want error = %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRouteAuthMethods(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{"narrowed routes", `{"bulk":"apikey","hec":"apikey","logs":"jwt, apikey"}`, false},
+		{"unknown route", `{"metrics":"jwt"}`, true},
+		{"no methods", `{"bulk":" , "}`, true},
+		{"method not enabled", `{"otlp":"mtls"}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setMinimalEnv(t)
+			t.Setenv("AUTH_METHODS", "jwt,apikey")
+			t.Setenv("API_KEYS", `{"key-1":"1"}`)
+			t.Setenv("ROUTE_AUTH_METHODS", tt.value)
+			cfg, err := Load()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, want error = %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			for route, want := range map[string]string{"bulk": "[apikey]", "logs": "[jwt apikey]", "otlp": "[jwt apikey]"} {
+				if got := fmt.Sprint(cfg.AuthMethodsFor(route)); got != want {
+					t.Errorf("AuthMethodsFor(%s) = %s, want %s", route, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package filesink
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ManifestName is the file, kept next to the data files, that lists the
+// SHA-256 of every rotated file in `sha256sum` format so it can be checked
+// with `sha256sum -c`.
+const ManifestName = "MANIFEST.sha256"
+
+// Config describes where a Writer puts its files and when it rotates them.
+// With Compress set, rotated files are gzip-compressed to <name>.gz and the
+// manifest lists the compressed file. Rotated files older than Retention
+// are deleted, so verify manifests with `sha256sum -c --ignore-missing`.
+type Config struct {
+	Dir       string
+	Prefix    string
+	MaxBytes  int64
+	MaxAge    time.Duration
+	Manifest  bool
+	Compress  bool
+	Retention time.Duration
+}
+
+// Writer appends records to a file under Config.Dir and rotates it once it
+// exceeds MaxBytes or MaxAge. It is safe for concurrent use.
+type Writer struct {
+	cfg Config
+
+	mu       sync.Mutex
+	file     *os.File
+	name     string
+	size     int64
+	openedAt time.Time
+	sum      hash.Hash
+}
+
+func New(cfg Config) (*Writer, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("file sink directory must be provided")
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "sink"
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create file sink directory: %w", err)
+	}
+	return &Writer{cfg: cfg}, nil
+}
+
+// Write appends p to the current file, rotating first if the file is full or
+// too old. Each call is written as a unit so records never straddle files.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file != nil && w.shouldRotate(int64(len(p))) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	w.sum.Write(p[:n])
+	return n, err
+}
+
+// Rotate closes the current file, records it in the manifest and starts a new
+// one on the next write.
+func (w *Writer) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	return w.rotate()
+}
+
+// RotateExpired rotates the current file once it is older than MaxAge, for
+// files that stop receiving writes before they expire.
+func (w *Writer) RotateExpired() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil || w.cfg.MaxAge <= 0 || time.Since(w.openedAt) < w.cfg.MaxAge {
+		return nil
+	}
+	return w.rotate()
+}
+
+// Cleanup deletes rotated files whose last write is older than Retention.
+// It does nothing when Retention is not set.
+func (w *Writer) Cleanup() error {
+	if w.cfg.Retention <= 0 {
+		return nil
+	}
+	w.mu.Lock()
+	current := w.name
+	w.mu.Unlock()
+
+	matches, err := filepath.Glob(filepath.Join(w.cfg.Dir, w.cfg.Prefix+"-*"))
+	if err != nil {
+		return fmt.Errorf("failed to list sink files: %w", err)
+	}
+	cutoff := time.Now().Add(-w.cfg.Retention)
+	for _, path := range matches {
+		if filepath.Base(path) == current {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove expired sink file: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close rotates out the current file.
+func (w *Writer) Close() error {
+	return w.Rotate()
+}
+
+func (w *Writer) shouldRotate(next int64) bool {
+	if w.cfg.MaxBytes > 0 && w.size > 0 && w.size+next > w.cfg.MaxBytes {
+		return true
+	}
+	return w.cfg.MaxAge > 0 && time.Since(w.openedAt) >= w.cfg.MaxAge
+}
+
+func (w *Writer) open() error {
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%s-%s.ndjson", w.cfg.Prefix, now.Format("20060102T150405.000000000"))
+	f, err := os.OpenFile(filepath.Join(w.cfg.Dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open sink file: %w", err)
+	}
+	w.file = f
+	w.name = name
+	w.size = 0
+	w.openedAt = now
+	w.sum = sha256.New()
+	return nil
+}
+
+func (w *Writer) rotate() error {
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync sink file: %w", err)
+	}
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close sink file: %w", err)
+	}
+	name, digest := w.name, hex.EncodeToString(w.sum.Sum(nil))
+	w.file = nil
+	w.name = ""
+
+	if w.cfg.Compress {
+		var err error
+		if name, digest, err = compress(w.cfg.Dir, name); err != nil {
+			return err
+		}
+	}
+	if !w.cfg.Manifest {
+		return nil
+	}
+	return appendManifest(w.cfg.Dir, name, digest)
+}
+
+// compress replaces the file name in dir with a gzip-compressed name.gz and
+// returns the new name and its SHA-256.
+func compress(dir, name string) (string, string, error) {
+	path := filepath.Join(dir, name)
+	src, err := os.Open(path)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to open sink file for compression: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create compressed sink file: %w", err)
+	}
+	sum := sha256.New()
+	gz := gzip.NewWriter(io.MultiWriter(dst, sum))
+	_, err = io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return "", "", fmt.Errorf("failed to compress sink file: %w", err)
+	}
+	if err := os.Remove(path); err != nil {
+		return "", "", fmt.Errorf("failed to remove compressed sink file: %w", err)
+	}
+	return name + ".gz", hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+func appendManifest(dir, name, digest string) error {
+	f, err := os.OpenFile(filepath.Join(dir, ManifestName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s  %s\n", digest, name); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return f.Sync()
+}
@@ -0,0 +1,165 @@
+package filesink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readManifest returns the digests the manifest in dir lists, by file name.
+func readManifest(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	f, err := os.Open(filepath.Join(dir, ManifestName))
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+	digests := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		digest, name, ok := strings.Cut(scanner.Text(), "  ")
+		if !ok {
+			t.Fatalf("malformed manifest line %q", scanner.Text())
+		}
+		digests[name] = digest
+	}
+	return digests
+}
+
+func fileDigest(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestWriterRotatesAndRecordsManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		compress bool
+	}{
+		{"plain", false},
+		{"compressed", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w, err := New(Config{Dir: dir, Prefix: "test", MaxBytes: 10, Manifest: true, Compress: tt.compress})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			// Each record fills a file, so the second and third rotate.
+			for _, record := range []string{"first-rec\n", "second-re\n", "third-rec\n"} {
+				if _, err := w.Write([]byte(record)); err != nil {
+					t.Fatalf("Write() error = %v", err)
+				}
+				// Distinct timestamps keep the file names apart.
+				time.Sleep(time.Millisecond)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			digests := readManifest(t, dir)
+			if len(digests) != 3 {
+				t.Fatalf("manifest lists %d files, want 3: %v", len(digests), digests)
+			}
+			var contents []string
+			for name, digest := range digests {
+				if got := fileDigest(t, filepath.Join(dir, name)); got != digest {
+					t.Errorf("manifest digest of %s = %s, file has %s", name, digest, got)
+				}
+				if strings.HasSuffix(name, ".gz") != tt.compress {
+					t.Errorf("rotated file %s, compress = %t", name, tt.compress)
+				}
+				contents = append(contents, readSinkFile(t, filepath.Join(dir, name)))
+			}
+			for _, content := range contents {
+				if len(content) != 10 {
+					t.Errorf("rotated file holds %q, want exactly one record", content)
+				}
+			}
+		})
+	}
+}
+
+func readSinkFile(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("failed to decompress %s: %v", path, err)
+		}
+		r = gz
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return string(data)
+}
+
+func TestWriterWithoutManifest(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New(Config{Dir: dir, Prefix: "test"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if _, err := w.Write([]byte("record\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ManifestName)); !os.IsNotExist(err) {
+		t.Errorf("manifest exists without Manifest set: %v", err)
+	}
+}
+
+func TestCleanupRemovesExpiredFiles(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New(Config{Dir: dir, Prefix: "test", Retention: time.Hour})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	old := filepath.Join(dir, "test-old.ndjson")
+	recent := filepath.Join(dir, "test-recent.ndjson")
+	other := filepath.Join(dir, "other-old.ndjson")
+	for _, path := range []string{old, recent, other} {
+		if err := os.WriteFile(path, []byte("x\n"), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expired := time.Now().Add(-2 * time.Hour)
+	for _, path := range []string{old, other} {
+		if err := os.Chtimes(path, expired, expired); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Cleanup(); err != nil {
+		t.Fatalf("Cleanup() error = %v", err)
+	}
+	for path, wantExists := range map[string]bool{old: false, recent: true, other: true} {
+		_, err := os.Stat(path)
+		if exists := err == nil; exists != wantExists {
+			t.Errorf("%s exists = %t, want %t", filepath.Base(path), exists, wantExists)
+		}
+	}
+}
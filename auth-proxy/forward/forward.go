@@ -0,0 +1,438 @@
+// Package forward implements the server side of the Fluentd forward
+// protocol, which Fluentd and Fluent Bit use to ship msgpack-encoded
+// events over TCP.
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"auth-proxy/auth"
+	"auth-proxy/logging"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var logger = logging.Component("forward")
+
+// TokenOption is the message option carrying a bearer token when the
+// listener is not configured with shared keys.
+const TokenOption = "token"
+
+// idleTimeout closes connections that send nothing for this long.
+const idleTimeout = 5 * time.Minute
+
+func init() {
+	msgpack.RegisterExt(0, (*EventTime)(nil))
+}
+
+// EventTime is the forward protocol's nanosecond timestamp extension.
+type EventTime struct {
+	time.Time
+}
+
+// MarshalMsgpack encodes t as seconds and nanoseconds, big-endian.
+func (t *EventTime) MarshalMsgpack() ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(t.Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(t.Nanosecond()))
+	return b, nil
+}
+
+// UnmarshalMsgpack decodes the 8-byte EventTime payload.
+func (t *EventTime) UnmarshalMsgpack(b []byte) error {
+	if len(b) != 8 {
+		return fmt.Errorf("invalid EventTime length %d", len(b))
+	}
+	t.Time = time.Unix(int64(binary.BigEndian.Uint32(b)), int64(binary.BigEndian.Uint32(b[4:])))
+	return nil
+}
+
+// Batch is one decoded forward message.
+type Batch struct {
+	Claims  *auth.Claims
+	Remote  net.Addr
+	Tag     string
+	Bytes   int64
+	Entries []map[string]interface{}
+}
+
+// Handler receives each batch from an authenticated caller. Entries are not
+// acknowledged when it returns an error, so clients requesting acks will
+// retry them.
+type Handler func(ctx context.Context, batch *Batch) error
+
+// Options configures a Server.
+type Options struct {
+	// SharedKeys maps an account ID to the shared key its agents use in the
+	// HELO/PING/PONG handshake. When empty, every message must instead carry
+	// a token in its options, checked by Validator.
+	SharedKeys map[string]string
+	Validator  auth.Validator
+	// Hostname is sent to clients in PONG replies.
+	Hostname string
+	// MaxMessageBytes caps the size of a single message, after gzip
+	// decompression for CompressedPackedForward.
+	MaxMessageBytes int64
+}
+
+// Server accepts forward protocol connections.
+type Server struct {
+	opts       Options
+	sharedKeys map[int64]string
+	handler    Handler
+}
+
+// NewServer returns a Server passing decoded entries to handler.
+func NewServer(opts Options, handler Handler) (*Server, error) {
+	if len(opts.SharedKeys) == 0 && opts.Validator == nil {
+		return nil, fmt.Errorf("forward listener needs shared keys or a token validator")
+	}
+	sharedKeys := make(map[int64]string, len(opts.SharedKeys))
+	for account, key := range opts.SharedKeys {
+		accountID, err := strconv.ParseInt(account, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid account ID %q in forward shared keys: %w", account, err)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("empty forward shared key for account %s", account)
+		}
+		sharedKeys[accountID] = key
+	}
+	return &Server{opts: opts, sharedKeys: sharedKeys, handler: handler}, nil
+}
+
+// Serve accepts connections on listener until it is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.serveConn(conn); err != nil && !errors.Is(err, io.EOF) {
+				logger.Warn("closing forward connection", "remote_addr", conn.RemoteAddr().String(), "error", err)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) error {
+	limited := &io.LimitedReader{R: conn, N: s.opts.MaxMessageBytes}
+	counter := &countingReader{Reader: bufio.NewReader(limited)}
+	dec := msgpack.NewDecoder(counter)
+	dec.UseLooseInterfaceDecoding(true)
+	enc := msgpack.NewEncoder(conn)
+	ctx := context.Background()
+
+	var claims *auth.Claims
+	if len(s.sharedKeys) > 0 {
+		conn.SetDeadline(time.Now().Add(idleTimeout))
+		var err error
+		if claims, err = s.handshake(conn, dec, enc); err != nil {
+			return err
+		}
+	}
+
+	for {
+		conn.SetDeadline(time.Now().Add(idleTimeout))
+		limited.N = s.opts.MaxMessageBytes
+		counter.n = 0
+		raw, err := dec.DecodeInterface()
+		if err != nil {
+			if limited.N <= 0 {
+				return fmt.Errorf("message exceeds %d bytes", s.opts.MaxMessageBytes)
+			}
+			return err
+		}
+		msg, err := parseMessage(raw, s.opts.MaxMessageBytes)
+		if err != nil {
+			return err
+		}
+
+		msgClaims := claims
+		if msgClaims == nil {
+			token := asString(msg.options[TokenOption])
+			if token == "" {
+				return fmt.Errorf("message without %q option", TokenOption)
+			}
+			if msgClaims, err = s.opts.Validator.Validate(ctx, token); err != nil {
+				return fmt.Errorf("invalid token: %w", err)
+			}
+		}
+
+		if len(msg.entries) > 0 {
+			batch := &Batch{Claims: msgClaims, Remote: conn.RemoteAddr(), Tag: msg.tag, Bytes: counter.n, Entries: msg.entries}
+			if err := s.handler(ctx, batch); err != nil {
+				return err
+			}
+		}
+		if chunk := asString(msg.options["chunk"]); chunk != "" {
+			if err := enc.Encode(map[string]string{"ack": chunk}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handshake runs the shared key authentication described in the forward
+// protocol: HELO with a nonce, PING carrying a digest of the key, and PONG
+// proving the server knows the key too. The account is identified by
+// whichever configured key produces the client's digest.
+func (s *Server) handshake(conn net.Conn, dec *msgpack.Decoder, enc *msgpack.Encoder) (*auth.Claims, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	helo := []interface{}{"HELO", map[string]interface{}{"nonce": nonce, "auth": []byte{}, "keepalive": true}}
+	if err := enc.Encode(helo); err != nil {
+		return nil, err
+	}
+
+	raw, err := dec.DecodeInterface()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PING: %w", err)
+	}
+	ping, ok := raw.([]interface{})
+	if !ok || len(ping) < 4 || asString(ping[0]) != "PING" {
+		return nil, fmt.Errorf("expected PING")
+	}
+	clientHostname, salt, digest := asString(ping[1]), asString(ping[2]), asString(ping[3])
+
+	for accountID, key := range s.sharedKeys {
+		expected := sharedKeyDigest(salt, clientHostname, nonce, key)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(digest)) != 1 {
+			continue
+		}
+		pong := []interface{}{"PONG", true, "", s.opts.Hostname, sharedKeyDigest(salt, s.opts.Hostname, nonce, key)}
+		if err := enc.Encode(pong); err != nil {
+			return nil, err
+		}
+		return &auth.Claims{AccountID: accountID, Subject: "forward:" + clientHostname}, nil
+	}
+
+	enc.Encode([]interface{}{"PONG", false, "shared key mismatch", s.opts.Hostname, ""})
+	logging.Audit.Warn("rejected forward handshake: shared key mismatch", "remote_addr", conn.RemoteAddr().String(), "hostname", clientHostname)
+	return nil, fmt.Errorf("shared key mismatch")
+}
+
+func sharedKeyDigest(salt, hostname string, nonce []byte, key string) string {
+	h := sha512.New()
+	h.Write([]byte(salt))
+	h.Write([]byte(hostname))
+	h.Write(nonce)
+	h.Write([]byte(key))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type message struct {
+	tag     string
+	entries []map[string]interface{}
+	options map[string]interface{}
+}
+
+// parseMessage handles the Message, Forward, PackedForward and
+// CompressedPackedForward modes. The tag is kept on each entry as
+// "fluent_tag" and the event time as "timestamp".
+func parseMessage(raw interface{}, maxBytes int64) (*message, error) {
+	fields, ok := raw.([]interface{})
+	if !ok || len(fields) < 2 {
+		return nil, fmt.Errorf("malformed forward message")
+	}
+	tag := asString(fields[0])
+	msg := &message{tag: tag}
+
+	switch body := fields[1].(type) {
+	case []interface{}:
+		// Forward: [tag, [[time, record], ...], option]
+		if len(fields) > 2 {
+			msg.options, _ = fields[2].(map[string]interface{})
+		}
+		for _, e := range body {
+			pair, ok := e.([]interface{})
+			if !ok || len(pair) < 2 {
+				return nil, fmt.Errorf("malformed forward entry")
+			}
+			if err := msg.add(tag, pair[0], pair[1]); err != nil {
+				return nil, err
+			}
+		}
+	case []byte, string:
+		// PackedForward: [tag, msgpack stream of [time, record], option]
+		if len(fields) > 2 {
+			msg.options, _ = fields[2].(map[string]interface{})
+		}
+		data := []byte(asString(body))
+		if asString(msg.options["compressed"]) == "gzip" {
+			var err error
+			if data, err = gunzip(data, maxBytes); err != nil {
+				return nil, err
+			}
+		}
+		dec := msgpack.NewDecoder(bytes.NewReader(data))
+		dec.UseLooseInterfaceDecoding(true)
+		for {
+			var pair []interface{}
+			if err := dec.Decode(&pair); err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				return nil, fmt.Errorf("malformed packed forward entries: %w", err)
+			}
+			if len(pair) < 2 {
+				return nil, fmt.Errorf("malformed forward entry")
+			}
+			if err := msg.add(tag, pair[0], pair[1]); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		// Message: [tag, time, record, option]
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("malformed forward message")
+		}
+		if len(fields) > 3 {
+			msg.options, _ = fields[3].(map[string]interface{})
+		}
+		if err := msg.add(tag, fields[1], fields[2]); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+func (m *message) add(tag string, eventTime, record interface{}) error {
+	entry, err := Entry(eventTime, record)
+	if err != nil {
+		return err
+	}
+	entry["fluent_tag"] = tag
+	m.entries = append(m.entries, entry)
+	return nil
+}
+
+// Entry converts a decoded event time and record into a log entry. The
+// event time becomes the timestamp unless the record has one. Fluent Bit's
+// msgpack output over HTTP carries the same events as the forward protocol.
+func Entry(eventTime, record interface{}) (map[string]interface{}, error) {
+	entry, ok := record.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("forward record is not a map")
+	}
+	for key, value := range entry {
+		entry[key] = normalize(value)
+	}
+	if _, ok := entry["timestamp"]; !ok {
+		if t, ok := toTime(eventTime); ok {
+			entry["timestamp"] = t.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return entry, nil
+}
+
+// normalize turns msgpack bin values into strings so entries encode as
+// JSON text rather than base64.
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case map[string]interface{}:
+		for key, field := range v {
+			v[key] = normalize(field)
+		}
+	case []interface{}:
+		for i, field := range v {
+			v[i] = normalize(field)
+		}
+	case *EventTime:
+		return v.UTC().Format(time.RFC3339Nano)
+	}
+	return value
+}
+
+func toTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case *EventTime:
+		return v.Time, true
+	case int64:
+		return time.Unix(v, 0), true
+	case uint64:
+		return time.Unix(int64(v), 0), true
+	case float64:
+		return time.Unix(0, int64(v*float64(time.Second))), true
+	}
+	return time.Time{}, false
+}
+
+func gunzip(data []byte, maxBytes int64) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip entries: %w", err)
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(io.LimitReader(zr, maxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip entries: %w", err)
+	}
+	if int64(len(out)) > maxBytes {
+		return nil, fmt.Errorf("decompressed entries exceed %d bytes", maxBytes)
+	}
+	return out, nil
+}
+
+// countingReader counts the bytes the decoder consumes. It keeps the
+// io.ByteScanner methods so msgpack does not wrap it in another buffer.
+type countingReader struct {
+	*bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.Reader.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+func (c *countingReader) UnreadByte() error {
+	err := c.Reader.UnreadByte()
+	if err == nil {
+		c.n--
+	}
+	return err
+}
+
+func asString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
@@ -0,0 +1,108 @@
+// Package gelf receives Graylog Extended Log Format messages over UDP,
+// including chunked and compressed datagrams, and over TCP, and converts
+// them into the log entries accepted by storage.LogStorage.
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+var severities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// Decode decompresses a gzip or zlib payload, leaving plain JSON as is,
+// and converts the GELF message into a log entry. maxBytes caps the
+// decompressed size.
+func Decode(data []byte, maxBytes int) (map[string]interface{}, error) {
+	payload, err := decompress(data, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	var message map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&message); err != nil || message == nil {
+		return nil, fmt.Errorf("invalid GELF message: not a JSON object")
+	}
+	return Entry(message), nil
+}
+
+func decompress(data []byte, maxBytes int) ([]byte, error) {
+	var (
+		reader io.ReadCloser
+		err    error
+	)
+	switch {
+	case len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b:
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+	case len(data) >= 2 && data[0] == 0x78 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0:
+		reader, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		if len(data) > maxBytes {
+			return nil, fmt.Errorf("GELF message exceeds %d bytes", maxBytes)
+		}
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed GELF message: %w", err)
+	}
+	defer reader.Close()
+	payload, err := io.ReadAll(io.LimitReader(reader, int64(maxBytes)+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed GELF message: %w", err)
+	}
+	if len(payload) > maxBytes {
+		return nil, fmt.Errorf("decompressed GELF message exceeds %d bytes", maxBytes)
+	}
+	return payload, nil
+}
+
+// Entry maps GELF fields onto log entry fields. short_message becomes the
+// message, the epoch timestamp is formatted as RFC 3339, and additional
+// fields lose their "_" prefix, so Docker's _container_name drives index
+// routing like Fluent Bit's container_name does.
+func Entry(message map[string]interface{}) map[string]interface{} {
+	entry := make(map[string]interface{}, len(message))
+	for key, value := range message {
+		switch key {
+		case "version", "_id":
+			// _id is reserved by GELF and would clash with the document ID.
+		case "short_message":
+			entry["message"] = value
+		case "timestamp":
+			if t, ok := epochTime(value); ok {
+				entry["timestamp"] = t.UTC().Format(time.RFC3339Nano)
+			}
+		case "level":
+			if n, ok := value.(json.Number); ok {
+				if level, err := n.Int64(); err == nil && level >= 0 && level < int64(len(severities)) {
+					entry["severity"] = severities[level]
+					entry["severity_number"] = level
+				}
+			}
+		default:
+			entry[strings.TrimPrefix(key, "_")] = value
+		}
+	}
+	return entry
+}
+
+func epochTime(value interface{}) (time.Time, bool) {
+	n, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := n.Float64()
+	if err != nil || seconds <= 0 {
+		return time.Time{}, false
+	}
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(math.Round(frac*1e6))*1e3), true
+}
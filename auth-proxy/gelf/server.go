@@ -0,0 +1,275 @@
+package gelf
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"auth-proxy/auth"
+	"auth-proxy/logging"
+)
+
+var logger = logging.Component("gelf")
+
+const (
+	// maxChunks is the largest sequence count GELF allows.
+	maxChunks = 128
+	// chunkTimeout is how long GELF senders are given to deliver every
+	// chunk of a message.
+	chunkTimeout = 5 * time.Second
+	// maxPendingMessages bounds the chunked messages being reassembled.
+	maxPendingMessages = 1000
+	// maxBatchEntries caps how many buffered TCP messages are handed to the
+	// Handler at once.
+	maxBatchEntries = 500
+	// idleTimeout closes TCP connections that send nothing for this long.
+	idleTimeout = 5 * time.Minute
+)
+
+var chunkMagic = []byte{0x1e, 0x0f}
+
+// Batch is a group of messages from one sender.
+type Batch struct {
+	Claims  *auth.Claims
+	Remote  net.Addr
+	Bytes   int64
+	Entries []map[string]interface{}
+}
+
+// Handler receives the decoded messages of an attributed sender.
+type Handler func(ctx context.Context, batch *Batch) error
+
+// Authenticator attributes a sender to an account, from its verified client
+// certificate when it connected over TLS or otherwise from its address.
+type Authenticator func(ctx context.Context, remote net.Addr, cert *x509.Certificate) (*auth.Claims, error)
+
+// Server accepts GELF over UDP and over null-byte delimited TCP.
+type Server struct {
+	authenticate    Authenticator
+	handler         Handler
+	maxMessageBytes int
+
+	mu      sync.Mutex
+	pending map[string]*chunkedMessage
+}
+
+type chunkedMessage struct {
+	chunks   [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// NewServer returns a Server that attributes senders with authenticate and
+// passes their messages to handler.
+func NewServer(authenticate Authenticator, handler Handler, maxMessageBytes int) *Server {
+	return &Server{
+		authenticate:    authenticate,
+		handler:         handler,
+		maxMessageBytes: maxMessageBytes,
+		pending:         make(map[string]*chunkedMessage),
+	}
+}
+
+// ServeUDP reads datagrams from conn until it is closed.
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	ctx := context.Background()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		claims, err := s.authenticate(ctx, addr, nil)
+		if err != nil {
+			continue
+		}
+
+		data := buf[:n]
+		if len(data) > 2 && data[0] == chunkMagic[0] && data[1] == chunkMagic[1] {
+			if data, err = s.addChunk(addr, data); err != nil {
+				logger.Warn("dropped GELF chunk", "remote_addr", addr.String(), "error", err)
+				continue
+			}
+			if data == nil {
+				continue
+			}
+		}
+		entry, err := Decode(data, s.maxMessageBytes)
+		if err != nil {
+			logger.Warn("dropped GELF message", "remote_addr", addr.String(), "error", err)
+			continue
+		}
+		batch := &Batch{Claims: claims, Remote: addr, Bytes: int64(len(data)), Entries: []map[string]interface{}{entry}}
+		if err := s.handler(ctx, batch); err != nil {
+			logger.Warn("dropped GELF message", "remote_addr", addr.String(), "account_id", claims.GetAccountID(), "error", err)
+		}
+	}
+}
+
+// addChunk stores one chunk and returns the reassembled message once every
+// chunk has arrived, or nil while some are still missing. Chunk layout:
+// magic (2 bytes), message ID (8), sequence number (1), sequence count (1).
+func (s *Server) addChunk(addr net.Addr, data []byte) ([]byte, error) {
+	if len(data) < 12 {
+		return nil, fmt.Errorf("truncated chunk header")
+	}
+	seq, count := int(data[10]), int(data[11])
+	if count == 0 || count > maxChunks || seq >= count {
+		return nil, fmt.Errorf("invalid chunk %d of %d", seq, count)
+	}
+	key := addr.String() + "|" + string(data[2:10])
+	payload := data[12:]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	msg, ok := s.pending[key]
+	if !ok {
+		s.expireChunks(now)
+		if len(s.pending) >= maxPendingMessages {
+			return nil, fmt.Errorf("too many incomplete chunked messages")
+		}
+		msg = &chunkedMessage{chunks: make([][]byte, count), started: now}
+		s.pending[key] = msg
+	}
+	if len(msg.chunks) != count {
+		delete(s.pending, key)
+		return nil, fmt.Errorf("inconsistent sequence count")
+	}
+	if msg.chunks[seq] != nil {
+		return nil, nil
+	}
+	msg.size += len(payload)
+	if msg.size > s.maxMessageBytes {
+		delete(s.pending, key)
+		return nil, fmt.Errorf("chunked message exceeds %d bytes", s.maxMessageBytes)
+	}
+	msg.chunks[seq] = append([]byte(nil), payload...)
+	msg.received++
+	if msg.received < count {
+		return nil, nil
+	}
+
+	delete(s.pending, key)
+	message := make([]byte, 0, msg.size)
+	for _, chunk := range msg.chunks {
+		message = append(message, chunk...)
+	}
+	return message, nil
+}
+
+// expireChunks drops messages whose chunks did not all arrive in time. The
+// caller holds s.mu.
+func (s *Server) expireChunks(now time.Time) {
+	for key, msg := range s.pending {
+		if now.Sub(msg.started) > chunkTimeout {
+			delete(s.pending, key)
+		}
+	}
+}
+
+// ServeTCP accepts stream connections on listener until it is closed.
+// Messages are uncompressed JSON terminated by a null byte.
+func (s *Server) ServeTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.serveConn(conn); err != nil && !errors.Is(err, io.EOF) {
+				logger.Warn("closing GELF connection", "remote_addr", conn.RemoteAddr().String(), "error", err)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) error {
+	ctx := context.Background()
+	conn.SetDeadline(time.Now().Add(idleTimeout))
+
+	var cert *x509.Certificate
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		if chains := tlsConn.ConnectionState().VerifiedChains; len(chains) > 0 {
+			cert = chains[0][0]
+		}
+	}
+	claims, err := s.authenticate(ctx, conn.RemoteAddr(), cert)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(conn, 64<<10)
+	for {
+		conn.SetDeadline(time.Now().Add(idleTimeout))
+		batch := &Batch{Claims: claims, Remote: conn.RemoteAddr()}
+		var readErr error
+		for len(batch.Entries) < maxBatchEntries {
+			var frame []byte
+			if frame, readErr = s.readFrame(reader); readErr != nil {
+				break
+			}
+			if len(frame) > 0 {
+				entry, err := Decode(frame, s.maxMessageBytes)
+				if err != nil {
+					logger.Warn("dropped GELF message", "remote_addr", conn.RemoteAddr().String(), "error", err)
+				} else {
+					batch.Bytes += int64(len(frame))
+					batch.Entries = append(batch.Entries, entry)
+				}
+			}
+			if reader.Buffered() == 0 {
+				break
+			}
+		}
+		if len(batch.Entries) > 0 {
+			if err := s.handler(ctx, batch); err != nil {
+				return err
+			}
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// readFrame reads up to the next null byte.
+func (s *Server) readFrame(reader *bufio.Reader) ([]byte, error) {
+	var frame []byte
+	for {
+		chunk, err := reader.ReadSlice(0)
+		frame = append(frame, chunk...)
+		if len(frame) > s.maxMessageBytes {
+			return nil, fmt.Errorf("message exceeds %d bytes", s.maxMessageBytes)
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil && len(frame) == 0 {
+			return nil, err
+		}
+		return bytes.TrimRight(frame, "\x00\r\n"), nil
+	}
+}
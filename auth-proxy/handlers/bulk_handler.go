@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"auth-proxy/auth"
+	"auth-proxy/middleware"
+	"auth-proxy/policy"
+	"auth-proxy/storage"
+)
+
+// compatibleESVersion is the Elasticsearch version reported to clients that
+// check it before sending, such as Filebeat.
+const compatibleESVersion = "8.11.0"
+
+// BulkHandler accepts Elasticsearch _bulk requests so Fluent Bit's es output
+// and Filebeat can send to the proxy unchanged. Only create and index
+// actions are supported. The index named by the client is not used: entries
+// are stored like any other batch, so storage picks the index, and the item
+// results report the index storage picked.
+type BulkHandler struct {
+	storage    storage.LogStorage
+	authorizer policy.Authorizer
+	// waitTimeout, when positive, is how long a request waits for storage
+	// to report the outcome of every entry, which its item results are
+	// built from.
+	waitTimeout time.Duration
+}
+
+func NewBulkHandler(storage storage.LogStorage, authorizer policy.Authorizer) *BulkHandler {
+	return &BulkHandler{storage: storage, authorizer: authorizer}
+}
+
+// WaitForIndexing makes every request wait up to timeout for storage to
+// report the outcome of its entries, so each item result carries the
+// status, index and ID Elasticsearch answered with. Without it, or with
+// storage that does not report results, stored entries are reported as
+// created.
+func (h *BulkHandler) WaitForIndexing(timeout time.Duration) *BulkHandler {
+	h.waitTimeout = timeout
+	return h
+}
+
+type bulkItemResult struct {
+	Index  string         `json:"_index,omitempty"`
+	ID     string         `json:"_id,omitempty"`
+	Status int            `json:"status"`
+	Result string         `json:"result,omitempty"`
+	Error  *bulkItemError `json:"error,omitempty"`
+	action string
+}
+
+type bulkItemError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+func (h *BulkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		middleware.Error(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := r.Context().Value(middleware.ClaimsContextKey).(*auth.Claims)
+	if !ok {
+		middleware.AuditRejection(r, http.StatusUnauthorized, "missing_claims", nil)
+		middleware.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// /{index}/_bulk sets the default index for actions that name none.
+	defaultIndex := strings.Trim(strings.TrimSuffix(r.URL.Path, "_bulk"), "/")
+
+	defer r.Body.Close()
+	body := &countingReader{r: r.Body}
+	items, logs, err := decodeBulk(body, defaultIndex)
+	if errors.Is(err, middleware.ErrBodyTooLarge) {
+		middleware.Error(w, r, "Request entity too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		writeESError(w, r, http.StatusBadRequest, "illegal_argument_exception", err.Error())
+		return
+	}
+
+	if !authorizeBatch(h.authorizer, w, r, claims, body.n, logs) {
+		return
+	}
+
+	ctx := r.Context()
+	var indexResults *storage.IndexResults
+	if h.waitTimeout > 0 {
+		ctx, indexResults = storage.WithIndexResults(ctx)
+	}
+	if len(logs) > 0 {
+		if err := h.storage.StoreLogs(ctx, claims.GetAccountID(), logs); err != nil {
+			var skippedErr *storage.SkippedEntriesError
+			var tooLarge *storage.BatchTooLargeError
+			if errors.As(err, &tooLarge) {
+				writeESError(w, r, http.StatusRequestEntityTooLarge, "illegal_argument_exception", tooLarge.Error())
+				return
+			}
+			if !errors.As(err, &skippedErr) {
+				if status := setRetryAfter(w, err); status == http.StatusTooManyRequests {
+					writeESError(w, r, status, "es_rejected_execution_exception", err.Error())
+					return
+				}
+				// Beats and Fluent Bit retry the whole request on 503.
+				logger.ErrorContext(r.Context(), "failed to store logs", "source", "bulk", "account_id", claims.GetAccountID(), "error", err)
+				writeESError(w, r, http.StatusServiceUnavailable, "unavailable_shards_exception", "failed to store logs")
+				return
+			}
+			logger.WarnContext(r.Context(), "stored logs with warnings", "source", "bulk", "account_id", claims.GetAccountID(), "error", err)
+			w.Header().Set(IngestWarningsHeader, skippedErr.Summary())
+		}
+	}
+
+	var outcomes []storage.IndexResult
+	if indexResults != nil && len(logs) > 0 {
+		waitCtx, cancel := context.WithTimeout(r.Context(), h.waitTimeout)
+		outcomes, err = indexResults.Wait(waitCtx)
+		cancel()
+		if err != nil {
+			writeESError(w, r, http.StatusGatewayTimeout, "timeout_exception", "timed out waiting for logs to be indexed")
+			return
+		}
+	}
+	// Items left without a status by decodeBulk were stored, in order.
+	stored := 0
+	for _, item := range items {
+		if item.Status != 0 {
+			continue
+		}
+		if stored < len(outcomes) {
+			item.setOutcome(outcomes[stored])
+		} else {
+			item.Status = http.StatusCreated
+			item.Result = "created"
+		}
+		stored++
+	}
+
+	hasErrors := false
+	results := make([]map[string]*bulkItemResult, len(items))
+	for i, item := range items {
+		if item.Error != nil {
+			hasErrors = true
+		}
+		results[i] = map[string]*bulkItemResult{item.action: item}
+	}
+	writeES(w, http.StatusOK, map[string]interface{}{
+		"took":   time.Since(start).Milliseconds(),
+		"errors": hasErrors,
+		"items":  results,
+	})
+}
+
+// setOutcome fills in the item from what storage reported for its entry.
+func (item *bulkItemResult) setOutcome(outcome storage.IndexResult) {
+	item.Index = outcome.Index
+	if outcome.ID != "" {
+		item.ID = outcome.ID
+	}
+	item.Status = outcome.Status
+	item.Result = outcome.Result
+	if outcome.Error != nil {
+		item.Error = &bulkItemError{Type: outcome.Error.Type, Reason: outcome.Error.Reason}
+	}
+}
+
+// decodeBulk reads action and source line pairs. Unsupported actions get an
+// error result instead of failing the request, as Elasticsearch does. Items
+// of the entries it returns are left without a status or index, for the
+// caller to fill in once they are stored; their _id is passed on to
+// storage in the entry.
+func decodeBulk(body io.Reader, defaultIndex string) ([]*bulkItemResult, []map[string]interface{}, error) {
+	reader := bufio.NewReader(body)
+	nextLine := func() ([]byte, error) {
+		for {
+			line, err := reader.ReadBytes('\n')
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				return line, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var items []*bulkItemResult
+	var logs []map[string]interface{}
+	for {
+		line, err := nextLine()
+		if err == io.EOF {
+			return items, logs, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var action map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		if err := json.Unmarshal(line, &action); err != nil || len(action) != 1 {
+			return nil, nil, errors.New("malformed action/metadata line")
+		}
+		for name, meta := range action {
+			item := &bulkItemResult{ID: meta.ID, action: name}
+			items = append(items, item)
+
+			if name == "delete" {
+				item.Index = clientIndex(meta.Index, defaultIndex)
+				item.Status = http.StatusBadRequest
+				item.Error = &bulkItemError{Type: "action_request_validation_exception", Reason: "only create and index actions are supported"}
+				continue
+			}
+			source, err := nextLine()
+			if err == io.EOF {
+				return nil, nil, errors.New("action line without a source line")
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			if name != "create" && name != "index" {
+				item.Index = clientIndex(meta.Index, defaultIndex)
+				item.Status = http.StatusBadRequest
+				item.Error = &bulkItemError{Type: "action_request_validation_exception", Reason: "only create and index actions are supported"}
+				continue
+			}
+
+			var entry map[string]interface{}
+			if err := json.Unmarshal(source, &entry); err != nil || entry == nil {
+				item.Index = clientIndex(meta.Index, defaultIndex)
+				item.Status = http.StatusBadRequest
+				item.Error = &bulkItemError{Type: "mapper_parsing_exception", Reason: "failed to parse source as a JSON object"}
+				continue
+			}
+			if meta.ID != "" {
+				entry["_id"] = meta.ID
+			}
+			logs = append(logs, entry)
+		}
+	}
+}
+
+// clientIndex is the index an action names, or the one of the request
+// path, reported for actions that are never stored.
+func clientIndex(index, defaultIndex string) string {
+	if index == "" {
+		return defaultIndex
+	}
+	return index
+}
+
+// NewESInfoHandler answers GET / with cluster information, which
+// Elasticsearch clients request to check the server version.
+func NewESInfoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			middleware.Error(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeES(w, http.StatusOK, map[string]interface{}{
+			"name":         "auth-proxy",
+			"cluster_name": "auth-proxy",
+			"version": map[string]interface{}{
+				"number":                              compatibleESVersion,
+				"build_flavor":                        "default",
+				"minimum_wire_compatibility_version":  "7.17.0",
+				"minimum_index_compatibility_version": "7.0.0",
+			},
+			"tagline": "You Know, for Search",
+		})
+	})
+}
+
+// writeES writes an Elasticsearch-style JSON response. Official clients
+// refuse responses without the X-Elastic-Product header.
+func writeES(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeESError writes an Elasticsearch error body. The request ID is added
+// as an extra field, which Elasticsearch clients ignore.
+func writeESError(w http.ResponseWriter, r *http.Request, status int, errorType, reason string) {
+	body := map[string]interface{}{
+		"error":  map[string]interface{}{"type": errorType, "reason": reason},
+		"status": status,
+	}
+	if id := middleware.RequestID(r.Context()); id != "" {
+		body["request_id"] = id
+	}
+	writeES(w, status, body)
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"auth-proxy/config"
+	"auth-proxy/storage"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+const bulkBody = `{"create":{"_index":"client-index","_id":"doc-1"}}
+{"container_name":"api","message":"kept"}
+{"index":{"_index":"client-index"}}
+{"container_name":"api","message":"rejected"}
+{"delete":{"_index":"client-index","_id":"doc-2"}}
+`
+
+type bulkResponse struct {
+	Errors bool                                `json:"errors"`
+	Items  []map[string]map[string]interface{} `json:"items"`
+}
+
+// rejectingCluster answers bulk requests like Elasticsearch, rejecting
+// every document whose message is "rejected".
+func rejectingCluster() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+			w.Write([]byte(`{"version":{"number":"8.19.0"}}`))
+			return
+		}
+		var items []map[string]interface{}
+		failed := false
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var header map[string]map[string]interface{}
+			json.Unmarshal(scanner.Bytes(), &header)
+			scanner.Scan()
+			var document map[string]interface{}
+			json.Unmarshal(scanner.Bytes(), &document)
+			for action, meta := range header {
+				id := meta["_id"]
+				if id == nil {
+					id = "generated"
+				}
+				item := map[string]interface{}{"_index": meta["_index"], "_id": id, "status": http.StatusCreated, "result": "created"}
+				if document["message"] == "rejected" {
+					failed = true
+					item = map[string]interface{}{"_index": meta["_index"], "status": http.StatusBadRequest,
+						"error": map[string]interface{}{"type": "mapper_parsing_exception", "reason": "bad field"}}
+				}
+				items = append(items, map[string]interface{}{action: item})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"took": 1, "errors": failed, "items": items})
+	})
+}
+
+func postBulk(h http.Handler) (*httptest.ResponseRecorder, bulkResponse) {
+	rec := postLogs(h, "application/x-ndjson", bulkBody)
+	var body bulkResponse
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	return rec, body
+}
+
+func TestBulkHandlerReportsStorageOutcomes(t *testing.T) {
+	server := httptest.NewServer(rejectingCluster())
+	t.Cleanup(server.Close)
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	es := storage.NewElasticsearchStorage(client, &config.Config{
+		BulkWorkers:         1,
+		BulkFlushBytes:      1 << 20,
+		BulkFlushInterval:   10 * time.Millisecond,
+		BulkRetryBackoff:    time.Millisecond,
+		ShutdownTimeout:     5 * time.Second,
+		IndexRotation:       "none",
+		QueueFullRetryAfter: time.Second,
+	}, nil, nil)
+	t.Cleanup(func() { es.Close() })
+
+	rec, body := postBulk(NewBulkHandler(es, nil).WaitForIndexing(5 * time.Second))
+	if rec.Code != http.StatusOK || len(body.Items) != 3 {
+		t.Fatalf("status = %d with %d items, want 200 with 3: %s", rec.Code, len(body.Items), rec.Body)
+	}
+	if !body.Errors {
+		t.Error("errors = false, want true")
+	}
+	created := body.Items[0]["create"]
+	if created["status"] != float64(http.StatusCreated) || created["_id"] != "doc-1" || created["_index"] != "logs-containers-api" {
+		t.Errorf("create item = %v, want 201 for doc-1 in the tenant index", created)
+	}
+	rejected := body.Items[1]["index"]
+	if rejected["status"] != float64(http.StatusBadRequest) || rejected["error"] == nil || rejected["_index"] != "logs-containers-api" {
+		t.Errorf("index item = %v, want the cluster's rejection", rejected)
+	}
+	deleted := body.Items[2]["delete"]
+	if deleted["status"] != float64(http.StatusBadRequest) || deleted["_index"] != "client-index" {
+		t.Errorf("delete item = %v, want 400 for the client's index", deleted)
+	}
+}
+
+func TestBulkHandlerWithoutResults(t *testing.T) {
+	store := &scriptedStorage{}
+	rec, body := postBulk(NewBulkHandler(store, nil))
+	if rec.Code != http.StatusOK || len(body.Items) != 3 {
+		t.Fatalf("status = %d with %d items, want 200 with 3: %s", rec.Code, len(body.Items), rec.Body)
+	}
+	created := body.Items[0]["create"]
+	if created["status"] != float64(http.StatusCreated) || created["_id"] != "doc-1" {
+		t.Errorf("create item = %v, want 201 for doc-1", created)
+	}
+	if _, ok := created["_index"]; ok {
+		t.Errorf("create item = %v, want no index, which storage did not report", created)
+	}
+	if len(store.batches) != 1 || len(store.batches[0]) != 2 {
+		t.Fatalf("stored %v, want one batch of 2 entries", store.batches)
+	}
+	if id := store.batches[0][0]["_id"]; id != "doc-1" {
+		t.Errorf("_id = %v, want the action's doc-1 passed to storage", id)
+	}
+	if _, ok := store.batches[0][1]["_id"]; ok {
+		t.Errorf("entry without an action _id was given one: %v", store.batches[0][1])
+	}
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// payloadFormat selects the decoder for a /logs request body.
+type payloadFormat int
+
+const (
+	formatJSON payloadFormat = iota
+	formatNDJSON
+	formatMsgpack
+)
+
+// payloadFormats maps every accepted Content-Type to its format.
+var payloadFormats = map[string]payloadFormat{
+	"application/json":        formatJSON,
+	"application/x-ndjson":    formatNDJSON,
+	"application/ndjson":      formatNDJSON,
+	"application/jsonlines":   formatNDJSON,
+	"application/x-jsonlines": formatNDJSON,
+	"application/msgpack":     formatMsgpack,
+	"application/x-msgpack":   formatMsgpack,
+	"application/vnd.msgpack": formatMsgpack,
+}
+
+// supportedContentTypes names one accepted type per format in 415 responses.
+var supportedContentTypes = []string{"application/json", "application/x-ndjson", "application/msgpack"}
+
+var unsupportedContentTypeMessage = "Unsupported Content-Type, expected one of " + strings.Join(supportedContentTypes, ", ")
+
+// requestFormat picks the decoder from the Content-Type header. A missing
+// header means JSON, which is what agents sent before the header was
+// checked; any other unknown or malformed type is refused.
+func requestFormat(r *http.Request) (payloadFormat, bool) {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return formatJSON, true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return 0, false
+	}
+	format, ok := payloadFormats[mediaType]
+	return format, ok
+}
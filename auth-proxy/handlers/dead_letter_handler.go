@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"auth-proxy/storage"
+)
+
+// DeadLetterReplayHandler starts a replay of the dead-letter queue on POST,
+// taking storage.ReplayOptions as an optional JSON body, and reports the
+// progress of the current or last replay on GET.
+type DeadLetterReplayHandler struct {
+	replayer *storage.DeadLetterReplayer
+}
+
+func NewDeadLetterReplayHandler(replayer *storage.DeadLetterReplayer) *DeadLetterReplayHandler {
+	return &DeadLetterReplayHandler{replayer: replayer}
+}
+
+func (h *DeadLetterReplayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var opts storage.ReplayOptions
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if opts.Rate < 0 {
+			http.Error(w, "rate must not be negative", http.StatusBadRequest)
+			return
+		}
+		if err := h.replayer.Start(opts); errors.Is(err, storage.ErrReplayRunning) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		status = http.StatusAccepted
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(h.replayer.Progress())
+}
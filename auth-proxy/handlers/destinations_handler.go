@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"auth-proxy/storage"
+)
+
+type DestinationsHandler struct {
+	provider storage.DestinationStatsProvider
+}
+
+func NewDestinationsHandler(provider storage.DestinationStatsProvider) *DestinationsHandler {
+	return &DestinationsHandler{provider: provider}
+}
+
+// ServeHTTP returns the per-destination counters of a fan-out storage.
+func (h *DestinationsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"destinations": h.provider.DestinationStats(),
+	})
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"auth-proxy/storage"
+)
+
+const (
+	defaultDevLogsLimit = 100
+	maxDevLogsLimit     = 10000
+)
+
+type DevLogsHandler struct {
+	provider storage.MemoryLogProvider
+}
+
+func NewDevLogsHandler(provider storage.MemoryLogProvider) *DevLogsHandler {
+	return &DevLogsHandler{provider: provider}
+}
+
+// ServeHTTP returns the most recent logs, newest first, optionally filtered
+// by the account and container query parameters. limit defaults to 100.
+func (h *DevLogsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultDevLogsLimit
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxDevLogsLimit)
+	}
+
+	logs := h.provider.Recent(query.Get("account"), query.Get("container"), limit)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(map[string]interface{}{
+		"count": len(logs),
+		"logs":  logs,
+	})
+}
@@ -1,14 +1,138 @@
 package handlers
 
-import "net/http"
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
 
-type HealthHandler struct{}
+	"auth-proxy/middleware"
+	"auth-proxy/storage"
+)
+
+type HealthHandler struct {
+	reporter  storage.HealthReporter
+	interval  time.Duration
+	startedAt time.Time
+
+	mu     sync.RWMutex
+	report *storage.HealthReport
+}
+
+type healthResponse struct {
+	Status        string                `json:"status"`
+	Elasticsearch string                `json:"elasticsearch"`
+	Indexer       *storage.IndexerStats `json:"indexer"`
+	Panics        uint64                `json:"panics"`
+	Uptime        string                `json:"uptime"`
+}
 
 func NewHealthHandler() *HealthHandler {
 	return &HealthHandler{}
 }
 
+// NewCachedHealthHandler returns a handler that reports dependency state from a
+// result refreshed in the background every interval, so probes never hit
+// Elasticsearch directly.
+func NewCachedHealthHandler(reporter storage.HealthReporter, interval time.Duration) *HealthHandler {
+	h := &HealthHandler{
+		reporter:  reporter,
+		interval:  interval,
+		startedAt: time.Now(),
+	}
+	h.refresh()
+	go h.refreshLoop()
+	return h
+}
+
 func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.reporter == nil {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status":"healthy"}`))
+		return
+	}
+
+	h.mu.RLock()
+	report := *h.report
+	h.mu.RUnlock()
+
+	resp := healthResponse{
+		Status:        "healthy",
+		Elasticsearch: report.Elasticsearch,
+		Indexer:       &report.Indexer,
+		Panics:        middleware.Panics(),
+		Uptime:        time.Since(h.startedAt).Round(time.Second).String(),
+	}
+	if report.Elasticsearch != "up" {
+		resp.Status = "degraded"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"healthy"}`))
+	json.NewEncoder(w).Encode(resp)
+}
+
+// NewLivenessHandler returns a handler that answers 200 while the process
+// serves requests, whatever the state of its dependencies.
+func NewLivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"alive"}`))
+	})
+}
+
+type readinessResponse struct {
+	Status  string   `json:"status"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// Readiness returns a handler that answers 503 with the reasons while the
+// cached result has Elasticsearch down, the indexer queue full or the index
+// template missing, so traffic is routed to other instances. A handler
+// without a reporter is always ready.
+func (h *HealthHandler) Readiness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := readinessResponse{Status: "ready"}
+		if h.reporter != nil {
+			h.mu.RLock()
+			report := *h.report
+			h.mu.RUnlock()
+
+			if report.Elasticsearch == "down" {
+				resp.Reasons = append(resp.Reasons, "elasticsearch is down")
+			}
+			if report.Saturated {
+				resp.Reasons = append(resp.Reasons, "bulk indexer queue is full")
+			}
+			if report.Template == "missing" {
+				resp.Reasons = append(resp.Reasons, "index template is not installed")
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if len(resp.Reasons) > 0 {
+			resp.Status = "not_ready"
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+func (h *HealthHandler) refreshLoop() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.refresh()
+	}
+}
+
+func (h *HealthHandler) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), h.interval)
+	defer cancel()
+	report := h.reporter.Health(ctx)
+
+	h.mu.Lock()
+	h.report = &report
+	h.mu.Unlock()
 }
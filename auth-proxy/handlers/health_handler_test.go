@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"auth-proxy/storage"
+)
+
+// fakeReporter returns whatever report was last set, counting the checks.
+type fakeReporter struct {
+	mu     sync.Mutex
+	report storage.HealthReport
+	checks int
+}
+
+func (f *fakeReporter) Health(ctx context.Context) storage.HealthReport {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.checks++
+	return f.report
+}
+
+func (f *fakeReporter) set(report storage.HealthReport) {
+	f.mu.Lock()
+	f.report = report
+	f.mu.Unlock()
+}
+
+func (f *fakeReporter) checkCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.checks
+}
+
+func getHealth(t *testing.T, h http.Handler) (int, healthResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	var resp healthResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode health response: %v", err)
+	}
+	return rec.Code, resp
+}
+
+func TestCachedHealthHandlerServesCachedReport(t *testing.T) {
+	reporter := &fakeReporter{report: storage.HealthReport{Elasticsearch: "up"}}
+	h := NewCachedHealthHandler(reporter, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		code, resp := getHealth(t, h)
+		if code != http.StatusOK || resp.Status != "healthy" || resp.Elasticsearch != "up" {
+			t.Fatalf("health = %d %+v, want 200 healthy with elasticsearch up", code, resp)
+		}
+	}
+	if got := reporter.checkCount(); got != 1 {
+		t.Errorf("reporter checked %d times, want 1: probes must not reach Elasticsearch", got)
+	}
+}
+
+func TestCachedHealthHandlerRefreshes(t *testing.T) {
+	reporter := &fakeReporter{report: storage.HealthReport{Elasticsearch: "up"}}
+	h := NewCachedHealthHandler(reporter, 10*time.Millisecond)
+	reporter.set(storage.HealthReport{Elasticsearch: "down"})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		code, resp := getHealth(t, h)
+		if resp.Status == "degraded" {
+			// A degraded cluster keeps the proxy alive for the probe.
+			if code != http.StatusOK {
+				t.Errorf("degraded health status code = %d, want 200", code)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("health still %+v after the reporter went down", resp)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	tests := []struct {
+		name   string
+		report storage.HealthReport
+		want   int
+	}{
+		{"up", storage.HealthReport{Elasticsearch: "up", Template: "installed"}, http.StatusOK},
+		{"down", storage.HealthReport{Elasticsearch: "down"}, http.StatusServiceUnavailable},
+		{"saturated", storage.HealthReport{Elasticsearch: "up", Saturated: true}, http.StatusServiceUnavailable},
+		{"template missing", storage.HealthReport{Elasticsearch: "up", Template: "missing"}, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewCachedHealthHandler(&fakeReporter{report: tt.report}, time.Hour)
+			rec := httptest.NewRecorder()
+			h.Readiness().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tt.want {
+				t.Errorf("readiness = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestUncachedHealthHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewHealthHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"status":"healthy"}` {
+		t.Errorf("health = %d %s", rec.Code, rec.Body.String())
+	}
+}
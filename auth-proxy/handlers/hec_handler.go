@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"auth-proxy/auth"
+	"auth-proxy/middleware"
+	"auth-proxy/policy"
+	"auth-proxy/storage"
+)
+
+// HEC status codes, as documented for Splunk's HTTP Event Collector.
+const (
+	hecCodeSuccess       = 0
+	hecCodeTokenRequired = 2
+	hecCodeNoData        = 5
+	hecCodeInvalidFormat = 6
+	hecCodeServerBusy    = 9
+	hecCodeEventRequired = 12
+	hecCodeEventBlank    = 13
+	hecCodeHealthy       = 17
+)
+
+// HECHandler accepts Splunk HTTP Event Collector event batches so Splunk
+// forwarders and logging libraries can send to the proxy unchanged. The HEC
+// token is any credential AuthMiddleware accepts, typically an API key.
+type HECHandler struct {
+	storage    storage.LogStorage
+	authorizer policy.Authorizer
+}
+
+func NewHECHandler(storage storage.LogStorage, authorizer policy.Authorizer) *HECHandler {
+	return &HECHandler{storage: storage, authorizer: authorizer}
+}
+
+// hecEvent is one object of a HEC request body.
+type hecEvent struct {
+	Event      json.RawMessage        `json:"event"`
+	Time       json.RawMessage        `json:"time"`
+	Host       string                 `json:"host"`
+	Source     string                 `json:"source"`
+	SourceType string                 `json:"sourcetype"`
+	Index      string                 `json:"index"`
+	Fields     map[string]interface{} `json:"fields"`
+}
+
+// ServeHTTP decodes a body of concatenated event objects. HEC rejects the
+// whole request when any event is invalid, and so does this handler.
+func (h *HECHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		middleware.Error(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := r.Context().Value(middleware.ClaimsContextKey).(*auth.Claims)
+	if !ok {
+		middleware.AuditRejection(r, http.StatusUnauthorized, "missing_claims", nil)
+		writeHEC(w, http.StatusUnauthorized, hecCodeTokenRequired, "Token is required")
+		return
+	}
+
+	defer r.Body.Close()
+	body := &countingReader{r: r.Body}
+	decoder := json.NewDecoder(body)
+	var logs []map[string]interface{}
+	for {
+		var event hecEvent
+		err := decoder.Decode(&event)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, middleware.ErrBodyTooLarge) {
+			middleware.Error(w, r, "Request entity too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			writeHEC(w, http.StatusBadRequest, hecCodeInvalidFormat, "Invalid data format")
+			return
+		}
+		entry, code, text := hecEntry(&event)
+		if entry == nil {
+			writeHEC(w, http.StatusBadRequest, code, text)
+			return
+		}
+		logs = append(logs, entry)
+	}
+	if len(logs) == 0 {
+		writeHEC(w, http.StatusBadRequest, hecCodeNoData, "No data")
+		return
+	}
+
+	if !authorizeBatch(h.authorizer, w, r, claims, body.n, logs) {
+		return
+	}
+
+	if err := h.storage.StoreLogs(r.Context(), claims.GetAccountID(), logs); err != nil {
+		var skippedErr *storage.SkippedEntriesError
+		var tooLarge *storage.BatchTooLargeError
+		if errors.As(err, &tooLarge) {
+			writeHEC(w, http.StatusRequestEntityTooLarge, hecCodeInvalidFormat, tooLarge.Error())
+			return
+		}
+		if !errors.As(err, &skippedErr) {
+			// Forwarders retry on "server is busy", which also covers a
+			// full indexer queue.
+			logger.ErrorContext(r.Context(), "failed to store logs", "source", "hec", "account_id", claims.GetAccountID(), "error", err)
+			setRetryAfter(w, err)
+			writeHEC(w, http.StatusServiceUnavailable, hecCodeServerBusy, "Server is busy")
+			return
+		}
+		logger.WarnContext(r.Context(), "stored logs with warnings", "source", "hec", "account_id", claims.GetAccountID(), "error", err)
+		w.Header().Set(IngestWarningsHeader, skippedErr.Summary())
+	}
+	writeHEC(w, http.StatusOK, hecCodeSuccess, "Success")
+}
+
+// hecEntry converts an event into a log entry. A string event becomes the
+// message; an object event is stored as is. Indexed fields are added at the
+// top level, where Splunk would make them searchable.
+func hecEntry(event *hecEvent) (map[string]interface{}, int, string) {
+	if len(event.Event) == 0 || string(event.Event) == "null" {
+		return nil, hecCodeEventRequired, "Event field is required"
+	}
+	var value interface{}
+	if err := json.Unmarshal(event.Event, &value); err != nil {
+		return nil, hecCodeInvalidFormat, "Invalid data format"
+	}
+
+	var entry map[string]interface{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		entry = v
+	case string:
+		if v == "" {
+			return nil, hecCodeEventBlank, "Event field cannot be blank"
+		}
+		entry = map[string]interface{}{"message": v}
+	default:
+		entry = map[string]interface{}{"message": string(event.Event)}
+	}
+
+	for key, field := range event.Fields {
+		entry[key] = field
+	}
+	for key, field := range map[string]string{"host": event.Host, "source": event.Source, "sourcetype": event.SourceType, "index": event.Index} {
+		if field != "" {
+			entry[key] = field
+		}
+	}
+	if t, ok := hecTime(event.Time); ok {
+		entry["timestamp"] = t.UTC().Format(time.RFC3339Nano)
+	}
+	return entry, 0, ""
+}
+
+// hecTime parses epoch seconds, with an optional fraction, given as a JSON
+// number or string.
+func hecTime(raw json.RawMessage) (time.Time, bool) {
+	if len(raw) == 0 {
+		return time.Time{}, false
+	}
+	var s string
+	if json.Unmarshal(raw, &s) != nil {
+		s = string(raw)
+	}
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil || seconds <= 0 {
+		return time.Time{}, false
+	}
+	whole, frac := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(math.Round(frac*1e6))*1e3), true
+}
+
+func writeHEC(w http.ResponseWriter, status, code int, text string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"text": text, "code": code})
+}
+
+// NewHECHealthHandler answers HEC health checks, which forwarders send
+// without a token.
+func NewHECHealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHEC(w, http.StatusOK, hecCodeHealthy, "HEC is healthy")
+	})
+}
@@ -1,51 +1,501 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"auth-proxy/auth"
+	"auth-proxy/logging"
 	"auth-proxy/middleware"
+	"auth-proxy/policy"
 	"auth-proxy/storage"
+	"auth-proxy/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
+var logger = logging.Component("handlers")
+
+// IngestWarningsHeader summarizes entries skipped while preparing a batch,
+// e.g. "invalid_version=1; marshal_failed=2".
+const IngestWarningsHeader = "X-Akto-Ingest-Warnings"
+
+// StoredEntriesHeader is set on errors answered after some entries of a
+// streamed batch were already stored, to how many were. Those errors are
+// never retryable, since retrying would store the entries again.
+const StoredEntriesHeader = "X-Akto-Stored-Entries"
+
+// LogsV1MediaType is the response schema of the versioned logs API. Clients
+// may list it in Accept to fail fast once a later version replaces it.
+const LogsV1MediaType = "application/vnd.akto.logs.v1+json"
+
 type LogsHandler struct {
-	storage storage.LogStorage
+	storage    storage.LogStorage
+	authorizer policy.Authorizer
+	// versioned answers with the LogsV1MediaType schema, errors included,
+	// instead of the plain responses of the original /logs endpoint.
+	versioned bool
+	// streamChunkEntries, when positive, is how many entries of a streamed
+	// JSON array are decoded before they are handed to storage.
+	streamChunkEntries int
+	// waitAlways makes every request wait for index results, not only those
+	// with ?wait=true. A request waits at most waitTimeout.
+	waitAlways  bool
+	waitTimeout time.Duration
+}
+
+// NewLogsHandler stores decoded batches in storage. authorizer, when not nil,
+// gets the final say on every batch before it is stored.
+func NewLogsHandler(storage storage.LogStorage, authorizer policy.Authorizer) *LogsHandler {
+	return &LogsHandler{storage: storage, authorizer: authorizer}
+}
+
+// NewLogsV1Handler is NewLogsHandler for the versioned API. It accepts the
+// same payloads and answers with a structured JSON body carrying the
+// accepted count and request ID.
+func NewLogsV1Handler(storage storage.LogStorage, authorizer policy.Authorizer) *LogsHandler {
+	return &LogsHandler{storage: storage, authorizer: authorizer, versioned: true}
+}
+
+// StreamEntries makes the handler decode JSON arrays element by element and
+// store every chunkEntries entries as they are decoded, instead of holding
+// the whole batch in memory first. It has no effect with an authorizer,
+// which must see the whole batch. A streamed request that fails partway
+// through keeps the chunks stored before the failure, and is answered with
+// a non-retryable status and the StoredEntriesHeader.
+func (h *LogsHandler) StreamEntries(chunkEntries int) *LogsHandler {
+	h.streamChunkEntries = chunkEntries
+	return h
 }
 
-func NewLogsHandler(storage storage.LogStorage) *LogsHandler {
-	return &LogsHandler{storage: storage}
+// WaitForIndexing sets how long requests with ?wait=true wait for storage
+// to report the outcome of every entry before answering, with always making
+// every request wait. Only Elasticsearch storage reports results.
+func (h *LogsHandler) WaitForIndexing(always bool, timeout time.Duration) *LogsHandler {
+	h.waitAlways = always
+	h.waitTimeout = timeout
+	return h
+}
+
+type logsV1Response struct {
+	RequestID string         `json:"request_id"`
+	Accepted  int            `json:"accepted"`
+	Skipped   int            `json:"skipped"`
+	Warnings  map[string]int `json:"warnings,omitempty"`
+	// Failed and Items are only set when the request waited for indexing.
+	Failed int                   `json:"failed,omitempty"`
+	Items  []storage.IndexResult `json:"items,omitempty"`
+}
+
+type logsV1Error struct {
+	RequestID string `json:"request_id"`
+	Error     string `json:"error"`
+	// Stored is set when entries were stored before the error.
+	Stored int `json:"stored,omitempty"`
 }
 
 func (h *LogsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		h.fail(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if h.versioned && !acceptsLogsV1(r) {
+		h.fail(w, r, http.StatusNotAcceptable, "Not acceptable, this endpoint responds with "+LogsV1MediaType)
+		return
+	}
+
+	format, ok := requestFormat(r)
+	if !ok {
+		h.fail(w, r, http.StatusUnsupportedMediaType, unsupportedContentTypeMessage)
 		return
 	}
 
 	claims, ok := r.Context().Value(middleware.ClaimsContextKey).(*auth.Claims)
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		middleware.AuditRejection(r, http.StatusUnauthorized, "missing_claims", nil)
+		h.fail(w, r, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
 	accountID := claims.GetAccountID()
 
 	defer r.Body.Close()
-	var logs []map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&logs); err != nil {
-		http.Error(w, "Bad request", http.StatusBadRequest)
+	body := &countingReader{r: r.Body}
+
+	ctx := r.Context()
+	var results *storage.IndexResults
+	if h.waitTimeout > 0 && (h.waitAlways || r.URL.Query().Get("wait") == "true") {
+		ctx, results = storage.WithIndexResults(ctx)
+	}
+
+	// store may be called once per chunk of a streamed request, so skipped
+	// and stored entries are summed across calls.
+	total, stored := 0, 0
+	skipped := make(map[string]int)
+	var storeErr error
+	store := func(logs []map[string]interface{}) error {
+		total += len(logs)
+		err := h.storage.StoreLogs(ctx, accountID, logs)
+		var chunkSkipped *storage.SkippedEntriesError
+		if errors.As(err, &chunkSkipped) {
+			logger.WarnContext(ctx, "stored logs with warnings", "source", "logs", "account_id", accountID, "error", err)
+			for reason, n := range chunkSkipped.Skipped {
+				skipped[reason] += n
+			}
+			stored += len(logs) - chunkSkipped.Count()
+			return nil
+		}
+		if err == nil {
+			stored += len(logs)
+		}
+		storeErr = err
+		return err
+	}
+
+	malformed := 0
+	var err error
+	if format == formatJSON && h.streamChunkEntries > 0 && h.authorizer == nil {
+		err = streamJSONBatch(body, h.streamChunkEntries, store)
+	} else {
+		var logs []map[string]interface{}
+		_, span := tracing.Tracer("auth-proxy/handlers").Start(r.Context(), "decode")
+		switch format {
+		case formatNDJSON:
+			logs, malformed, err = decodeNDJSON(body)
+			if err == nil && len(logs) == 0 && malformed > 0 {
+				err = errors.New("no valid lines")
+			}
+		case formatMsgpack:
+			logs, err = decodeMsgpack(body)
+		default:
+			logs, err = decodeJSONBatch(body)
+		}
+		span.SetAttributes(attribute.Int("entries", len(logs)), attribute.Int64("bytes", body.n))
+		span.End()
+		if err == nil {
+			if policyErr := checkBatchPolicy(h.authorizer, r, claims, body.n, logs); policyErr != nil {
+				h.fail(w, r, http.StatusForbidden, "Forbidden")
+				return
+			}
+			err = store(logs)
+		}
+	}
+	if err != nil && stored > 0 {
+		// Only a streamed request gets here. Whatever failed, the client
+		// must not send the batch again, or its first chunks are stored
+		// twice.
+		logger.ErrorContext(r.Context(), "streamed logs failed after some were stored", "source", "logs", "account_id", accountID, "stored", stored, "error", err)
+		w.Header().Set(StoredEntriesHeader, strconv.Itoa(stored))
+		status, message := http.StatusBadRequest, "Bad request"
+		switch {
+		case errors.Is(err, middleware.ErrBodyTooLarge):
+			status, message = http.StatusRequestEntityTooLarge, "Request entity too large"
+		case storeErr != nil:
+			status, message = http.StatusUnprocessableEntity, "Storage failed partway through the batch"
+		}
+		h.failStored(w, r, status, message+", "+strconv.Itoa(stored)+" entries were stored", stored)
+		return
+	}
+	if storeErr != nil {
+		var tooLarge *storage.BatchTooLargeError
+		if errors.As(storeErr, &tooLarge) {
+			h.fail(w, r, http.StatusRequestEntityTooLarge, tooLarge.Error())
+			return
+		}
+		if status := setRetryAfter(w, storeErr); status != 0 {
+			h.fail(w, r, status, http.StatusText(status))
+			return
+		}
+		logger.ErrorContext(r.Context(), "failed to store logs", "source", "logs", "account_id", accountID, "error", storeErr)
+		h.fail(w, r, http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if errors.Is(err, middleware.ErrBodyTooLarge) {
+		h.fail(w, r, http.StatusRequestEntityTooLarge, "Request entity too large")
+		return
+	}
+	if err != nil {
+		h.fail(w, r, http.StatusBadRequest, "Bad request")
 		return
 	}
 
-	if err := h.storage.StoreLogs(r.Context(), accountID, logs); err != nil {
-		log.Printf("Failed to store logs: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	var items []storage.IndexResult
+	failed := 0
+	if results != nil {
+		waitCtx, cancel := context.WithTimeout(r.Context(), h.waitTimeout)
+		items, err = results.Wait(waitCtx)
+		cancel()
+		if err != nil {
+			h.fail(w, r, http.StatusGatewayTimeout, "Timed out waiting for logs to be indexed")
+			return
+		}
+		for _, item := range items {
+			if item.Error != nil {
+				failed++
+			}
+		}
+	}
+
+	var skippedErr *storage.SkippedEntriesError
+	if len(skipped) > 0 || malformed > 0 {
+		skippedErr = &storage.SkippedEntriesError{Total: total, Skipped: skipped}
+	}
+	accepted := total
+	if skippedErr != nil {
+		accepted -= skippedErr.Count()
+	}
+	if malformed > 0 {
+		// Lines that never made it to storage are reported alongside the
+		// entries storage skipped.
+		skippedErr.Total += malformed
+		skippedErr.Skipped["malformed_line"] += malformed
+	}
+
+	if h.versioned {
+		resp := logsV1Response{RequestID: middleware.RequestID(r.Context()), Accepted: accepted, Failed: failed, Items: items}
+		if skippedErr != nil {
+			w.Header().Set(IngestWarningsHeader, skippedErr.Summary())
+			resp.Skipped = skippedErr.Count()
+			resp.Warnings = skippedErr.Skipped
+		}
+		writeLogsV1(w, r, http.StatusOK, resp)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	if skippedErr != nil || results != nil {
+		resp := map[string]interface{}{"status": "success"}
+		if skippedErr != nil {
+			// Entries dropped during pre-processing are reported to the
+			// client instead of failing the batch, since the rest was
+			// accepted.
+			w.Header().Set(IngestWarningsHeader, skippedErr.Summary())
+			resp["skipped"] = skippedErr.Count()
+			resp["warnings"] = skippedErr.Skipped
+		}
+		if results != nil {
+			if failed > 0 {
+				resp["status"] = "partial"
+			}
+			resp["failed"] = failed
+			resp["items"] = items
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"status":"success"}`))
 }
+
+// fail writes an error in the handler's response schema.
+func (h *LogsHandler) fail(w http.ResponseWriter, r *http.Request, status int, message string) {
+	h.failStored(w, r, status, message, 0)
+}
+
+// failStored is fail for a request that stored some entries first.
+func (h *LogsHandler) failStored(w http.ResponseWriter, r *http.Request, status int, message string, stored int) {
+	if !h.versioned {
+		middleware.Error(w, r, message, status)
+		return
+	}
+	writeLogsV1(w, r, status, logsV1Error{RequestID: middleware.RequestID(r.Context()), Error: message, Stored: stored})
+}
+
+// setRetryAfter sets the Retry-After header, in whole seconds, when err
+// means storage is shedding load. It returns the status that tells clients
+// to back off: 429 when the indexer queue is full and 503 while the circuit
+// breaker is open, or zero for any other error.
+func setRetryAfter(w http.ResponseWriter, err error) int {
+	var queueFull *storage.QueueFullError
+	var unavailable *storage.UnavailableError
+	var retryAfter time.Duration
+	status := 0
+	switch {
+	case errors.As(err, &queueFull):
+		retryAfter, status = queueFull.RetryAfter, http.StatusTooManyRequests
+	case errors.As(err, &unavailable):
+		retryAfter, status = unavailable.RetryAfter, http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		// Storage could not take the batch before the request deadline.
+		retryAfter, status = time.Second, http.StatusServiceUnavailable
+	default:
+		return 0
+	}
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	return status
+}
+
+// acceptsLogsV1 reports whether the Accept header allows a LogsV1MediaType
+// or plain JSON response. A missing header accepts anything.
+func acceptsLogsV1(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return true
+	}
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case LogsV1MediaType, "application/json", "application/*", "*/*":
+			return true
+		}
+	}
+	return false
+}
+
+// writeLogsV1 answers in LogsV1MediaType when the client asked for it by
+// name and as application/json otherwise.
+func writeLogsV1(w http.ResponseWriter, r *http.Request, status int, body interface{}) {
+	contentType := "application/json"
+	if strings.Contains(r.Header.Get("Accept"), LogsV1MediaType) {
+		contentType = LogsV1MediaType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// batchWrapperKeys are the keys webhook-style producers wrap a batch in,
+// e.g. {"records": [...]}.
+var batchWrapperKeys = []string{"records", "logs"}
+
+// decodeJSONBatch reads a JSON array of entries, a single entry object, or
+// an object whose only key is one of batchWrapperKeys holding the array.
+func decodeJSONBatch(body io.Reader) ([]map[string]interface{}, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return nil, err
+	}
+	raw = bytes.TrimLeft(raw, " \t\r\n")
+	if len(raw) > 0 && raw[0] == '[' {
+		var logs []map[string]interface{}
+		if err := json.Unmarshal(raw, &logs); err != nil {
+			return nil, err
+		}
+		return logs, nil
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	if len(entry) == 1 {
+		for _, key := range batchWrapperKeys {
+			if _, ok := entry[key].([]interface{}); ok {
+				var wrapped map[string][]map[string]interface{}
+				if err := json.Unmarshal(raw, &wrapped); err != nil {
+					return nil, err
+				}
+				return wrapped[key], nil
+			}
+		}
+	}
+	return []map[string]interface{}{entry}, nil
+}
+
+// streamJSONBatch decodes a JSON array with the json.Decoder token API and
+// passes its entries to flush in chunks of chunkEntries. Objects, which may
+// be batch wrappers, are decoded whole by decodeJSONBatch.
+func streamJSONBatch(body io.Reader, chunkEntries int, flush func([]map[string]interface{}) error) error {
+	decoder := json.NewDecoder(body)
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	switch token {
+	case json.Delim('['):
+	case json.Delim('{'):
+		logs, err := decodeJSONBatch(io.MultiReader(strings.NewReader("{"), decoder.Buffered(), body))
+		if err != nil || len(logs) == 0 {
+			return err
+		}
+		return flush(logs)
+	case nil:
+		return nil
+	default:
+		return errors.New("payload must be a JSON array or object")
+	}
+
+	chunk := make([]map[string]interface{}, 0, chunkEntries)
+	for decoder.More() {
+		var entry map[string]interface{}
+		if err := decoder.Decode(&entry); err != nil {
+			return err
+		}
+		chunk = append(chunk, entry)
+		if len(chunk) == chunkEntries {
+			if err := flush(chunk); err != nil {
+				return err
+			}
+			chunk = make([]map[string]interface{}, 0, chunkEntries)
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return err
+	}
+	if len(chunk) == 0 {
+		return nil
+	}
+	return flush(chunk)
+}
+
+// authorizeBatch asks authorizer, when set, whether the decoded batch may be
+// stored, and writes a 403 if not. It fails closed: a policy that cannot be
+// evaluated rejects the batch.
+func authorizeBatch(authorizer policy.Authorizer, w http.ResponseWriter, r *http.Request, claims *auth.Claims, payloadBytes int64, logs []map[string]interface{}) bool {
+	if err := checkBatchPolicy(authorizer, r, claims, payloadBytes, logs); err != nil {
+		middleware.Error(w, r, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// checkBatchPolicy is authorizeBatch for handlers that write their own
+// error responses.
+func checkBatchPolicy(authorizer policy.Authorizer, r *http.Request, claims *auth.Claims, payloadBytes int64, logs []map[string]interface{}) error {
+	if authorizer == nil {
+		return nil
+	}
+	input := policy.Input{
+		Claims:       claims,
+		AccountID:    claims.GetAccountID(),
+		Method:       r.Method,
+		Path:         r.URL.Path,
+		PayloadBytes: payloadBytes,
+		Entries:      len(logs),
+		Containers:   storage.ContainerNames(logs),
+	}
+	if err := authorizer.Authorize(r.Context(), input); err != nil {
+		logger.WarnContext(r.Context(), "rejected logs by policy", "path", r.URL.Path, "account_id", input.AccountID, "error", err)
+		middleware.AuditRejection(r, http.StatusForbidden, "policy_denied", claims)
+		return err
+	}
+	return nil
+}
+
+// countingReader records how many bytes of the request body were read.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"auth-proxy/auth"
+	"auth-proxy/middleware"
+	"auth-proxy/storage"
+)
+
+// scriptedStorage records the batches it is given. fail, when set, picks
+// the error of each call by the order it arrived in, from 0.
+type scriptedStorage struct {
+	mu      sync.Mutex
+	batches [][]map[string]interface{}
+	fail    func(n int, logs []map[string]interface{}) error
+}
+
+func (s *scriptedStorage) StoreLogs(ctx context.Context, accountID string, logs []map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.batches)
+	s.batches = append(s.batches, logs)
+	if s.fail != nil {
+		return s.fail(n, logs)
+	}
+	return nil
+}
+
+// postLogs posts body to h as account 1.
+func postLogs(h http.Handler, contentType, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/logs", strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), middleware.ClaimsContextKey, &auth.Claims{AccountID: 1}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+const fiveEntries = `[{"n":1},{"n":2},{"n":3},{"n":4},{"n":5}]`
+
+func TestLogsHandlerStreamsInChunks(t *testing.T) {
+	store := &scriptedStorage{}
+	rec := postLogs(NewLogsHandler(store, nil).StreamEntries(2), "application/json", fiveEntries)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if len(store.batches) != 3 || len(store.batches[2]) != 1 {
+		t.Errorf("stored %d batches, want chunks of 2, 2 and 1", len(store.batches))
+	}
+}
+
+func TestLogsHandlerStreamFailures(t *testing.T) {
+	queueFull := &storage.QueueFullError{RetryAfter: time.Second}
+	tests := []struct {
+		name       string
+		body       string
+		fail       func(n int, logs []map[string]interface{}) error
+		wantStatus int
+		wantStored string
+	}{
+		{
+			name:       "storage fails on the first chunk",
+			body:       fiveEntries,
+			fail:       func(int, []map[string]interface{}) error { return queueFull },
+			wantStatus: http.StatusTooManyRequests,
+		},
+		{
+			name: "storage fails after a chunk was stored",
+			body: fiveEntries,
+			fail: func(n int, _ []map[string]interface{}) error {
+				if n == 1 {
+					return queueFull
+				}
+				return nil
+			},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantStored: "2",
+		},
+		{
+			name:       "decoding fails after a chunk was stored",
+			body:       `[{"n":1},{"n":2},{"n":3},`,
+			wantStatus: http.StatusBadRequest,
+			wantStored: "2",
+		},
+		{
+			name: "entries skipped by storage are not counted as stored",
+			body: fiveEntries,
+			fail: func(n int, logs []map[string]interface{}) error {
+				if n == 1 {
+					return queueFull
+				}
+				return &storage.SkippedEntriesError{Total: len(logs), Skipped: map[string]int{"marshal_failed": 1}}
+			},
+			wantStatus: http.StatusUnprocessableEntity,
+			wantStored: "1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &scriptedStorage{fail: tt.fail}
+			rec := postLogs(NewLogsHandler(store, nil).StreamEntries(2), "application/json", tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if got := rec.Header().Get(StoredEntriesHeader); got != tt.wantStored {
+				t.Errorf("%s = %q, want %q", StoredEntriesHeader, got, tt.wantStored)
+			}
+			if tt.wantStored != "" && rec.Header().Get("Retry-After") != "" {
+				t.Error("a partly stored batch must not be answered with Retry-After")
+			}
+		})
+	}
+}
+
+func TestLogsV1HandlerReportsStoredEntries(t *testing.T) {
+	store := &scriptedStorage{fail: func(n int, _ []map[string]interface{}) error {
+		if n == 2 {
+			return &storage.UnavailableError{RetryAfter: time.Second}
+		}
+		return nil
+	}}
+	rec := postLogs(NewLogsV1Handler(store, nil).StreamEntries(2), "application/json", fiveEntries)
+	var resp logsV1Error
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if rec.Code != http.StatusUnprocessableEntity || resp.Stored != 4 {
+		t.Errorf("response = %d %+v, want 422 with 4 stored", rec.Code, resp)
+	}
+}
+
+func TestLogsHandlerIngestWarnings(t *testing.T) {
+	skip := func(reason string, n int) func(int, []map[string]interface{}) error {
+		return func(_ int, logs []map[string]interface{}) error {
+			return &storage.SkippedEntriesError{Total: len(logs), Skipped: map[string]int{reason: n}}
+		}
+	}
+	tests := []struct {
+		name         string
+		contentType  string
+		body         string
+		fail         func(n int, logs []map[string]interface{}) error
+		wantHeader   string
+		wantSkipped  int
+		wantAccepted int
+	}{
+		{
+			name:         "clean batch",
+			contentType:  "application/json",
+			body:         fiveEntries,
+			wantAccepted: 5,
+		},
+		{
+			name:         "entries skipped by storage",
+			contentType:  "application/json",
+			body:         fiveEntries,
+			fail:         skip("invalid_version", 2),
+			wantHeader:   "invalid_version=2",
+			wantSkipped:  2,
+			wantAccepted: 3,
+		},
+		{
+			name:         "malformed lines",
+			contentType:  "application/x-ndjson",
+			body:         "{\"n\":1}\nnot json\n{\"n\":2}\n",
+			wantHeader:   "malformed_line=1",
+			wantSkipped:  1,
+			wantAccepted: 2,
+		},
+		{
+			name:         "malformed lines and entries skipped by storage",
+			contentType:  "application/x-ndjson",
+			body:         "{\"n\":1}\nnot json\n{\"n\":2}\n{\"n\":3}\n",
+			fail:         skip("marshal_failed", 1),
+			wantHeader:   "malformed_line=1; marshal_failed=1",
+			wantSkipped:  2,
+			wantAccepted: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := postLogs(NewLogsHandler(&scriptedStorage{fail: tt.fail}, nil), tt.contentType, tt.body)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get(IngestWarningsHeader); got != tt.wantHeader {
+				t.Errorf("%s = %q, want %q", IngestWarningsHeader, got, tt.wantHeader)
+			}
+			var resp struct {
+				Status   string         `json:"status"`
+				Skipped  int            `json:"skipped"`
+				Warnings map[string]int `json:"warnings"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if resp.Status != "success" || resp.Skipped != tt.wantSkipped || sumCounts(resp.Warnings) != tt.wantSkipped {
+				t.Errorf("response = %+v, want success with %d skipped", resp, tt.wantSkipped)
+			}
+
+			rec = postLogs(NewLogsV1Handler(&scriptedStorage{fail: tt.fail}, nil), tt.contentType, tt.body)
+			if got := rec.Header().Get(IngestWarningsHeader); got != tt.wantHeader {
+				t.Errorf("v1 %s = %q, want %q", IngestWarningsHeader, got, tt.wantHeader)
+			}
+			var v1 logsV1Response
+			if err := json.NewDecoder(rec.Body).Decode(&v1); err != nil {
+				t.Fatalf("failed to decode v1 response: %v", err)
+			}
+			if rec.Code != http.StatusOK || v1.Accepted != tt.wantAccepted || v1.Skipped != tt.wantSkipped || sumCounts(v1.Warnings) != tt.wantSkipped {
+				t.Errorf("v1 response = %d %+v, want 200 with %d accepted and %d skipped", rec.Code, v1, tt.wantAccepted, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func sumCounts(counts map[string]int) int {
+	n := 0
+	for _, c := range counts {
+		n += c
+	}
+	return n
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"auth-proxy/auth"
+	"auth-proxy/loki"
+	"auth-proxy/middleware"
+	"auth-proxy/policy"
+	"auth-proxy/storage"
+)
+
+// LokiHandler implements the Loki push API so Promtail and other Loki
+// clients can use the proxy as their Loki endpoint.
+type LokiHandler struct {
+	storage    storage.LogStorage
+	authorizer policy.Authorizer
+	maxBytes   int64
+}
+
+// NewLokiHandler stores pushed streams in storage. maxBytes caps the
+// decompressed size of snappy-compressed protobuf bodies.
+func NewLokiHandler(storage storage.LogStorage, authorizer policy.Authorizer, maxBytes int64) *LokiHandler {
+	return &LokiHandler{storage: storage, authorizer: authorizer, maxBytes: maxBytes}
+}
+
+// ServeHTTP accepts snappy-compressed protobuf (application/x-protobuf) and
+// JSON bodies and answers 204 like Loki does.
+func (h *LokiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		middleware.Error(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := r.Context().Value(middleware.ClaimsContextKey).(*auth.Claims)
+	if !ok {
+		middleware.AuditRejection(r, http.StatusUnauthorized, "missing_claims", nil)
+		middleware.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-protobuf" && mediaType != "application/json" {
+		middleware.Error(w, r, "Unsupported Content-Type, expected application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	defer r.Body.Close()
+	data, err := io.ReadAll(r.Body)
+	if errors.Is(err, middleware.ErrBodyTooLarge) {
+		middleware.Error(w, r, "Request entity too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		middleware.Error(w, r, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	var streams []loki.Stream
+	if mediaType == "application/json" {
+		streams, err = loki.DecodeJSON(data)
+	} else {
+		streams, err = loki.DecodeProtobuf(data, h.maxBytes)
+	}
+	if err != nil {
+		middleware.Error(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	logs := loki.Entries(streams)
+	if !authorizeBatch(h.authorizer, w, r, claims, int64(len(data)), logs) {
+		return
+	}
+
+	if len(logs) > 0 {
+		if err := h.storage.StoreLogs(r.Context(), claims.GetAccountID(), logs); err != nil {
+			var skippedErr *storage.SkippedEntriesError
+			var tooLarge *storage.BatchTooLargeError
+			if errors.As(err, &tooLarge) {
+				middleware.Error(w, r, tooLarge.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			if !errors.As(err, &skippedErr) {
+				// Promtail retries 429 and 5xx responses.
+				if status := setRetryAfter(w, err); status == http.StatusTooManyRequests {
+					middleware.Error(w, r, err.Error(), status)
+					return
+				}
+				logger.ErrorContext(r.Context(), "failed to store logs", "source", "loki", "account_id", claims.GetAccountID(), "error", err)
+				middleware.Error(w, r, "Service unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			logger.WarnContext(r.Context(), "stored logs with warnings", "source", "loki", "account_id", claims.GetAccountID(), "error", err)
+			w.Header().Set(IngestWarningsHeader, skippedErr.Summary())
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
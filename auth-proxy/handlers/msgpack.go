@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"auth-proxy/forward"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// decodeMsgpack reads a sequence of msgpack values, each an entry map, an
+// array of entry maps, or a Fluent Bit event: [time, record] or, since
+// Fluent Bit 2.1, [[time, metadata], record]. Fluent Bit's http output with
+// format msgpack sends a concatenation of such events.
+func decodeMsgpack(body io.Reader) ([]map[string]interface{}, error) {
+	decoder := msgpack.NewDecoder(bufio.NewReader(body))
+	decoder.UseLooseInterfaceDecoding(true)
+
+	var logs []map[string]interface{}
+	for {
+		value, err := decoder.DecodeInterface()
+		if errors.Is(err, io.EOF) {
+			return logs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			entry, err := forward.Entry(nil, v)
+			if err != nil {
+				return nil, err
+			}
+			logs = append(logs, entry)
+		case []interface{}:
+			entries, err := msgpackArray(v)
+			if err != nil {
+				return nil, err
+			}
+			logs = append(logs, entries...)
+		default:
+			return nil, fmt.Errorf("msgpack value is not a map or array")
+		}
+	}
+}
+
+// msgpackArray decodes an array holding one Fluent Bit event or a batch of
+// entries and events.
+func msgpackArray(values []interface{}) ([]map[string]interface{}, error) {
+	if len(values) == 2 {
+		_, timeIsMap := values[0].(map[string]interface{})
+		if record, ok := values[1].(map[string]interface{}); ok && !timeIsMap {
+			eventTime := values[0]
+			if header, ok := eventTime.([]interface{}); ok && len(header) > 0 {
+				eventTime = header[0]
+			}
+			entry, err := forward.Entry(eventTime, record)
+			if err != nil {
+				return nil, err
+			}
+			return []map[string]interface{}{entry}, nil
+		}
+	}
+
+	entries := make([]map[string]interface{}, 0, len(values))
+	for _, value := range values {
+		if event, ok := value.([]interface{}); ok {
+			eventEntries, err := msgpackArray(event)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, eventEntries...)
+			continue
+		}
+		entry, err := forward.Entry(nil, value)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// decodeNDJSON reads one JSON object per line. Lines that are not valid JSON
+// objects are counted in malformed instead of failing the batch; blank lines
+// are ignored. Only a read error aborts decoding.
+func decodeNDJSON(body io.Reader) (logs []map[string]interface{}, malformed int, err error) {
+	reader := bufio.NewReader(body)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var entry map[string]interface{}
+			if json.Unmarshal(line, &entry) == nil && entry != nil {
+				logs = append(logs, entry)
+			} else {
+				malformed++
+			}
+		}
+		if readErr == io.EOF {
+			return logs, malformed, nil
+		}
+		if readErr != nil {
+			return nil, 0, readErr
+		}
+	}
+}
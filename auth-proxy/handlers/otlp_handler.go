@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"auth-proxy/auth"
+	"auth-proxy/middleware"
+	"auth-proxy/otlp"
+	"auth-proxy/policy"
+	"auth-proxy/storage"
+
+	collectorlogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// OTLPHandler receives OTLP/HTTP log exports so OpenTelemetry Collectors and
+// SDKs can send to the proxy without a custom exporter.
+type OTLPHandler struct {
+	storage    storage.LogStorage
+	authorizer policy.Authorizer
+}
+
+func NewOTLPHandler(storage storage.LogStorage, authorizer policy.Authorizer) *OTLPHandler {
+	return &OTLPHandler{storage: storage, authorizer: authorizer}
+}
+
+// ServeHTTP accepts application/x-protobuf and application/json bodies and
+// answers in the same encoding, reporting skipped records as a partial
+// success as the OTLP specification requires.
+func (h *OTLPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		middleware.Error(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := r.Context().Value(middleware.ClaimsContextKey).(*auth.Claims)
+	if !ok {
+		middleware.AuditRejection(r, http.StatusUnauthorized, "missing_claims", nil)
+		middleware.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-protobuf" && mediaType != "application/json" {
+		middleware.Error(w, r, "Unsupported Content-Type, expected application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	defer r.Body.Close()
+	data, err := io.ReadAll(r.Body)
+	if errors.Is(err, middleware.ErrBodyTooLarge) {
+		middleware.Error(w, r, "Request entity too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		middleware.Error(w, r, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	var req *collectorlogs.ExportLogsServiceRequest
+	if mediaType == "application/json" {
+		req, err = otlp.DecodeJSON(data)
+	} else {
+		req, err = otlp.DecodeProtobuf(data)
+	}
+	if err != nil {
+		middleware.Error(w, r, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	logs := otlp.Entries(req)
+	if !authorizeBatch(h.authorizer, w, r, claims, int64(len(data)), logs) {
+		return
+	}
+
+	resp := &collectorlogs.ExportLogsServiceResponse{}
+	if len(logs) > 0 {
+		if err := h.storage.StoreLogs(r.Context(), claims.GetAccountID(), logs); err != nil {
+			var skippedErr *storage.SkippedEntriesError
+			var tooLarge *storage.BatchTooLargeError
+			if errors.As(err, &tooLarge) {
+				// Exporters do not retry 413, so the batch is not resent as is.
+				middleware.Error(w, r, tooLarge.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			if !errors.As(err, &skippedErr) {
+				// 429 and 503 tell OTLP exporters the export may be retried.
+				if status := setRetryAfter(w, err); status == http.StatusTooManyRequests {
+					middleware.Error(w, r, err.Error(), status)
+					return
+				}
+				logger.ErrorContext(r.Context(), "failed to store logs", "source", "otlp", "account_id", claims.GetAccountID(), "error", err)
+				middleware.Error(w, r, "Service unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			logger.WarnContext(r.Context(), "stored logs with warnings", "source", "otlp", "account_id", claims.GetAccountID(), "error", err)
+			resp.PartialSuccess = &collectorlogs.ExportLogsPartialSuccess{
+				RejectedLogRecords: int64(skippedErr.Count()),
+				ErrorMessage:       skippedErr.Summary(),
+			}
+		}
+	}
+
+	var body []byte
+	if mediaType == "application/json" {
+		body, err = protojson.Marshal(resp)
+	} else {
+		body, err = proto.Marshal(resp)
+	}
+	if err != nil {
+		middleware.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
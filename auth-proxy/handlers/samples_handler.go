@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"auth-proxy/auth"
+	"auth-proxy/middleware"
+	"auth-proxy/storage"
+)
+
+type SamplesHandler struct {
+	provider storage.SampleProvider
+}
+
+func NewSamplesHandler(provider storage.SampleProvider) *SamplesHandler {
+	return &SamplesHandler{provider: provider}
+}
+
+// ServeHTTP returns the sampled documents for the index given in the query
+// string. Admins see every tenant's documents; should the handler ever be
+// mounted behind tenant auth, only that tenant's documents are shown.
+func (h *SamplesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		middleware.Error(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	index := r.URL.Query().Get("index")
+	if index == "" {
+		middleware.Error(w, r, "index is required", http.StatusBadRequest)
+		return
+	}
+
+	samples := h.provider.Samples(index)
+	if claims, ok := r.Context().Value(middleware.ClaimsContextKey).(*auth.Claims); ok {
+		accountID := claims.GetAccountID()
+		filtered := samples[:0]
+		for _, sample := range samples {
+			if sample.AccountID == accountID {
+				filtered = append(filtered, sample)
+			}
+		}
+		samples = filtered
+	}
+	if samples == nil {
+		samples = []storage.Sample{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"index":   index,
+		"samples": samples,
+	})
+}
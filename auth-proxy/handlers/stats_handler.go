@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"auth-proxy/storage"
+)
+
+type StatsHandler struct {
+	provider storage.IndexerStatsProvider
+}
+
+func NewStatsHandler(provider storage.IndexerStatsProvider) *StatsHandler {
+	return &StatsHandler{provider: provider}
+}
+
+// ServeHTTP returns the bulk indexer counters. Unlike /health it does not
+// contact the cluster, so it is cheap to poll.
+func (h *StatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"indexer": h.provider.IndexerStats(),
+	})
+}
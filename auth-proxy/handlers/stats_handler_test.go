@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"auth-proxy/storage"
+)
+
+type fixedStats storage.IndexerStats
+
+func (f fixedStats) IndexerStats() storage.IndexerStats {
+	return storage.IndexerStats(f)
+}
+
+func TestStatsHandler(t *testing.T) {
+	h := NewStatsHandler(fixedStats{NumAdded: 5, NumFlushed: 4, NumFailed: 1, NumRequests: 2})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var resp struct {
+		Indexer storage.IndexerStats `json:"indexer"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode stats response: %v", err)
+	}
+	if rec.Code != http.StatusOK || resp.Indexer.NumAdded != 5 || resp.Indexer.NumFailed != 1 || resp.Indexer.NumRequests != 2 {
+		t.Errorf("stats = %d %+v", rec.Code, resp.Indexer)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/stats", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /stats = %d, want 405", rec.Code)
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	h := NewVersionHandler(Features{Backends: []string{"elasticsearch"}, Listeners: []string{"http", "syslog"}})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	var resp struct {
+		Commit    string   `json:"commit"`
+		GoVersion string   `json:"go_version"`
+		Features  Features `json:"features"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode version response: %v", err)
+	}
+	if rec.Code != http.StatusOK || resp.Commit == "" || resp.GoVersion == "" {
+		t.Errorf("version = %d %+v", rec.Code, resp)
+	}
+	if len(resp.Features.Listeners) != 2 || resp.Features.Backends[0] != "elasticsearch" {
+		t.Errorf("features = %+v, want the configured backends and listeners", resp.Features)
+	}
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"auth-proxy/auth"
+	"auth-proxy/middleware"
+)
+
+type TokenRefreshHandler struct {
+	issuer *auth.TokenIssuer
+}
+
+type tokenResponse struct {
+	Token     string `json:"token"`
+	TokenType string `json:"tokenType"`
+	ExpiresAt int64  `json:"expiresAt"`
+	ExpiresIn int64  `json:"expiresIn"`
+}
+
+func NewTokenRefreshHandler(issuer *auth.TokenIssuer) *TokenRefreshHandler {
+	return &TokenRefreshHandler{issuer: issuer}
+}
+
+// ServeHTTP exchanges the caller's credential for a new short-lived token
+// with the same account, subject and scopes. An optional ?ttl= duration asks
+// for a shorter lifetime than the configured maximum; the new token never
+// outlives the credential it was refreshed from.
+func (h *TokenRefreshHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		middleware.Error(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := r.Context().Value(middleware.ClaimsContextKey).(*auth.Claims)
+	if !ok {
+		middleware.AuditRejection(r, http.StatusUnauthorized, "missing_claims", nil)
+		middleware.Error(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var ttl time.Duration
+	if raw := r.URL.Query().Get("ttl"); raw != "" {
+		var err error
+		if ttl, err = time.ParseDuration(raw); err != nil || ttl <= 0 {
+			middleware.Error(w, r, "ttl must be a positive duration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	issued, err := h.issuer.Issue(claims, ttl)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "failed to issue token", "account_id", claims.GetAccountID(), "error", err)
+		middleware.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokenResponse{
+		Token:     issued.Token,
+		TokenType: "Bearer",
+		ExpiresAt: issued.ExpiresAt.Unix(),
+		ExpiresIn: int64(time.Until(issued.ExpiresAt).Round(time.Second) / time.Second),
+	})
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"auth-proxy/version"
+)
+
+// Features lists what a deployment has enabled, for /version.
+type Features struct {
+	Backends    []string `json:"backends"`
+	Listeners   []string `json:"listeners"`
+	AuthMethods []string `json:"auth_methods"`
+	Tracing     bool     `json:"tracing"`
+	Metrics     bool     `json:"metrics"`
+}
+
+type VersionHandler struct {
+	features Features
+}
+
+func NewVersionHandler(features Features) *VersionHandler {
+	return &VersionHandler{features: features}
+}
+
+// ServeHTTP returns the build and enabled features, so operators can check
+// what each instance is running.
+func (h *VersionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(struct {
+		version.Info
+		Features Features `json:"features"`
+	}{version.Get(), h.features})
+}
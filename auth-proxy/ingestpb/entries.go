@@ -0,0 +1,42 @@
+// Package ingestpb defines the native LogIngest gRPC API. ingest.pb.go and
+// ingest_grpc.pb.go are generated from ingest.proto.
+package ingestpb
+
+//go:generate protoc -I .. --go_out=.. --go_opt=paths=source_relative --go-grpc_out=.. --go-grpc_opt=paths=source_relative ../ingestpb/ingest.proto
+
+import (
+	"strings"
+	"time"
+)
+
+// Entries converts the typed entries of req into the log entries accepted
+// by storage.LogStorage. The container becomes container_name so index
+// routing works as it does for Fluent Bit payloads.
+func Entries(req *IngestRequest) []map[string]interface{} {
+	entries := make([]map[string]interface{}, 0, len(req.GetEntries()))
+	for _, logEntry := range req.GetEntries() {
+		entry := map[string]interface{}{}
+		if ts := logEntry.GetTimestamp(); ts != nil {
+			entry["timestamp"] = ts.AsTime().UTC().Format(time.RFC3339Nano)
+		}
+		if severity := logEntry.GetSeverity(); severity != Severity_SEVERITY_UNSPECIFIED {
+			entry["severity"] = strings.ToLower(strings.TrimPrefix(severity.String(), "SEVERITY_"))
+			entry["severity_number"] = int32(severity)
+		}
+		if logEntry.GetMessage() != "" {
+			entry["message"] = logEntry.GetMessage()
+		}
+		if attributes := logEntry.GetAttributes(); len(attributes) > 0 {
+			fields := make(map[string]interface{}, len(attributes))
+			for key, value := range attributes {
+				fields[key] = value
+			}
+			entry["attributes"] = fields
+		}
+		if logEntry.GetContainer() != "" {
+			entry["container_name"] = logEntry.GetContainer()
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
@@ -0,0 +1,240 @@
+// Package kafka consumes log batches from Kafka topics as an alternative to
+// the HTTP ingestion path.
+package kafka
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"auth-proxy/logging"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+var logger = logging.Component("kafka")
+
+const (
+	// pollRecords caps how many records are processed between commits.
+	pollRecords = 1000
+	// maxRetryBackoff caps the wait between attempts at a failing record.
+	maxRetryBackoff = 30 * time.Second
+)
+
+// Options configures a Consumer or Producer. Group, Topics and
+// TopicPattern only apply to consumers.
+type Options struct {
+	Brokers []string
+	Group   string
+	// Topics lists the topics to consume. With TopicPattern set, each entry
+	// is a regular expression matched against every topic in the cluster.
+	Topics       []string
+	TopicPattern bool
+	// TLS enables TLS to the brokers when not nil.
+	TLS *tls.Config
+	// SASLMechanism is "plain", "scram-sha-256" or "scram-sha-512", or empty
+	// to disable SASL.
+	SASLMechanism string
+	SASLUsername  string
+	SASLPassword  string
+}
+
+// Record is a consumed Kafka message.
+type Record struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Headers   map[string]string
+	Value     []byte
+}
+
+// Handler processes one record. A returned error is retried with backoff
+// and blocks the record's partition until it succeeds, so records that can
+// never succeed should be logged and dropped by returning nil.
+type Handler func(ctx context.Context, record *Record) error
+
+// Consumer reads records as a member of a consumer group and commits each
+// record's offset only after its Handler succeeded.
+type Consumer struct {
+	client  *kgo.Client
+	handler Handler
+}
+
+// NewConsumer connects a consumer group member. Records are not consumed
+// until Run is called.
+func NewConsumer(opts Options, handler Handler) (*Consumer, error) {
+	if len(opts.Brokers) == 0 || opts.Group == "" || len(opts.Topics) == 0 {
+		return nil, fmt.Errorf("kafka consumer needs brokers, a group and topics")
+	}
+	kopts, err := clientOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	kopts = append(kopts,
+		kgo.ConsumerGroup(opts.Group),
+		kgo.ConsumeTopics(opts.Topics...),
+		kgo.AutoCommitMarks(),
+		kgo.BlockRebalanceOnPoll(),
+		kgo.OnPartitionsRevoked(func(ctx context.Context, client *kgo.Client, _ map[string][]int32) {
+			if err := client.CommitMarkedOffsets(ctx); err != nil {
+				logger.Warn("failed to commit kafka offsets on rebalance", "error", err)
+			}
+		}),
+	)
+	if opts.TopicPattern {
+		kopts = append(kopts, kgo.ConsumeRegex())
+	}
+
+	client, err := kgo.NewClient(kopts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kafka client: %w", err)
+	}
+	return &Consumer{client: client, handler: handler}, nil
+}
+
+// clientOpts returns the broker, TLS and SASL options shared by consumers
+// and producers.
+func clientOpts(opts Options) ([]kgo.Opt, error) {
+	kopts := []kgo.Opt{kgo.SeedBrokers(opts.Brokers...)}
+	if opts.TLS != nil {
+		kopts = append(kopts, kgo.DialTLSConfig(opts.TLS))
+	}
+	switch strings.ToLower(opts.SASLMechanism) {
+	case "":
+	case "plain":
+		kopts = append(kopts, kgo.SASL(plain.Auth{User: opts.SASLUsername, Pass: opts.SASLPassword}.AsMechanism()))
+	case "scram-sha-256":
+		kopts = append(kopts, kgo.SASL(scram.Auth{User: opts.SASLUsername, Pass: opts.SASLPassword}.AsSha256Mechanism()))
+	case "scram-sha-512":
+		kopts = append(kopts, kgo.SASL(scram.Auth{User: opts.SASLUsername, Pass: opts.SASLPassword}.AsSha512Mechanism()))
+	default:
+		return nil, fmt.Errorf("unsupported kafka SASL mechanism %q", opts.SASLMechanism)
+	}
+	return kopts, nil
+}
+
+// TLSConfig returns the TLS configuration for brokers, verified against the
+// CA certificates in caFile or the system roots when caFile is empty.
+func TLSConfig(caFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read kafka CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in kafka CA file")
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// Run consumes until ctx is done or the consumer is closed.
+func (c *Consumer) Run(ctx context.Context) error {
+	for {
+		fetches := c.client.PollRecords(ctx, pollRecords)
+		if fetches.IsClientClosed() || ctx.Err() != nil {
+			return ctx.Err()
+		}
+		fetches.EachError(func(topic string, partition int32, err error) {
+			logger.Warn("kafka fetch error", "topic", topic, "partition", partition, "error", err)
+		})
+
+		var done []*kgo.Record
+		fetches.EachRecord(func(r *kgo.Record) {
+			if ctx.Err() != nil {
+				return
+			}
+			if c.process(ctx, r) {
+				done = append(done, r)
+			}
+		})
+		c.client.MarkCommitRecords(done...)
+		c.client.AllowRebalance()
+	}
+}
+
+// process calls the handler until it succeeds or ctx is done.
+func (c *Consumer) process(ctx context.Context, r *kgo.Record) bool {
+	record := &Record{
+		Topic:     r.Topic,
+		Partition: r.Partition,
+		Offset:    r.Offset,
+		Headers:   make(map[string]string, len(r.Headers)),
+		Value:     r.Value,
+	}
+	for _, header := range r.Headers {
+		record.Headers[strings.ToLower(header.Key)] = string(header.Value)
+	}
+
+	backoff := time.Second
+	for {
+		err := c.handler(ctx, record)
+		if err == nil {
+			return true
+		}
+		logger.Warn("retrying kafka record", "topic", r.Topic, "partition", r.Partition, "offset", r.Offset, "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// Close commits processed offsets and leaves the consumer group.
+func (c *Consumer) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.client.CommitMarkedOffsets(ctx); err != nil {
+		logger.Warn("failed to commit kafka offsets", "error", err)
+	}
+	c.client.Close()
+}
+
+// DecodeEntries parses a record value holding a JSON array of entries, or
+// one JSON object per line. Lines that are not JSON objects are counted in
+// malformed.
+func DecodeEntries(value []byte) (entries []map[string]interface{}, malformed int, err error) {
+	value = bytes.TrimSpace(value)
+	if len(value) > 0 && value[0] == '[' {
+		if err := json.Unmarshal(value, &entries); err != nil {
+			return nil, 0, fmt.Errorf("invalid JSON array: %w", err)
+		}
+		return entries, 0, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(value))
+	scanner.Buffer(nil, len(value)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var entry map[string]interface{}
+		if json.Unmarshal(line, &entry) == nil && entry != nil {
+			entries = append(entries, entry)
+		} else {
+			malformed++
+		}
+	}
+	if len(entries) == 0 && malformed > 0 {
+		return nil, malformed, errors.New("no valid lines")
+	}
+	return entries, malformed, nil
+}
@@ -0,0 +1,67 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// produceTimeout bounds how long a message is retried before Produce fails,
+// so callers without a deadline do not block while brokers are down.
+const produceTimeout = 30 * time.Second
+
+// Message is a record to publish.
+type Message struct {
+	Topic   string
+	Key     []byte
+	Headers map[string]string
+	Value   []byte
+}
+
+// Producer publishes messages and waits for the brokers to acknowledge them.
+type Producer struct {
+	client *kgo.Client
+}
+
+// NewProducer connects a producer. Topics that do not exist are created when
+// the brokers allow automatic topic creation.
+func NewProducer(opts Options) (*Producer, error) {
+	if len(opts.Brokers) == 0 {
+		return nil, fmt.Errorf("kafka producer needs brokers")
+	}
+	kopts, err := clientOpts(opts)
+	if err != nil {
+		return nil, err
+	}
+	kopts = append(kopts, kgo.AllowAutoTopicCreation(), kgo.RecordDeliveryTimeout(produceTimeout))
+
+	client, err := kgo.NewClient(kopts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kafka client: %w", err)
+	}
+	return &Producer{client: client}, nil
+}
+
+// Produce publishes messages and returns the first failure once every
+// message was acknowledged or failed.
+func (p *Producer) Produce(ctx context.Context, messages []Message) error {
+	records := make([]*kgo.Record, 0, len(messages))
+	for _, message := range messages {
+		record := &kgo.Record{Topic: message.Topic, Key: message.Key, Value: message.Value}
+		for key, value := range message.Headers {
+			record.Headers = append(record.Headers, kgo.RecordHeader{Key: key, Value: []byte(value)})
+		}
+		records = append(records, record)
+	}
+	if err := p.client.ProduceSync(ctx, records...).FirstErr(); err != nil {
+		return fmt.Errorf("failed to produce to kafka: %w", err)
+	}
+	return nil
+}
+
+// Close flushes buffered messages and disconnects.
+func (p *Producer) Close() {
+	p.client.Close()
+}
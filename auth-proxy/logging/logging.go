@@ -0,0 +1,130 @@
+// Package logging configures the proxy's structured logger. Every package
+// logs through log/slog; Setup picks the level and output format, and
+// Component tags a package's records with where they came from.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Audit logs security decisions, such as rejected credentials, under the
+// "audit" component so they can be routed and retained separately.
+var Audit = Component("audit")
+
+// Setup makes slog.Default write records at level or above to w, as
+// logfmt-style "text" or "json". Output of the standard log package goes
+// through the same handler at the info level. Records logged with a context
+// carrying a request ID are tagged request_id.
+func Setup(w io.Writer, level, format string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format %q, want text or json", format)
+	}
+	slog.SetDefault(slog.New(requestIDHandler{handler}))
+	return nil
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID ctx carries, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Detach returns a context that is never canceled and only keeps what ctx
+// carries for logging: its request ID, and whether its records are kept
+// from being shipped. Callbacks that run after a request log with it.
+func Detach(ctx context.Context) context.Context {
+	detached := WithRequestID(context.Background(), RequestID(ctx))
+	if ctx.Value(shippingKey{}) != nil {
+		detached = context.WithValue(detached, shippingKey{}, true)
+	}
+	return detached
+}
+
+// requestIDHandler adds the request ID of the context to every record
+// logged with one.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// Component returns a logger that adds component=name to its records. It
+// writes through whatever slog.Default is when it logs, so package-level
+// loggers created before Setup runs follow it.
+func Component(name string) *slog.Logger {
+	return slog.New(&deferredHandler{
+		wrap: []func(slog.Handler) slog.Handler{
+			func(h slog.Handler) slog.Handler { return h.WithAttrs([]slog.Attr{slog.String("component", name)}) },
+		},
+	})
+}
+
+// deferredHandler applies its attributes and groups, in the order they
+// were added, to the default handler at the time of each call.
+type deferredHandler struct {
+	wrap []func(slog.Handler) slog.Handler
+}
+
+func (h *deferredHandler) handler() slog.Handler {
+	next := slog.Default().Handler()
+	for _, wrap := range h.wrap {
+		next = wrap(next)
+	}
+	return next
+}
+
+func (h *deferredHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return slog.Default().Handler().Enabled(ctx, level)
+}
+
+func (h *deferredHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler().Handle(ctx, r)
+}
+
+func (h *deferredHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *deferredHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *deferredHandler) with(wrap func(slog.Handler) slog.Handler) *deferredHandler {
+	return &deferredHandler{wrap: append(append([]func(slog.Handler) slog.Handler{}, h.wrap...), wrap)}
+}
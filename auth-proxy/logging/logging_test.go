@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSetup(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	logger := Component("test")
+	var buf bytes.Buffer
+	if err := Setup(&buf, "warn", "json"); err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	logger.Info("dropped")
+	logger.With("account_id", "7").Warn("kept", "error", "boom")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("logged %d lines, want only the warning: %q", len(lines), buf.String())
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("record is not JSON: %v", err)
+	}
+	for key, want := range map[string]string{"level": "WARN", "msg": "kept", "component": "test", "account_id": "7", "error": "boom"} {
+		if record[key] != want {
+			t.Errorf("record[%q] = %v, want %q", key, record[key], want)
+		}
+	}
+}
+
+func TestSetupTagsRequestID(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	var buf bytes.Buffer
+	if err := Setup(&buf, "info", "text"); err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	ctx := WithRequestID(context.Background(), "req-9")
+	Component("test").InfoContext(ctx, "stored")
+	if !strings.Contains(buf.String(), "request_id=req-9") {
+		t.Errorf("record %q does not carry the request ID", buf.String())
+	}
+}
+
+func TestSetupRejectsInvalidSettings(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	if err := Setup(&bytes.Buffer{}, "loud", "text"); err == nil {
+		t.Error("Setup() accepted level \"loud\"")
+	}
+	if err := Setup(&bytes.Buffer{}, "info", "xml"); err == nil {
+		t.Error("Setup() accepted format \"xml\"")
+	}
+}
@@ -0,0 +1,194 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var logger = Component("logging")
+
+// Sink stores log records as documents. storage.LogStorage implementations
+// satisfy it.
+type Sink interface {
+	StoreLogs(ctx context.Context, accountID string, logs []map[string]interface{}) error
+}
+
+// ShipOptions configures Ship.
+type ShipOptions struct {
+	// Rate is the most records shipped per second; the rest are dropped.
+	Rate int
+	// FlushInterval is how often buffered records are passed to the sink.
+	FlushInterval time.Duration
+}
+
+// shipBufferSize is the most records waiting to be passed to the sink.
+const shipBufferSize = 1024
+
+type shippingKey struct{}
+
+// Ship makes slog.Default also send its records at the info level or above
+// to sink, as the documents the JSON format would print. Records are sent
+// in the background and dropped over opts.Rate or while the sink falls
+// behind, so logging never waits on it. Records logged while the sink
+// stores a batch are not shipped, which would feed on itself. The returned
+// function restores the previous default logger and sends what is
+// buffered.
+func Ship(sink Sink, opts ShipOptions) (stop func()) {
+	s := &shipper{
+		sink:    sink,
+		rate:    opts.Rate,
+		records: make(chan []byte, shipBufferSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	previous := slog.Default()
+	doc := slog.NewJSONHandler(s, &slog.HandlerOptions{Level: slog.LevelInfo})
+	slog.SetDefault(slog.New(shipHandler{
+		next:    previous.Handler(),
+		doc:     requestIDHandler{doc},
+		shipper: s,
+	}))
+	go s.run(opts.FlushInterval)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			slog.SetDefault(previous)
+			close(s.done)
+			<-s.stopped
+		})
+	}
+}
+
+// shipper buffers the records written to it by a JSON handler, one per
+// Write, and passes them to the sink in batches.
+type shipper struct {
+	sink    Sink
+	rate    int
+	records chan []byte
+	dropped atomic.Uint64
+
+	mu          sync.Mutex
+	windowStart time.Time
+	shipped     int
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// allow reports whether another record fits in the rate of the current
+// second.
+func (s *shipper) allow() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.windowStart) >= time.Second {
+		s.windowStart = now
+		s.shipped = 0
+	}
+	if s.shipped >= s.rate {
+		return false
+	}
+	s.shipped++
+	return true
+}
+
+func (s *shipper) Write(p []byte) (int, error) {
+	record := make([]byte, len(p))
+	copy(record, p)
+	select {
+	case s.records <- record:
+	default:
+		s.dropped.Add(1)
+	}
+	return len(p), nil
+}
+
+func (s *shipper) run(flushInterval time.Duration) {
+	defer close(s.stopped)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	var batch []map[string]interface{}
+	for {
+		select {
+		case record := <-s.records:
+			batch = s.appendRecord(batch, record)
+			if len(batch) >= shipBufferSize {
+				batch = s.flush(batch)
+			}
+		case <-ticker.C:
+			batch = s.flush(batch)
+		case <-s.done:
+			for {
+				select {
+				case record := <-s.records:
+					batch = s.appendRecord(batch, record)
+				default:
+					s.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *shipper) appendRecord(batch []map[string]interface{}, record []byte) []map[string]interface{} {
+	var document map[string]interface{}
+	if err := json.Unmarshal(record, &document); err != nil {
+		s.dropped.Add(1)
+		return batch
+	}
+	return append(batch, document)
+}
+
+// flush passes batch to the sink and returns it emptied for reuse.
+func (s *shipper) flush(batch []map[string]interface{}) []map[string]interface{} {
+	ctx := context.WithValue(context.Background(), shippingKey{}, true)
+	if dropped := s.dropped.Swap(0); dropped > 0 {
+		logger.WarnContext(ctx, "dropped service log records", "dropped", dropped, "rate", s.rate)
+	}
+	if len(batch) == 0 {
+		return batch
+	}
+	if err := s.sink.StoreLogs(ctx, "", batch); err != nil {
+		logger.WarnContext(ctx, "failed to ship service logs", "records", len(batch), "error", err)
+	}
+	return batch[:0]
+}
+
+// shipHandler writes records through next and hands those allowed by the
+// rate to doc, which formats them for the shipper.
+type shipHandler struct {
+	next    slog.Handler
+	doc     slog.Handler
+	shipper *shipper
+}
+
+func (h shipHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h shipHandler) Handle(ctx context.Context, r slog.Record) error {
+	err := h.next.Handle(ctx, r)
+	if !h.doc.Enabled(ctx, r.Level) || ctx.Value(shippingKey{}) != nil {
+		return err
+	}
+	if h.shipper.allow() {
+		_ = h.doc.Handle(ctx, r)
+	} else {
+		h.shipper.dropped.Add(1)
+	}
+	return err
+}
+
+func (h shipHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return shipHandler{next: h.next.WithAttrs(attrs), doc: h.doc.WithAttrs(attrs), shipper: h.shipper}
+}
+
+func (h shipHandler) WithGroup(name string) slog.Handler {
+	return shipHandler{next: h.next.WithGroup(name), doc: h.doc.WithGroup(name), shipper: h.shipper}
+}
@@ -0,0 +1,56 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeSink struct {
+	mu        sync.Mutex
+	documents []map[string]interface{}
+}
+
+func (s *fakeSink) StoreLogs(ctx context.Context, accountID string, logs []map[string]interface{}) error {
+	// Logged while storing, so it must not be shipped back.
+	slog.InfoContext(ctx, "storing service logs")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.documents = append(s.documents, logs...)
+	return nil
+}
+
+func TestShip(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+
+	var buf bytes.Buffer
+	if err := Setup(&buf, "debug", "text"); err != nil {
+		t.Fatal(err)
+	}
+	sink := &fakeSink{}
+	stop := Ship(sink, ShipOptions{Rate: 2, FlushInterval: time.Hour})
+
+	logger := Component("test")
+	logger.Debug("below the shipped level")
+	logger.InfoContext(WithRequestID(context.Background(), "abc"), "first")
+	logger.Warn("second", "account_id", "7")
+	logger.Warn("over the rate")
+	stop()
+
+	if len(sink.documents) != 2 {
+		t.Fatalf("shipped %d records, want 2: %v", len(sink.documents), sink.documents)
+	}
+	first, second := sink.documents[0], sink.documents[1]
+	if first["msg"] != "first" || first["component"] != "test" || first["request_id"] != "abc" {
+		t.Errorf("first record = %v", first)
+	}
+	if second["msg"] != "second" || second["level"] != "WARN" || second["account_id"] != "7" {
+		t.Errorf("second record = %v", second)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("over the rate")) {
+		t.Errorf("records over the rate must still be written, got %q", buf.String())
+	}
+}
@@ -0,0 +1,284 @@
+// Package loki decodes Grafana Loki push requests, as sent by Promtail and
+// other Loki clients, into the log entries accepted by storage.LogStorage.
+package loki
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Stream is a set of entries sharing one label set.
+type Stream struct {
+	Labels  map[string]string
+	Entries []Entry
+}
+
+// Entry is one log line of a stream.
+type Entry struct {
+	Timestamp time.Time
+	Line      string
+	// Metadata holds the entry's structured metadata, if any.
+	Metadata map[string]string
+}
+
+// DecodeProtobuf parses a snappy-compressed logproto.PushRequest. The
+// message is decoded field by field so the proxy does not depend on Loki's
+// own packages. maxBytes caps the decompressed size.
+func DecodeProtobuf(data []byte, maxBytes int64) ([]Stream, error) {
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy payload: %w", err)
+	}
+	if int64(n) > maxBytes {
+		return nil, fmt.Errorf("decompressed push request exceeds %d bytes", maxBytes)
+	}
+	raw, err := snappy.Decode(nil, data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy payload: %w", err)
+	}
+
+	var streams []Stream
+	err = walk(raw, func(num protowire.Number, value []byte) error {
+		if num != 1 {
+			return nil
+		}
+		stream, err := decodeStream(value)
+		if err != nil {
+			return err
+		}
+		streams = append(streams, stream)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid Loki push request: %w", err)
+	}
+	return streams, nil
+}
+
+func decodeStream(data []byte) (Stream, error) {
+	var stream Stream
+	err := walk(data, func(num protowire.Number, value []byte) error {
+		switch num {
+		case 1:
+			labels, err := ParseLabels(string(value))
+			if err != nil {
+				return err
+			}
+			stream.Labels = labels
+		case 2:
+			entry, err := decodeEntry(value)
+			if err != nil {
+				return err
+			}
+			stream.Entries = append(stream.Entries, entry)
+		}
+		return nil
+	})
+	return stream, err
+}
+
+func decodeEntry(data []byte) (Entry, error) {
+	var entry Entry
+	err := walk(data, func(num protowire.Number, value []byte) error {
+		switch num {
+		case 1:
+			var seconds, nanos uint64
+			err := walkVarints(value, func(num protowire.Number, v uint64) {
+				switch num {
+				case 1:
+					seconds = v
+				case 2:
+					nanos = v
+				}
+			})
+			if err != nil {
+				return err
+			}
+			entry.Timestamp = time.Unix(int64(seconds), int64(int32(nanos)))
+		case 2:
+			entry.Line = string(value)
+		case 3:
+			var name, labelValue string
+			err := walk(value, func(num protowire.Number, v []byte) error {
+				switch num {
+				case 1:
+					name = string(v)
+				case 2:
+					labelValue = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if entry.Metadata == nil {
+				entry.Metadata = make(map[string]string)
+			}
+			entry.Metadata[name] = labelValue
+		}
+		return nil
+	})
+	return entry, err
+}
+
+// walk calls fn for every length-delimited field of a message and skips
+// the others.
+func walk(data []byte, fn func(num protowire.Number, value []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if typ == protowire.BytesType {
+			value, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if err := fn(num, value); err != nil {
+				return err
+			}
+			data = data[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// walkVarints calls fn for every varint field of a message.
+func walkVarints(data []byte, fn func(num protowire.Number, value uint64)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if typ == protowire.VarintType {
+			value, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			fn(num, value)
+			data = data[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// DecodeJSON parses the JSON push format:
+// {"streams":[{"stream":{...},"values":[["<unix nanos>","<line>",{...}]]}]}
+func DecodeJSON(data []byte) ([]Stream, error) {
+	var req struct {
+		Streams []struct {
+			Stream map[string]string   `json:"stream"`
+			Values [][]json.RawMessage `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, fmt.Errorf("invalid Loki JSON payload: %w", err)
+	}
+
+	streams := make([]Stream, 0, len(req.Streams))
+	for _, s := range req.Streams {
+		stream := Stream{Labels: s.Stream}
+		for _, value := range s.Values {
+			if len(value) < 2 {
+				return nil, fmt.Errorf("invalid Loki JSON payload: value needs a timestamp and a line")
+			}
+			var nanos string
+			var entry Entry
+			if err := json.Unmarshal(value[0], &nanos); err != nil {
+				return nil, fmt.Errorf("invalid Loki JSON timestamp: %w", err)
+			}
+			ts, err := strconv.ParseInt(nanos, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Loki JSON timestamp %q", nanos)
+			}
+			entry.Timestamp = time.Unix(0, ts)
+			if err := json.Unmarshal(value[1], &entry.Line); err != nil {
+				return nil, fmt.Errorf("invalid Loki JSON line: %w", err)
+			}
+			if len(value) > 2 {
+				if err := json.Unmarshal(value[2], &entry.Metadata); err != nil {
+					return nil, fmt.Errorf("invalid Loki JSON structured metadata: %w", err)
+				}
+			}
+			stream.Entries = append(stream.Entries, entry)
+		}
+		streams = append(streams, stream)
+	}
+	return streams, nil
+}
+
+// ParseLabels parses a Prometheus label set such as
+// {container="api", namespace="prod"}.
+func ParseLabels(s string) (map[string]string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("invalid label set %q", s)
+	}
+	s = s[1 : len(s)-1]
+	labels := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if s == "" {
+			return labels, nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 || eq+1 >= len(s) || s[eq+1] != '"' {
+			return nil, fmt.Errorf("invalid label set near %q", s)
+		}
+		name := strings.TrimSpace(s[:eq])
+		value, err := strconv.QuotedPrefix(s[eq+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for label %s: %w", name, err)
+		}
+		s = s[eq+1+len(value):]
+		if labels[name], err = strconv.Unquote(value); err != nil {
+			return nil, fmt.Errorf("invalid value for label %s: %w", name, err)
+		}
+	}
+}
+
+// Entries flattens streams into log entries. Labels and structured metadata
+// become fields, the line becomes the message, and the "container" label is
+// copied to container_name so index routing works as it does for Fluent Bit
+// payloads.
+func Entries(streams []Stream) []map[string]interface{} {
+	var entries []map[string]interface{}
+	for _, stream := range streams {
+		for _, e := range stream.Entries {
+			entry := make(map[string]interface{}, len(stream.Labels)+len(e.Metadata)+3)
+			for name, value := range stream.Labels {
+				entry[name] = value
+			}
+			for name, value := range e.Metadata {
+				entry[name] = value
+			}
+			if container := stream.Labels["container"]; container != "" {
+				entry["container_name"] = container
+			}
+			entry["message"] = e.Line
+			entry["timestamp"] = e.Timestamp.UTC().Format(time.RFC3339Nano)
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
@@ -1,55 +1,432 @@
 package main
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"auth-proxy/audit"
 	"auth-proxy/auth"
 	"auth-proxy/config"
+	"auth-proxy/logging"
+	"auth-proxy/secrets"
 	"auth-proxy/server"
 	"auth-proxy/storage"
+	"auth-proxy/tracing"
+	"auth-proxy/version"
 
-	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/joho/godotenv"
 )
 
 func main() {
+	dev := flag.Bool("dev", false, "keep logs in memory and serve them on /dev/logs, for local pipeline testing")
+	replay := flag.Bool("replay-dead-letters", false, "submit the documents in DEAD_LETTER_DIR to storage again, then exit")
+	replaySet := flag.String("replay-set", "", "JSON object of fields to set on every replayed document")
+	replayRemove := flag.String("replay-remove", "", "comma-separated fields to remove from every replayed document")
+	replayRate := flag.Float64("replay-rate", 0, "maximum documents replayed per second, 0 for no limit")
+	flag.Parse()
+
 	_ = godotenv.Load() // loads .env if present, ignore error
+	if *dev {
+		os.Setenv("DEV_MODE", "true")
+	}
 	cfg, err := config.Load()
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		fatal("failed to load config", err)
+	}
+	if err := logging.Setup(os.Stderr, cfg.LogLevel, cfg.LogFormat); err != nil {
+		fatal("invalid LOG_LEVEL or LOG_FORMAT", err)
+	}
+	build := version.Get()
+	slog.Info("starting log ingestion service", "commit", build.Commit, "build_time", build.BuildTime, "go_version", build.GoVersion)
+
+	if err := auth.SetAccountIDFormat(cfg.AccountIDFormat); err != nil {
+		fatal("invalid ACCOUNT_ID_FORMAT", err)
 	}
 
-	// Initialize Elasticsearch client
-	elasticsearchClient, err := elasticsearch.NewClient(elasticsearch.Config{
-		Addresses: []string{cfg.ElasticsearchURL},
-	})
+	auth.SetDefaultScopes(cfg.DefaultScopes)
+
+	stopTracing := func(context.Context) error { return nil }
+	if cfg.Tracing {
+		if stopTracing, err = tracing.Setup(context.Background()); err != nil {
+			fatal("failed to set up tracing", err)
+		}
+	}
+
+	secretStore, err := newSecretStore(cfg)
 	if err != nil {
-		log.Fatalf("Failed to create Elasticsearch client: %v", err)
+		fatal("failed to configure secrets backend", err)
 	}
 
-	// Verify connection to Elasticsearch
-	response, err := elasticsearchClient.Info()
+	tokenIssuer, err := newTokenIssuer(cfg, secretStore)
 	if err != nil {
-		log.Fatalf("Failed to connect to Elasticsearch: %v", err)
+		fatal("failed to load token signing key", err)
+	}
+
+	validator, routeValidators, err := newValidators(cfg, secretStore, tokenIssuer)
+	if err != nil {
+		fatal("failed to create validator", err)
+	}
+
+	tenantStatus, err := newTenantStatus(cfg)
+	if err != nil {
+		fatal("failed to load tenant status", err)
+	}
+
+	logStorage, err := newStorage(cfg)
+	if err != nil {
+		fatal("failed to configure storage", err)
+	}
+	var auditStorage storage.LogStorage
+	if cfg.AuditIndex != "" {
+		if auditStorage, err = newAuditStorage(cfg); err != nil {
+			fatal("failed to configure audit storage", err)
+		}
+		audit.SetSink(auditStorage)
+	}
+
+	if *replay {
+		opts := storage.ReplayOptions{Rate: *replayRate}
+		if *replaySet != "" {
+			if err := json.Unmarshal([]byte(*replaySet), &opts.Set); err != nil {
+				fatal("invalid -replay-set", err)
+			}
+		}
+		if *replayRemove != "" {
+			opts.Remove = strings.Split(*replayRemove, ",")
+		}
+		if err := replayDeadLetters(cfg, logStorage, opts); err != nil {
+			fatal("dead-letter replay failed", err)
+		}
+		return
+	}
+
+	stopShipping := func() {}
+	if cfg.SelfMonitoring {
+		serviceLogs := storage.NewServiceLogStorage(clusterDestination(logStorage), cfg.SelfMonitoringIndex)
+		stopShipping = logging.Ship(serviceLogs, logging.ShipOptions{
+			Rate:          cfg.SelfMonitoringRate,
+			FlushInterval: cfg.BulkFlushInterval,
+		})
+	}
+
+	srv := server.New(cfg, validator, tenantStatus, tokenIssuer, logStorage).RouteValidators(routeValidators)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Start()
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-serveErr:
+		fatal("server failed", err)
+	case sig := <-signals:
+		slog.Info("shutting down", "signal", sig.String(), "timeout", cfg.ShutdownTimeout)
+	}
+	signal.Stop(signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("server did not shut down cleanly", "error", err)
+	}
+	// Stopped before storage closes, so the last records are flushed with it.
+	stopShipping()
+	if err := closeStorage(ctx, logStorage); err != nil {
+		slog.Warn("failed to close storage", "error", err)
+	}
+	if auditStorage != nil {
+		if err := closeStorage(ctx, auditStorage); err != nil {
+			slog.Warn("failed to close audit storage", "error", err)
+		}
+	}
+	// Flushed after storage, so the spans of the last bulk requests are sent.
+	if err := stopTracing(ctx); err != nil {
+		slog.Warn("failed to flush traces", "error", err)
+	}
+	slog.Info("shutdown complete")
+}
+
+// closeStorage closes logStorage, flushing what it holds, and gives up
+// once ctx is done.
+func closeStorage(ctx context.Context, logStorage storage.LogStorage) error {
+	closer, ok := logStorage.(interface{ Close() error })
+	if !ok {
+		return nil
+	}
+	closed := make(chan error, 1)
+	go func() {
+		closed <- closer.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			return fmt.Errorf("failed to flush storage: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("storage did not flush before shutdown: %w", ctx.Err())
+	}
+}
+
+// replayDeadLetters replays DEAD_LETTER_DIR into logStorage, logging
+// progress as it goes, and flushes logStorage before returning.
+func replayDeadLetters(cfg *config.Config, logStorage storage.LogStorage, opts storage.ReplayOptions) error {
+	if cfg.DeadLetterDir == "" {
+		return fmt.Errorf("DEAD_LETTER_DIR is not set")
 	}
-	defer response.Body.Close()
+	replayer := storage.NewDeadLetterReplayer(cfg.DeadLetterDir, logStorage)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				progress := replayer.Progress()
+				slog.Info("replaying dead letters", "replayed", progress.Replayed, "files_done", progress.FilesDone, "files", progress.Files)
+			}
+		}
+	}()
+	err := replayer.Run(context.Background(), opts)
+	close(done)
 
-	if response.IsError() {
-		log.Fatalf("Elasticsearch returned error status: %s", response.Status())
+	progress := replayer.Progress()
+	slog.Info("replayed dead letters", "replayed", progress.Replayed, "files_done", progress.FilesDone, "files", progress.Files, "skipped", progress.Skipped, "malformed", progress.Malformed)
+	if closer, ok := logStorage.(interface{ Close() error }); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
 	}
+	return err
+}
 
-	log.Printf("Connected to Elasticsearch successfully")
+// newSecretStore returns the configured secret store, or nil when keys are
+// only read from the environment and files.
+func newSecretStore(cfg *config.Config) (secrets.Store, error) {
+	switch cfg.SecretsBackend {
+	case "vault":
+		return secrets.NewVault(cfg.VaultAddr, cfg.VaultToken, cfg.VaultNamespace)
+	case "aws":
+		return secrets.NewAWSSecretsManager(cfg.AWSRegion)
+	}
+	return nil, nil
+}
+
+// newTokenIssuer loads the /token/refresh signing key from a file or the
+// secret store. It returns nil when no signing key is configured.
+func newTokenIssuer(cfg *config.Config, store secrets.Store) (*auth.TokenIssuer, error) {
+	switch {
+	case cfg.TokenSigningKeyFile != "":
+		return auth.LoadTokenIssuer(cfg.TokenSigningKeyFile, cfg.TokenSigningKid, cfg.JWTIssuer, cfg.JWTAudience, cfg.TokenMaxTTL)
+	case cfg.TokenSigningKeySecret != "":
+		keyPEM, err := fetchSecret(store, cfg.TokenSigningKeySecret)
+		if err != nil {
+			return nil, err
+		}
+		issuer, err := auth.NewTokenIssuer([]byte(keyPEM), cfg.TokenSigningKid, cfg.JWTIssuer, cfg.JWTAudience, cfg.TokenMaxTTL)
+		if err != nil {
+			return nil, err
+		}
+		go secrets.Watch(store, cfg.TokenSigningKeySecret, cfg.SecretsRefreshInterval, keyPEM, func(value string) error {
+			return issuer.SetKey([]byte(value))
+		})
+		return issuer, nil
+	}
+	return nil, nil
+}
 
-	validator, err := auth.NewJWTValidator(cfg.JWTPublicKey)
+func fetchSecret(store secrets.Store, ref string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	value, err := store.Get(ctx, ref)
 	if err != nil {
-		log.Fatalf("Failed to create validator: %v", err)
+		return "", fmt.Errorf("failed to read secret %s: %w", ref, err)
 	}
+	return value, nil
+}
 
-	logStorage := storage.NewElasticsearchStorage(elasticsearchClient)
+// newValidators builds the validator for /logs from the enabled
+// AUTH_METHODS, and one for every route ROUTE_AUTH_METHODS narrows. Tokens
+// signed by issuer, when not nil, are accepted as JWTs.
+func newValidators(cfg *config.Config, store secrets.Store, issuer *auth.TokenIssuer) (auth.Validator, map[string]auth.Validator, error) {
+	revocations, err := newRevocationList(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	methods := make(map[string]auth.Validator, len(cfg.AuthMethods))
+	for _, method := range cfg.AuthMethods {
+		validator, err := newMethodValidator(cfg, method, store, issuer, revocations)
+		if err != nil {
+			return nil, nil, err
+		}
+		methods[method] = validator
+	}
+	chain := func(names []string) auth.Validator {
+		var validators auth.ChainValidator
+		for _, name := range names {
+			validators = append(validators, methods[name])
+		}
+		var validator auth.Validator = validators
+		if len(validators) == 1 {
+			validator = validators[0]
+		}
+		if cfg.TokenCacheSize > 0 {
+			// Revocations are checked outside the cache so they apply to
+			// cached tokens as well.
+			validator = auth.NewCachedValidator(validator, cfg.TokenCacheSize, cfg.TokenCacheTTL, revocations)
+		}
+		return validator
+	}
+	routes := make(map[string]auth.Validator, len(cfg.RouteAuthMethods))
+	for route, names := range cfg.RouteAuthMethods {
+		routes[route] = chain(names)
+	}
+	return chain(cfg.AuthMethods), routes, nil
+}
 
-	srv := server.New(cfg, validator, logStorage)
+// newMethodValidator builds the validator for one of AUTH_METHODS.
+func newMethodValidator(cfg *config.Config, method string, store secrets.Store, issuer *auth.TokenIssuer, revocations auth.RevocationList) (auth.Validator, error) {
+	switch method {
+	case "jwt":
+		return newJWTValidator(cfg, store, issuer, revocations)
+	case "apikey":
+		return newAPIKeyValidator(cfg)
+	case "introspection":
+		return auth.NewIntrospectionValidator(auth.IntrospectionOptions{
+			URL:          cfg.IntrospectionURL,
+			ClientID:     cfg.IntrospectionClientID,
+			ClientSecret: cfg.IntrospectionClientSecret,
+			Timeout:      cfg.IntrospectionTimeout,
+			CacheTTL:     cfg.IntrospectionCacheTTL,
+			AccountClaim: cfg.IntrospectionAccountClaim,
+		})
+	case "hmac":
+		return auth.NewHMACValidator(cfg.HMACSecrets, cfg.HMACMaxSkew)
+	case "mtls":
+		return auth.NewCertValidator(cfg.MTLSAccountSource, cfg.MTLSURIPrefix)
+	}
+	return nil, fmt.Errorf("unknown auth method %q", method)
+}
 
-	if err := srv.Start(); err != nil {
-		log.Fatalf("Server failed: %v", err)
+// newRevocationList returns the configured list of revoked tokens, or nil
+// when none is configured.
+func newRevocationList(cfg *config.Config) (auth.RevocationList, error) {
+	switch {
+	case cfg.RevocationFile != "":
+		return auth.NewFileRevocationList(cfg.RevocationFile, cfg.RevocationReloadInterval)
+	case cfg.RevocationRedisURL != "":
+		return auth.NewRedisRevocationList(cfg.RevocationRedisURL, cfg.RevocationRedisKey, cfg.RevocationReloadInterval)
 	}
+	return nil, nil
+}
+
+// newTenantStatus returns the configured source of suspended accounts, or nil
+// when none is configured.
+func newTenantStatus(cfg *config.Config) (auth.TenantStatus, error) {
+	switch {
+	case cfg.TenantStatusFile != "":
+		return auth.NewFileTenantStatus(cfg.TenantStatusFile, cfg.TenantStatusRefreshInterval)
+	case cfg.TenantStatusRedisURL != "":
+		return auth.NewRedisTenantStatus(cfg.TenantStatusRedisURL, cfg.TenantStatusRedisKey, cfg.TenantStatusRefreshInterval)
+	case cfg.TenantStatusURL != "":
+		return auth.NewHTTPTenantStatus(cfg.TenantStatusURL, cfg.TenantStatusRefreshInterval, 5*time.Second)
+	}
+	return nil, nil
+}
+
+func newJWTValidator(cfg *config.Config, store secrets.Store, issuer *auth.TokenIssuer, revocations auth.RevocationList) (*auth.JWTValidator, error) {
+	var keySets []auth.KeySet
+	publicKeys := make(map[string]string, len(cfg.JWTPublicKeys)+1)
+	for kid, pem := range cfg.JWTPublicKeys {
+		publicKeys[kid] = pem
+	}
+	if cfg.JWTPublicKey != "" {
+		publicKeys[""] = cfg.JWTPublicKey
+	}
+	if len(publicKeys) > 0 {
+		keySet, err := auth.NewPEMKeySet(publicKeys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load public keys: %w", err)
+		}
+		keySets = append(keySets, keySet)
+	}
+	if cfg.JWTPublicKeySecret != "" {
+		publicKey, err := fetchSecret(store, cfg.JWTPublicKeySecret)
+		if err != nil {
+			return nil, err
+		}
+		keySet, err := auth.NewReloadableKeySet(map[string]string{"": publicKey})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load public key from secret store: %w", err)
+		}
+		go secrets.Watch(store, cfg.JWTPublicKeySecret, cfg.SecretsRefreshInterval, publicKey, func(value string) error {
+			return keySet.Set(map[string]string{"": value})
+		})
+		keySets = append(keySets, keySet)
+	}
+	if cfg.JWKSURL != "" {
+		jwks, err := auth.NewJWKS(cfg.JWKSURL, cfg.JWKSRefreshInterval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load JWKS: %w", err)
+		}
+		keySets = append(keySets, jwks)
+	}
+	if issuer != nil {
+		if !containsString(cfg.JWTAlgorithms, issuer.Algorithm()) {
+			return nil, fmt.Errorf("token signing algorithm %s is not in JWT_ALLOWED_ALGORITHMS", issuer.Algorithm())
+		}
+		keySets = append(keySets, issuer)
+	}
+
+	options := auth.ValidatorOptions{
+		Algorithms:  cfg.JWTAlgorithms,
+		Issuer:      cfg.JWTIssuer,
+		Audience:    cfg.JWTAudience,
+		Leeway:      cfg.JWTLeeway,
+		Revocations: revocations,
+	}
+	return auth.NewJWTValidator(auth.CombineKeySets(keySets...), options)
+}
+
+func newAPIKeyValidator(cfg *config.Config) (*auth.APIKeyValidator, error) {
+	keys := make(map[string]string, len(cfg.APIKeys))
+	for key, account := range cfg.APIKeys {
+		keys[key] = account
+	}
+	if cfg.APIKeysFile != "" {
+		fileKeys, err := auth.LoadAPIKeys(cfg.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		for key, account := range fileKeys {
+			keys[key] = account
+		}
+	}
+	return auth.NewAPIKeyValidator(keys)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// fatal logs err and exits, for failures the proxy cannot start without.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
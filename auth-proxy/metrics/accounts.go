@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// OtherAccounts labels the accounts seen after the cap set by
+// SetMaxAccounts was reached.
+const OtherAccounts = "other"
+
+var (
+	// AccountDocuments counts the log entries storage accepted by account.
+	AccountDocuments = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "account_documents_total",
+		Help:      "Log entries accepted by storage, by account.",
+	}, []string{"account"})
+
+	// AccountBytes counts the bytes of the documents queued for indexing by
+	// account.
+	AccountBytes = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "account_bytes_total",
+		Help:      "Bytes of documents queued for indexing, by account.",
+	}, []string{"account"})
+
+	// AccountRejections counts the log entries storage refused by account
+	// and reason, such as "queue_full" or a skip reason like
+	// "marshal_failed".
+	AccountRejections = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "account_rejections_total",
+		Help:      "Log entries refused by storage, by account and reason.",
+	}, []string{"account", "reason"})
+
+	// AccountIndexFailures counts the documents the cluster failed to index
+	// by account.
+	AccountIndexFailures = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "account_index_failures_total",
+		Help:      "Documents that failed to index, by account.",
+	}, []string{"account"})
+)
+
+// accountLabels tracks the accounts that have a label of their own.
+var accountLabels = struct {
+	sync.Mutex
+	max  int
+	seen map[string]struct{}
+}{max: 1000, seen: make(map[string]struct{})}
+
+// SetMaxAccounts caps how many accounts get labels of their own; the rest
+// are counted under OtherAccounts. Accounts already labelled keep their
+// label. The default is 1000.
+func SetMaxAccounts(n int) {
+	accountLabels.Lock()
+	accountLabels.max = n
+	accountLabels.Unlock()
+}
+
+// Account returns the label value for accountID: the ID itself for the
+// first accounts seen, up to the cap, and OtherAccounts after that.
+func Account(accountID string) string {
+	accountLabels.Lock()
+	defer accountLabels.Unlock()
+	if _, ok := accountLabels.seen[accountID]; ok {
+		return accountID
+	}
+	if len(accountLabels.seen) >= accountLabels.max {
+		return OtherAccounts
+	}
+	accountLabels.seen[accountID] = struct{}{}
+	return accountID
+}
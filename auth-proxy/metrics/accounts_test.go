@@ -0,0 +1,24 @@
+package metrics
+
+import "testing"
+
+func TestAccountCapsLabels(t *testing.T) {
+	SetMaxAccounts(2)
+	defer SetMaxAccounts(1000)
+
+	tests := []struct {
+		accountID string
+		want      string
+	}{
+		{"1", "1"},
+		{"2", "2"},
+		{"3", OtherAccounts},
+		{"1", "1"},
+		{"4", OtherAccounts},
+	}
+	for _, tt := range tests {
+		if got := Account(tt.accountID); got != tt.want {
+			t.Errorf("Account(%s) = %q, want %q", tt.accountID, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// latencyBuckets span a few milliseconds to about a minute, covering both
+// a fast enqueue and a bulk request retried under backpressure.
+var latencyBuckets = prometheus.ExponentialBuckets(0.001, 2, 17)
+
+var (
+	// EnqueueLatency measures the time from receiving a batch until all of
+	// it was handed to the bulk indexer.
+	EnqueueLatency = factory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "enqueue_latency_seconds",
+		Help:      "Time from receiving a batch until it was enqueued for indexing.",
+		Buckets:   latencyBuckets,
+	})
+
+	// AckLatency measures the time from enqueueing a document until
+	// Elasticsearch acknowledged it, by result: "indexed" or "failed".
+	// Retries are included.
+	AckLatency = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "ack_latency_seconds",
+		Help:      "Time from enqueueing a document until Elasticsearch acknowledged it, by result.",
+		Buckets:   latencyBuckets,
+	}, []string{"result"})
+)
+
+type receivedAtKey struct{}
+
+// WithReceivedAt returns a copy of ctx recording that its request was
+// received at t, for EnqueueLatency.
+func WithReceivedAt(ctx context.Context, t time.Time) context.Context {
+	return context.WithValue(ctx, receivedAtKey{}, t)
+}
+
+// ReceivedAt returns the time WithReceivedAt recorded in ctx.
+func ReceivedAt(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(receivedAtKey{}).(time.Time)
+	return t, ok
+}
@@ -0,0 +1,97 @@
+// Package metrics holds the Prometheus metrics the proxy serves on /metrics.
+// Metrics are registered on Registry rather than the global registry, so
+// only the proxy's own metrics and the Go and process collectors are
+// exported.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Namespace prefixes every metric name.
+const Namespace = "log_ingestion"
+
+// Registry holds every metric the proxy exports.
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	// HTTPRequests counts requests by the route that served them, method
+	// and status code.
+	HTTPRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	// HTTPRequestDuration measures requests from the first middleware until
+	// the handler returns.
+	HTTPRequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	// AuthFailures counts requests refused with 401 or 403 by reason, such
+	// as "missing_credentials" or "invalid_token".
+	AuthFailures = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "auth_failures_total",
+		Help:      "Requests refused by authentication or authorization, by reason.",
+	}, []string{"reason"})
+
+	// BatchEntries measures the log entries in each batch handed to storage.
+	BatchEntries = factory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "batch_entries",
+		Help:      "Log entries per batch handed to storage.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 9),
+	})
+
+	// BulkFlushDuration measures the bulk requests the indexers send.
+	BulkFlushDuration = factory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "bulk_flush_duration_seconds",
+		Help:      "Duration of the bulk requests sent to Elasticsearch.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves Registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// RegisterCounterFunc exports a counter whose value is read from value at
+// every scrape, for counters kept elsewhere. Registering a name twice is an
+// error.
+func RegisterCounterFunc(name, help string, value func() float64) error {
+	return Registry.Register(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      name,
+		Help:      help,
+	}, value))
+}
+
+// RegisterGaugeFunc exports a gauge read from value at every scrape.
+func RegisterGaugeFunc(name, help string, value func() float64) error {
+	return Registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      name,
+		Help:      help,
+	}, value))
+}
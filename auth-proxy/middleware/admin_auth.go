@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// AdminAuth protects administrative routes with a static bearer token that
+// lives in its own realm: tenant JWTs, API keys and client certificates are
+// never accepted here, and the admin token is never accepted on /logs.
+func AdminAuth(token string) func(http.Handler) http.Handler {
+	want := sha256.Sum256([]byte(token))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authHeader := r.Header.Get("Authorization")
+			parts := strings.SplitN(authHeader, " ", 2)
+			if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" || parts[1] == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				rejectAuth(w, r, http.StatusUnauthorized, "missing_admin_token", nil)
+				return
+			}
+
+			got := sha256.Sum256([]byte(parts[1]))
+			if subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+				rejectAuth(w, r, http.StatusForbidden, "invalid_admin_token", nil)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"auth-proxy/audit"
+	"auth-proxy/auth"
+)
+
+// AuditRejection records an audit event for r, refused with status for
+// reason. claims identify the credential when known; otherwise they are
+// taken from the context or, unverified, from a JWT the request presented.
+func AuditRejection(r *http.Request, status int, reason string, claims *auth.Claims) {
+	if claims == nil {
+		claims, _ = r.Context().Value(ClaimsContextKey).(*auth.Claims)
+	}
+	if claims == nil {
+		claims = auth.UnverifiedClaims(presentedToken(r))
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	event := audit.Event{
+		Status:     status,
+		Reason:     reason,
+		RemoteAddr: host,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		UserAgent:  r.UserAgent(),
+	}
+	if claims != nil {
+		event.Subject = claims.Subject
+		event.AccountID = claims.GetAccountID()
+	}
+	audit.Record(r.Context(), event)
+}
+
+// presentedToken returns the token in the Authorization header, in any of
+// the schemes AuthMiddleware accepts, or "".
+func presentedToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok {
+		return ""
+	}
+	switch strings.ToLower(scheme) {
+	case "bearer", HECAuthScheme:
+		return token
+	case "basic":
+		_, password, _ := r.BasicAuth()
+		return password
+	}
+	return ""
+}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"auth-proxy/audit"
+)
+
+// capturingSink keeps the audit events it is given.
+type capturingSink struct {
+	mu     sync.Mutex
+	events []map[string]interface{}
+}
+
+func (s *capturingSink) StoreLogs(ctx context.Context, accountID string, logs []map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, logs...)
+	return nil
+}
+
+func TestRejectedRequestsAreAudited(t *testing.T) {
+	sink := &capturingSink{}
+	audit.SetSink(sink)
+	defer audit.SetSink(nil)
+
+	h := RequestIDMiddleware(AuthMiddleware(staticValidator{}, nil)(http.NotFoundHandler()))
+	// The validator refuses the token, but its claims can still be read.
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"agent-7","accountId":42}`))
+	r := httptest.NewRequest(http.MethodPost, "/logs", nil)
+	r.RemoteAddr = "203.0.113.9:52100"
+	r.Header.Set("Authorization", "Bearer e30."+payload+".c2ln")
+	r.Header.Set(RequestIDHeader, "req-3")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", rec.Code)
+	}
+	if len(sink.events) != 1 {
+		t.Fatalf("audit events = %d, want 1", len(sink.events))
+	}
+	event := sink.events[0]
+	want := map[string]interface{}{
+		"status":      http.StatusForbidden,
+		"reason":      "invalid_token",
+		"remote_addr": "203.0.113.9",
+		"subject":     "agent-7",
+		"account_id":  "42",
+		"request_id":  "req-3",
+	}
+	for key, value := range want {
+		if event[key] != value {
+			t.Errorf("audit event %s = %v, want %v", key, event[key], value)
+		}
+	}
+	if event["@timestamp"] == nil {
+		t.Error("audit event has no timestamp")
+	}
+}
+
+func TestAuditWithoutReadableCredential(t *testing.T) {
+	sink := &capturingSink{}
+	audit.SetSink(sink)
+	defer audit.SetSink(nil)
+
+	h := AdminAuth("secret")(http.NotFoundHandler())
+	r := httptest.NewRequest(http.MethodGet, "/admin/samples", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(sink.events) != 1 {
+		t.Fatalf("audit events = %d, want 1", len(sink.events))
+	}
+	event := sink.events[0]
+	if event["reason"] != "invalid_admin_token" || event["subject"] != nil || event["account_id"] != nil {
+		t.Errorf("audit event = %v, want invalid_admin_token without an identity", event)
+	}
+}
@@ -1,40 +1,161 @@
 package middleware
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
 	"net/http"
 	"strings"
 
 	"auth-proxy/auth"
+	"auth-proxy/metrics"
+	"auth-proxy/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type contextKey string
 
 const ClaimsContextKey = contextKey("claims")
 
-func AuthMiddleware(validator auth.Validator) func(http.Handler) http.Handler {
+// APIKeyHeader carries a static API key for agents that cannot send a bearer
+// token.
+const APIKeyHeader = "X-API-Key"
+
+// HECAuthScheme is the Authorization scheme Splunk HEC clients use for
+// their token. It is accepted wherever a bearer token is.
+const HECAuthScheme = "splunk"
+
+// Headers of an HMAC-signed request. SignatureHeader holds the hex
+// HMAC-SHA256 of the timestamp, a ".", and the raw body.
+const (
+	SignatureHeader          = "X-Akto-Signature"
+	SignatureTimestampHeader = "X-Akto-Timestamp"
+	SignatureAccountHeader   = "X-Akto-Account"
+)
+
+// AuthMiddleware authenticates the request and stores its claims in the
+// context. tenants, when not nil, is consulted after authentication so
+// suspended accounts are refused even with an unexpired credential.
+func AuthMiddleware(validator auth.Validator, tenants auth.TenantStatus) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
+		// serve ends the auth span, which rejected requests end on return,
+		// so the handlers' spans are not counted as authentication.
+		serve := func(w http.ResponseWriter, r *http.Request, claims *auth.Claims, span trace.Span) {
+			setAccessLogAccount(r.Context(), claims.GetAccountID())
+			if tenants != nil && tenants.Suspended(r.Context(), claims.AccountID) {
+				rejectAuth(w, r, http.StatusForbidden, "suspended", claims)
+				return
+			}
+			span.SetAttributes(attribute.String("account_id", claims.GetAccountID()))
+			span.End()
+			ctx := context.WithValue(r.Context(), ClaimsContextKey, claims)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			authHeader := r.Header.Get("Authorization")
-			if authHeader == "" {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			_, span := tracing.Tracer("auth-proxy/middleware").Start(r.Context(), "auth")
+			defer span.End()
+
+			// A verified client certificate authenticates the request on its
+			// own; otherwise fall through to the bearer token or API key.
+			if certValidator, ok := validator.(auth.CertificateValidator); ok && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+				if claims, err := certValidator.ValidateCertificate(r.Context(), r.TLS.VerifiedChains[0][0]); err == nil {
+					serve(w, r, claims, span)
+					return
+				}
+			}
+
+			// A signed request is authenticated by its signature alone and is
+			// rejected outright if the signature does not verify.
+			if signatureValidator, ok := validator.(auth.SignatureValidator); ok && r.Header.Get(SignatureHeader) != "" {
+				body, err := io.ReadAll(r.Body)
+				r.Body.Close()
+				if errors.Is(err, ErrBodyTooLarge) {
+					Error(w, r, "Request entity too large", http.StatusRequestEntityTooLarge)
+					return
+				}
+				if err != nil {
+					Error(w, r, "Bad request", http.StatusBadRequest)
+					return
+				}
+				r.Body = io.NopCloser(bytes.NewReader(body))
+
+				claims, err := signatureValidator.ValidateSignature(r.Context(), auth.SignedRequest{
+					AccountID: r.Header.Get(SignatureAccountHeader),
+					Timestamp: r.Header.Get(SignatureTimestampHeader),
+					Signature: r.Header.Get(SignatureHeader),
+					Body:      body,
+				})
+				if err != nil {
+					rejectAuth(w, r, http.StatusForbidden, "invalid_signature", nil)
+					return
+				}
+				serve(w, r, claims, span)
 				return
 			}
 
-			parts := strings.SplitN(authHeader, " ", 2)
-			if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			token := r.Header.Get(APIKeyHeader)
+			if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+				parts := strings.SplitN(authHeader, " ", 2)
+				scheme := strings.ToLower(parts[0])
+				switch {
+				case len(parts) != 2:
+					rejectAuth(w, r, http.StatusUnauthorized, "malformed_authorization", nil)
+					return
+				case scheme == "bearer" || scheme == HECAuthScheme:
+					token = parts[1]
+				case scheme == "basic":
+					// Clients that only support basic auth, such as Fluent
+					// Bit's es output, send the token as the password.
+					_, password, ok := r.BasicAuth()
+					if !ok {
+						rejectAuth(w, r, http.StatusUnauthorized, "malformed_authorization", nil)
+						return
+					}
+					token = password
+				default:
+					rejectAuth(w, r, http.StatusUnauthorized, "unsupported_scheme", nil)
+					return
+				}
+			}
+			if token == "" {
+				rejectAuth(w, r, http.StatusUnauthorized, "missing_credentials", nil)
 				return
 			}
 
-			claims, err := validator.Validate(r.Context(), parts[1])
+			claims, err := validator.Validate(r.Context(), token)
 			if err != nil {
-				http.Error(w, "Forbidden", http.StatusForbidden)
+				rejectAuth(w, r, http.StatusForbidden, "invalid_token", nil)
 				return
 			}
 
-			ctx := context.WithValue(r.Context(), ClaimsContextKey, claims)
-			next.ServeHTTP(w, r.WithContext(ctx))
+			serve(w, r, claims, span)
 		})
 	}
 }
+
+// RequireScope rejects requests whose authenticated claims do not grant
+// scope. It must run after AuthMiddleware.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value(ClaimsContextKey).(*auth.Claims)
+			if !ok || !claims.HasScope(scope) {
+				rejectAuth(w, r, http.StatusForbidden, "missing_scope", nil)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rejectAuth answers a request refused by authentication or authorization
+// with status, counting it by reason and recording an audit event.
+func rejectAuth(w http.ResponseWriter, r *http.Request, status int, reason string, claims *auth.Claims) {
+	metrics.AuthFailures.WithLabelValues(reason).Inc()
+	AuditRejection(r, status, reason, claims)
+	Error(w, r, http.StatusText(status), status)
+}
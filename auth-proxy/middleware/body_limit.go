@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"auth-proxy/auth"
+)
+
+// BodyLimits caps request body sizes, with per-account overrides.
+type BodyLimits struct {
+	defaultBytes int64
+	tenants      map[int64]int64
+	max          int64
+}
+
+// NewBodyLimits parses tenants, a map from account ID to a byte limit that
+// replaces defaultBytes for that account.
+func NewBodyLimits(defaultBytes int64, tenants map[string]string) (*BodyLimits, error) {
+	l := &BodyLimits{defaultBytes: defaultBytes, tenants: make(map[int64]int64, len(tenants)), max: defaultBytes}
+	for account, limit := range tenants {
+		accountID, err := strconv.ParseInt(account, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid account ID %q in body size limits", account)
+		}
+		bytes, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil || bytes <= 0 {
+			return nil, fmt.Errorf("invalid body size limit %q for account %s", limit, account)
+		}
+		l.tenants[accountID] = bytes
+		l.max = max(l.max, bytes)
+	}
+	return l, nil
+}
+
+// For returns the limit of accountID.
+func (l *BodyLimits) For(accountID int64) int64 {
+	if bytes, ok := l.tenants[accountID]; ok {
+		return bytes
+	}
+	return l.defaultBytes
+}
+
+// BodyLimitMiddleware rejects bodies above the limit with 413, up front when
+// Content-Length gives the size away and otherwise by failing reads with
+// ErrBodyTooLarge, which handlers answer with 413. Before authentication
+// the largest configured limit applies; once claims are in the context the
+// caller's own limit does, so it must run on both sides of AuthMiddleware
+// for the limit to also cover bodies read while authenticating.
+func BodyLimitMiddleware(limits *BodyLimits) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := limits.max
+			claims, authenticated := r.Context().Value(ClaimsContextKey).(*auth.Claims)
+			if authenticated {
+				limit = limits.For(claims.AccountID)
+			}
+			if r.ContentLength > limit {
+				if authenticated {
+					logger.WarnContext(r.Context(), "rejected request body over the limit", "account_id", claims.GetAccountID(), "bytes", r.ContentLength, "limit", limit)
+				}
+				Error(w, r, fmt.Sprintf("Request entity too large, limit is %d bytes", limit), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = &limitedBody{r: r.Body, remaining: limit, closers: []io.Closer{r.Body}}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package middleware
+
+import "net/http"
+
+// RequireClientCertificate rejects requests that did not present a client
+// certificate verified against the client CA bundle, whatever else they
+// authenticate with.
+func RequireClientCertificate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			AuditRejection(r, http.StatusUnauthorized, "client_certificate_required", nil)
+			Error(w, r, "Client certificate required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
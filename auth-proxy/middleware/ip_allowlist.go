@@ -0,0 +1,163 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"auth-proxy/auth"
+)
+
+// IPAllowlist restricts each listed account to a set of source networks.
+// Accounts without an entry are not restricted.
+type IPAllowlist struct {
+	tenants        map[int64][]*net.IPNet
+	trustedProxies []*net.IPNet
+}
+
+// NewIPAllowlist parses tenants, a map from account ID to comma-separated
+// CIDRs or bare IPs, and trustedProxies, the networks whose X-Forwarded-For
+// header is believed. A network listed for two accounts is rejected, since
+// AccountFor could not choose between them.
+func NewIPAllowlist(tenants map[string]string, trustedProxies []string) (*IPAllowlist, error) {
+	a := &IPAllowlist{tenants: make(map[int64][]*net.IPNet, len(tenants))}
+	// Networks of the same length overlap only when they are equal.
+	owners := make(map[string]int64)
+	for account, cidrs := range tenants {
+		accountID, err := strconv.ParseInt(account, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid account ID %q in IP allowlist", account)
+		}
+		networks, err := parseNetworks(strings.Split(cidrs, ","))
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP allowlist for account %s: %w", account, err)
+		}
+		for _, network := range networks {
+			if owner, ok := owners[network.String()]; ok && owner != accountID {
+				return nil, fmt.Errorf("network %s is in the IP allowlist of both account %d and account %d",
+					network, min(owner, accountID), max(owner, accountID))
+			}
+			owners[network.String()] = accountID
+		}
+		a.tenants[accountID] = networks
+	}
+
+	networks, err := parseNetworks(trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy list: %w", err)
+	}
+	a.trustedProxies = networks
+	return a, nil
+}
+
+// Allowed reports whether ip may be used by accountID.
+func (a *IPAllowlist) Allowed(accountID int64, ip net.IP) bool {
+	networks, ok := a.tenants[accountID]
+	if !ok {
+		return true
+	}
+	return ip != nil && containsIP(networks, ip)
+}
+
+// AccountFor returns the account whose networks contain ip, preferring the
+// most specific network when several accounts match.
+func (a *IPAllowlist) AccountFor(ip net.IP) (int64, bool) {
+	var (
+		accountID int64
+		bestOnes  = -1
+	)
+	for account, networks := range a.tenants {
+		for _, network := range networks {
+			if ones, _ := network.Mask.Size(); network.Contains(ip) && ones > bestOnes {
+				accountID, bestOnes = account, ones
+			}
+		}
+	}
+	return accountID, bestOnes >= 0
+}
+
+// ClientIP returns the address the request came from. X-Forwarded-For is
+// only honoured when the direct peer is a trusted proxy, and is walked from
+// the right so a client cannot spoof its address by prepending entries.
+func (a *IPAllowlist) ClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(a.trustedProxies, ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(a.trustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// IPAllowlistMiddleware rejects requests from outside the authenticated
+// tenant's allowed networks. It must run after AuthMiddleware.
+func IPAllowlistMiddleware(allowlist *IPAllowlist) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value(ClaimsContextKey).(*auth.Claims)
+			if !ok {
+				rejectAuth(w, r, http.StatusForbidden, "missing_claims", nil)
+				return
+			}
+			ip := allowlist.ClientIP(r)
+			if !allowlist.Allowed(claims.AccountID, ip) {
+				rejectAuth(w, r, http.StatusForbidden, "ip_not_allowed", claims)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNewIPAllowlistRejectsSharedNetworks(t *testing.T) {
+	tests := []struct {
+		name    string
+		tenants map[string]string
+		wantErr bool
+	}{
+		{"nested networks", map[string]string{"1": "10.0.0.0/8", "2": "10.1.0.0/16"}, false},
+		{"same network twice in one account", map[string]string{"1": "10.0.0.0/8,10.0.0.0/8"}, false},
+		{"same network", map[string]string{"1": "10.0.0.0/16", "2": "10.0.0.0/16"}, true},
+		{"same network written differently", map[string]string{"1": "10.0.5.0/16", "2": "10.0.0.0/16"}, true},
+		{"bare IP and its /32", map[string]string{"1": "192.0.2.1", "2": "192.0.2.1/32"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewIPAllowlist(tt.tenants, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewIPAllowlist() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIPAllowlistAccountFor(t *testing.T) {
+	allowlist, err := NewIPAllowlist(map[string]string{"1": "10.0.0.0/8", "2": "10.1.0.0/16,192.0.2.1"}, nil)
+	if err != nil {
+		t.Fatalf("NewIPAllowlist() error = %v", err)
+	}
+	tests := []struct {
+		ip     string
+		want   int64
+		wantOK bool
+	}{
+		{"10.2.0.1", 1, true},
+		{"10.1.0.1", 2, true},
+		{"192.0.2.1", 2, true},
+		{"198.51.100.1", 0, false},
+	}
+	for _, tt := range tests {
+		if got, ok := allowlist.AccountFor(net.ParseIP(tt.ip)); got != tt.want || ok != tt.wantOK {
+			t.Errorf("AccountFor(%s) = %d, %v, want %d, %v", tt.ip, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
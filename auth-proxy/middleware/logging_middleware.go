@@ -1,16 +1,88 @@
 package middleware
 
 import (
-	"log"
+	"context"
+	"io"
+	"log/slog"
+	"math/rand"
 	"net/http"
+	"sync"
 	"time"
+
+	"auth-proxy/logging"
 )
 
-func LoggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		log.Printf("%s %s %s", r.Method, r.RequestURI, r.RemoteAddr)
-		next.ServeHTTP(w, r)
-		log.Printf("Completed in %v", time.Since(start))
-	})
+var logger = logging.Component("http")
+
+const accessLogContextKey = contextKey("access_log")
+
+// AccessLogOptions configures LoggingMiddleware.
+type AccessLogOptions struct {
+	// Format is "json" or "text" for logfmt-style lines. Any other value,
+	// such as "off", disables access logs.
+	Format string
+	// LogsSampleRate is the fraction of requests to /logs, the high-volume
+	// ingest route, that are logged: 1 logs all of them and 0 none. Failed
+	// requests are logged regardless.
+	LogsSampleRate float64
+}
+
+// accessLogEntry collects what inner handlers learn about a request, such
+// as the account it was authenticated as, for its access log line.
+type accessLogEntry struct {
+	mu        sync.Mutex
+	accountID string
+}
+
+// setAccessLogAccount records the account of the request ctx belongs to in
+// its access log line.
+func setAccessLogAccount(ctx context.Context, accountID string) {
+	if entry, ok := ctx.Value(accessLogContextKey).(*accessLogEntry); ok {
+		entry.mu.Lock()
+		entry.accountID = accountID
+		entry.mu.Unlock()
+	}
+}
+
+// LoggingMiddleware writes one access log line to w for every request, with
+// its method, path, status, duration, response size, account, request ID
+// and user agent.
+func LoggingMiddleware(w io.Writer, opts AccessLogOptions) func(http.Handler) http.Handler {
+	var handler slog.Handler
+	switch opts.Format {
+	case "json":
+		handler = slog.NewJSONHandler(w, nil)
+	case "text":
+		handler = slog.NewTextHandler(w, nil)
+	default:
+		return func(next http.Handler) http.Handler { return next }
+	}
+	accessLog := slog.New(handler)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			entry := &accessLogEntry{}
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), accessLogContextKey, entry)))
+
+			if r.URL.Path == "/logs" && recorder.status < 400 && rand.Float64() >= opts.LogsSampleRate {
+				return
+			}
+			entry.mu.Lock()
+			accountID := entry.accountID
+			entry.mu.Unlock()
+			accessLog.LogAttrs(r.Context(), slog.LevelInfo, "access",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", recorder.status),
+				slog.Duration("duration", time.Since(start)),
+				slog.Int64("bytes", recorder.bytes),
+				slog.String("account_id", accountID),
+				slog.String("request_id", RequestID(r.Context())),
+				slog.String("remote_addr", r.RemoteAddr),
+				slog.String("user_agent", r.UserAgent()),
+			)
+		})
+	}
 }
@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoggingMiddlewareLogsAccess(t *testing.T) {
+	var buf bytes.Buffer
+	inner := AuthMiddleware(staticValidator{}, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("stored"))
+	}))
+	h := RequestIDMiddleware(LoggingMiddleware(&buf, AccessLogOptions{Format: "json", LogsSampleRate: 1})(inner))
+
+	r := httptest.NewRequest(http.MethodPost, "/logs?source=agent", nil)
+	r.Header.Set("Authorization", "Bearer good")
+	r.Header.Set("User-Agent", "fluent-bit/3.0")
+	r.Header.Set(RequestIDHeader, "req-1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("access log %q is not JSON: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"msg":        "access",
+		"method":     http.MethodPost,
+		"path":       "/logs",
+		"status":     float64(http.StatusOK),
+		"bytes":      float64(len("stored")),
+		"account_id": "1",
+		"request_id": "req-1",
+		"user_agent": "fluent-bit/3.0",
+	}
+	for key, value := range want {
+		if line[key] != value {
+			t.Errorf("access log %s = %v, want %v", key, line[key], value)
+		}
+	}
+	if _, ok := line["duration"]; !ok {
+		t.Error("access log has no duration")
+	}
+}
+
+func TestLoggingMiddlewareSamplesLogsRoute(t *testing.T) {
+	var buf bytes.Buffer
+	status := http.StatusOK
+	h := LoggingMiddleware(&buf, AccessLogOptions{Format: "text", LogsSampleRate: 0})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/logs", nil))
+	if buf.Len() != 0 {
+		t.Errorf("successful /logs request logged with a zero sample rate: %q", buf.String())
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+	if !strings.Contains(buf.String(), "path=/health") {
+		t.Errorf("/health request not logged: %q", buf.String())
+	}
+
+	buf.Reset()
+	status = http.StatusServiceUnavailable
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/logs", nil))
+	if !strings.Contains(buf.String(), "status=503") {
+		t.Errorf("failed /logs request not logged: %q", buf.String())
+	}
+}
+
+func TestLoggingMiddlewareOff(t *testing.T) {
+	var buf bytes.Buffer
+	h := LoggingMiddleware(&buf, AccessLogOptions{Format: "off", LogsSampleRate: 1})(http.NotFoundHandler())
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+	if buf.Len() != 0 {
+		t.Errorf("access log written while off: %q", buf.String())
+	}
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"auth-proxy/auth"
+	"auth-proxy/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatalf("failed to read counter: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestMetricsMiddlewareCountsByRoute(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/teapot/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	route := func(r *http.Request) string {
+		_, pattern := mux.Handler(r)
+		return pattern
+	}
+	h := MetricsMiddleware(route)(mux)
+
+	teapot := metrics.HTTPRequests.WithLabelValues("/teapot/", http.MethodGet, "418")
+	unmatched := metrics.HTTPRequests.WithLabelValues("unmatched", http.MethodGet, "404")
+	teapotBefore, unmatchedBefore := counterValue(t, teapot), counterValue(t, unmatched)
+
+	for _, path := range []string{"/teapot/a", "/teapot/b", "/missing"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if got := counterValue(t, teapot) - teapotBefore; got != 2 {
+		t.Errorf("/teapot/ requests counted = %v, want 2 under one route label", got)
+	}
+	if got := counterValue(t, unmatched) - unmatchedBefore; got != 1 {
+		t.Errorf("unmatched requests counted = %v, want 1", got)
+	}
+}
+
+// staticValidator accepts only the token "good".
+type staticValidator struct{}
+
+func (staticValidator) Validate(ctx context.Context, token string) (*auth.Claims, error) {
+	if token != "good" {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return &auth.Claims{AccountID: 1}, nil
+}
+
+func TestAuthFailuresCountedByReason(t *testing.T) {
+	h := AuthMiddleware(staticValidator{}, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		header string
+		reason string
+		code   int
+	}{
+		{"", "missing_credentials", http.StatusUnauthorized},
+		{"Bearer bad", "invalid_token", http.StatusForbidden},
+		{"Digest abc", "unsupported_scheme", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		counter := metrics.AuthFailures.WithLabelValues(tt.reason)
+		before := counterValue(t, counter)
+		r := httptest.NewRequest(http.MethodPost, "/logs", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tt.code {
+			t.Errorf("Authorization %q: status = %d, want %d", tt.header, rec.Code, tt.code)
+		}
+		if got := counterValue(t, counter) - before; got != 1 {
+			t.Errorf("Authorization %q: %s failures counted = %v, want 1", tt.header, tt.reason, got)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+var panics atomic.Uint64
+
+// Panics returns how many requests RecoverMiddleware recovered from a panic.
+func Panics() uint64 {
+	return panics.Load()
+}
+
+// RecoverMiddleware turns a panic in next into a 500 response, and logs it
+// with the request ID and a stack trace. http.ErrAbortHandler is passed on
+// so the server still aborts the response, as it would without this.
+func RecoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			panics.Add(1)
+			logger.ErrorContext(r.Context(), "handler panicked", "method", r.Method, "path", r.URL.Path, "panic", recovered, "stack", string(debug.Stack()))
+			// A handler that already wrote its header leaves the client with
+			// a truncated response.
+			Error(w, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"container/list"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"auth-proxy/auth"
+)
+
+// NonceHeader carries a value the client never reuses, checked when replay
+// protection runs in "nonce" mode.
+const NonceHeader = "X-Akto-Nonce"
+
+// ReplayCache remembers recently seen request identifiers for a fixed window.
+// It holds at most size entries; when full it refuses new identifiers until
+// the oldest expire, since forgetting live ones early would let a client
+// flush the cache with unique identifiers and then replay.
+type ReplayCache struct {
+	window time.Duration
+	size   int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type replayEntry struct {
+	key     string
+	expires time.Time
+}
+
+// ErrReplayed is returned by Reserve for an identifier already recorded
+// within the window, and ErrReplayCacheFull when no more can be recorded.
+var (
+	ErrReplayed        = errors.New("request identifier already seen")
+	ErrReplayCacheFull = errors.New("replay cache is full")
+)
+
+func NewReplayCache(window time.Duration, size int) *ReplayCache {
+	return &ReplayCache{
+		window:  window,
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Reserve records key, or returns ErrReplayed when it was already recorded
+// within the window and ErrReplayCacheFull when the cache has no room.
+func (c *ReplayCache) Reserve(key string) error {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Entries share one window, so insertion order is also expiry order.
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		entry := front.Value.(*replayEntry)
+		if now.Before(entry.expires) {
+			break
+		}
+		c.order.Remove(front)
+		delete(c.entries, entry.key)
+	}
+
+	if _, ok := c.entries[key]; ok {
+		return ErrReplayed
+	}
+	if c.order.Len() >= c.size {
+		return ErrReplayCacheFull
+	}
+	c.entries[key] = c.order.PushBack(&replayEntry{key: key, expires: now.Add(c.window)})
+	return nil
+}
+
+// Forget removes key, so a request that failed may be sent again.
+func (c *ReplayCache) Forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// ReplayMiddleware rejects requests that repeat an identifier already seen
+// for the same account. In "jti" mode the token's jti claim is the
+// identifier, so each token is usable once; in "nonce" mode every request
+// must carry a NonceHeader. Signed requests are always keyed by their
+// signature, which already covers the timestamp and body. Identifiers of
+// requests answered with an error are forgotten, so they can be retried.
+// It must run after AuthMiddleware.
+func ReplayMiddleware(cache *ReplayCache, mode string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value(ClaimsContextKey).(*auth.Claims)
+			if !ok {
+				rejectAuth(w, r, http.StatusForbidden, "missing_claims", nil)
+				return
+			}
+
+			var key string
+			switch {
+			case r.Header.Get(SignatureHeader) != "":
+				key = "sig:" + r.Header.Get(SignatureHeader)
+			case mode == "jti" && claims.ID != "":
+				key = "jti:" + claims.ID
+			case mode == "nonce":
+				nonce := r.Header.Get(NonceHeader)
+				if nonce == "" {
+					Error(w, r, "Bad request: missing "+NonceHeader, http.StatusBadRequest)
+					return
+				}
+				key = "nonce:" + nonce
+			}
+
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key = claims.GetAccountID() + "|" + key
+			switch err := cache.Reserve(key); {
+			case errors.Is(err, ErrReplayed):
+				rejectAuth(w, r, http.StatusForbidden, "replayed", claims)
+				return
+			case errors.Is(err, ErrReplayCacheFull):
+				logger.WarnContext(r.Context(), "replay cache is full, rejecting request", "account_id", claims.GetAccountID())
+				w.Header().Set("Retry-After", "1")
+				Error(w, r, "Service unavailable", http.StatusServiceUnavailable)
+				return
+			}
+
+			// Only a request that succeeded uses up its identifier; one
+			// that failed, for instance because storage shed it, may be
+			// retried.
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r)
+			if recorder.status < 200 || recorder.status >= 300 {
+				cache.Forget(key)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"auth-proxy/auth"
+)
+
+func TestReplayCacheRefusesWhenFull(t *testing.T) {
+	cache := NewReplayCache(time.Hour, 2)
+	for _, key := range []string{"a", "b"} {
+		if err := cache.Reserve(key); err != nil {
+			t.Fatalf("Reserve(%q) error = %v", key, err)
+		}
+	}
+	if err := cache.Reserve("c"); err != ErrReplayCacheFull {
+		t.Errorf("Reserve on a full cache error = %v, want ErrReplayCacheFull", err)
+	}
+	// The live entries must not have been evicted to make room.
+	if err := cache.Reserve("a"); err != ErrReplayed {
+		t.Errorf("Reserve(a) error = %v, want ErrReplayed", err)
+	}
+}
+
+func TestReplayCacheExpires(t *testing.T) {
+	cache := NewReplayCache(10*time.Millisecond, 1)
+	if err := cache.Reserve("a"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := cache.Reserve("b"); err != nil {
+		t.Errorf("Reserve after the window error = %v, want nil", err)
+	}
+}
+
+func TestReplayMiddleware(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	handler := ReplayMiddleware(NewReplayCache(time.Hour, 10), "nonce")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	send := func() int {
+		r := httptest.NewRequest(http.MethodPost, "/logs", nil)
+		r.Header.Set(NonceHeader, "n-1")
+		r = r.WithContext(context.WithValue(r.Context(), ClaimsContextKey, &auth.Claims{AccountID: 1}))
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	if code := send(); code != http.StatusServiceUnavailable {
+		t.Fatalf("first request = %d, want the handler's 503", code)
+	}
+	status = http.StatusOK
+	if code := send(); code != http.StatusOK {
+		t.Fatalf("retry after a failure = %d, want 200", code)
+	}
+	if code := send(); code != http.StatusForbidden {
+		t.Errorf("replay after a success = %d, want 403", code)
+	}
+}
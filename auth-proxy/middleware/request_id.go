@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"auth-proxy/logging"
+)
+
+// RequestIDHeader carries the request ID. A client-supplied ID is kept so
+// agents can correlate their own logs with the proxy's.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds client-supplied IDs, which are echoed back and
+// logged.
+const maxRequestIDLength = 128
+
+// RequestIDMiddleware assigns every request an ID, stores it in the context,
+// where it tags the request's log records, and returns it in the
+// RequestIDHeader response header.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+// RequestID returns the ID RequestIDMiddleware assigned, or "" outside it.
+func RequestID(ctx context.Context) string {
+	return logging.RequestID(ctx)
+}
+
+// Error replies to r like http.Error, with the request ID appended to
+// message so clients can quote it when reporting a failure.
+func Error(w http.ResponseWriter, r *http.Request, message string, code int) {
+	if id := RequestID(r.Context()); id != "" {
+		message += " (request ID " + id + ")"
+	}
+	http.Error(w, message, code)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorIncludesRequestID(t *testing.T) {
+	h := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Error(w, r, "Bad request", http.StatusBadRequest)
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/logs", nil)
+	r.Header.Set(RequestIDHeader, "agent-42")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+
+	if got := rec.Header().Get(RequestIDHeader); got != "agent-42" {
+		t.Errorf("%s = %q, want the client's ID", RequestIDHeader, got)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "agent-42") {
+		t.Errorf("error body = %q, want it to name the request ID", body)
+	}
+}
+
+func TestRequestIDMiddlewareReplacesInvalidIDs(t *testing.T) {
+	var seen string
+	h := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+	}))
+	r := httptest.NewRequest(http.MethodPost, "/logs", nil)
+	r.Header.Set(RequestIDHeader, "bad id\n")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+
+	if seen == "" || seen == "bad id\n" || rec.Header().Get(RequestIDHeader) != seen {
+		t.Errorf("request ID = %q, header = %q, want a generated ID in both", seen, rec.Header().Get(RequestIDHeader))
+	}
+}
@@ -0,0 +1,111 @@
+// Package notify sends alerts about ingestion problems, such as failing
+// bulk requests, to a webhook so they are noticed without watching logs or
+// dashboards.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Options configures a Notifier.
+type Options struct {
+	URL string
+	// Format is "json" for a generic JSON body or "slack" for a Slack
+	// incoming webhook message.
+	Format  string
+	Timeout time.Duration
+}
+
+// Alert is a condition that started or, when Resolved, stopped.
+type Alert struct {
+	Name      string
+	Summary   string
+	Value     float64
+	Threshold float64
+	Resolved  bool
+}
+
+// Notifier posts alerts to a webhook.
+type Notifier struct {
+	opts     Options
+	client   *http.Client
+	hostname string
+}
+
+func New(opts Options) (*Notifier, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("notification webhook URL must be provided")
+	}
+	if opts.Format != "json" && opts.Format != "slack" {
+		return nil, fmt.Errorf("notification format %q must be json or slack", opts.Format)
+	}
+	hostname, _ := os.Hostname()
+	return &Notifier{
+		opts:     opts,
+		client:   &http.Client{Timeout: opts.Timeout},
+		hostname: hostname,
+	}, nil
+}
+
+// webhookPayload is the body of a "json" notification.
+type webhookPayload struct {
+	Alert     string  `json:"alert"`
+	Status    string  `json:"status"`
+	Summary   string  `json:"summary"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	Host      string  `json:"host"`
+	Time      string  `json:"time"`
+}
+
+// Notify posts alert to the webhook.
+func (n *Notifier) Notify(ctx context.Context, alert Alert) error {
+	status := "firing"
+	if alert.Resolved {
+		status = "resolved"
+	}
+	var payload interface{} = webhookPayload{
+		Alert:     alert.Name,
+		Status:    status,
+		Summary:   alert.Summary,
+		Value:     alert.Value,
+		Threshold: alert.Threshold,
+		Host:      n.hostname,
+		Time:      time.Now().UTC().Format(time.RFC3339),
+	}
+	if n.opts.Format == "slack" {
+		icon := ":rotating_light:"
+		if alert.Resolved {
+			icon = ":white_check_mark:"
+		}
+		payload = map[string]string{
+			"text": fmt.Sprintf("%s [%s] log ingestion on %s: %s", icon, status, n.hostname, alert.Summary),
+		}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build notification request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("notification webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notification webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	var got map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("failed to decode body: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	alert := Alert{Name: "dead_letter_size", Summary: "dead-letter queue holds 200 bytes", Value: 200, Threshold: 100}
+
+	notifier, err := New(Options{URL: server.URL, Format: "json", Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Notify(context.Background(), alert); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	if got["alert"] != "dead_letter_size" || got["status"] != "firing" || got["value"] != 200.0 || got["threshold"] != 100.0 {
+		t.Errorf("json payload = %v", got)
+	}
+
+	notifier, err = New(Options{URL: server.URL, Format: "slack", Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alert.Resolved = true
+	if err := notifier.Notify(context.Background(), alert); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+	text, _ := got["text"].(string)
+	if !strings.Contains(text, "[resolved]") || !strings.Contains(text, alert.Summary) {
+		t.Errorf("slack text = %q", text)
+	}
+}
+
+func TestNotifyReportsFailedWebhook(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	notifier, err := New(Options{URL: server.URL, Format: "json", Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Notify(context.Background(), Alert{Name: "bulk_failure_rate"}); err == nil {
+		t.Error("Notify() error = nil, want error for status 500")
+	}
+}
+
+func TestNewRejectsUnknownFormat(t *testing.T) {
+	if _, err := New(Options{URL: "http://example.com", Format: "xml"}); err == nil {
+		t.Error("New() error = nil, want error for format xml")
+	}
+}
@@ -0,0 +1,179 @@
+// Package otlp converts OpenTelemetry log export requests into the log
+// entries accepted by storage.LogStorage.
+package otlp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	collectorlogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// DecodeProtobuf parses a binary ExportLogsServiceRequest.
+func DecodeProtobuf(data []byte) (*collectorlogs.ExportLogsServiceRequest, error) {
+	req := &collectorlogs.ExportLogsServiceRequest{}
+	if err := proto.Unmarshal(data, req); err != nil {
+		return nil, fmt.Errorf("invalid OTLP protobuf payload: %w", err)
+	}
+	return req, nil
+}
+
+// DecodeJSON parses an ExportLogsServiceRequest in the OTLP/JSON encoding,
+// which differs from the canonical protobuf JSON mapping in that trace and
+// span IDs are hex rather than base64 encoded.
+func DecodeJSON(data []byte) (*collectorlogs.ExportLogsServiceRequest, error) {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid OTLP JSON payload: %w", err)
+	}
+	hexIDsToBase64(raw)
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &collectorlogs.ExportLogsServiceRequest{}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, req); err != nil {
+		return nil, fmt.Errorf("invalid OTLP JSON payload: %w", err)
+	}
+	return req, nil
+}
+
+func hexIDsToBase64(value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if s, ok := field.(string); ok && (key == "traceId" || key == "spanId") {
+				if id, err := hex.DecodeString(s); err == nil {
+					v[key] = base64.StdEncoding.EncodeToString(id)
+				}
+				continue
+			}
+			hexIDsToBase64(field)
+		}
+	case []interface{}:
+		for _, item := range v {
+			hexIDsToBase64(item)
+		}
+	}
+}
+
+// Entries flattens every log record in req into a log entry. Resource and
+// scope metadata are copied onto each record, and the container name is
+// lifted from the k8s.container.name or container.name resource attribute so
+// index routing works as it does for Fluent Bit payloads.
+func Entries(req *collectorlogs.ExportLogsServiceRequest) []map[string]interface{} {
+	var entries []map[string]interface{}
+	for _, resourceLogs := range req.GetResourceLogs() {
+		resource := attributesToMap(resourceLogs.GetResource().GetAttributes())
+		containerName := containerFromResource(resource)
+
+		for _, scopeLogs := range resourceLogs.GetScopeLogs() {
+			var scope map[string]interface{}
+			if s := scopeLogs.GetScope(); s != nil && (s.GetName() != "" || s.GetVersion() != "") {
+				scope = map[string]interface{}{"name": s.GetName(), "version": s.GetVersion()}
+			}
+
+			for _, record := range scopeLogs.GetLogRecords() {
+				entry := map[string]interface{}{}
+				if ts := record.GetTimeUnixNano(); ts != 0 {
+					entry["timestamp"] = formatNanos(ts)
+				}
+				if ts := record.GetObservedTimeUnixNano(); ts != 0 {
+					entry["observed_timestamp"] = formatNanos(ts)
+				}
+				if record.GetSeverityText() != "" {
+					entry["severity_text"] = record.GetSeverityText()
+				}
+				if record.GetSeverityNumber() != 0 {
+					entry["severity_number"] = int32(record.GetSeverityNumber())
+				}
+				if body := anyValue(record.GetBody()); body != nil {
+					if s, ok := body.(string); ok {
+						entry["message"] = s
+					} else {
+						entry["body"] = body
+					}
+				}
+				if attributes := attributesToMap(record.GetAttributes()); len(attributes) > 0 {
+					entry["attributes"] = attributes
+				}
+				if len(record.GetTraceId()) > 0 {
+					entry["trace_id"] = hex.EncodeToString(record.GetTraceId())
+				}
+				if len(record.GetSpanId()) > 0 {
+					entry["span_id"] = hex.EncodeToString(record.GetSpanId())
+				}
+				if record.GetFlags() != 0 {
+					entry["flags"] = record.GetFlags()
+				}
+				if len(resource) > 0 {
+					entry["resource"] = resource
+				}
+				if scope != nil {
+					entry["scope"] = scope
+				}
+				if containerName != "" {
+					entry["container_name"] = containerName
+				}
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+func containerFromResource(resource map[string]interface{}) string {
+	for _, key := range []string{"k8s.container.name", "container.name"} {
+		if name, ok := resource[key].(string); ok && name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+func formatNanos(nanos uint64) string {
+	return time.Unix(0, int64(nanos)).UTC().Format(time.RFC3339Nano)
+}
+
+func attributesToMap(attributes []*commonpb.KeyValue) map[string]interface{} {
+	if len(attributes) == 0 {
+		return nil
+	}
+	out := make(map[string]interface{}, len(attributes))
+	for _, kv := range attributes {
+		out[kv.GetKey()] = anyValue(kv.GetValue())
+	}
+	return out
+}
+
+func anyValue(value *commonpb.AnyValue) interface{} {
+	switch v := value.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return v.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return v.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		return v.DoubleValue
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	case *commonpb.AnyValue_ArrayValue:
+		values := v.ArrayValue.GetValues()
+		out := make([]interface{}, len(values))
+		for i, item := range values {
+			out[i] = anyValue(item)
+		}
+		return out
+	case *commonpb.AnyValue_KvlistValue:
+		return attributesToMap(v.KvlistValue.GetValues())
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+
+	"auth-proxy/auth"
+)
+
+// Input is the request context an Authorizer decides on. It is evaluated
+// after the credential has been validated and the payload decoded.
+type Input struct {
+	Claims       *auth.Claims `json:"claims"`
+	AccountID    string       `json:"accountId"`
+	Method       string       `json:"method"`
+	Path         string       `json:"path"`
+	PayloadBytes int64        `json:"payloadBytes"`
+	Entries      int          `json:"entries"`
+	Containers   []string     `json:"containers"`
+}
+
+// Authorizer makes the final allow/deny decision for an ingest request.
+// It returns a *DeniedError when the request is refused; any other error
+// means no decision could be made.
+type Authorizer interface {
+	Authorize(ctx context.Context, input Input) error
+}
+
+// DeniedError reports a request refused by policy.
+type DeniedError struct {
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	if e.Reason == "" {
+		return "request denied by policy"
+	}
+	return fmt.Sprintf("request denied by policy: %s", e.Reason)
+}
+
+// All allows a request only when every authorizer allows it, consulting them
+// in order and stopping at the first refusal.
+type All []Authorizer
+
+func (a All) Authorize(ctx context.Context, input Input) error {
+	for _, authorizer := range a {
+		if err := authorizer.Authorize(ctx, input); err != nil {
+			return err
+		}
+	}
+	return nil
+}
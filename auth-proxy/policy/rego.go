@@ -0,0 +1,59 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/open-policy-agent/opa/rego"
+)
+
+// DefaultQuery is evaluated when no query is configured. It must yield a
+// boolean.
+const DefaultQuery = "data.akto.ingest.allow"
+
+// RegoAuthorizer evaluates an embedded OPA policy against every request so
+// security teams can encode ingestion rules without code changes.
+type RegoAuthorizer struct {
+	query rego.PreparedEvalQuery
+}
+
+// NewRegoAuthorizer compiles the Rego module at path. query selects the
+// boolean rule that allows a request, e.g. "data.akto.ingest.allow".
+func NewRegoAuthorizer(ctx context.Context, path, query string) (*RegoAuthorizer, error) {
+	module, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+	if query == "" {
+		query = DefaultQuery
+	}
+	prepared, err := rego.New(
+		rego.Query(query),
+		rego.Module(path, string(module)),
+	).PrepareForEval(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile policy: %w", err)
+	}
+	return &RegoAuthorizer{query: prepared}, nil
+}
+
+// Authorize denies the request unless the query evaluates to true. An
+// undefined result, e.g. no matching allow rule, counts as a denial.
+func (a *RegoAuthorizer) Authorize(ctx context.Context, input Input) error {
+	results, err := a.query.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		return fmt.Errorf("policy evaluation failed: %w", err)
+	}
+	if len(results) == 0 || len(results[0].Expressions) == 0 {
+		return &DeniedError{}
+	}
+	allowed, ok := results[0].Expressions[0].Value.(bool)
+	if !ok {
+		return fmt.Errorf("policy query returned %T, want bool", results[0].Expressions[0].Value)
+	}
+	if !allowed {
+		return &DeniedError{}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxWebhookCacheEntries bounds the decision cache.
+const maxWebhookCacheEntries = 10000
+
+// WebhookOptions configures a WebhookAuthorizer.
+type WebhookOptions struct {
+	URL     string
+	Timeout time.Duration
+	// CacheTTL is how long an allow or deny decision is reused. Decisions are
+	// cached per account, path and set of containers, so a webhook that
+	// decides on payload size must run with caching disabled (zero).
+	CacheTTL time.Duration
+}
+
+// WebhookAuthorizer asks an external entitlement service whether a request
+// may be stored. The service receives the Input as JSON and answers with
+// {"allow": bool, "reason": string}.
+type WebhookAuthorizer struct {
+	opts   WebhookOptions
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]webhookDecision
+}
+
+type webhookDecision struct {
+	err     error
+	expires time.Time
+}
+
+type webhookResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+func NewWebhookAuthorizer(opts WebhookOptions) (*WebhookAuthorizer, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("authorization webhook URL must be provided")
+	}
+	return &WebhookAuthorizer{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+		cache:  make(map[[sha256.Size]byte]webhookDecision),
+	}, nil
+}
+
+func (a *WebhookAuthorizer) Authorize(ctx context.Context, input Input) error {
+	key := decisionKey(input)
+	if decision, ok := a.cached(key); ok {
+		return decision.err
+	}
+
+	// Only real decisions are cached; a failing webhook is retried on the
+	// next request.
+	err := a.ask(ctx, input)
+	var denied *DeniedError
+	if err == nil || errors.As(err, &denied) {
+		a.store(key, err)
+	}
+	return err
+}
+
+func (a *WebhookAuthorizer) ask(ctx context.Context, input Input) error {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return fmt.Errorf("failed to encode authorization request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build authorization request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("authorization webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("authorization webhook returned status %d", resp.StatusCode)
+	}
+
+	var decision webhookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return fmt.Errorf("failed to decode authorization response: %w", err)
+	}
+	if !decision.Allow {
+		return &DeniedError{Reason: decision.Reason}
+	}
+	return nil
+}
+
+// decisionKey identifies requests that share a cached decision. Payload size
+// and entry count are deliberately left out so decisions can be reused.
+func decisionKey(input Input) [sha256.Size]byte {
+	input.PayloadBytes = 0
+	input.Entries = 0
+	data, _ := json.Marshal(input)
+	return sha256.Sum256(data)
+}
+
+func (a *WebhookAuthorizer) cached(key [sha256.Size]byte) (webhookDecision, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	decision, ok := a.cache[key]
+	if !ok {
+		return webhookDecision{}, false
+	}
+	if time.Now().After(decision.expires) {
+		delete(a.cache, key)
+		return webhookDecision{}, false
+	}
+	return decision, true
+}
+
+func (a *WebhookAuthorizer) store(key [sha256.Size]byte, err error) {
+	if a.opts.CacheTTL <= 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.cache) >= maxWebhookCacheEntries {
+		now := time.Now()
+		for k, decision := range a.cache {
+			if now.After(decision.expires) {
+				delete(a.cache, k)
+			}
+		}
+		if len(a.cache) >= maxWebhookCacheEntries {
+			return
+		}
+	}
+	a.cache[key] = webhookDecision{err: err, expires: time.Now().Add(a.opts.CacheTTL)}
+}
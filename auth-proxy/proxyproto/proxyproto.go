@@ -0,0 +1,274 @@
+// Package proxyproto reads the PROXY protocol header, version 1 or 2, that
+// load balancers such as HAProxy and AWS NLB send ahead of a connection, so
+// the server sees the client's address instead of the balancer's.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"auth-proxy/logging"
+)
+
+var logger = logging.Component("proxyproto")
+
+// headerTimeout bounds how long a connection may take to send its header.
+const headerTimeout = 5 * time.Second
+
+// maxV1Header is the longest version 1 header the protocol allows.
+const maxV1Header = 107
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Listener expects a header on every connection from its sources, and
+// serves connections from other peers with their own address.
+type Listener struct {
+	net.Listener
+	sources []*net.IPNet
+}
+
+// NewListener wraps inner. sources are the CIDRs or IPs of the load
+// balancers; when empty, every peer must send a header.
+func NewListener(inner net.Listener, sources []string) (*Listener, error) {
+	l := &Listener{Listener: inner}
+	for _, source := range sources {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		if !strings.Contains(source, "/") {
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid PROXY protocol source %q", source)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 128
+			} else {
+				ip = ip.To4()
+			}
+			l.sources = append(l.sources, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY protocol source %q: %w", source, err)
+		}
+		l.sources = append(l.sources, network)
+	}
+	return l, nil
+}
+
+// Accept returns the next connection. The header is read on the
+// connection's first Read, RemoteAddr or LocalAddr call, so a slow sender
+// does not hold up Accept.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.expectsHeader(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &Conn{Conn: conn}, nil
+}
+
+func (l *Listener) expectsHeader(addr net.Addr) bool {
+	if len(l.sources) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.sources {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection whose addresses come from its PROXY protocol header.
+// A connection without a valid header fails on its first Read.
+type Conn struct {
+	net.Conn
+
+	once          sync.Once
+	reader        *bufio.Reader
+	remote, local net.Addr
+	err           error
+
+	// readDeadline is the deadline the server set, restored once the
+	// header is read under headerTimeout.
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *Conn) init() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		c.mu.Lock()
+		deadline := time.Now().Add(headerTimeout)
+		if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+			deadline = c.readDeadline
+		}
+		c.Conn.SetReadDeadline(deadline)
+		c.mu.Unlock()
+
+		c.err = c.readHeader()
+
+		c.mu.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.mu.Unlock()
+		if c.err != nil {
+			logger.Warn("dropping connection with an invalid PROXY header", "remote_addr", c.Conn.RemoteAddr().String(), "error", c.err)
+		}
+	})
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// RemoteAddr returns the client address from the header, or the peer's
+// when the header carries none.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	c.init()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *Conn) readHeader() error {
+	start, err := c.reader.Peek(5)
+	if err != nil {
+		return fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+	if string(start) == "PROXY" {
+		return c.readV1()
+	}
+	signature, err := c.reader.Peek(len(v2Signature))
+	if err != nil || !bytes.Equal(signature, v2Signature) {
+		return errors.New("missing PROXY protocol header")
+	}
+	return c.readV2()
+}
+
+// readV1 parses "PROXY TCP4|TCP6 src dst srcport dstport\r\n", or
+// "PROXY UNKNOWN ...\r\n" which keeps the peer's address.
+func (c *Conn) readV1() error {
+	var line []byte
+	for len(line) < maxV1Header {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return fmt.Errorf("failed to read PROXY protocol header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("malformed PROXY protocol v1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return errors.New("malformed PROXY protocol v1 header")
+	}
+	remote, err := v1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	local, err := v1Addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.remote, c.local = remote, local
+	return nil
+}
+
+func v1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	number, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.New("malformed PROXY protocol v1 address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(number)}, nil
+}
+
+// readV2 parses the binary header. A LOCAL command, as sent by balancer
+// health checks, and families other than TCP over IPv4 or IPv6 keep the
+// peer's address. TLVs after the addresses are skipped.
+func (c *Conn) readV2() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+
+	command, family, transport := header[12]&0x0f, header[13]>>4, header[13]&0x0f
+	if command == 0 || transport != 1 {
+		return nil
+	}
+	var size int
+	switch family {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default:
+		return nil
+	}
+	if len(body) < 2*size+4 {
+		return errors.New("malformed PROXY protocol v2 header")
+	}
+	c.remote = &net.TCPAddr{IP: net.IP(body[:size]), Port: int(binary.BigEndian.Uint16(body[2*size:]))}
+	c.local = &net.TCPAddr{IP: net.IP(body[size : 2*size]), Port: int(binary.BigEndian.Uint16(body[2*size+2:]))}
+	return nil
+}
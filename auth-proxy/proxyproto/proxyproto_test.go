@@ -0,0 +1,120 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// v2Header builds a version 2 header for command and the family and
+// transport byte, with body following it.
+func v2Header(command, familyTransport byte, body []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, familyTransport, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(body)))
+	return append(header, body...)
+}
+
+func tcp4Body(src, dst string, srcPort, dstPort uint16) []byte {
+	body := append(net.ParseIP(src).To4(), net.ParseIP(dst).To4()...)
+	body = binary.BigEndian.AppendUint16(body, srcPort)
+	return binary.BigEndian.AppendUint16(body, dstPort)
+}
+
+func tcp6Body(src, dst string, srcPort, dstPort uint16) []byte {
+	body := append(net.ParseIP(src).To16(), net.ParseIP(dst).To16()...)
+	body = binary.BigEndian.AppendUint16(body, srcPort)
+	return binary.BigEndian.AppendUint16(body, dstPort)
+}
+
+func TestConnReadsHeader(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     []byte
+		wantRemote string // "" keeps the peer's address
+		wantErr    bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"), "203.0.113.7:51234", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51234 443\r\n"), "[2001:db8::7]:51234", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 missing crlf", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\n"), "", true},
+		{"v1 bad port", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 99999 443\r\n"), "", true},
+		{"v1 bad address", []byte("PROXY TCP4 not-an-ip 10.0.0.1 51234 443\r\n"), "", true},
+		{"v1 too few fields", []byte("PROXY TCP4 203.0.113.7\r\n"), "", true},
+		{"v2 tcp4", v2Header(1, 0x11, tcp4Body("203.0.113.7", "10.0.0.1", 51234, 443)), "203.0.113.7:51234", false},
+		{"v2 tcp6", v2Header(1, 0x21, tcp6Body("2001:db8::7", "2001:db8::1", 51234, 443)), "[2001:db8::7]:51234", false},
+		{"v2 with TLVs", v2Header(1, 0x11, append(tcp4Body("203.0.113.7", "10.0.0.1", 51234, 443), 0x04, 0, 1, 'x')), "203.0.113.7:51234", false},
+		{"v2 local", v2Header(0, 0x11, tcp4Body("203.0.113.7", "10.0.0.1", 51234, 443)), "", false},
+		{"v2 udp", v2Header(1, 0x12, tcp4Body("203.0.113.7", "10.0.0.1", 51234, 443)), "", false},
+		{"v2 short addresses", v2Header(1, 0x11, []byte{1, 2, 3}), "", true},
+		{"no header", []byte("GET / HTTP/1.1\r\n\r\n"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				client.Write(append(tt.header, "hello"...))
+			}()
+			conn := &Conn{Conn: server}
+			defer conn.Close()
+
+			buf := make([]byte, 5)
+			_, err := io.ReadFull(conn, buf)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Read() succeeded, want a header error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			if string(buf) != "hello" {
+				t.Errorf("Read() = %q, want the data after the header", buf)
+			}
+			wantRemote := tt.wantRemote
+			if wantRemote == "" {
+				wantRemote = server.RemoteAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != wantRemote {
+				t.Errorf("RemoteAddr() = %s, want %s", got, wantRemote)
+			}
+		})
+	}
+}
+
+func TestListenerExpectsHeaderFromSources(t *testing.T) {
+	l, err := NewListener(nil, []string{"10.0.0.0/8", "192.0.2.1", " "})
+	if err != nil {
+		t.Fatalf("NewListener() error = %v", err)
+	}
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.2")}, false},
+		{&net.UnixAddr{Name: "/tmp/sock"}, false},
+	}
+	for _, tt := range tests {
+		if got := l.expectsHeader(tt.addr); got != tt.want {
+			t.Errorf("expectsHeader(%s) = %t, want %t", tt.addr, got, tt.want)
+		}
+	}
+
+	everyone, _ := NewListener(nil, nil)
+	if !everyone.expectsHeader(&net.UnixAddr{Name: "/tmp/sock"}) {
+		t.Error("a listener without sources must expect a header from every peer")
+	}
+}
+
+func TestNewListenerRejectsInvalidSources(t *testing.T) {
+	for _, source := range []string{"not-an-ip", "10.0.0.0/33"} {
+		if _, err := NewListener(nil, []string{source}); err == nil {
+			t.Errorf("NewListener(%q) succeeded, want an error", source)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"auth-proxy/sigv4"
+)
+
+// AWSSecretsManager reads secrets from AWS Secrets Manager. References are
+// secret names or ARNs, optionally followed by "#field" for JSON secrets.
+// Credentials come from the standard AWS_* environment variables.
+type AWSSecretsManager struct {
+	region   string
+	endpoint string
+	creds    sigv4.Credentials
+	client   *http.Client
+}
+
+func NewAWSSecretsManager(region string) (*AWSSecretsManager, error) {
+	if region == "" {
+		return nil, fmt.Errorf("AWS region must be provided")
+	}
+	creds, err := sigv4.CredentialsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return &AWSSecretsManager{
+		region:   region,
+		endpoint: fmt.Sprintf("https://secretsmanager.%s.amazonaws.com/", region),
+		creds:    creds,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (a *AWSSecretsManager) Get(ctx context.Context, ref string) (string, error) {
+	secretID, field := splitRef(ref)
+	body, err := json.Marshal(map[string]string{"SecretId": secretID})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to build Secrets Manager request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	sigv4.Sign(req, sigv4.PayloadHash(body), a.creds, a.region, "secretsmanager", time.Now())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Secrets Manager request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return "", fmt.Errorf("Secrets Manager returned status %d for %s: %s %s", resp.StatusCode, secretID, apiErr.Type, apiErr.Message)
+	}
+
+	var out struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("failed to decode Secrets Manager response: %w", err)
+	}
+	if out.SecretString == "" {
+		return "", fmt.Errorf("secret %s has no string value", secretID)
+	}
+	return pickField(out.SecretString, field)
+}
@@ -0,0 +1,71 @@
+// Package secrets fetches key material from an external secret store so it
+// does not have to be pasted into environment variables.
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"auth-proxy/logging"
+)
+
+var logger = logging.Component("secrets")
+
+// Store reads a secret by reference. A reference is a store-specific path,
+// optionally followed by "#field" to pick one member of a JSON secret.
+type Store interface {
+	Get(ctx context.Context, ref string) (string, error)
+}
+
+// splitRef separates a reference into its path and optional field.
+func splitRef(ref string) (string, string) {
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+// pickField returns field from the JSON object in value, or value itself
+// when no field is requested.
+func pickField(value, field string) (string, error) {
+	if field == "" {
+		return value, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object, cannot select field %q", field)
+	}
+	s, ok := fields[field].(string)
+	if !ok {
+		return "", fmt.Errorf("secret has no string field %q", field)
+	}
+	return s, nil
+}
+
+// Watch fetches ref from store every interval and calls apply with the value
+// whenever it changes. Failures are logged and the previous value kept.
+func Watch(store Store, ref string, interval time.Duration, current string, apply func(string) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		value, err := store.Get(ctx, ref)
+		cancel()
+		if err != nil {
+			logger.Warn("failed to refresh secret, keeping previous value", "secret", ref, "error", err)
+			continue
+		}
+		if value == current {
+			continue
+		}
+		if err := apply(value); err != nil {
+			logger.Warn("failed to apply refreshed secret, keeping previous value", "secret", ref, "error", err)
+			continue
+		}
+		current = value
+		logger.Info("reloaded secret", "secret", ref)
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// clientCerts holds the TLS config client certificates are verified with,
+// rebuilt from the client CA bundle and CRL whenever they change on disk, so
+// rotated CAs and new revocations apply without a restart.
+type clientCerts struct {
+	base    *tls.Config
+	caFile  string
+	crlFile string
+
+	current atomic.Pointer[tls.Config]
+	// Only load touches the file contents last loaded.
+	caPEM, crl []byte
+}
+
+func newClientCerts(base *tls.Config, caFile, crlFile string) (*clientCerts, error) {
+	c := &clientCerts{base: base, caFile: caFile, crlFile: crlFile}
+	if _, err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// configForClient serves as tls.Config.GetConfigForClient.
+func (c *clientCerts) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return c.current.Load(), nil
+}
+
+func (c *clientCerts) refresh(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		changed, err := c.load()
+		switch {
+		case err != nil:
+			logger.Warn("failed to reload client CA bundle and CRL, keeping the previous ones", "error", err)
+		case changed:
+			logger.Info("reloaded client CA bundle and CRL")
+		}
+	}
+}
+
+// load reads the CA bundle and CRL and, when either changed, replaces the
+// current config. It reports whether it did.
+func (c *clientCerts) load() (bool, error) {
+	caPEM, err := os.ReadFile(c.caFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read client CA file: %w", err)
+	}
+	var crl []byte
+	if c.crlFile != "" {
+		if crl, err = os.ReadFile(c.crlFile); err != nil {
+			return false, fmt.Errorf("failed to read client CRL file: %w", err)
+		}
+	}
+	if c.current.Load() != nil && bytes.Equal(caPEM, c.caPEM) && bytes.Equal(crl, c.crl) {
+		return false, nil
+	}
+
+	pool := x509.NewCertPool()
+	var cas []*x509.Certificate
+	for rest := caPEM; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse client CA file: %w", err)
+		}
+		pool.AddCert(ca)
+		cas = append(cas, ca)
+	}
+	if len(cas) == 0 {
+		return false, fmt.Errorf("no certificates found in client CA file")
+	}
+	revoked, err := revokedCertificates(crl, cas)
+	if err != nil {
+		return false, err
+	}
+
+	config := c.base.Clone()
+	config.GetConfigForClient = nil
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	// This config replaces the listener's own, so it offers the protocols
+	// HTTP/2 and gRPC negotiate; other clients do not use ALPN.
+	config.NextProtos = []string{"h2", "http/1.1"}
+	if len(revoked) > 0 {
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, chain := range state.VerifiedChains {
+				for _, cert := range chain {
+					if revoked[revocationKey(cert.RawIssuer, cert.SerialNumber)] {
+						return fmt.Errorf("client certificate %s is revoked", cert.Subject)
+					}
+				}
+			}
+			return nil
+		}
+	}
+	c.current.Store(config)
+	c.caPEM, c.crl = caPEM, crl
+	return true, nil
+}
+
+// revokedCertificates parses the PEM or DER revocation lists in data, each
+// of which must be signed by one of cas, into a set of revocationKeys.
+func revokedCertificates(data []byte, cas []*x509.Certificate) (map[string]bool, error) {
+	var lists [][]byte
+	for rest := data; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			lists = append(lists, block.Bytes)
+		}
+	}
+	if len(lists) == 0 && len(bytes.TrimSpace(data)) > 0 {
+		lists = [][]byte{data}
+	}
+
+	revoked := make(map[string]bool)
+	for _, der := range lists {
+		list, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse client CRL: %w", err)
+		}
+		signed := false
+		for _, ca := range cas {
+			if bytes.Equal(ca.RawSubject, list.RawIssuer) && list.CheckSignatureFrom(ca) == nil {
+				signed = true
+				break
+			}
+		}
+		if !signed {
+			return nil, fmt.Errorf("client CRL issued by %s is not signed by a client CA", list.Issuer)
+		}
+		if !list.NextUpdate.IsZero() && time.Now().After(list.NextUpdate) {
+			logger.Warn("client CRL is past its next update", "issuer", list.Issuer.String(), "next_update", list.NextUpdate.Format(time.RFC3339))
+		}
+		for _, entry := range list.RevokedCertificateEntries {
+			revoked[revocationKey(list.RawIssuer, entry.SerialNumber)] = true
+		}
+	}
+	return revoked, nil
+}
+
+// revocationKey identifies a certificate by its issuer and serial number.
+func revocationKey(issuer []byte, serial *big.Int) string {
+	return string(issuer) + "/" + serial.String()
+}
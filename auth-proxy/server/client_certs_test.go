@@ -0,0 +1,185 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority that issues client certificates and
+// revocation lists.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "agent"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func (ca *testCA) crl(t *testing.T, number int64, serials ...int64) []byte {
+	t.Helper()
+	template := &x509.RevocationList{
+		Number:     big.NewInt(number),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range serials {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// verify runs the current config's revocation check on a chain of cert
+// and the CA.
+func verify(c *clientCerts, ca *testCA, cert *x509.Certificate) error {
+	config := c.current.Load()
+	if config.VerifyConnection == nil {
+		return nil
+	}
+	return config.VerifyConnection(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert, ca.cert}}})
+}
+
+func TestClientCertsReloadCRL(t *testing.T) {
+	dir := t.TempDir()
+	caFile, crlFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "crl.pem")
+	ca := newTestCA(t, "client CA")
+	writeFile(t, caFile, ca.pem)
+	writeFile(t, crlFile, ca.crl(t, 1))
+
+	c, err := newClientCerts(&tls.Config{}, caFile, crlFile)
+	if err != nil {
+		t.Fatalf("newClientCerts() error = %v", err)
+	}
+	revokedCert, validCert := ca.issue(t, 2), ca.issue(t, 3)
+	if err := verify(c, ca, revokedCert); err != nil {
+		t.Fatalf("certificate rejected before it was revoked: %v", err)
+	}
+
+	if changed, err := c.load(); changed || err != nil {
+		t.Errorf("load() of unchanged files = %t, %v, want false, nil", changed, err)
+	}
+
+	writeFile(t, crlFile, ca.crl(t, 2, 2))
+	if changed, err := c.load(); !changed || err != nil {
+		t.Fatalf("load() after the CRL changed = %t, %v, want true, nil", changed, err)
+	}
+	tests := []struct {
+		name    string
+		cert    *x509.Certificate
+		wantErr bool
+	}{
+		{"revoked", revokedCert, true},
+		{"valid", validCert, false},
+	}
+	for _, tt := range tests {
+		if err := verify(c, ca, tt.cert); (err != nil) != tt.wantErr {
+			t.Errorf("%s certificate: verify error = %v, want error = %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestClientCertsKeepPreviousConfigOnBadReload(t *testing.T) {
+	tests := []struct {
+		name string
+		crl  func(ca, other *testCA) []byte
+	}{
+		{"signed by another CA", func(ca, other *testCA) []byte { return other.crl(t, 2, 2) }},
+		{"malformed", func(ca, other *testCA) []byte { return []byte("not a CRL") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			caFile, crlFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "crl.pem")
+			ca, other := newTestCA(t, "client CA"), newTestCA(t, "other CA")
+			writeFile(t, caFile, ca.pem)
+			writeFile(t, crlFile, ca.crl(t, 1, 2))
+			c, err := newClientCerts(&tls.Config{}, caFile, crlFile)
+			if err != nil {
+				t.Fatalf("newClientCerts() error = %v", err)
+			}
+			previous := c.current.Load()
+
+			writeFile(t, crlFile, tt.crl(ca, other))
+			if _, err := c.load(); err == nil {
+				t.Fatal("load() of a bad CRL succeeded")
+			}
+			if c.current.Load() != previous {
+				t.Error("a bad CRL replaced the previous config")
+			}
+			if err := verify(c, ca, ca.issue(t, 2)); err == nil {
+				t.Error("revocations from the previous CRL no longer apply")
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"auth-proxy/middleware"
+)
+
+// startDebug serves the pprof profiles and expvar variables, such as
+// memstats, on their own port behind the admin token, so they are never
+// exposed on the ingest port.
+func (s *Server) startDebug() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	listener, err := s.listenConfig().Listen(context.Background(), "tcp", ":"+s.config.DebugPort)
+	if err != nil {
+		return fmt.Errorf("failed to listen for debug endpoints: %w", err)
+	}
+	// No write timeout: CPU profiles and traces stream for as long as the
+	// seconds parameter asks.
+	debugServer := &http.Server{
+		Handler:           middleware.AdminAuth(s.config.AdminToken)(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	s.onShutdown(debugServer.Shutdown)
+	go func() {
+		logger.Info("starting debug listener", "port", s.config.DebugPort)
+		if err := debugServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("debug server stopped", "error", err)
+		}
+	}()
+	return nil
+}
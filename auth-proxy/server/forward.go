@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+
+	"auth-proxy/forward"
+	"auth-proxy/policy"
+)
+
+// startForward serves the Fluentd forward protocol on its own port so
+// Fluentd and Fluent Bit can use their forward output.
+func (s *Server) startForward(authorizer policy.Authorizer, tlsConfig *tls.Config) error {
+	allowlist, err := s.listenerAllowlist()
+	if err != nil {
+		return err
+	}
+	hostname := s.config.ForwardHostname
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	forwardServer, err := forward.NewServer(forward.Options{
+		SharedKeys:      s.config.ForwardSharedKeys,
+		Validator:       s.validator,
+		Hostname:        hostname,
+		MaxMessageBytes: s.config.MaxDecompressedBytes,
+	}, func(ctx context.Context, batch *forward.Batch) error {
+		return s.storeBatch(ctx, authorizer, allowlist, listenerBatch{
+			claims:  batch.Claims,
+			ip:      addrIP(batch.Remote),
+			method:  "forward",
+			path:    batch.Tag,
+			bytes:   batch.Bytes,
+			entries: batch.Entries,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	listener, err := s.listen("tcp", ":"+s.config.ForwardPort)
+	if err != nil {
+		return fmt.Errorf("failed to listen for forward protocol: %w", err)
+	}
+	if tlsConfig != nil {
+		if tlsConfig, err = s.listenerTLSConfig(tlsConfig); err != nil {
+			listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	s.closeOnShutdown(listener)
+	go func() {
+		logger.Info("starting forward listener", "port", s.config.ForwardPort)
+		if err := forwardServer.Serve(listener); err != nil {
+			logger.Error("forward server stopped", "error", err)
+		}
+	}()
+	return nil
+}
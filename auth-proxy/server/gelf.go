@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"auth-proxy/gelf"
+	"auth-proxy/policy"
+)
+
+// startGELF serves GELF on the same port over TCP, using TLS when the
+// proxy has a certificate, and over UDP.
+func (s *Server) startGELF(authorizer policy.Authorizer, tlsConfig *tls.Config) error {
+	allowlist, err := s.listenerAllowlist()
+	if err != nil {
+		return err
+	}
+	authenticate, err := s.sourceAuthenticator(s.config.GELFSourceAccounts, "gelf")
+	if err != nil {
+		return err
+	}
+
+	handler := func(ctx context.Context, batch *gelf.Batch) error {
+		ip := addrIP(batch.Remote)
+		for _, entry := range batch.Entries {
+			entry["source_ip"] = ip.String()
+		}
+		return s.storeBatch(ctx, authorizer, allowlist, listenerBatch{
+			claims:  batch.Claims,
+			ip:      ip,
+			method:  "gelf",
+			bytes:   batch.Bytes,
+			entries: batch.Entries,
+		})
+	}
+	gelfServer := gelf.NewServer(authenticate, handler, s.config.GELFMaxMessageBytes)
+
+	listener, err := s.listen("tcp", ":"+s.config.GELFPort)
+	if err != nil {
+		return fmt.Errorf("failed to listen for GELF over TCP: %w", err)
+	}
+	packetConn, err := s.listenPacket("udp", ":"+s.config.GELFPort)
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to listen for GELF over UDP: %w", err)
+	}
+	if tlsConfig != nil {
+		if tlsConfig, err = s.listenerTLSConfig(tlsConfig); err != nil {
+			listener.Close()
+			packetConn.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	s.closeOnShutdown(listener, packetConn)
+	logger.Info("starting GELF listener on TCP and UDP", "port", s.config.GELFPort)
+	go func() {
+		if err := gelfServer.ServeTCP(listener); err != nil {
+			logger.Error("GELF TCP server stopped", "error", err)
+		}
+	}()
+	go func() {
+		if err := gelfServer.ServeUDP(packetConn); err != nil {
+			logger.Error("GELF UDP server stopped", "error", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"auth-proxy/auth"
+	"auth-proxy/ingestpb"
+	"auth-proxy/metrics"
+	"auth-proxy/middleware"
+	"auth-proxy/otlp"
+	"auth-proxy/policy"
+	"auth-proxy/storage"
+
+	collectorlogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip" // lets clients send gzip-compressed exports
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// startGRPC serves the OTLP gRPC LogsService and the native LogIngest service
+// on their own port, authenticated with the same credentials as HTTP: a
+// bearer token in the "authorization" metadata, an API key in "x-api-key",
+// or a verified client certificate.
+func (s *Server) startGRPC(authorizer policy.Authorizer, tlsConfig *tls.Config) error {
+	listener, err := s.listen("tcp", ":"+s.config.GRPCPort)
+	if err != nil {
+		return fmt.Errorf("failed to listen for gRPC: %w", err)
+	}
+
+	allowlist, err := s.listenerAllowlist()
+	if err != nil {
+		return err
+	}
+
+	options := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(int(s.config.MaxDecompressedBytes)),
+		grpc.UnaryInterceptor(s.grpcAuthInterceptor(allowlist)),
+		grpc.StreamInterceptor(s.grpcStreamAuthInterceptor(allowlist)),
+	}
+	if tlsConfig != nil {
+		if tlsConfig, err = s.listenerTLSConfig(tlsConfig); err != nil {
+			return err
+		}
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	grpcServer := grpc.NewServer(options...)
+	collectorlogs.RegisterLogsServiceServer(grpcServer, &otlpLogsService{storage: s.storage, authorizer: authorizer})
+	ingestpb.RegisterLogIngestServer(grpcServer, &logIngestService{storage: s.storage, authorizer: authorizer})
+
+	go func() {
+		logger.Info("starting gRPC listener", "port", s.config.GRPCPort)
+		if err := grpcServer.Serve(listener); err != nil {
+			logger.Error("gRPC server stopped", "error", err)
+		}
+	}()
+	s.onShutdown(func(ctx context.Context) error {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			return nil
+		case <-ctx.Done():
+			grpcServer.Stop()
+			return fmt.Errorf("gRPC calls did not finish before shutdown: %w", ctx.Err())
+		}
+	})
+	return nil
+}
+
+// grpcAuthInterceptor authenticates every call and stores the claims in the
+// context under middleware.ClaimsContextKey, as AuthMiddleware does.
+func (s *Server) grpcAuthInterceptor(allowlist *middleware.IPAllowlist) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		received := time.Now()
+		ctx, err := s.grpcAuthContext(ctx, allowlist, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(metrics.WithReceivedAt(ctx, received), req)
+	}
+}
+
+// grpcStreamAuthInterceptor is grpcAuthInterceptor for streaming calls,
+// which are authenticated once when the stream opens.
+func (s *Server) grpcStreamAuthInterceptor(allowlist *middleware.IPAllowlist) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := s.grpcAuthContext(stream.Context(), allowlist, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &claimsServerStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+func (s *Server) grpcAuthContext(ctx context.Context, allowlist *middleware.IPAllowlist, fullMethod string) (context.Context, error) {
+	claims, err := s.authenticateGRPC(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ip net.IP
+	if p, ok := peer.FromContext(ctx); ok {
+		ip = addrIP(p.Addr)
+	}
+	if err := s.admit(ctx, claims, ip, allowlist, "gRPC call to "+fullMethod); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	return context.WithValue(ctx, middleware.ClaimsContextKey, claims), nil
+}
+
+// claimsServerStream overrides the context of a stream with one carrying
+// the caller's claims.
+type claimsServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (c *claimsServerStream) Context() context.Context {
+	return c.ctx
+}
+
+func (s *Server) authenticateGRPC(ctx context.Context) (*auth.Claims, error) {
+	if certValidator, ok := s.validator.(auth.CertificateValidator); ok {
+		if p, ok := peer.FromContext(ctx); ok {
+			if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.VerifiedChains) > 0 {
+				if claims, err := certValidator.ValidateCertificate(ctx, tlsInfo.State.VerifiedChains[0][0]); err == nil {
+					return claims, nil
+				}
+			}
+		}
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	if values := md.Get(strings.ToLower(middleware.APIKeyHeader)); len(values) > 0 {
+		token = values[0]
+	}
+	if values := md.Get("authorization"); len(values) > 0 {
+		parts := strings.SplitN(values[0], " ", 2)
+		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+			return nil, status.Error(codes.Unauthenticated, "authorization must be a bearer token")
+		}
+		token = parts[1]
+	}
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing credentials")
+	}
+
+	claims, err := s.validator.Validate(ctx, token)
+	if err != nil {
+		return nil, status.Error(codes.PermissionDenied, "invalid credentials")
+	}
+	return claims, nil
+}
+
+// otlpLogsService implements the OTLP gRPC LogsService on top of LogStorage.
+type otlpLogsService struct {
+	collectorlogs.UnimplementedLogsServiceServer
+	storage    storage.LogStorage
+	authorizer policy.Authorizer
+}
+
+func (o *otlpLogsService) Export(ctx context.Context, req *collectorlogs.ExportLogsServiceRequest) (*collectorlogs.ExportLogsServiceResponse, error) {
+	claims, ok := ctx.Value(middleware.ClaimsContextKey).(*auth.Claims)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "missing credentials")
+	}
+
+	logs := otlp.Entries(req)
+	if o.authorizer != nil {
+		input := policy.Input{
+			Claims:       claims,
+			AccountID:    claims.GetAccountID(),
+			Method:       "grpc",
+			Path:         "/opentelemetry.proto.collector.logs.v1.LogsService/Export",
+			PayloadBytes: int64(proto.Size(req)),
+			Entries:      len(logs),
+			Containers:   storage.ContainerNames(logs),
+		}
+		if err := o.authorizer.Authorize(ctx, input); err != nil {
+			logger.WarnContext(ctx, "rejected logs by policy", "source", "otlp-grpc", "account_id", input.AccountID, "error", err)
+			return nil, status.Error(codes.PermissionDenied, "request denied by policy")
+		}
+	}
+
+	resp := &collectorlogs.ExportLogsServiceResponse{}
+	if len(logs) == 0 {
+		return resp, nil
+	}
+	if err := o.storage.StoreLogs(ctx, claims.GetAccountID(), logs); err != nil {
+		var skippedErr *storage.SkippedEntriesError
+		var tooLarge *storage.BatchTooLargeError
+		if errors.As(err, &tooLarge) {
+			return nil, status.Error(codes.InvalidArgument, tooLarge.Error())
+		}
+		if !errors.As(err, &skippedErr) {
+			// Unavailable tells OTLP exporters the export may be retried.
+			logger.ErrorContext(ctx, "failed to store logs", "source", "otlp-grpc", "account_id", claims.GetAccountID(), "error", err)
+			return nil, status.Error(codes.Unavailable, "failed to store logs")
+		}
+		logger.WarnContext(ctx, "stored logs with warnings", "source", "otlp-grpc", "account_id", claims.GetAccountID(), "error", err)
+		resp.PartialSuccess = &collectorlogs.ExportLogsPartialSuccess{
+			RejectedLogRecords: int64(skippedErr.Count()),
+			ErrorMessage:       skippedErr.Summary(),
+		}
+	}
+	return resp, nil
+}
+
+// logIngestService implements the native LogIngest service on top of
+// LogStorage.
+type logIngestService struct {
+	ingestpb.UnimplementedLogIngestServer
+	storage    storage.LogStorage
+	authorizer policy.Authorizer
+}
+
+func (l *logIngestService) Ingest(ctx context.Context, req *ingestpb.IngestRequest) (*ingestpb.IngestResponse, error) {
+	resp := &ingestpb.IngestResponse{}
+	if err := l.store(ctx, ingestpb.LogIngest_Ingest_FullMethodName, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// IngestStream stores every batch before reading the next, so a failed
+// stream has stored all batches before the one that failed.
+func (l *logIngestService) IngestStream(stream ingestpb.LogIngest_IngestStreamServer) error {
+	resp := &ingestpb.IngestResponse{}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(resp)
+		}
+		if err != nil {
+			return err
+		}
+		ctx := metrics.WithReceivedAt(stream.Context(), time.Now())
+		if err := l.store(ctx, ingestpb.LogIngest_IngestStream_FullMethodName, req, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// store authorizes and stores one batch, adding its counts to resp.
+func (l *logIngestService) store(ctx context.Context, fullMethod string, req *ingestpb.IngestRequest, resp *ingestpb.IngestResponse) error {
+	claims, ok := ctx.Value(middleware.ClaimsContextKey).(*auth.Claims)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "missing credentials")
+	}
+
+	logs := ingestpb.Entries(req)
+	if l.authorizer != nil {
+		input := policy.Input{
+			Claims:       claims,
+			AccountID:    claims.GetAccountID(),
+			Method:       "grpc",
+			Path:         fullMethod,
+			PayloadBytes: int64(proto.Size(req)),
+			Entries:      len(logs),
+			Containers:   storage.ContainerNames(logs),
+		}
+		if err := l.authorizer.Authorize(ctx, input); err != nil {
+			logger.WarnContext(ctx, "rejected logs by policy", "source", "grpc", "account_id", input.AccountID, "error", err)
+			return status.Error(codes.PermissionDenied, "request denied by policy")
+		}
+	}
+
+	if len(logs) == 0 {
+		return nil
+	}
+	rejected := 0
+	if err := l.storage.StoreLogs(ctx, claims.GetAccountID(), logs); err != nil {
+		var skippedErr *storage.SkippedEntriesError
+		var tooLarge *storage.BatchTooLargeError
+		if errors.As(err, &tooLarge) {
+			return status.Error(codes.InvalidArgument, tooLarge.Error())
+		}
+		if !errors.As(err, &skippedErr) {
+			logger.ErrorContext(ctx, "failed to store logs", "source", "grpc", "account_id", claims.GetAccountID(), "error", err)
+			return status.Errorf(codes.Unavailable, "failed to store logs after accepting %d entries", resp.Accepted)
+		}
+		logger.WarnContext(ctx, "stored logs with warnings", "source", "grpc", "account_id", claims.GetAccountID(), "error", err)
+		rejected = skippedErr.Count()
+		resp.ErrorMessage = skippedErr.Summary()
+	}
+	resp.Accepted += int64(len(logs) - rejected)
+	resp.Rejected += int64(rejected)
+	return nil
+}
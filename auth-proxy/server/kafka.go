@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"auth-proxy/auth"
+	"auth-proxy/kafka"
+	"auth-proxy/policy"
+)
+
+// startKafka consumes log batches from Kafka. Each record is attributed to
+// an account by its token header or, when enabled, its account header.
+// Records carry no client address, so tenant IP allowlists do not apply.
+func (s *Server) startKafka(authorizer policy.Authorizer) error {
+	opts := kafka.Options{
+		Brokers:       s.config.KafkaBrokers,
+		Group:         s.config.KafkaGroupID,
+		Topics:        s.config.KafkaTopics,
+		TopicPattern:  s.config.KafkaTopicPattern,
+		SASLMechanism: s.config.KafkaSASLMechanism,
+		SASLUsername:  s.config.KafkaSASLUsername,
+		SASLPassword:  s.config.KafkaSASLPassword,
+	}
+	if s.config.KafkaTLS {
+		tlsConfig, err := kafka.TLSConfig(s.config.KafkaTLSCAFile)
+		if err != nil {
+			return err
+		}
+		opts.TLS = tlsConfig
+	}
+
+	consumer, err := kafka.NewConsumer(opts, func(ctx context.Context, record *kafka.Record) error {
+		claims, err := s.kafkaClaims(ctx, record)
+		if err != nil {
+			logger.WarnContext(ctx, "dropped kafka record", "topic", record.Topic, "partition", record.Partition, "offset", record.Offset, "error", err)
+			return nil
+		}
+		entries, malformed, err := kafka.DecodeEntries(record.Value)
+		if err != nil {
+			logger.WarnContext(ctx, "dropped kafka record", "topic", record.Topic, "partition", record.Partition, "offset", record.Offset, "account_id", claims.GetAccountID(), "error", err)
+			return nil
+		}
+		if malformed > 0 {
+			logger.WarnContext(ctx, "skipped malformed lines in kafka record", "malformed", malformed, "topic", record.Topic, "partition", record.Partition, "offset", record.Offset, "account_id", claims.GetAccountID())
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+
+		err = s.storeBatch(ctx, authorizer, nil, listenerBatch{
+			claims:  claims,
+			method:  "kafka",
+			path:    record.Topic,
+			bytes:   int64(len(record.Value)),
+			entries: entries,
+		})
+		if err != nil && !errors.Is(err, errStoreFailed) {
+			logger.WarnContext(ctx, "dropped kafka record", "topic", record.Topic, "partition", record.Partition, "offset", record.Offset, "account_id", claims.GetAccountID(), "error", err)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// A record interrupted by shutdown is not committed, and is consumed
+	// again after the restart.
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		logger.Info("consuming kafka topics", "topics", strings.Join(s.config.KafkaTopics, ","), "group", s.config.KafkaGroupID)
+		if err := consumer.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			logger.Error("kafka consumer stopped", "error", err)
+		}
+	}()
+	s.onShutdown(func(context.Context) error {
+		cancel()
+		<-stopped
+		consumer.Close()
+		return nil
+	})
+	return nil
+}
+
+func (s *Server) kafkaClaims(ctx context.Context, record *kafka.Record) (*auth.Claims, error) {
+	if header := s.config.KafkaTokenHeader; header != "" {
+		if token := record.Headers[strings.ToLower(header)]; token != "" {
+			if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+				token = token[7:]
+			}
+			claims, err := s.validator.Validate(ctx, token)
+			if err != nil {
+				return nil, fmt.Errorf("invalid token: %w", err)
+			}
+			return claims, nil
+		}
+	}
+	if header := s.config.KafkaAccountHeader; header != "" {
+		if account := record.Headers[strings.ToLower(header)]; account != "" {
+			accountID, err := strconv.ParseInt(account, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid account header %q", account)
+			}
+			return &auth.Claims{AccountID: accountID, Subject: "kafka:" + record.Topic}, nil
+		}
+	}
+	return nil, fmt.Errorf("no credentials in record headers")
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"auth-proxy/proxyproto"
+)
+
+// listen opens a stream listener on address, shared through SO_REUSEPORT
+// with other processes when REUSE_PORT is set, that reads client addresses
+// from the PROXY protocol when PROXY_PROTOCOL is set.
+func (s *Server) listen(network, address string) (net.Listener, error) {
+	listener, err := s.listenConfig().Listen(context.Background(), network, address)
+	if err != nil || !s.config.ProxyProtocol {
+		return listener, err
+	}
+	proxyListener, err := proxyproto.NewListener(listener, s.config.ProxyProtocolSources)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return proxyListener, nil
+}
+
+// listenPacket is listen for datagram listeners.
+func (s *Server) listenPacket(network, address string) (net.PacketConn, error) {
+	return s.listenConfig().ListenPacket(context.Background(), network, address)
+}
+
+// listenUnix listens on the UNIX_SOCKET path with UNIX_SOCKET_MODE,
+// replacing the socket file a previous run left.
+func (s *Server) listenUnix() (net.Listener, error) {
+	path := s.config.UnixSocket
+	mode, err := strconv.ParseUint(s.config.UnixSocketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UNIX_SOCKET_MODE: %w", err)
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on unix socket: %w", err)
+	}
+	// The file is left on close: after a restart it belongs to the new
+	// process, which replaced it.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set unix socket mode: %w", err)
+	}
+	return listener, nil
+}
+
+func (s *Server) listenConfig() *net.ListenConfig {
+	if !s.config.ReusePort {
+		return &net.ListenConfig{}
+	}
+	return &net.ListenConfig{Control: reusePort}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"auth-proxy/auth"
+	"auth-proxy/logging"
+	"auth-proxy/metrics"
+	"auth-proxy/middleware"
+	"auth-proxy/policy"
+	"auth-proxy/storage"
+)
+
+// errStoreFailed marks storeBatch errors that may succeed on retry, as
+// opposed to rejections of the batch itself.
+var errStoreFailed = errors.New("failed to store logs")
+
+// listenerBatch is a group of entries received by a non-HTTP listener.
+// method and path stand in for the HTTP request line in policy input.
+type listenerBatch struct {
+	claims  *auth.Claims
+	ip      net.IP
+	method  string
+	path    string
+	bytes   int64
+	entries []map[string]interface{}
+}
+
+// storeBatch admits, authorizes and stores a batch. These protocols cannot
+// report partial success, so entries storage skipped are only logged.
+func (s *Server) storeBatch(ctx context.Context, authorizer policy.Authorizer, allowlist *middleware.IPAllowlist, batch listenerBatch) error {
+	ctx = metrics.WithReceivedAt(ctx, time.Now())
+	if err := s.admit(ctx, batch.claims, batch.ip, allowlist, batch.method); err != nil {
+		return err
+	}
+	accountID := batch.claims.GetAccountID()
+	if authorizer != nil {
+		input := policy.Input{
+			Claims:       batch.claims,
+			AccountID:    accountID,
+			Method:       batch.method,
+			Path:         batch.path,
+			PayloadBytes: batch.bytes,
+			Entries:      len(batch.entries),
+			Containers:   storage.ContainerNames(batch.entries),
+		}
+		if err := authorizer.Authorize(ctx, input); err != nil {
+			logger.WarnContext(ctx, "rejected logs by policy", "source", batch.method, "account_id", accountID, "error", err)
+			return err
+		}
+	}
+	if err := s.storage.StoreLogs(ctx, accountID, batch.entries); err != nil {
+		var skippedErr *storage.SkippedEntriesError
+		var tooLarge *storage.BatchTooLargeError
+		if errors.As(err, &tooLarge) {
+			return err
+		}
+		if !errors.As(err, &skippedErr) {
+			return fmt.Errorf("%w: %v", errStoreFailed, err)
+		}
+		logger.WarnContext(ctx, "stored logs with warnings", "source", batch.method, "account_id", accountID, "error", err)
+	}
+	return nil
+}
+
+// sourceAuthenticator attributes senders of unauthenticated protocols to an
+// account: by verified client certificate when the validator accepts them,
+// otherwise by matching the sender address against sources, a map from
+// account ID to comma-separated CIDRs or IPs.
+func (s *Server) sourceAuthenticator(sources map[string]string, protocol string) (func(ctx context.Context, remote net.Addr, cert *x509.Certificate) (*auth.Claims, error), error) {
+	var networks *middleware.IPAllowlist
+	if len(sources) > 0 {
+		var err error
+		if networks, err = middleware.NewIPAllowlist(sources, nil); err != nil {
+			return nil, fmt.Errorf("invalid %s source accounts: %w", protocol, err)
+		}
+	}
+	certValidator, _ := s.validator.(auth.CertificateValidator)
+
+	return func(ctx context.Context, remote net.Addr, cert *x509.Certificate) (*auth.Claims, error) {
+		if cert != nil && certValidator != nil {
+			return certValidator.ValidateCertificate(ctx, cert)
+		}
+		ip := addrIP(remote)
+		if networks != nil {
+			if accountID, ok := networks.AccountFor(ip); ok {
+				return &auth.Claims{AccountID: accountID, Subject: protocol + ":" + ip.String()}, nil
+			}
+		}
+		return nil, fmt.Errorf("no account for %s sender %s", protocol, ip)
+	}, nil
+}
+
+// admit applies the per-account checks that ingestMiddleware performs for
+// HTTP to callers of the non-HTTP listeners: tenant suspension, the
+// logs:write scope and tenant IP allowlists. X-Forwarded-For does not exist
+// on these listeners, so ip is always the direct peer.
+func (s *Server) admit(ctx context.Context, claims *auth.Claims, ip net.IP, allowlist *middleware.IPAllowlist, source string) error {
+	if s.tenantStatus != nil && s.tenantStatus.Suspended(ctx, claims.AccountID) {
+		logging.Audit.WarnContext(ctx, "rejected request for suspended account", "source", source, "account_id", claims.GetAccountID())
+		return errors.New("account suspended")
+	}
+	if !claims.HasScope(auth.ScopeLogsWrite) {
+		return errors.New("missing scope " + auth.ScopeLogsWrite)
+	}
+	if allowlist != nil && !allowlist.Allowed(claims.AccountID, ip) {
+		logging.Audit.WarnContext(ctx, "rejected request from source IP not in allowlist", "source", source, "remote_addr", ip.String(), "account_id", claims.GetAccountID())
+		return errors.New("source address not allowed")
+	}
+	return nil
+}
+
+// listenerAllowlist builds the tenant IP allowlist for listeners that see
+// clients directly, or returns nil when none is configured.
+func (s *Server) listenerAllowlist() (*middleware.IPAllowlist, error) {
+	if len(s.config.TenantIPAllowlists) == 0 {
+		return nil, nil
+	}
+	return middleware.NewIPAllowlist(s.config.TenantIPAllowlists, nil)
+}
+
+// listenerTLSConfig adds the server certificate to tlsConfig for listeners
+// that, unlike http.Server, cannot load it themselves.
+func (s *Server) listenerTLSConfig(tlsConfig *tls.Config) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.config.TLSCertFile, s.config.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	return tlsConfig, nil
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
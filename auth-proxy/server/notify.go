@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"auth-proxy/notify"
+	"auth-proxy/storage"
+)
+
+// alertWatcher decides which alerts to send, from the state of the
+// indexer, the circuit breaker, cluster failover and the dead-letter queue.
+// Conditions are sent once when they start and once when they resolve;
+// circuit breaker trips and failovers are sent every time.
+type alertWatcher struct {
+	stats         storage.IndexerStatsProvider
+	breaker       *storage.CircuitBreaker
+	failover      storage.FailoverStatusProvider
+	deadLetterDir string
+	// failureRate and deadLetterBytes are the thresholds, zero when their
+	// alert is disabled.
+	failureRate     float64
+	deadLetterBytes int64
+
+	firing       map[string]bool
+	lastStats    storage.IndexerStats
+	lastTrips    uint64
+	lastSwitches uint64
+}
+
+func (s *Server) newAlertWatcher() *alertWatcher {
+	w := &alertWatcher{
+		breaker:         s.breaker,
+		deadLetterDir:   s.config.DeadLetterDir,
+		failureRate:     s.config.NotifyFailureRate,
+		deadLetterBytes: s.config.NotifyDeadLetterBytes,
+		firing:          make(map[string]bool),
+	}
+	if provider, ok := s.backend.(storage.IndexerStatsProvider); ok {
+		w.stats = provider
+		w.lastStats = provider.IndexerStats()
+	}
+	if w.breaker != nil {
+		w.lastTrips = w.breaker.Trips()
+	}
+	if provider, ok := s.backend.(storage.FailoverStatusProvider); ok {
+		w.failover = provider
+		w.lastSwitches = provider.Switches()
+	}
+	return w
+}
+
+// watchAlerts checks for alerts every interval and sends them through
+// notifier until Shutdown runs.
+func (s *Server) watchAlerts(notifier *notify.Notifier, interval time.Duration) {
+	watcher := s.newAlertWatcher()
+	done := make(chan struct{})
+	s.onShutdown(func(context.Context) error {
+		close(done)
+		return nil
+	})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				for _, alert := range watcher.check() {
+					if err := notifier.Notify(context.Background(), alert); err != nil {
+						logger.Warn("failed to send notification", "alert", alert.Name, "error", err)
+					}
+				}
+			}
+		}
+	}()
+}
+
+// check returns the alerts that started or resolved since the last check.
+func (w *alertWatcher) check() []notify.Alert {
+	var alerts []notify.Alert
+	if w.stats != nil && w.failureRate > 0 {
+		stats := w.stats.IndexerStats()
+		failed := stats.NumFailed - w.lastStats.NumFailed
+		total := failed + stats.NumFlushed - w.lastStats.NumFlushed
+		w.lastStats = stats
+		rate := 0.0
+		if total > 0 {
+			rate = float64(failed) / float64(total)
+		}
+		summary := fmt.Sprintf("%.1f%% of documents failed to index (%d of %d)", rate*100, failed, total)
+		if alert, ok := w.transition("bulk_failure_rate", rate >= w.failureRate && failed > 0, summary, rate, w.failureRate); ok {
+			alerts = append(alerts, alert)
+		}
+	}
+	if w.breaker != nil {
+		if trips := w.breaker.Trips(); trips > w.lastTrips {
+			alerts = append(alerts, notify.Alert{
+				Name:    "circuit_breaker_open",
+				Summary: fmt.Sprintf("circuit breaker opened %d times, logs are being shed", trips-w.lastTrips),
+				Value:   float64(trips - w.lastTrips),
+			})
+			w.lastTrips = trips
+		}
+	}
+	if w.failover != nil {
+		// Every switch is sent, so a failover and failback between two
+		// checks is still reported.
+		if switches := w.failover.Switches(); switches > w.lastSwitches {
+			onSecondary := w.failover.OnSecondary()
+			summary := "primary Elasticsearch cluster failed its health checks, writing to the secondary cluster"
+			if !onSecondary {
+				summary = "primary Elasticsearch cluster is healthy again, writing to it"
+			}
+			alerts = append(alerts, notify.Alert{
+				Name:     "elasticsearch_failover",
+				Summary:  summary,
+				Value:    float64(switches - w.lastSwitches),
+				Resolved: !onSecondary,
+			})
+			w.lastSwitches = switches
+		}
+	}
+	if w.deadLetterDir != "" && w.deadLetterBytes > 0 {
+		size, err := dirSize(w.deadLetterDir)
+		if err != nil {
+			logger.Warn("failed to measure dead-letter queue", "error", err)
+		} else {
+			summary := fmt.Sprintf("dead-letter queue holds %d bytes", size)
+			if alert, ok := w.transition("dead_letter_size", size >= w.deadLetterBytes, summary, float64(size), float64(w.deadLetterBytes)); ok {
+				alerts = append(alerts, alert)
+			}
+		}
+	}
+	return alerts
+}
+
+// transition records whether the alert name is firing, and returns the
+// alert to send when that changed.
+func (w *alertWatcher) transition(name string, firing bool, summary string, value, threshold float64) (notify.Alert, bool) {
+	if w.firing[name] == firing {
+		return notify.Alert{}, false
+	}
+	w.firing[name] = firing
+	return notify.Alert{Name: name, Summary: summary, Value: value, Threshold: threshold, Resolved: !firing}, true
+}
+
+// dirSize returns the total size of the files under dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
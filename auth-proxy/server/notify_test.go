@@ -0,0 +1,100 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"auth-proxy/storage"
+)
+
+type fakeStatsProvider struct {
+	stats storage.IndexerStats
+}
+
+func (p *fakeStatsProvider) IndexerStats() storage.IndexerStats {
+	return p.stats
+}
+
+type fakeFailover struct {
+	onSecondary bool
+	switches    uint64
+}
+
+func (f *fakeFailover) OnSecondary() bool { return f.onSecondary }
+func (f *fakeFailover) Switches() uint64  { return f.switches }
+
+func TestAlertWatcher(t *testing.T) {
+	dir := t.TempDir()
+	provider := &fakeStatsProvider{}
+	watcher := &alertWatcher{
+		stats:           provider,
+		deadLetterDir:   dir,
+		failureRate:     0.1,
+		deadLetterBytes: 10,
+		firing:          make(map[string]bool),
+	}
+
+	if alerts := watcher.check(); len(alerts) != 0 {
+		t.Fatalf("check() with no activity = %v, want none", alerts)
+	}
+
+	provider.stats.NumFlushed = 80
+	provider.stats.NumFailed = 20
+	if err := os.WriteFile(filepath.Join(dir, "dead-letters.ndjson"), make([]byte, 20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	alerts := watcher.check()
+	if len(alerts) != 2 || alerts[0].Name != "bulk_failure_rate" || alerts[1].Name != "dead_letter_size" {
+		t.Fatalf("check() = %v, want bulk_failure_rate and dead_letter_size firing", alerts)
+	}
+	if alerts[0].Resolved || alerts[0].Value != 0.2 {
+		t.Errorf("bulk_failure_rate alert = %+v", alerts[0])
+	}
+
+	// Still over the thresholds: nothing new to send.
+	provider.stats.NumFailed = 40
+	if alerts := watcher.check(); len(alerts) != 0 {
+		t.Fatalf("check() while firing = %v, want none", alerts)
+	}
+
+	provider.stats.NumFlushed = 180
+	if err := os.Remove(filepath.Join(dir, "dead-letters.ndjson")); err != nil {
+		t.Fatal(err)
+	}
+	alerts = watcher.check()
+	if len(alerts) != 2 || !alerts[0].Resolved || !alerts[1].Resolved {
+		t.Fatalf("check() = %v, want both alerts resolved", alerts)
+	}
+}
+
+func TestAlertWatcherFailover(t *testing.T) {
+	failover := &fakeFailover{}
+	watcher := &alertWatcher{failover: failover, firing: make(map[string]bool)}
+
+	if alerts := watcher.check(); len(alerts) != 0 {
+		t.Fatalf("check() without switches = %v, want none", alerts)
+	}
+
+	failover.onSecondary, failover.switches = true, 1
+	alerts := watcher.check()
+	if len(alerts) != 1 || alerts[0].Name != "elasticsearch_failover" || alerts[0].Resolved {
+		t.Fatalf("check() after a failover = %v, want elasticsearch_failover firing", alerts)
+	}
+	if alerts := watcher.check(); len(alerts) != 0 {
+		t.Fatalf("check() with no new switch = %v, want none", alerts)
+	}
+
+	// A failback and another failover between checks are both counted.
+	failover.switches = 3
+	alerts = watcher.check()
+	if len(alerts) != 1 || alerts[0].Value != 2 || alerts[0].Resolved {
+		t.Fatalf("check() after two switches = %v, want one firing alert with value 2", alerts)
+	}
+
+	failover.onSecondary, failover.switches = false, 4
+	alerts = watcher.check()
+	if len(alerts) != 1 || !alerts[0].Resolved {
+		t.Fatalf("check() after a failback = %v, want elasticsearch_failover resolved", alerts)
+	}
+}
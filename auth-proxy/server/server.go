@@ -1,51 +1,481 @@
 package server
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"auth-proxy/auth"
 	"auth-proxy/config"
 	"auth-proxy/handlers"
+	"auth-proxy/logging"
+	"auth-proxy/metrics"
 	"auth-proxy/middleware"
+	"auth-proxy/notify"
+	"auth-proxy/policy"
 	"auth-proxy/storage"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
+var logger = logging.Component("server")
+
 type Server struct {
-	config    *config.Config
-	validator auth.Validator
-	storage   storage.LogStorage
+	config       *config.Config
+	validator    auth.Validator
+	tenantStatus auth.TenantStatus
+	tokenIssuer  *auth.TokenIssuer
+	// routeValidators replace validator on the HTTP ingest routes they are
+	// keyed by, one of config.IngestRoutes.
+	routeValidators map[string]auth.Validator
+	// storage receives ingested batches. It wraps backend when batches are
+	// limited, logged ahead or behind a circuit breaker, so optional backend
+	// capabilities are looked up on backend.
+	storage storage.LogStorage
+	backend storage.LogStorage
+	wal     *storage.WALStorage
+	breaker *storage.CircuitBreaker
+
+	mu           sync.Mutex
+	shuttingDown bool
+	stops        []func(ctx context.Context) error
+}
+
+// New builds the server. tenantStatus may be nil when account suspension is
+// not tracked, and tokenIssuer nil when /token/refresh is disabled.
+func New(cfg *config.Config, validator auth.Validator, tenantStatus auth.TenantStatus, tokenIssuer *auth.TokenIssuer, logStorage storage.LogStorage) *Server {
+	s := &Server{
+		config:       cfg,
+		validator:    validator,
+		tenantStatus: tenantStatus,
+		tokenIssuer:  tokenIssuer,
+		storage:      logStorage,
+		backend:      logStorage,
+	}
+	reporter, _ := logStorage.(storage.HealthReporter)
+	if reporter != nil && cfg.CircuitBreaker {
+		s.breaker = storage.NewCircuitBreaker(s.storage, reporter, storage.CircuitBreakerConfig{
+			Threshold:     cfg.CircuitBreakerThreshold,
+			CheckInterval: cfg.CircuitBreakerInterval,
+			OpenFor:       cfg.CircuitBreakerOpenFor,
+		})
+		s.storage = s.breaker
+	}
+	// The write-ahead log goes outside the circuit breaker so batches are
+	// held on disk, not shed, while the cluster is down.
+	if cfg.WALDir != "" {
+		walStorage, err := storage.NewWALStorage(s.storage, reporter, storage.WALConfig{
+			Dir:          cfg.WALDir,
+			SegmentBytes: cfg.WALSegmentBytes,
+			MaxBytes:     cfg.WALMaxBytes,
+			Sync:         cfg.WALSync,
+			RetryAfter:   cfg.QueueFullRetryAfter,
+		})
+		if err != nil {
+			logger.Error("failed to open write-ahead log", "error", err)
+			os.Exit(1)
+		}
+		s.storage = walStorage
+		s.wal = walStorage
+	}
+	// Oversized batches are rejected before they reach the log.
+	if cfg.MaxBatchEntries > 0 {
+		s.storage = storage.NewBatchLimiter(s.storage, cfg.MaxBatchEntries, cfg.BatchLimitMode == "split")
+	}
+	if cfg.Metrics {
+		metrics.SetMaxAccounts(cfg.MetricsMaxAccounts)
+		s.storage = storage.NewInstrumentedStorage(s.storage)
+		if provider, ok := logStorage.(storage.IndexerStatsProvider); ok {
+			storage.RegisterIndexerMetrics(provider)
+		}
+		if provider, ok := logStorage.(storage.FailoverStatusProvider); ok {
+			storage.RegisterFailoverMetrics(provider)
+		}
+		if err := metrics.RegisterCounterFunc("http_panics_total", "Requests recovered from a panic.", func() float64 {
+			return float64(middleware.Panics())
+		}); err != nil {
+			logger.Warn("failed to register metric", "metric", "http_panics_total", "error", err)
+		}
+	}
+	return s
+}
+
+// RouteValidators makes the HTTP ingest routes in validators, keyed by one
+// of config.IngestRoutes, authenticate with their own validator instead of
+// the server's.
+func (s *Server) RouteValidators(validators map[string]auth.Validator) *Server {
+	s.routeValidators = validators
+	return s
 }
 
-func New(cfg *config.Config, validator auth.Validator, storage storage.LogStorage) *Server {
-	return &Server{
-		config:    cfg,
-		validator: validator,
-		storage:   storage,
+// validatorFor returns the validator of the HTTP ingest route.
+func (s *Server) validatorFor(route string) auth.Validator {
+	if validator, ok := s.routeValidators[route]; ok {
+		return validator
 	}
+	return s.validator
 }
 
 func (s *Server) Start() error {
 	mux := http.NewServeMux()
 
-	logsHandler := handlers.NewLogsHandler(s.storage)
-	authMiddleware := middleware.AuthMiddleware(s.validator)
-	mux.Handle("/logs", authMiddleware(logsHandler))
+	authorizer, err := s.authorizer()
+	if err != nil {
+		return err
+	}
+	ingest, err := s.ingestMiddleware()
+	if err != nil {
+		return err
+	}
+	authMiddleware := middleware.AuthMiddleware(s.validator, s.tenantStatus)
+	if s.config.HTTPIngest {
+		logsHandler := handlers.NewLogsHandler(s.storage, authorizer)
+		logsV1Handler := handlers.NewLogsV1Handler(s.storage, authorizer)
+		// Streamed chunks would slip under a batch limit that rejects,
+		// since no single chunk exceeds it.
+		if s.config.MaxBatchEntries == 0 || s.config.BatchLimitMode == "split" {
+			logsHandler.StreamEntries(s.config.StreamChunkEntries)
+			logsV1Handler.StreamEntries(s.config.StreamChunkEntries)
+		}
+		logsHandler.WaitForIndexing(s.config.SyncIngest, s.config.SyncIngestTimeout)
+		logsV1Handler.WaitForIndexing(s.config.SyncIngest, s.config.SyncIngestTimeout)
+		mux.Handle("/logs", ingest("logs", logsHandler))
+		// The versioned API cannot live at /v1/logs, which OTLP exporters
+		// already use.
+		mux.Handle("/api/v1/logs", ingest("logs", logsV1Handler))
+		// OTLP/HTTP exporters post to /v1/logs by default.
+		mux.Handle("/v1/logs", ingest("otlp", handlers.NewOTLPHandler(s.storage, authorizer)))
+		// Splunk HEC clients post to either path.
+		hecHandler := ingest("hec", handlers.NewHECHandler(s.storage, authorizer))
+		mux.Handle("/services/collector", hecHandler)
+		mux.Handle("/services/collector/event", hecHandler)
+		mux.Handle("/services/collector/event/1.0", hecHandler)
+		mux.Handle("/services/collector/health", handlers.NewHECHealthHandler())
+		mux.Handle("/loki/api/v1/push", ingest("loki", handlers.NewLokiHandler(s.storage, authorizer, s.config.MaxDecompressedBytes)))
+		bulkHandler := ingest("bulk", handlers.NewBulkHandler(s.storage, authorizer).WaitForIndexing(s.config.SyncIngestTimeout))
+		mux.Handle("/_bulk", bulkHandler)
+		esAuth := middleware.AuthMiddleware(s.validatorFor("bulk"), s.tenantStatus)
+		mux.Handle("/", esCompatRoutes(bulkHandler, esAuth(handlers.NewESInfoHandler())))
+	} else {
+		logger.Info("HTTP_INGEST is disabled, HTTP ingestion routes are not served")
+	}
+
+	if s.tokenIssuer != nil {
+		mux.Handle("/token/refresh", authMiddleware(handlers.NewTokenRefreshHandler(s.tokenIssuer)))
+	}
 
+	if s.config.AdminToken != "" {
+		adminAuth := middleware.AdminAuth(s.config.AdminToken)
+		if provider, ok := s.backend.(storage.SampleProvider); ok && s.config.SampleReservoirSize > 0 {
+			mux.Handle("/admin/samples", adminAuth(handlers.NewSamplesHandler(provider)))
+		}
+		if provider, ok := s.backend.(storage.DestinationStatsProvider); ok {
+			mux.Handle("/admin/storage/destinations", adminAuth(handlers.NewDestinationsHandler(provider)))
+		}
+		if s.config.DeadLetterDir != "" {
+			// Replayed documents go through the same storage as ingested ones.
+			replayer := storage.NewDeadLetterReplayer(s.config.DeadLetterDir, s.storage)
+			mux.Handle("/admin/dead-letters/replay", adminAuth(handlers.NewDeadLetterReplayHandler(replayer)))
+		}
+	} else {
+		logger.Info("ADMIN_TOKEN is not set, admin routes are disabled")
+	}
+
+	if s.config.DevMode {
+		if provider, ok := s.backend.(storage.MemoryLogProvider); ok {
+			logger.Warn("dev mode is enabled, /dev/logs serves ingested logs without authentication")
+			mux.Handle("/dev/logs", handlers.NewDevLogsHandler(provider))
+		}
+	}
+
+	// /health keeps its response for existing probes; Kubernetes should use
+	// /healthz for liveness and /readyz for readiness.
 	healthHandler := handlers.NewHealthHandler()
-	mux.Handle("/health", healthHandler)
+	if reporter, ok := s.backend.(storage.HealthReporter); ok {
+		healthHandler = handlers.NewCachedHealthHandler(reporter, s.config.HealthRefreshInterval)
+	}
+	if s.config.HealthDetail {
+		mux.Handle("/health", healthHandler)
+	} else {
+		mux.Handle("/health", handlers.NewHealthHandler())
+	}
+	mux.Handle("/healthz", handlers.NewLivenessHandler())
+	mux.Handle("/readyz", healthHandler.Readiness())
 
-	handler := middleware.LoggingMiddleware(mux)
+	metricsAuth := func(h http.Handler) http.Handler { return h }
+	if s.config.MetricsToken != "" {
+		metricsAuth = middleware.AdminAuth(s.config.MetricsToken)
+	}
+	if s.config.Metrics {
+		mux.Handle("/metrics", metricsAuth(metrics.Handler()))
+	}
+	mux.Handle("/version", metricsAuth(handlers.NewVersionHandler(s.features())))
+	if provider, ok := s.backend.(storage.IndexerStatsProvider); ok {
+		mux.Handle("/stats", metricsAuth(handlers.NewStatsHandler(provider)))
+		if s.config.StatsLogInterval > 0 {
+			s.logStats(provider, s.config.StatsLogInterval)
+		}
+	}
+
+	// Requests are counted by the pattern that matched them.
+	route := func(r *http.Request) string {
+		_, pattern := mux.Handler(r)
+		return pattern
+	}
+	accessLog := middleware.LoggingMiddleware(os.Stdout, middleware.AccessLogOptions{
+		Format:         s.config.AccessLogFormat,
+		LogsSampleRate: s.config.AccessLogLogsSampleRate,
+	})
+	handler := middleware.RequestIDMiddleware(middleware.MetricsMiddleware(route)(accessLog(middleware.RecoverMiddleware(middleware.TimeoutMiddleware(s.config.RequestTimeout)(mux)))))
+	if s.config.Tracing {
+		handler = otelhttp.NewHandler(handler, "http", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + route(r)
+		}))
+	}
 
 	httpServer := &http.Server{
-		Addr:         ":" + s.config.Port,
-		Handler:      handler,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Addr:              ":" + s.config.Port,
+		Handler:           handler,
+		ReadTimeout:       s.config.HTTPReadTimeout,
+		ReadHeaderTimeout: s.config.HTTPReadHeaderTimeout,
+		WriteTimeout:      s.config.HTTPWriteTimeout,
+		IdleTimeout:       s.config.HTTPIdleTimeout,
+		MaxHeaderBytes:    s.config.HTTPMaxHeaderBytes,
 	}
 
-	log.Printf("Starting auth proxy on port %s", s.config.Port)
-	return httpServer.ListenAndServe()
+	var tlsConfig *tls.Config
+	if s.config.TLSCertFile != "" {
+		if tlsConfig, err = s.tlsConfig(); err != nil {
+			return err
+		}
+	}
+	// ConfigureServer offers h2 through the TLS config, so it must be set.
+	httpServer.TLSConfig = tlsConfig
+	http2Server := &http2.Server{MaxConcurrentStreams: uint32(s.config.HTTP2MaxConcurrentStreams)}
+	if err := http2.ConfigureServer(httpServer, http2Server); err != nil {
+		return fmt.Errorf("failed to configure HTTP/2: %w", err)
+	}
+	if s.config.H2C {
+		httpServer.Handler = h2c.NewHandler(handler, http2Server)
+	}
+	if s.config.GRPCPort != "" {
+		if err := s.startGRPC(authorizer, tlsConfig); err != nil {
+			return err
+		}
+	}
+	if s.config.ForwardPort != "" {
+		if err := s.startForward(authorizer, tlsConfig); err != nil {
+			return err
+		}
+	}
+	if s.config.SyslogPort != "" {
+		if err := s.startSyslog(authorizer, tlsConfig); err != nil {
+			return err
+		}
+	}
+	if s.config.GELFPort != "" {
+		if err := s.startGELF(authorizer, tlsConfig); err != nil {
+			return err
+		}
+	}
+	if len(s.config.KafkaBrokers) > 0 {
+		if err := s.startKafka(authorizer); err != nil {
+			return err
+		}
+	}
+	if s.config.DebugPort != "" {
+		if err := s.startDebug(); err != nil {
+			return err
+		}
+	}
+	if s.config.NotifyWebhookURL != "" {
+		notifier, err := notify.New(notify.Options{
+			URL:     s.config.NotifyWebhookURL,
+			Format:  s.config.NotifyFormat,
+			Timeout: 10 * time.Second,
+		})
+		if err != nil {
+			return err
+		}
+		s.watchAlerts(notifier, s.config.NotifyInterval)
+	}
+
+	var listeners []net.Listener
+	if s.config.Port != "off" {
+		listener, err := s.listen("tcp", httpServer.Addr)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+	if s.config.UnixSocket != "" {
+		listener, err := s.listenUnix()
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+	// Shutdown makes the serve calls below return http.ErrServerClosed,
+	// even when it ran first.
+	s.onShutdown(httpServer.Shutdown)
+	serve := func(listener net.Listener) error {
+		if tlsConfig == nil {
+			return httpServer.Serve(listener)
+		}
+		return httpServer.ServeTLS(listener, s.config.TLSCertFile, s.config.TLSKeyFile)
+	}
+
+	if s.config.UnixSocket != "" {
+		logger.Info("starting auth proxy", "socket", s.config.UnixSocket, "tls", tlsConfig != nil)
+	}
+	if s.config.Port != "off" {
+		logger.Info("starting auth proxy", "port", s.config.Port, "tls", tlsConfig != nil)
+	}
+	for _, listener := range listeners[1:] {
+		go func(listener net.Listener) {
+			if err := serve(listener); err != nil && err != http.ErrServerClosed {
+				logger.Error("HTTP server stopped", "address", listener.Addr().String(), "error", err)
+			}
+		}(listener)
+	}
+	return serve(listeners[0])
+}
+
+// esCompatRoutes serves the Elasticsearch paths ServeMux cannot match on its
+// own: GET / and /{index}/_bulk. Any other path is not found.
+func esCompatRoutes(bulk, info http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/":
+			info.ServeHTTP(w, r)
+		case strings.HasSuffix(r.URL.Path, "/_bulk") && strings.Count(r.URL.Path, "/") == 2:
+			bulk.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// ingestMiddleware returns the chain shared by every ingestion endpoint:
+// authentication with the validator of the route, the logs:write scope, tenant IP allowlists, replay
+// protection and, once the caller is known, body decompression.
+func (s *Server) ingestMiddleware() (func(route string, handler http.Handler) http.Handler, error) {
+	var allowlist *middleware.IPAllowlist
+	if len(s.config.TenantIPAllowlists) > 0 {
+		var err error
+		allowlist, err = middleware.NewIPAllowlist(s.config.TenantIPAllowlists, s.config.TrustedProxies)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var replayCache *middleware.ReplayCache
+	if s.config.ReplayProtection != "off" {
+		replayCache = middleware.NewReplayCache(s.config.ReplayWindow, s.config.ReplayCacheSize)
+	}
+	bodyLimits, err := middleware.NewBodyLimits(s.config.MaxBodyBytes, s.config.TenantMaxBodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	bodyLimit := middleware.BodyLimitMiddleware(bodyLimits)
+
+	return func(route string, handler http.Handler) http.Handler {
+		authMiddleware := middleware.AuthMiddleware(s.validatorFor(route), s.tenantStatus)
+		handler = middleware.DecompressMiddleware(s.config.MaxDecompressedBytes)(handler)
+		handler = bodyLimit(handler)
+		if allowlist != nil {
+			handler = middleware.IPAllowlistMiddleware(allowlist)(handler)
+		}
+		if replayCache != nil {
+			handler = middleware.ReplayMiddleware(replayCache, s.config.ReplayProtection)(handler)
+		}
+		handler = middleware.RequireScope(auth.ScopeLogsWrite)(handler)
+		handler = bodyLimit(authMiddleware(handler))
+		if s.config.MTLSRequired {
+			handler = middleware.RequireClientCertificate(handler)
+		}
+		return handler
+	}, nil
+}
+
+// authorizer combines the configured policy and webhook authorizers. It
+// returns nil when neither is enabled.
+func (s *Server) authorizer() (policy.Authorizer, error) {
+	var authorizers policy.All
+	if s.config.PolicyFile != "" {
+		regoAuthorizer, err := policy.NewRegoAuthorizer(context.Background(), s.config.PolicyFile, s.config.PolicyQuery)
+		if err != nil {
+			return nil, err
+		}
+		authorizers = append(authorizers, regoAuthorizer)
+	}
+	if s.config.AuthzWebhookURL != "" {
+		webhookAuthorizer, err := policy.NewWebhookAuthorizer(policy.WebhookOptions{
+			URL:      s.config.AuthzWebhookURL,
+			Timeout:  s.config.AuthzWebhookTimeout,
+			CacheTTL: s.config.AuthzWebhookCacheTTL,
+		})
+		if err != nil {
+			return nil, err
+		}
+		authorizers = append(authorizers, webhookAuthorizer)
+	}
+
+	switch len(authorizers) {
+	case 0:
+		return nil, nil
+	case 1:
+		return authorizers[0], nil
+	}
+	return authorizers, nil
+}
+
+// tlsConfig accepts TLS_MIN_VERSION and newer with modern cipher suites, and
+// asks clients for a certificate when a client CA is configured, rejecting
+// those on the CRL.
+// Certificates are optional at the handshake so token-authenticated agents
+// can share the listener; AuthMiddleware decides what is accepted.
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// TLS 1.2 is limited to forward-secret AEAD suites; TLS 1.3 suites
+		// are not configurable and all modern.
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	}
+	if s.config.TLSMinVersion == "1.3" {
+		tlsConfig.MinVersion = tls.VersionTLS13
+	}
+	if s.config.MTLSCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	// Every handshake uses the config built from the current CA bundle and
+	// CRL, which must carry the server certificate itself.
+	cert, err := tls.LoadX509KeyPair(s.config.TLSCertFile, s.config.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	certs, err := newClientCerts(tlsConfig, s.config.MTLSCAFile, s.config.MTLSCRLFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.GetConfigForClient = certs.configForClient
+	go certs.refresh(s.config.MTLSRefreshInterval)
+	return tlsConfig, nil
 }
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"auth-proxy/auth"
+	"auth-proxy/config"
+)
+
+// tokenValidator accepts one token, as account 1.
+type tokenValidator string
+
+func (v tokenValidator) Validate(ctx context.Context, token string) (*auth.Claims, error) {
+	if token != string(v) {
+		return nil, errors.New("invalid token")
+	}
+	return &auth.Claims{AccountID: 1}, nil
+}
+
+func TestIngestRoutesUseTheirValidators(t *testing.T) {
+	s := New(&config.Config{ReplayProtection: "off"}, tokenValidator("jwt-token"), nil, nil, nil).
+		RouteValidators(map[string]auth.Validator{"bulk": tokenValidator("api-key")})
+	ingest, err := s.ingestMiddleware()
+	if err != nil {
+		t.Fatalf("ingestMiddleware() error = %v", err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		route      string
+		token      string
+		wantStatus int
+	}{
+		{"logs", "jwt-token", http.StatusOK},
+		{"logs", "api-key", http.StatusForbidden},
+		{"bulk", "api-key", http.StatusOK},
+		{"bulk", "jwt-token", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.route+" with "+tt.token, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := httptest.NewRecorder()
+			ingest(tt.route, ok).ServeHTTP(rec, r)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
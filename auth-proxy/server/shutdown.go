@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// onShutdown registers stop to be called by Shutdown, or calls it at once
+// with a done context when Shutdown has already run.
+func (s *Server) onShutdown(stop func(ctx context.Context) error) {
+	s.mu.Lock()
+	if !s.shuttingDown {
+		s.stops = append(s.stops, stop)
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stop(ctx)
+}
+
+// closeOnShutdown closes listeners when Shutdown runs.
+func (s *Server) closeOnShutdown(listeners ...io.Closer) {
+	s.onShutdown(func(context.Context) error {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		return nil
+	})
+}
+
+// Shutdown stops every listener from accepting and stops consuming Kafka,
+// waits until ctx is done for in-flight HTTP requests and gRPC calls to
+// finish, and then stops feeding storage from the write-ahead log.
+// Connections of the forward, syslog and GELF listeners are not waited for.
+// Storage itself is left for the caller to close.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	stops := s.stops
+	s.stops = nil
+	s.mu.Unlock()
+
+	errs := make([]error, len(stops))
+	var wg sync.WaitGroup
+	for i, stop := range stops {
+		wg.Add(1)
+		go func(i int, stop func(ctx context.Context) error) {
+			defer wg.Done()
+			errs[i] = stop(ctx)
+		}(i, stop)
+	}
+	wg.Wait()
+
+	if s.wal != nil {
+		errs = append(errs, s.wal.Close())
+	}
+	return errors.Join(errs...)
+}
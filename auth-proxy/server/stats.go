@@ -0,0 +1,33 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"auth-proxy/storage"
+)
+
+// logStats logs the bulk indexer counters of provider every interval until
+// Shutdown runs.
+func (s *Server) logStats(provider storage.IndexerStatsProvider, interval time.Duration) {
+	done := make(chan struct{})
+	s.onShutdown(func(context.Context) error {
+		close(done)
+		return nil
+	})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				stats := provider.IndexerStats()
+				logger.Info("bulk indexer stats", "added", stats.NumAdded, "flushed", stats.NumFlushed, "failed", stats.NumFailed,
+					"requests", stats.NumRequests, "retried", stats.NumRetried, "dead_lettered", stats.NumDeadLettered,
+					"workers", stats.Workers, "queued_docs", stats.QueuedDocs, "queued_bytes", stats.QueuedBytes)
+			}
+		}
+	}()
+}
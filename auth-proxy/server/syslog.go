@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"auth-proxy/policy"
+	"auth-proxy/syslog"
+)
+
+// startSyslog serves syslog on the same port over TCP, using TLS when the
+// proxy has a certificate, and over UDP.
+func (s *Server) startSyslog(authorizer policy.Authorizer, tlsConfig *tls.Config) error {
+	allowlist, err := s.listenerAllowlist()
+	if err != nil {
+		return err
+	}
+	authenticate, err := s.sourceAuthenticator(s.config.SyslogSourceAccounts, "syslog")
+	if err != nil {
+		return err
+	}
+
+	handler := func(ctx context.Context, batch *syslog.Batch) error {
+		ip := addrIP(batch.Remote)
+		for _, entry := range batch.Entries {
+			entry["source_ip"] = ip.String()
+		}
+		return s.storeBatch(ctx, authorizer, allowlist, listenerBatch{
+			claims:  batch.Claims,
+			ip:      ip,
+			method:  "syslog",
+			bytes:   batch.Bytes,
+			entries: batch.Entries,
+		})
+	}
+	syslogServer := syslog.NewServer(authenticate, handler, s.config.SyslogMaxMessageBytes)
+
+	listener, err := s.listen("tcp", ":"+s.config.SyslogPort)
+	if err != nil {
+		return fmt.Errorf("failed to listen for syslog over TCP: %w", err)
+	}
+	packetConn, err := s.listenPacket("udp", ":"+s.config.SyslogPort)
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to listen for syslog over UDP: %w", err)
+	}
+	if tlsConfig != nil {
+		if tlsConfig, err = s.listenerTLSConfig(tlsConfig); err != nil {
+			listener.Close()
+			packetConn.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	s.closeOnShutdown(listener, packetConn)
+	logger.Info("starting syslog listener on TCP and UDP", "port", s.config.SyslogPort)
+	go func() {
+		if err := syslogServer.ServeTCP(listener); err != nil {
+			logger.Error("syslog TCP server stopped", "error", err)
+		}
+	}()
+	go func() {
+		if err := syslogServer.ServeUDP(packetConn); err != nil {
+			logger.Error("syslog UDP server stopped", "error", err)
+		}
+	}()
+	return nil
+}
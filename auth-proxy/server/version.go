@@ -0,0 +1,37 @@
+package server
+
+import "auth-proxy/handlers"
+
+// features lists the backends, listeners and options this instance was
+// configured with, for /version.
+func (s *Server) features() handlers.Features {
+	features := handlers.Features{
+		AuthMethods: s.config.AuthMethods,
+		Tracing:     s.config.Tracing,
+		Metrics:     s.config.Metrics,
+	}
+	for _, destination := range s.config.StorageDestinations() {
+		features.Backends = append(features.Backends, destination.Backend)
+	}
+
+	listeners := []struct {
+		name    string
+		enabled bool
+	}{
+		{"http", s.config.Port != "off"},
+		{"unix", s.config.UnixSocket != ""},
+		{"otlp_grpc", s.config.GRPCPort != ""},
+		{"forward", s.config.ForwardPort != ""},
+		{"syslog", s.config.SyslogPort != ""},
+		{"gelf", s.config.GELFPort != ""},
+		{"kafka", len(s.config.KafkaBrokers) > 0},
+		{"debug", s.config.DebugPort != ""},
+	}
+	features.Listeners = []string{}
+	for _, listener := range listeners {
+		if listener.enabled {
+			features.Listeners = append(features.Listeners, listener.name)
+		}
+	}
+	return features
+}
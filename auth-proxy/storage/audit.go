@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+)
+
+// AuditStorage writes audit events to a single index of their own, apart
+// from the log indices, so they can be kept and searched separately.
+type AuditStorage struct {
+	index        string
+	indexer      esutil.BulkIndexer
+	closeTimeout time.Duration
+}
+
+// NewAuditStorage returns storage that indexes documents into index through
+// client, flushing at least every flushInterval.
+func NewAuditStorage(client *elasticsearch.Client, index string, flushInterval, closeTimeout time.Duration) (*AuditStorage, error) {
+	indexer, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
+		Client:        client,
+		NumWorkers:    1,
+		FlushInterval: flushInterval,
+		OnError: func(ctx context.Context, err error) {
+			logger.Error("audit bulk request failed", "index", index, "error", err)
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create audit bulk indexer: %w", err)
+	}
+	return &AuditStorage{index: index, indexer: indexer, closeTimeout: closeTimeout}, nil
+}
+
+func (s *AuditStorage) StoreLogs(ctx context.Context, accountID string, logs []map[string]interface{}) error {
+	for _, document := range logs {
+		body, err := json.Marshal(document)
+		if err != nil {
+			return fmt.Errorf("failed to marshal audit event: %w", err)
+		}
+		err = s.indexer.Add(ctx, esutil.BulkIndexerItem{
+			Action: "create",
+			Index:  s.index,
+			Body:   bytes.NewReader(body),
+			OnFailure: func(ctx context.Context, item esutil.BulkIndexerItem, resp esutil.BulkIndexerResponseItem, err error) {
+				if err == nil {
+					err = fmt.Errorf("%s: %s", resp.Error.Type, resp.Error.Reason)
+				}
+				logger.Warn("audit event not indexed", "index", item.Index, "status", resp.Status, "error", err)
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to enqueue audit event: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close flushes the events not yet indexed.
+func (s *AuditStorage) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.closeTimeout)
+	defer cancel()
+	if err := s.indexer.Close(ctx); err != nil {
+		return fmt.Errorf("failed to close audit bulk indexer: %w", err)
+	}
+	return nil
+}
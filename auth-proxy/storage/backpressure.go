@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+// QueueFullError is returned when the bulk indexer already holds as many
+// documents or bytes as it is allowed to. None of the batch was stored; it
+// may be sent again after RetryAfter.
+type QueueFullError struct {
+	QueuedDocs  int64
+	QueuedBytes int64
+	RetryAfter  time.Duration
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("bulk indexer queue is full with %d documents (%d bytes), retry after %v", e.QueuedDocs, e.QueuedBytes, e.RetryAfter)
+}
+
+// queueFull returns a QueueFullError when either queue limit is reached,
+// or nil. Zero limits are unlimited.
+func (es *ElasticsearchStorage) queueFull() error {
+	docs, size := es.queuedDocs.Load(), es.queuedBytes.Load()
+	if (es.maxQueuedDocs > 0 && docs >= es.maxQueuedDocs) || (es.maxQueuedBytes > 0 && size >= es.maxQueuedBytes) {
+		return &QueueFullError{QueuedDocs: docs, QueuedBytes: size, RetryAfter: es.queueFullRetryAfter}
+	}
+	return nil
+}
+
+// enqueued counts a document of size bytes as queued until dequeued is
+// called for it, once it is stored or dropped.
+func (es *ElasticsearchStorage) enqueued(size int) {
+	es.queuedDocs.Add(1)
+	es.queuedBytes.Add(int64(size))
+}
+
+func (es *ElasticsearchStorage) dequeued(size int) {
+	es.queuedDocs.Add(-1)
+	es.queuedBytes.Add(-int64(size))
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// BatchTooLargeError is returned by a BatchLimiter that rejects a batch with
+// more entries than it allows. None of the batch was stored.
+type BatchTooLargeError struct {
+	Entries int
+	Limit   int
+}
+
+func (e *BatchTooLargeError) Error() string {
+	return fmt.Sprintf("batch of %d log entries exceeds the limit of %d entries per request", e.Entries, e.Limit)
+}
+
+// BatchLimiter caps the number of entries a single StoreLogs call passes to
+// the wrapped storage, so one agent cannot monopolize the bulk indexer.
+// Oversized batches are rejected with BatchTooLargeError, or with split set,
+// stored as consecutive chunks of at most maxEntries.
+type BatchLimiter struct {
+	next       LogStorage
+	maxEntries int
+	split      bool
+}
+
+func NewBatchLimiter(next LogStorage, maxEntries int, split bool) *BatchLimiter {
+	return &BatchLimiter{next: next, maxEntries: maxEntries, split: split}
+}
+
+// StoreLogs stores chunks in order and stops at the first failing one, so
+// on error the chunks before it have already been stored. Entries skipped
+// across chunks are reported together.
+func (b *BatchLimiter) StoreLogs(ctx context.Context, accountID string, logs []map[string]interface{}) error {
+	if len(logs) <= b.maxEntries {
+		return b.next.StoreLogs(ctx, accountID, logs)
+	}
+	if !b.split {
+		return &BatchTooLargeError{Entries: len(logs), Limit: b.maxEntries}
+	}
+
+	var skipped *SkippedEntriesError
+	for start := 0; start < len(logs); start += b.maxEntries {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("stored %d of %d log entries: %w", start, len(logs), err)
+		}
+		chunk := logs[start:min(start+b.maxEntries, len(logs))]
+		err := b.next.StoreLogs(ctx, accountID, chunk)
+		if err == nil {
+			continue
+		}
+		var chunkSkipped *SkippedEntriesError
+		if !errors.As(err, &chunkSkipped) {
+			return err
+		}
+		if skipped == nil {
+			skipped = &SkippedEntriesError{Skipped: make(map[string]int)}
+		}
+		for reason, n := range chunkSkipped.Skipped {
+			skipped.Skipped[reason] += n
+		}
+	}
+	if skipped != nil {
+		skipped.Total = len(logs)
+		return skipped
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+)
+
+// maxBulkRetryBackoff caps the delay before an item is retried.
+const maxBulkRetryBackoff = 30 * time.Second
+
+var errStorageClosed = errors.New("elasticsearch storage is closed")
+
+// isRetryableStatus reports whether a bulk item failed because Elasticsearch
+// was shedding load, so sending it again later may succeed.
+func isRetryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// retryItem adds a copy of item back to the indexer of pipeline after a
+// jittered exponential backoff. attempt is the number of the retry, from 1.
+// It reports false when the retries are used up.
+func (es *ElasticsearchStorage) retryItem(pipeline string, item esutil.BulkIndexerItem, body []byte, attempt int) bool {
+	if attempt > es.retryAttempts {
+		es.retriesExhausted.Add(1)
+		return false
+	}
+	es.retried.Add(1)
+
+	// The indexer serializes metadata into the item it is given, so the
+	// retry is built from the item's fields rather than copied.
+	retry := esutil.BulkIndexerItem{
+		Action:      item.Action,
+		Index:       item.Index,
+		DocumentID:  item.DocumentID,
+		Version:     item.Version,
+		VersionType: item.VersionType,
+		Body:        bytes.NewReader(body),
+		OnSuccess:   item.OnSuccess,
+		OnFailure:   item.OnFailure,
+	}
+	backoff := es.retryBackoff
+	for i := 1; i < attempt && backoff < maxBulkRetryBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxBulkRetryBackoff)
+	delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	time.AfterFunc(delay, func() {
+		if err := es.add(context.Background(), pipeline, retry); err != nil {
+			// Handled like a failed bulk request, so the entry is accounted
+			// for and dead-lettered.
+			retry.OnFailure(context.Background(), retry, esutil.BulkIndexerResponseItem{}, fmt.Errorf("failed to retry after %d attempts: %w", attempt, err))
+		}
+	})
+	return true
+}
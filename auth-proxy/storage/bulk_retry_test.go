@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// capturingStorage keeps every entry it is asked to store.
+type capturingStorage struct {
+	mu      sync.Mutex
+	entries []map[string]interface{}
+}
+
+func (c *capturingStorage) StoreLogs(ctx context.Context, tokenAccountID string, logs []map[string]interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = append(c.entries, logs...)
+	return nil
+}
+
+func (c *capturingStorage) stored() []map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]map[string]interface{}{}, c.entries...)
+}
+
+// waitDrained waits until every document added to es is stored or given
+// up on, including those waiting to be retried.
+func waitDrained(t *testing.T, es *ElasticsearchStorage) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for es.queuedDocs.Load() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d documents still queued", es.queuedDocs.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBulkRetry(t *testing.T) {
+	tests := []struct {
+		name             string
+		status           func(n int) int
+		wantSent         int
+		wantRetried      uint64
+		wantExhausted    uint64
+		wantDeadLettered uint64
+	}{
+		{"stored first time", nil, 1, 0, 0, 0},
+		{"recovers after 429", func(n int) int {
+			if n == 0 {
+				return http.StatusTooManyRequests
+			}
+			return http.StatusCreated
+		}, 2, 1, 0, 0},
+		{"recovers after 503", func(n int) int {
+			if n < 2 {
+				return http.StatusServiceUnavailable
+			}
+			return http.StatusCreated
+		}, 3, 2, 0, 0},
+		{"retries exhausted", func(n int) int { return http.StatusTooManyRequests }, 3, 2, 1, 1},
+		{"not retryable", func(n int) int { return http.StatusBadRequest }, 1, 0, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &fakeCluster{status: tt.status}
+			cfg := testConfig()
+			cfg.BulkRetryAttempts = 2
+			deadLetters := &capturingStorage{}
+			es := newTestStorage(t, cluster, cfg, deadLetters)
+
+			if err := es.StoreLogs(context.Background(), "1", []map[string]interface{}{{"container_name": "api"}}); err != nil {
+				t.Fatalf("StoreLogs() error = %v", err)
+			}
+			waitDrained(t, es)
+			if err := es.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			if got := len(cluster.received()); got != tt.wantSent {
+				t.Errorf("cluster received %d attempts, want %d", got, tt.wantSent)
+			}
+			if got := es.retried.Load(); got != tt.wantRetried {
+				t.Errorf("retried = %d, want %d", got, tt.wantRetried)
+			}
+			if got := es.retriesExhausted.Load(); got != tt.wantExhausted {
+				t.Errorf("retries exhausted = %d, want %d", got, tt.wantExhausted)
+			}
+			if got := es.deadLettered.Load(); got != tt.wantDeadLettered {
+				t.Errorf("dead-lettered = %d, want %d", got, tt.wantDeadLettered)
+			}
+		})
+	}
+}
+
+func TestIsRetryableStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{http.StatusTooManyRequests, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusBadRequest, false},
+		{http.StatusConflict, false},
+		{http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		if got := isRetryableStatus(tt.status); got != tt.want {
+			t.Errorf("isRetryableStatus(%d) = %t, want %t", tt.status, got, tt.want)
+		}
+	}
+}
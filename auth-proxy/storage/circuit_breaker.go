@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// UnavailableError is returned by a CircuitBreaker while it sheds load.
+// None of the batch was stored; it may be sent again after RetryAfter.
+type UnavailableError struct {
+	RetryAfter time.Duration
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("storage is unavailable, retry after %v", e.RetryAfter)
+}
+
+// CircuitBreakerConfig controls when a CircuitBreaker opens and closes.
+type CircuitBreakerConfig struct {
+	// Threshold is how many consecutive failed health checks or stores open
+	// the breaker.
+	Threshold int
+	// CheckInterval is how often the backend's health is checked.
+	CheckInterval time.Duration
+	// OpenFor is how long batches are rejected before the backend is probed.
+	OpenFor time.Duration
+}
+
+// CircuitBreaker rejects batches with UnavailableError while the wrapped
+// storage is failing, instead of queueing them into a cluster that cannot
+// keep up. A check fails like a FailoverStorage check does; stores fail
+// when they return an error other than skipped entries, a full queue or a
+// canceled request. Once open, the backend is probed every OpenFor and the
+// breaker closes on the first ping it answers.
+type CircuitBreaker struct {
+	next     LogStorage
+	reporter HealthReporter
+	cfg      CircuitBreakerConfig
+
+	mu        sync.Mutex
+	failed    int
+	openUntil time.Time // zero while closed
+	lastStats IndexerStats
+	trips     uint64
+}
+
+// NewCircuitBreaker starts health checks of reporter, normally the storage
+// next wraps.
+func NewCircuitBreaker(next LogStorage, reporter HealthReporter, cfg CircuitBreakerConfig) *CircuitBreaker {
+	b := &CircuitBreaker{next: next, reporter: reporter, cfg: cfg}
+	go b.monitor()
+	return b
+}
+
+func (b *CircuitBreaker) StoreLogs(ctx context.Context, accountID string, logs []map[string]interface{}) error {
+	if retryAfter, open := b.open(); open {
+		return &UnavailableError{RetryAfter: retryAfter}
+	}
+	err := b.next.StoreLogs(ctx, accountID, logs)
+	var skipped *SkippedEntriesError
+	var tooLarge *BatchTooLargeError
+	var queueFull *QueueFullError
+	switch {
+	case err == nil:
+	case errors.As(err, &skipped), errors.As(err, &tooLarge), errors.As(err, &queueFull), errors.Is(err, context.Canceled):
+	default:
+		b.record(false)
+	}
+	return err
+}
+
+// open reports whether batches are rejected, and for how long clients
+// should wait. Past OpenFor, the breaker stays open until a probe passes.
+func (b *CircuitBreaker) open() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return 0, false
+	}
+	retryAfter := time.Until(b.openUntil)
+	if retryAfter <= 0 {
+		retryAfter = b.cfg.CheckInterval
+	}
+	return retryAfter, true
+}
+
+func (b *CircuitBreaker) monitor() {
+	ticker := time.NewTicker(b.cfg.CheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		b.check()
+	}
+}
+
+func (b *CircuitBreaker) check() {
+	b.mu.Lock()
+	waiting := !b.openUntil.IsZero() && time.Now().Before(b.openUntil)
+	b.mu.Unlock()
+	if waiting {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.cfg.CheckInterval)
+	report := b.reporter.Health(ctx)
+	cancel()
+
+	b.mu.Lock()
+	stats := report.Indexer
+	healthy := report.Elasticsearch == "up" &&
+		!(stats.NumFailed > b.lastStats.NumFailed && stats.NumFlushed == b.lastStats.NumFlushed)
+	b.lastStats = stats
+	if !b.openUntil.IsZero() {
+		// Nothing is flushed while open, so only the ping decides the probe.
+		if report.Elasticsearch == "up" {
+			b.openUntil = time.Time{}
+			b.failed = 0
+			logger.Info("circuit breaker closed, elasticsearch answered a probe, accepting logs again")
+		} else {
+			b.openUntil = time.Now().Add(b.cfg.OpenFor)
+			logger.Warn("circuit breaker probe failed, shedding logs", "open_for", b.cfg.OpenFor)
+		}
+		b.mu.Unlock()
+		return
+	}
+	b.mu.Unlock()
+	b.record(healthy)
+}
+
+// Trips returns how many times the breaker has opened.
+func (b *CircuitBreaker) Trips() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.trips
+}
+
+// record counts a passed or failed check or store, and opens the breaker
+// after Threshold consecutive failures.
+func (b *CircuitBreaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.openUntil.IsZero() {
+		return
+	}
+	if ok {
+		b.failed = 0
+		return
+	}
+	b.failed++
+	if b.failed >= b.cfg.Threshold {
+		b.openUntil = time.Now().Add(b.cfg.OpenFor)
+		b.trips++
+		logger.Warn("circuit breaker opened, shedding logs", "failures", b.failed, "open_for", b.cfg.OpenFor)
+	}
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubStorage fails every store with err.
+type stubStorage struct {
+	mu     sync.Mutex
+	err    error
+	stores int
+}
+
+func (s *stubStorage) StoreLogs(ctx context.Context, tokenAccountID string, logs []map[string]interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stores++
+	return s.err
+}
+
+// stubReporter reports report, which tests change between checks.
+type stubReporter struct {
+	mu     sync.Mutex
+	report HealthReport
+}
+
+func (r *stubReporter) Health(ctx context.Context) HealthReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.report
+}
+
+func (r *stubReporter) set(report HealthReport) {
+	r.mu.Lock()
+	r.report = report
+	r.mu.Unlock()
+}
+
+// newTestBreaker returns a breaker whose checks only run when the test
+// calls check.
+func newTestBreaker(next LogStorage, reporter HealthReporter, openFor time.Duration) *CircuitBreaker {
+	return NewCircuitBreaker(next, reporter, CircuitBreakerConfig{Threshold: 2, CheckInterval: time.Hour, OpenFor: openFor})
+}
+
+func store(b *CircuitBreaker) error {
+	return b.StoreLogs(context.Background(), "1", []map[string]interface{}{{"log": "x"}})
+}
+
+func TestCircuitBreakerOpensOnStoreFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantOpen bool
+	}{
+		{"failure", errors.New("connection refused"), true},
+		{"skipped entries", &SkippedEntriesError{Total: 1, Skipped: map[string]int{"invalid": 1}}, false},
+		{"batch too large", &BatchTooLargeError{Entries: 2, Limit: 1}, false},
+		{"queue full", &QueueFullError{RetryAfter: time.Second}, false},
+		{"canceled", fmt.Errorf("store: %w", context.Canceled), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &stubStorage{err: tt.err}
+			b := newTestBreaker(next, &stubReporter{}, time.Hour)
+			store(b)
+			store(b)
+
+			var unavailable *UnavailableError
+			err := store(b)
+			if open := errors.As(err, &unavailable); open != tt.wantOpen {
+				t.Fatalf("third store error = %v, want open = %t", err, tt.wantOpen)
+			}
+			if tt.wantOpen && next.stores != 2 {
+				t.Errorf("wrapped storage called %d times, want the open breaker to shed the batch", next.stores)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerPassedCheckResetsFailures(t *testing.T) {
+	next := &stubStorage{err: errors.New("connection refused")}
+	reporter := &stubReporter{report: HealthReport{Elasticsearch: "up"}}
+	b := newTestBreaker(next, reporter, time.Hour)
+	store(b)
+	b.check()
+	store(b)
+	if _, open := b.open(); open {
+		t.Error("breaker opened on failures that were not consecutive")
+	}
+}
+
+func TestCircuitBreakerChecks(t *testing.T) {
+	tests := []struct {
+		name     string
+		reports  []HealthReport
+		wantOpen bool
+	}{
+		{"up", []HealthReport{{Elasticsearch: "up"}, {Elasticsearch: "up"}}, false},
+		{"down", []HealthReport{{Elasticsearch: "down"}, {Elasticsearch: "down"}}, true},
+		{"recovers", []HealthReport{{Elasticsearch: "down"}, {Elasticsearch: "up"}, {Elasticsearch: "down"}}, false},
+		{"failing flushes", []HealthReport{
+			{Elasticsearch: "up", Indexer: IndexerStats{NumFailed: 5}},
+			{Elasticsearch: "up", Indexer: IndexerStats{NumFailed: 10}},
+		}, true},
+		{"partly failing flushes", []HealthReport{
+			{Elasticsearch: "up", Indexer: IndexerStats{NumFailed: 5, NumFlushed: 5}},
+			{Elasticsearch: "up", Indexer: IndexerStats{NumFailed: 10, NumFlushed: 10}},
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reporter := &stubReporter{}
+			b := newTestBreaker(&stubStorage{}, reporter, time.Hour)
+			for _, report := range tt.reports {
+				reporter.set(report)
+				b.check()
+			}
+			if _, open := b.open(); open != tt.wantOpen {
+				t.Errorf("open = %t, want %t", open, tt.wantOpen)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerProbe(t *testing.T) {
+	tests := []struct {
+		name      string
+		probe     string
+		wantClose bool
+	}{
+		{"answered", "up", true},
+		{"failed", "down", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reporter := &stubReporter{report: HealthReport{Elasticsearch: "down"}}
+			b := newTestBreaker(&stubStorage{}, reporter, time.Millisecond)
+			b.check()
+			b.check()
+			retryAfter, open := b.open()
+			if !open {
+				t.Fatal("breaker did not open")
+			}
+			if retryAfter > time.Millisecond {
+				t.Errorf("retry after = %v, want at most OpenFor", retryAfter)
+			}
+
+			time.Sleep(2 * time.Millisecond)
+			reporter.set(HealthReport{Elasticsearch: tt.probe})
+			b.check()
+			if _, open := b.open(); open == tt.wantClose {
+				t.Errorf("open after probe = %t, want closed = %t", open, tt.wantClose)
+			}
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clickHouseInsertAttempts is how many times a batch insert is tried before
+// its rows are dropped.
+const clickHouseInsertAttempts = 3
+
+// ClickHouseConfig configures a ClickHouseStorage.
+type ClickHouseConfig struct {
+	// URL is the ClickHouse HTTP interface, e.g. http://clickhouse:8123.
+	URL      string
+	Database string
+	Table    string
+	Username string
+	Password string
+	// CreateTable creates the logs table at startup when it is missing.
+	CreateTable bool
+	// BatchRows and FlushInterval bound how many rows and how long logs are
+	// buffered before they are inserted.
+	BatchRows     int
+	FlushInterval time.Duration
+	// MaxBufferedRows bounds the rows held in memory. StoreLogs fails once
+	// it is reached.
+	MaxBufferedRows int
+}
+
+// ClickHouseStorage inserts logs into a MergeTree table ordered by account,
+// container and timestamp. Each row keeps the full entry as JSON in the log
+// column. Logs are buffered and inserted in batches over the HTTP interface,
+// so a batch is stored once it is buffered.
+type ClickHouseStorage struct {
+	cfg    ClickHouseConfig
+	client *http.Client
+	table  string
+
+	mu       sync.Mutex
+	pending  []clickHouseRow
+	inFlight int
+
+	flush chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+type clickHouseRow struct {
+	AccountID string `json:"account_id"`
+	Container string `json:"container"`
+	Timestamp string `json:"timestamp"`
+	Log       string `json:"log"`
+}
+
+var clickHouseIdentifierRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// clickHouseTimeLayout is the DateTime64(3) text format.
+const clickHouseTimeLayout = "2006-01-02 15:04:05.000"
+
+func NewClickHouseStorage(cfg ClickHouseConfig) (*ClickHouseStorage, error) {
+	if _, err := url.Parse(cfg.URL); err != nil || cfg.URL == "" {
+		return nil, fmt.Errorf("invalid ClickHouse URL %q", cfg.URL)
+	}
+	if !clickHouseIdentifierRegex.MatchString(cfg.Database) || !clickHouseIdentifierRegex.MatchString(cfg.Table) {
+		return nil, fmt.Errorf("invalid ClickHouse database or table name %s.%s", cfg.Database, cfg.Table)
+	}
+
+	ch := &ClickHouseStorage{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+		table:  cfg.Database + "." + cfg.Table,
+		flush:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if cfg.CreateTable {
+		if err := ch.createTable(); err != nil {
+			return nil, err
+		}
+	}
+	ch.wg.Add(1)
+	go ch.flushLoop()
+	return ch, nil
+}
+
+func (ch *ClickHouseStorage) createTable() error {
+	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	account_id String,
+	container LowCardinality(String),
+	timestamp DateTime64(3, 'UTC'),
+	log String
+) ENGINE = MergeTree
+PARTITION BY toDate(timestamp)
+ORDER BY (account_id, container, timestamp)`, ch.table)
+	if err := ch.exec(context.Background(), query, nil); err != nil {
+		return fmt.Errorf("failed to create ClickHouse table %s: %w", ch.table, err)
+	}
+	return nil
+}
+
+func (ch *ClickHouseStorage) StoreLogs(ctx context.Context, tokenAccountID string, logs []map[string]interface{}) error {
+	now := time.Now().UTC()
+	skipped := make(map[string]int)
+
+	rows := make([]clickHouseRow, 0, len(logs))
+	for _, logEntry := range logs {
+		logEntry["token_accountId"] = tokenAccountID
+		if _, ok := logEntry["@timestamp"]; !ok {
+			logEntry["@timestamp"] = now.Format(time.RFC3339)
+		}
+		line, err := json.Marshal(logEntry)
+		if err != nil {
+			logger.WarnContext(ctx, "failed to marshal log entry for ClickHouse", "account_id", tokenAccountID, "error", err)
+			skipped["marshal_failed"]++
+			continue
+		}
+		rows = append(rows, clickHouseRow{
+			AccountID: tokenAccountID,
+			Container: extractContainerName(logEntry),
+			Timestamp: entryTime(logEntry, now).Format(clickHouseTimeLayout),
+			Log:       string(line),
+		})
+	}
+
+	ch.mu.Lock()
+	if len(ch.pending)+ch.inFlight+len(rows) > ch.cfg.MaxBufferedRows {
+		ch.mu.Unlock()
+		return fmt.Errorf("ClickHouse buffer is full with %d rows awaiting insert", ch.cfg.MaxBufferedRows)
+	}
+	ch.pending = append(ch.pending, rows...)
+	full := len(ch.pending) >= ch.cfg.BatchRows
+	ch.mu.Unlock()
+
+	if full {
+		select {
+		case ch.flush <- struct{}{}:
+		default:
+		}
+	}
+	if len(skipped) > 0 {
+		return &SkippedEntriesError{Total: len(logs), Skipped: skipped}
+	}
+	return nil
+}
+
+// entryTime returns the entry's own @timestamp or timestamp when it is
+// RFC 3339, and fallback otherwise.
+func entryTime(logEntry map[string]interface{}, fallback time.Time) time.Time {
+	for _, field := range []string{"@timestamp", "timestamp"} {
+		if value, ok := logEntry[field].(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				return t.UTC()
+			}
+		}
+	}
+	return fallback
+}
+
+func (ch *ClickHouseStorage) flushLoop() {
+	defer ch.wg.Done()
+	ticker := time.NewTicker(ch.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ch.done:
+			ch.insertPending()
+			return
+		case <-ticker.C:
+		case <-ch.flush:
+		}
+		ch.insertPending()
+	}
+}
+
+// insertPending inserts buffered rows in batches of at most BatchRows.
+func (ch *ClickHouseStorage) insertPending() {
+	for {
+		ch.mu.Lock()
+		n := min(len(ch.pending), ch.cfg.BatchRows)
+		batch := ch.pending[:n:n]
+		ch.pending = ch.pending[n:]
+		ch.inFlight = n
+		ch.mu.Unlock()
+		if n == 0 {
+			return
+		}
+
+		ch.insert(batch)
+
+		ch.mu.Lock()
+		ch.inFlight = 0
+		ch.mu.Unlock()
+	}
+}
+
+func (ch *ClickHouseStorage) insert(rows []clickHouseRow) {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, row := range rows {
+		encoder.Encode(row)
+	}
+	query := fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", ch.table)
+
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := ch.exec(context.Background(), query, body.Bytes())
+		if err == nil {
+			return
+		}
+		if attempt == clickHouseInsertAttempts {
+			logger.Error("dropped log entries after failing to insert into ClickHouse", "entries", len(rows), "error", err)
+			return
+		}
+		logger.Warn("ClickHouse insert failed, retrying", "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// exec runs query over the HTTP interface. For inserts, data is sent as the
+// request body after the query.
+func (ch *ClickHouseStorage) exec(ctx context.Context, query string, data []byte) error {
+	endpoint := strings.TrimRight(ch.cfg.URL, "/") + "/"
+	var body io.Reader = strings.NewReader(query)
+	if data != nil {
+		endpoint += "?" + url.Values{"query": {query}}.Encode()
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
+	if err != nil {
+		return fmt.Errorf("failed to build ClickHouse request: %w", err)
+	}
+	if ch.cfg.Username != "" {
+		req.Header.Set("X-ClickHouse-User", ch.cfg.Username)
+		req.Header.Set("X-ClickHouse-Key", ch.cfg.Password)
+	}
+
+	resp, err := ch.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("ClickHouse request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("ClickHouse returned status %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// Close inserts every buffered row before returning.
+func (ch *ClickHouseStorage) Close() error {
+	close(ch.done)
+	ch.wg.Wait()
+	return nil
+}
@@ -0,0 +1,35 @@
+package storage
+
+// elasticsearchTemplateName is the name of the composable index template that
+// covers the container log indices.
+const elasticsearchTemplateName = "logs-containers"
+
+// elasticsearchTemplateJSON is the index template for logs-containers-* indices.
+const elasticsearchTemplateJSON = `{
+  "index_patterns": ["logs-containers-*"],
+  "data_stream": {},
+  "priority": 200,
+  "template": {
+    "settings": {
+      "number_of_shards": 1
+    },
+    "mappings": {
+      "dynamic": true,
+      "properties": {
+        "@timestamp":      { "type": "date" },
+        "token_accountId": { "type": "keyword" },
+        "sub_account_id":  { "type": "keyword" },
+        "log_account_id":  { "type": "keyword" },
+        "container_name":  { "type": "keyword" },
+        "log":             { "type": "text" },
+        "kubernetes": {
+          "properties": {
+            "container_name": { "type": "keyword" },
+            "namespace_name": { "type": "keyword" },
+            "pod_name":       { "type": "keyword" }
+          }
+        }
+      }
+    }
+  }
+}`
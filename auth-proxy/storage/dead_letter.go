@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"auth-proxy/logging"
+
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+)
+
+// deadLetter writes a document the bulk indexer gave up on to the
+// dead-letter queue, with why it failed: the item error Elasticsearch
+// returned, or err when the whole bulk request failed, and the ID of the
+// request that sent it when ctx carries one. The original document is kept
+// under "document" so it can be sent again as is.
+func (es *ElasticsearchStorage) deadLetter(ctx context.Context, tokenAccountID string, item esutil.BulkIndexerItem, resp esutil.BulkIndexerResponseItem, err error, body []byte) {
+	if es.deadLetters == nil {
+		return
+	}
+	entry := map[string]interface{}{
+		"@timestamp": time.Now().UTC().Format(time.RFC3339),
+		"index":      item.Index,
+		"action":     item.Action,
+		"document":   json.RawMessage(body),
+	}
+	if item.DocumentID != "" {
+		entry["document_id"] = item.DocumentID
+	}
+	if requestID := logging.RequestID(ctx); requestID != "" {
+		entry["request_id"] = requestID
+	}
+	if err != nil {
+		entry["error"] = map[string]interface{}{"type": "request_failed", "reason": err.Error()}
+	} else {
+		entry["status"] = resp.Status
+		entry["error"] = map[string]interface{}{"type": resp.Error.Type, "reason": resp.Error.Reason}
+	}
+
+	if storeErr := es.deadLetters.StoreLogs(ctx, tokenAccountID, []map[string]interface{}{entry}); storeErr != nil {
+		logger.ErrorContext(ctx, "failed to write document to the dead-letter queue", "account_id", tokenAccountID, "index", item.Index, "error", storeErr)
+		return
+	}
+	es.deadLettered.Add(1)
+}
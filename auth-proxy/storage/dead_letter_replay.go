@@ -0,0 +1,386 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type originalTimestampsKey struct{}
+
+// withOriginalTimestamps returns a copy of ctx that makes
+// ElasticsearchStorage keep the @timestamp entries carry, and pick their
+// index by it, instead of stamping them with the time they are stored.
+func withOriginalTimestamps(ctx context.Context) context.Context {
+	return context.WithValue(ctx, originalTimestampsKey{}, true)
+}
+
+func originalTimestampsFrom(ctx context.Context) bool {
+	keep, _ := ctx.Value(originalTimestampsKey{}).(bool)
+	return keep
+}
+
+// replayCheckpointName is the file, kept next to the dead-letter files, that
+// records how far each of them has been replayed.
+const replayCheckpointName = "replay-checkpoint.json"
+
+// replayBatchEntries caps the documents submitted in one StoreLogs call.
+const replayBatchEntries = 500
+
+// ErrReplayRunning is returned when a replay is started while another runs.
+var ErrReplayRunning = errors.New("a dead-letter replay is already running")
+
+// ReplayOptions controls a dead-letter replay. Fields in Remove are deleted
+// from every document and those in Set then set on it, to fix what made
+// them fail. Rate caps the documents submitted per second; zero is
+// unlimited.
+type ReplayOptions struct {
+	Set    map[string]interface{} `json:"set,omitempty"`
+	Remove []string               `json:"remove,omitempty"`
+	Rate   float64                `json:"rate,omitempty"`
+}
+
+// ReplayProgress describes the current or last replay.
+type ReplayProgress struct {
+	Running    bool       `json:"running"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Files      int        `json:"files"`
+	FilesDone  int        `json:"files_done"`
+	Replayed   int        `json:"replayed"`
+	Skipped    int        `json:"skipped"`
+	Malformed  int        `json:"malformed"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// DeadLetterReplayer submits the documents in a dead-letter directory to
+// storage again, as the account that sent them and with the @timestamp and
+// document ID they were first stored with. Files are only appended to, so
+// each is replayed from where the last replay stopped, as recorded in the
+// checkpoint file; documents that fail again are dead-lettered anew and
+// replayed by a later run.
+type DeadLetterReplayer struct {
+	dir    string
+	target LogStorage
+
+	mu       sync.Mutex
+	progress ReplayProgress
+}
+
+func NewDeadLetterReplayer(dir string, target LogStorage) *DeadLetterReplayer {
+	return &DeadLetterReplayer{dir: dir, target: target}
+}
+
+// Progress returns a snapshot of the current or last replay.
+func (r *DeadLetterReplayer) Progress() ReplayProgress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.progress
+}
+
+// Start replays in the background. It returns ErrReplayRunning if a replay
+// is already running.
+func (r *DeadLetterReplayer) Start(opts ReplayOptions) error {
+	if err := r.begin(); err != nil {
+		return err
+	}
+	go func() {
+		r.finish(r.replay(context.Background(), opts))
+	}()
+	return nil
+}
+
+// Run replays and returns when it is done or ctx is.
+func (r *DeadLetterReplayer) Run(ctx context.Context, opts ReplayOptions) error {
+	if err := r.begin(); err != nil {
+		return err
+	}
+	err := r.replay(ctx, opts)
+	r.finish(err)
+	return err
+}
+
+func (r *DeadLetterReplayer) begin() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.progress.Running {
+		return ErrReplayRunning
+	}
+	now := time.Now().UTC()
+	r.progress = ReplayProgress{Running: true, StartedAt: &now}
+	return nil
+}
+
+func (r *DeadLetterReplayer) finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().UTC()
+	r.progress.Running = false
+	r.progress.FinishedAt = &now
+	if err != nil {
+		r.progress.Error = err.Error()
+	}
+}
+
+func (r *DeadLetterReplayer) update(fn func(*ReplayProgress)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.progress)
+}
+
+func (r *DeadLetterReplayer) replay(ctx context.Context, opts ReplayOptions) error {
+	names, err := r.files()
+	if err != nil {
+		return err
+	}
+	checkpoint, err := r.loadCheckpoint()
+	if err != nil {
+		return err
+	}
+	// Entries of files removed by retention are dropped.
+	kept := make(map[string]int64, len(names))
+	for _, name := range names {
+		kept[name] = checkpoint[name]
+	}
+	checkpoint = kept
+	r.update(func(p *ReplayProgress) { p.Files = len(names) })
+
+	pacer := newReplayPacer(opts.Rate)
+	for _, name := range names {
+		if err := r.replayFile(ctx, name, checkpoint, opts, pacer); err != nil {
+			return fmt.Errorf("failed to replay %s: %w", name, err)
+		}
+		r.update(func(p *ReplayProgress) { p.FilesDone++ })
+	}
+	return r.saveCheckpoint(checkpoint)
+}
+
+// files lists the dead-letter files oldest first; their names sort by the
+// time they were opened.
+func (r *DeadLetterReplayer) files() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(r.dir, "dead-letter-*.ndjson*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dead-letter files: %w", err)
+	}
+	names := make([]string, 0, len(matches))
+	for _, path := range matches {
+		names = append(names, filepath.Base(path))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// replayFile submits the whole lines of name past its checkpoint, saving
+// the checkpoint after every batch. Lines appended while it runs are left
+// for the next replay.
+func (r *DeadLetterReplayer) replayFile(ctx context.Context, name string, checkpoint map[string]int64, opts ReplayOptions, pacer *replayPacer) error {
+	file, err := os.Open(filepath.Join(r.dir, name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	offset := checkpoint[name]
+	var reader io.Reader
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, gz, offset); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		reader = gz
+	} else {
+		if offset >= info.Size() {
+			return nil
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		reader = io.LimitReader(file, info.Size()-offset)
+	}
+
+	var (
+		accountID string
+		batch     []map[string]interface{}
+		consumed  = offset
+	)
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := pacer.wait(ctx, len(batch)); err != nil {
+				return err
+			}
+			skipped, err := r.submit(ctx, accountID, batch)
+			if err != nil {
+				return err
+			}
+			n := len(batch)
+			r.update(func(p *ReplayProgress) {
+				p.Replayed += n - skipped
+				p.Skipped += skipped
+			})
+			batch = nil
+		}
+		checkpoint[name] = consumed
+		return r.saveCheckpoint(checkpoint)
+	}
+
+	lines := bufio.NewReader(reader)
+	for {
+		line, err := lines.ReadBytes('\n')
+		if len(line) == 0 || line[len(line)-1] != '\n' {
+			// A line without its newline is still being written.
+			if err != nil && err != io.EOF {
+				return err
+			}
+			return flush()
+		}
+
+		var entry struct {
+			AccountID  string                 `json:"token_accountId"`
+			DocumentID string                 `json:"document_id"`
+			Document   map[string]interface{} `json:"document"`
+		}
+		if json.Unmarshal(bytes.TrimSpace(line), &entry) != nil || entry.Document == nil {
+			r.update(func(p *ReplayProgress) { p.Malformed++ })
+			consumed += int64(len(line))
+			continue
+		}
+		if entry.AccountID != accountID || len(batch) >= pacer.batchSize() {
+			if err := flush(); err != nil {
+				return err
+			}
+			accountID = entry.AccountID
+		}
+		for _, field := range opts.Remove {
+			delete(entry.Document, field)
+		}
+		for field, value := range opts.Set {
+			entry.Document[field] = value
+		}
+		// Storage took the ID out of the document when it was first sent.
+		if entry.DocumentID != "" {
+			entry.Document["_id"] = entry.DocumentID
+		}
+		batch = append(batch, entry.Document)
+		consumed += int64(len(line))
+	}
+}
+
+// submit stores batch, waiting and trying again while storage sheds load.
+// It returns how many documents storage skipped.
+func (r *DeadLetterReplayer) submit(ctx context.Context, accountID string, batch []map[string]interface{}) (int, error) {
+	for {
+		err := r.target.StoreLogs(withOriginalTimestamps(ctx), accountID, batch)
+		var skipped *SkippedEntriesError
+		var queueFull *QueueFullError
+		var unavailable *UnavailableError
+		var retryAfter time.Duration
+		switch {
+		case err == nil:
+			return 0, nil
+		case errors.As(err, &skipped):
+			total := 0
+			for _, n := range skipped.Skipped {
+				total += n
+			}
+			return total, nil
+		case errors.As(err, &queueFull):
+			retryAfter = queueFull.RetryAfter
+		case errors.As(err, &unavailable):
+			retryAfter = unavailable.RetryAfter
+		default:
+			return 0, err
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(retryAfter):
+		}
+	}
+}
+
+func (r *DeadLetterReplayer) loadCheckpoint() (map[string]int64, error) {
+	checkpoint := make(map[string]int64)
+	data, err := os.ReadFile(filepath.Join(r.dir, replayCheckpointName))
+	if errors.Is(err, os.ErrNotExist) {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replay checkpoint: %w", err)
+	}
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to parse replay checkpoint: %w", err)
+	}
+	return checkpoint, nil
+}
+
+// saveCheckpoint replaces the checkpoint file atomically.
+func (r *DeadLetterReplayer) saveCheckpoint(checkpoint map[string]int64) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(r.dir, replayCheckpointName)
+	if err := os.WriteFile(path+".tmp", data, 0o640); err != nil {
+		return fmt.Errorf("failed to write replay checkpoint: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write replay checkpoint: %w", err)
+	}
+	return nil
+}
+
+// replayPacer spaces out batches so no more than rate documents are
+// submitted per second on average.
+type replayPacer struct {
+	rate      float64
+	start     time.Time
+	submitted int
+}
+
+func newReplayPacer(rate float64) *replayPacer {
+	return &replayPacer{rate: rate, start: time.Now()}
+}
+
+// batchSize keeps batches to about a second's worth of documents.
+func (p *replayPacer) batchSize() int {
+	if p.rate <= 0 {
+		return replayBatchEntries
+	}
+	return max(1, min(replayBatchEntries, int(p.rate)))
+}
+
+// wait returns once n more documents may be submitted.
+func (p *replayPacer) wait(ctx context.Context, n int) error {
+	if p.rate > 0 {
+		due := p.start.Add(time.Duration(float64(p.submitted) / p.rate * float64(time.Second)))
+		if delay := time.Until(due); delay > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+	}
+	p.submitted += n
+	return nil
+}
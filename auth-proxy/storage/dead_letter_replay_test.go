@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// appendDeadLetters appends lines to the dead-letter file name in dir.
+func appendDeadLetters(t *testing.T, dir, name string, lines ...string) {
+	t.Helper()
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		t.Fatalf("failed to open dead-letter file: %v", err)
+	}
+	defer file.Close()
+	for _, line := range lines {
+		if _, err := file.WriteString(line + "\n"); err != nil {
+			t.Fatalf("failed to write dead-letter file: %v", err)
+		}
+	}
+}
+
+func TestDeadLetterReplayResumesFromCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	appendDeadLetters(t, dir, "dead-letter-20260101T000000.ndjson",
+		`{"token_accountId":"1","document":{"message":"first"}}`,
+		`not json`,
+		`{"token_accountId":"1","document":{"message":"second"}}`,
+	)
+	target := &capturingStorage{}
+	replayer := NewDeadLetterReplayer(dir, target)
+	if err := replayer.Run(context.Background(), ReplayOptions{}); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if progress := replayer.Progress(); progress.Replayed != 2 || progress.Malformed != 1 || progress.FilesDone != 1 {
+		t.Errorf("progress = %+v, want 2 replayed, 1 malformed and 1 file done", progress)
+	}
+
+	// A line still being written is left for the next replay.
+	appendDeadLetters(t, dir, "dead-letter-20260101T000000.ndjson", `{"token_accountId":"1","document":{"message":"third"}}`)
+	file, err := os.OpenFile(filepath.Join(dir, "dead-letter-20260101T000000.ndjson"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("failed to open dead-letter file: %v", err)
+	}
+	file.WriteString(`{"token_accountId":"1","document":{"message":"fou`)
+	file.Close()
+
+	replayer = NewDeadLetterReplayer(dir, target)
+	if err := replayer.Run(context.Background(), ReplayOptions{}); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	stored := target.stored()
+	var messages []interface{}
+	for _, entry := range stored {
+		messages = append(messages, entry["message"])
+	}
+	if len(stored) != 3 || stored[2]["message"] != "third" {
+		t.Errorf("replayed %v, want first, second and then only third", messages)
+	}
+}
+
+func TestDeadLetterReplayTransform(t *testing.T) {
+	dir := t.TempDir()
+	appendDeadLetters(t, dir, "dead-letter-20260101T000000.ndjson",
+		`{"token_accountId":"1","document_id":"doc-1","document":{"message":"hi","level":{"bad":true},"env":"dev"}}`,
+	)
+	target := &capturingStorage{}
+	opts := ReplayOptions{Set: map[string]interface{}{"env": "prod"}, Remove: []string{"level"}}
+	if err := NewDeadLetterReplayer(dir, target).Run(context.Background(), opts); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	stored := target.stored()
+	if len(stored) != 1 {
+		t.Fatalf("replayed %d entries, want 1", len(stored))
+	}
+	entry := stored[0]
+	if _, ok := entry["level"]; ok || entry["env"] != "prod" || entry["message"] != "hi" {
+		t.Errorf("replayed %v, want level removed and env set to prod", entry)
+	}
+	if entry["_id"] != "doc-1" {
+		t.Errorf("_id = %v, want the dead-lettered document ID", entry["_id"])
+	}
+}
+
+func TestDeadLetterReplayKeepsIDAndTimestamp(t *testing.T) {
+	dir := t.TempDir()
+	appendDeadLetters(t, dir, "dead-letter-20260101T000000.ndjson",
+		`{"token_accountId":"1","document_id":"doc-1","document":{"container_name":"api","@timestamp":"2026-01-02T03:04:05Z"}}`,
+	)
+	cluster := &fakeCluster{}
+	cfg := testConfig()
+	cfg.IndexRotation = "daily"
+	es := newTestStorage(t, cluster, cfg, nil)
+	if err := NewDeadLetterReplayer(dir, es).Run(context.Background(), ReplayOptions{}); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if err := es.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	actions := cluster.received()
+	if len(actions) != 1 {
+		t.Fatalf("cluster received %d actions, want 1", len(actions))
+	}
+	action := actions[0]
+	if action.Meta["_id"] != "doc-1" {
+		t.Errorf("_id = %v, want doc-1", action.Meta["_id"])
+	}
+	if action.Document["@timestamp"] != "2026-01-02T03:04:05Z" {
+		t.Errorf("@timestamp = %v, want the original one", action.Document["@timestamp"])
+	}
+	if action.Meta["_index"] != "logs-containers-api-2026.01.02" {
+		t.Errorf("_index = %v, want the index of the original day", action.Meta["_index"])
+	}
+}
+
+func TestReplayPacer(t *testing.T) {
+	pacer := newReplayPacer(100)
+	if size := pacer.batchSize(); size != 100 {
+		t.Errorf("batchSize() = %d, want a second's worth of 100", size)
+	}
+	ctx := context.Background()
+	start := time.Now()
+	if err := pacer.wait(ctx, 50); err != nil {
+		t.Fatalf("wait() error = %v", err)
+	}
+	if err := pacer.wait(ctx, 50); err != nil {
+		t.Fatalf("wait() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 450*time.Millisecond {
+		t.Errorf("100 documents at 100/s took %v, want about 500ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := pacer.wait(ctx, 1); err != context.Canceled {
+		t.Errorf("wait() on a canceled context = %v, want context.Canceled", err)
+	}
+	if size := newReplayPacer(0).batchSize(); size != replayBatchEntries {
+		t.Errorf("unpaced batchSize() = %d, want %d", size, replayBatchEntries)
+	}
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"auth-proxy/logging"
+
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+)
+
+func TestDeadLetter(t *testing.T) {
+	rejected := esutil.BulkIndexerResponseItem{Status: http.StatusBadRequest}
+	rejected.Error.Type = "mapper_parsing_exception"
+	rejected.Error.Reason = "failed to parse field [level]"
+
+	tests := []struct {
+		name       string
+		item       esutil.BulkIndexerItem
+		resp       esutil.BulkIndexerResponseItem
+		err        error
+		wantError  string
+		wantStatus interface{}
+		wantID     interface{}
+	}{
+		{"item rejected", esutil.BulkIndexerItem{Index: "logs-containers-api", Action: "create"}, rejected, nil,
+			"mapper_parsing_exception", http.StatusBadRequest, nil},
+		{"request failed", esutil.BulkIndexerItem{Index: "logs-containers-api", Action: "create"}, esutil.BulkIndexerResponseItem{}, errors.New("connection refused"),
+			"request_failed", nil, nil},
+		{"with document ID", esutil.BulkIndexerItem{Index: "logs-containers-api", Action: "index", DocumentID: "doc-1"}, rejected, nil,
+			"mapper_parsing_exception", http.StatusBadRequest, "doc-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deadLetters := &capturingStorage{}
+			es := &ElasticsearchStorage{deadLetters: deadLetters}
+			ctx := logging.WithRequestID(context.Background(), "req-1")
+			es.deadLetter(ctx, "1", tt.item, tt.resp, tt.err, []byte(`{"level":{"bad":true}}`))
+
+			entries := deadLetters.stored()
+			if len(entries) != 1 {
+				t.Fatalf("dead-letter queue holds %d entries, want 1", len(entries))
+			}
+			entry := entries[0]
+			if entry["index"] != tt.item.Index || entry["action"] != tt.item.Action {
+				t.Errorf("entry = %v, want index %s and action %s", entry, tt.item.Index, tt.item.Action)
+			}
+			if entry["status"] != tt.wantStatus {
+				t.Errorf("status = %v, want %v", entry["status"], tt.wantStatus)
+			}
+			if entry["document_id"] != tt.wantID {
+				t.Errorf("document_id = %v, want %v", entry["document_id"], tt.wantID)
+			}
+			if entry["request_id"] != "req-1" {
+				t.Errorf("request_id = %v, want req-1", entry["request_id"])
+			}
+			if reason := entry["error"].(map[string]interface{}); reason["type"] != tt.wantError || reason["reason"] == "" {
+				t.Errorf("error = %v, want type %s with a reason", reason, tt.wantError)
+			}
+			// The document is kept as sent, so a replay can store it again.
+			var document map[string]interface{}
+			if err := json.Unmarshal(entry["document"].(json.RawMessage), &document); err != nil || document["level"] == nil {
+				t.Errorf("document = %s, want the original document", entry["document"])
+			}
+			if es.deadLettered.Load() != 1 {
+				t.Errorf("dead-lettered = %d, want 1", es.deadLettered.Load())
+			}
+		})
+	}
+}
+
+func TestDeadLetterWithoutQueue(t *testing.T) {
+	es := &ElasticsearchStorage{}
+	es.deadLetter(context.Background(), "1", esutil.BulkIndexerItem{Index: "logs-containers-api"}, esutil.BulkIndexerResponseItem{}, errors.New("failed"), []byte(`{}`))
+	if es.deadLettered.Load() != 0 {
+		t.Error("document counted as dead-lettered without a dead-letter queue")
+	}
+}
@@ -3,66 +3,341 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
+	"os"
 	"regexp"
 	"runtime"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"auth-proxy/config"
+	"auth-proxy/logging"
+	"auth-proxy/metrics"
+	"auth-proxy/tracing"
+
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/elastic/go-elasticsearch/v8/esutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ElasticsearchStorage struct {
 	elasticsearchClient *elasticsearch.Client
-	indexer             esutil.BulkIndexer
+
+	// mu guards indexers, which are replaced when the flush size is
+	// retuned. There is one per ingest pipeline, keyed by its name, since
+	// the pipeline is a parameter of the whole bulk request. Once closed,
+	// they are no longer replaced.
+	mu     sync.RWMutex
+	closed bool
+	// stop ends the flush size recovery and worker scaling loops on Close.
+	stop     chan struct{}
+	indexers map[string]esutil.BulkIndexer
+	tuning   *flushTuning
+	retired  esutil.BulkIndexerStats
+	pipeline pipelineSelector
+
+	sampler        *Sampler
+	enqueueRetries int
+	enqueueBackoff time.Duration
+	subAccountPath []string
+
+	clientVersioning bool
+	dataStreams      bool
+	lifecyclePolicy  *LifecyclePolicy
+	indexRotation    string
+	indexPattern     *indexPattern
+	indexPerAccount  bool
+	routePaths       [][]string
+	contentHashIDs   bool
+
+	// installTemplate is set when the proxy manages the index template;
+	// one that could not be installed at startup is retried by Health.
+	installTemplate   bool
+	templateInstalled atomic.Bool
+	bootstrapMu       sync.Mutex
+
+	// numWorkers is changed by worker scaling; new indexers pick it up.
+	numWorkers    atomic.Int64
+	flushBytes    int
+	flushInterval time.Duration
+	closeTimeout  time.Duration
+	flushes       atomic.Uint64
+	flushNanos    atomic.Uint64
+
+	// Items rejected with 429 or 503 are retried up to retryAttempts times.
+	retryAttempts    int
+	retryBackoff     time.Duration
+	retried          atomic.Uint64
+	retriesExhausted atomic.Uint64
+
+	// deadLetters, when set, receives the documents that were not stored.
+	deadLetters  LogStorage
+	deadLettered atomic.Uint64
+
+	callbackPanics atomic.Uint64
+
+	// queuedDocs and queuedBytes count documents added and not yet stored
+	// or dropped, including those waiting to be retried. StoreLogs rejects
+	// batches with QueueFullError once either reaches its limit.
+	queuedDocs          atomic.Int64
+	queuedBytes         atomic.Int64
+	maxQueuedDocs       int64
+	maxQueuedBytes      int64
+	queueFullRetryAfter time.Duration
 }
 
 // NewElasticsearchStorage creates a storage backed by esutil.BulkIndexer which handles batching and concurrency internally.
 // Reference : https://pkg.go.dev/github.com/elastic/go-elasticsearch/v8/esutil#NewBulkIndexer
-func NewElasticsearchStorage(elasticsearchClient *elasticsearch.Client) *ElasticsearchStorage {
-	bi, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
-		Client:        elasticsearchClient,
-		NumWorkers:    runtime.NumCPU(),
-		FlushBytes:    5 << 20, // 5MB
-		FlushInterval: 2 * time.Second,
-	})
+// A non-nil policy is installed and attached to the index template, and a
+// non-nil deadLetters receives the documents that fail to be stored.
+func NewElasticsearchStorage(elasticsearchClient *elasticsearch.Client, cfg *config.Config, policy *LifecyclePolicy, deadLetters LogStorage) *ElasticsearchStorage {
+	es := &ElasticsearchStorage{
+		elasticsearchClient: elasticsearchClient,
+		stop:                make(chan struct{}),
+		enqueueRetries:      cfg.EnqueueMaxRetries,
+		enqueueBackoff:      cfg.EnqueueRetryBackoff,
+		clientVersioning:    cfg.ClientVersioning,
+		dataStreams:         cfg.DataStreams,
+		lifecyclePolicy:     policy,
+		deadLetters:         deadLetters,
+		indexRotation:       cfg.IndexRotation,
+		indexPerAccount:     cfg.IndexPerAccount,
+		contentHashIDs:      cfg.ContentHashIDs,
+		flushBytes:          cfg.BulkFlushBytes,
+		flushInterval:       cfg.BulkFlushInterval,
+		closeTimeout:        cfg.ShutdownTimeout,
+		retryAttempts:       cfg.BulkRetryAttempts,
+		retryBackoff:        cfg.BulkRetryBackoff,
+		maxQueuedDocs:       int64(cfg.MaxQueuedDocs),
+		maxQueuedBytes:      int64(cfg.MaxQueuedBytes),
+		queueFullRetryAfter: cfg.QueueFullRetryAfter,
+		pipeline: pipelineSelector{
+			global:     cfg.IngestPipeline,
+			containers: cfg.ContainerPipelines,
+			tenants:    formatAccountKeys(cfg.TenantPipelines),
+		},
+	}
+	if cfg.IndexPattern != "" {
+		pattern, err := parseIndexPattern(cfg.IndexPattern)
+		if err != nil {
+			logger.Error("invalid ES_INDEX_PATTERN", "error", err)
+			os.Exit(1)
+		}
+		es.indexPattern = pattern
+	}
+	for _, field := range cfg.IndexRouteFields {
+		es.routePaths = append(es.routePaths, strings.Split(field, "."))
+	}
+	if cfg.SubAccountField != "" {
+		es.subAccountPath = strings.Split(cfg.SubAccountField, ".")
+	}
+	if cfg.SampleReservoirSize > 0 {
+		es.sampler = NewSampler(cfg.SampleReservoirSize, cfg.SampleMaxBytes)
+	}
+	if cfg.AdaptiveFlushBytes {
+		es.tuning = newFlushTuning(cfg.BulkFlushBytes, cfg.MinFlushBytes)
+		go es.recoverFlushBytes(cfg.FlushRecoveryInterval)
+	}
+
+	workers := cfg.BulkWorkers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	if cfg.AdaptiveWorkers {
+		scaling := &workerScaling{
+			min:           cfg.MinBulkWorkers,
+			max:           cfg.MaxBulkWorkers,
+			interval:      cfg.WorkerScaleInterval,
+			targetLatency: cfg.TargetBulkLatency,
+		}
+		if scaling.max == 0 {
+			scaling.max = 2 * workers
+		}
+		workers = max(scaling.min, min(scaling.max, workers))
+		go es.scaleWorkers(scaling)
+	}
+	es.numWorkers.Store(int64(workers))
+	indexers, err := es.newIndexers(cfg.BulkFlushBytes)
 	if err != nil {
-		log.Fatalf("failed to create bulk indexer: %v", err)
+		logger.Error("failed to create bulk indexer", "error", err)
+		os.Exit(1)
 	}
+	es.indexers = indexers
 
-	return &ElasticsearchStorage{
-		elasticsearchClient: elasticsearchClient,
-		indexer:             bi,
+	if cfg.InstallIndexTemplate {
+		if !es.dataStreams {
+			logger.Warn("installing a plain index template, which takes precedence over the built-in logs-*-* data stream template; set ES_DATA_STREAMS=true to keep writing to data streams", "index", es.indexWildcard())
+		}
+		// A cluster that is down at startup is not fatal; the policy and
+		// template are installed by a health check once it is up.
+		es.installTemplate = true
+		if err := es.bootstrap(context.Background()); err != nil {
+			logger.Warn("failed to install index template, retrying once the cluster is up", "error", err)
+		} else {
+			es.templateInstalled.Store(true)
+		}
+	}
+	if es.dataStreams {
+		es.warnPlainIndices(context.Background())
+	}
+	return es
+}
+
+// newIndexers creates a bulk indexer for every configured ingest pipeline.
+func (es *ElasticsearchStorage) newIndexers(flushBytes int) (map[string]esutil.BulkIndexer, error) {
+	indexers := make(map[string]esutil.BulkIndexer)
+	for _, pipeline := range es.pipeline.names() {
+		bi, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
+			Client:        statusTransport{next: es.elasticsearchClient},
+			NumWorkers:    int(es.numWorkers.Load()),
+			FlushBytes:    flushBytes,
+			FlushInterval: es.flushInterval,
+			Pipeline:      pipeline,
+			OnFlushStart:  es.onFlushStart,
+			OnFlushEnd:    es.onFlushEnd,
+			OnError: func(ctx context.Context, err error) {
+				es.onIndexerError(ctx, flushBytes, err)
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		indexers[pipeline] = bi
+	}
+	return indexers, nil
+}
+
+// onIndexerError is called for errors that fail a whole bulk request. The
+// flushBytes of the indexer that failed is passed so concurrent failures from
+// the same indexer only shrink the flush size once.
+func (es *ElasticsearchStorage) onIndexerError(ctx context.Context, flushBytes int, err error) {
+	logger.Error("bulk request failed", "error", err)
+	if es.tuning != nil && isPayloadTooLarge(ctx) {
+		if size, ok := es.tuning.shrink(flushBytes); ok {
+			logger.Warn("elasticsearch rejected bulk request as too large, reducing flush size", "flush_bytes", size)
+			go es.replaceIndexer(size)
+		}
 	}
 }
 
+// StoreLogs returns QueueFullError, without enqueueing any of logs, when the
+// queue limits are already reached. A batch may take the queue past them.
 func (es *ElasticsearchStorage) StoreLogs(ctx context.Context, tokenAccountID string, logs []map[string]interface{}) error {
-	timestamp := time.Now().Format(time.RFC3339)
-	marshalErrCount := 0
+	ctx, span := tracing.Tracer("auth-proxy/storage").Start(ctx, "enqueue", trace.WithAttributes(
+		attribute.String("account_id", tokenAccountID),
+		attribute.Int("entries", len(logs)),
+	))
+	defer span.End()
 
-	for _, logEntry := range logs {
+	if err := es.queueFull(); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	now := time.Now()
+	timestamp := now.Format(time.RFC3339)
+	indexSuffix := indexDateSuffix(es.indexRotation, now)
+	skipped := make(map[string]int)
+
+	results := indexResultsFrom(ctx)
+	accountLabel := metrics.Account(tokenAccountID)
+	// The bulk callbacks run after the request is done, so they get a
+	// context of their own. It keeps the request ID, and keeps failures of
+	// shipped service logs from being shipped again.
+	callbackLogCtx := logging.Detach(ctx)
+	fixedIndex := fixedIndexFrom(ctx)
+	keepTimestamps := originalTimestampsFrom(ctx)
+	for i, logEntry := range logs {
+		// The bulk indexer may still take an entry once ctx is done.
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("enqueued %d of %d log entries: %w", i, len(logs), err)
+		}
+		position := results.expect()
 		logAccountID := extractAccountIdFromLog(logEntry)
 		containerName := extractContainerName(logEntry)
 
 		// Log the received log entry before attempting to marshal/index it.
 		// This helps debug what arrives at the server prior to ES insertion.
-		if tokenAccountID == "1756844701" {
-			log.Printf("received log: token_account=%s extracted_account=%s container=%s entry=%+v", tokenAccountID, logAccountID, containerName, logEntry)
-		}
+		logger.DebugContext(ctx, "received log entry", "account_id", tokenAccountID, "log_account_id", logAccountID, "container", containerName, "entry", logEntry)
+
+		// Taken before fields are added so retried entries hash the same.
+		documentID := es.documentID(tokenAccountID, logEntry)
 
 		logEntry["token_accountId"] = tokenAccountID
-		logEntry["@timestamp"] = timestamp
+		if es.subAccountPath != nil {
+			if subAccountID := lookupField(logEntry, es.subAccountPath); subAccountID != "" {
+				logEntry["sub_account_id"] = subAccountID
+			}
+		}
+		// Replayed entries keep the time they were first received, and go
+		// to the index of that time.
+		entryTime, entrySuffix := now, indexSuffix
+		if original, ok := entryTimestamp(logEntry); keepTimestamps && ok {
+			entryTime, entrySuffix = original, indexDateSuffix(es.indexRotation, original)
+		} else {
+			logEntry["@timestamp"] = timestamp
+		}
 
-		indexName := buildIndexName(containerName)
+		var version *int64
+		if es.clientVersioning {
+			if raw, ok := logEntry["_version"]; ok {
+				delete(logEntry, "_version")
+				v, ok := parseDocumentVersion(raw)
+				if !ok {
+					logger.WarnContext(ctx, "skipping log entry with invalid _version", "account_id", tokenAccountID, "version", raw)
+					skipped["invalid_version"]++
+					results.skip(position, "invalid_version")
+					continue
+				}
+				// Elasticsearch rejects a version on an item without an _id.
+				if documentID == "" {
+					logger.WarnContext(ctx, "skipping log entry with _version but no _id or doc_id; set one, or ES_CONTENT_HASH_IDS, to version it", "account_id", tokenAccountID)
+					skipped["version_without_id"]++
+					results.skip(position, "version_without_id")
+					continue
+				}
+				version = &v
+			}
+		}
+
+		indexAccountID := ""
+		if es.indexPerAccount {
+			indexAccountID = tokenAccountID
+		}
+		route := extractRoute(logEntry, es.routePaths)
+		indexName := buildIndexName(indexAccountID, route, containerName) + entrySuffix
+		switch {
+		case fixedIndex != "":
+			indexName = fixedIndex
+		case es.indexPattern != nil:
+			name, err := es.indexPattern.name(newIndexNameData(tokenAccountID, logEntry, route, containerName, entryTime))
+			if err != nil {
+				logger.WarnContext(ctx, "failed to name index for log entry", "account_id", tokenAccountID, "error", err)
+				skipped["index_name_failed"]++
+				results.skip(position, "index_name_failed")
+				continue
+			}
+			indexName = name
+		}
 
 		body, err := json.Marshal(logEntry)
 		if err != nil {
 			// Count marshal failures and continue processing other logs.
-			log.Printf("warning: failed to marshal log entry: %v", err)
-			marshalErrCount++
+			logger.WarnContext(ctx, "failed to marshal log entry", "account_id", tokenAccountID, "error", err)
+			skipped["marshal_failed"]++
+			results.skip(position, "marshal_failed")
 			continue
 		}
 
@@ -71,52 +346,247 @@ func (es *ElasticsearchStorage) StoreLogs(ctx context.Context, tokenAccountID st
 		bodyCopy := make([]byte, len(body))
 		copy(bodyCopy, body)
 
+		pipeline := es.pipeline.pipelineFor(tokenAccountID, containerName)
+		attempts := 0
+		// Set before the item is added, so before any callback reads it.
+		var enqueuedAt time.Time
+
+		// Data streams only accept create actions.
 		item := esutil.BulkIndexerItem{
-			Action: "create",
-			Index:  indexName,
-			Body:   bytes.NewReader(bodyCopy),
+			Action:     "create",
+			Index:      indexName,
+			DocumentID: documentID,
+			Body:       bytes.NewReader(bodyCopy),
 			OnSuccess: func(callbackCtx context.Context, item esutil.BulkIndexerItem, resp esutil.BulkIndexerResponseItem) {
+				defer es.recoverCallback(item)
+				es.dequeued(len(bodyCopy))
+				metrics.AckLatency.WithLabelValues("indexed").Observe(time.Since(enqueuedAt).Seconds())
+				results.set(position, IndexResult{Status: resp.Status, Result: resp.Result, Index: item.Index, ID: resp.DocumentID})
+				if es.sampler != nil {
+					es.sampler.Add(item.Index, tokenAccountID, bodyCopy)
+				}
 				// Log the successfully indexed document (index, status and the document body)
-				if tokenAccountID == "1756844701" {
-					log.Printf("successfully indexed log to container index %s", item.Index)
-					log.Printf("Success : Log inserted - index=%s status=%d doc=%s", item.Index, resp.Status, string(bodyCopy))
+				if logger.Enabled(callbackLogCtx, slog.LevelDebug) {
+					logger.DebugContext(callbackLogCtx, "indexed log entry", "account_id", tokenAccountID, "index", item.Index, "status", resp.Status, "document", string(bodyCopy))
 				}
-
 			},
 			OnFailure: func(callbackCtx context.Context, item esutil.BulkIndexerItem, resp esutil.BulkIndexerResponseItem, err error) {
+				defer es.recoverCallback(item)
+				if err == nil && item.Action == "create" && item.DocumentID != "" && resp.Status == http.StatusConflict {
+					// An earlier attempt already stored the document.
+					es.dequeued(len(bodyCopy))
+					metrics.AckLatency.WithLabelValues("indexed").Observe(time.Since(enqueuedAt).Seconds())
+					results.set(position, IndexResult{Status: resp.Status, Result: "exists", Index: item.Index, ID: item.DocumentID})
+					return
+				}
+				if err == nil && isRetryableStatus(resp.Status) {
+					attempts++
+					if es.retryItem(pipeline, item, bodyCopy, attempts) {
+						return
+					}
+				}
+				es.dequeued(len(bodyCopy))
+				metrics.AckLatency.WithLabelValues("failed").Observe(time.Since(enqueuedAt).Seconds())
+				results.set(position, failedIndexResult(item, resp, err))
+				attrs := []any{"account_id", tokenAccountID, "index", item.Index, "status", resp.Status, "document", string(bodyCopy)}
 				if err != nil {
-					log.Printf("bulk indexer failure (err): %v", err)
-				} else {
+					attrs = append(attrs, "error", err)
+				} else if resp.Error.Type != "" {
 					// resp contains status and error body
-					if resp.Error.Type != "" {
-						log.Printf("bulk indexer item failed: index=%s status=%d error=%+v", item.Index, resp.Status, resp.Error)
-					}
+					attrs = append(attrs, "error_type", resp.Error.Type, "error_reason", resp.Error.Reason)
 				}
-
-				log.Printf("Failure : Log not inserted - index=%s status=%d doc=%s", item.Index, resp.Status, string(bodyCopy))
+				logger.WarnContext(callbackLogCtx, "log entry not indexed", attrs...)
+				metrics.AccountIndexFailures.WithLabelValues(accountLabel).Inc()
+				es.deadLetter(callbackLogCtx, tokenAccountID, item, resp, err, bodyCopy)
 			},
 		}
 
-		if err := es.indexer.Add(ctx, item); err != nil {
-			log.Printf("warning: bulk indexer Add error: %v", err)
-			return err
+		if version != nil {
+			// External versions are only accepted on index actions; ES keeps the
+			// document with the highest version.
+			item.Action = "index"
+			item.Version = version
+			item.VersionType = "external"
+		}
+
+		es.enqueued(len(bodyCopy))
+		enqueuedAt = time.Now()
+		if err := es.addWithRetry(ctx, pipeline, item); err != nil {
+			es.dequeued(len(bodyCopy))
+			span.SetStatus(codes.Error, err.Error())
+			return fmt.Errorf("enqueued %d of %d log entries: %w", i, len(logs), err)
 		}
+		metrics.AccountBytes.WithLabelValues(accountLabel).Add(float64(len(bodyCopy)))
+	}
+	if received, ok := metrics.ReceivedAt(ctx); ok {
+		metrics.EnqueueLatency.Observe(time.Since(received).Seconds())
 	}
 
-	if marshalErrCount > 0 {
-		return fmt.Errorf("%d log entries failed to marshal", marshalErrCount)
+	if len(skipped) > 0 {
+		return &SkippedEntriesError{Total: len(logs), Skipped: skipped}
 	}
 
 	return nil
 }
 
+// recoverCallback keeps a panic in a bulk indexer callback from killing the
+// process, which no HTTP middleware can catch on the indexer's workers.
+func (es *ElasticsearchStorage) recoverCallback(item esutil.BulkIndexerItem) {
+	if recovered := recover(); recovered != nil {
+		es.callbackPanics.Add(1)
+		logger.Error("bulk indexer callback panicked", "index", item.Index, "panic", recovered, "stack", string(debug.Stack()))
+	}
+}
+
+// addWithRetry adds item to the bulk indexer of pipeline, retrying transient
+// Add errors with exponential backoff until the retries are used up or ctx
+// is done.
+func (es *ElasticsearchStorage) addWithRetry(ctx context.Context, pipeline string, item esutil.BulkIndexerItem) error {
+	backoff := es.enqueueBackoff
+	for attempt := 0; ; attempt++ {
+		err := es.add(ctx, pipeline, item)
+		if err == nil {
+			return nil
+		}
+		if attempt >= es.enqueueRetries || ctx.Err() != nil {
+			logger.WarnContext(ctx, "failed to add item to bulk indexer", "attempts", attempt+1, "error", err)
+			return err
+		}
+
+		logger.WarnContext(ctx, "failed to add item to bulk indexer, retrying", "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// add holds the read lock for the whole Add so the indexer cannot be closed
+// underneath it by replaceIndexer.
+func (es *ElasticsearchStorage) add(ctx context.Context, pipeline string, item esutil.BulkIndexerItem) error {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	if es.closed {
+		return errStorageClosed
+	}
+	return es.indexers[pipeline].Add(ctx, item)
+}
+
+// Close flushes what the bulk indexers hold, for at most the shutdown
+// timeout, and stops retuning them.
 func (es *ElasticsearchStorage) Close() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), es.closeTimeout)
 	defer cancel()
-	if err := es.indexer.Close(ctx); err != nil {
-		return fmt.Errorf("failed to close bulk indexer: %w", err)
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.closed {
+		return nil
 	}
-	return nil
+	es.closed = true
+	if es.stop != nil {
+		close(es.stop)
+	}
+	var errs []error
+	for _, bi := range es.indexers {
+		if err := bi.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close bulk indexer: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Samples returns the example documents retained for index, or nil when
+// sampling is disabled.
+func (es *ElasticsearchStorage) Samples(index string) []Sample {
+	if es.sampler == nil {
+		return nil
+	}
+	return es.sampler.Samples(index)
+}
+
+// Health pings the cluster, installs the index template if startup could
+// not, and snapshots the bulk indexer counters.
+func (es *ElasticsearchStorage) Health(ctx context.Context) HealthReport {
+	report := HealthReport{Elasticsearch: "up", Saturated: es.queueFull() != nil}
+
+	res, err := es.elasticsearchClient.Ping(es.elasticsearchClient.Ping.WithContext(ctx))
+	if err != nil {
+		report.Elasticsearch = "down"
+	} else {
+		res.Body.Close()
+		if res.IsError() {
+			report.Elasticsearch = "down"
+		}
+	}
+
+	switch {
+	case !es.installTemplate:
+		report.Template = "unmanaged"
+	case es.templateInstalled.Load(), report.Elasticsearch == "up" && es.retryBootstrap(ctx):
+		report.Template = "installed"
+	default:
+		report.Template = "missing"
+	}
+
+	report.Indexer = es.IndexerStats()
+	return report
+}
+
+// IndexerStats reports the bulk indexer counters without contacting the
+// cluster.
+func (es *ElasticsearchStorage) IndexerStats() IndexerStats {
+	stats := es.indexerStats()
+	return IndexerStats{
+		NumAdded:            stats.NumAdded,
+		NumFlushed:          stats.NumFlushed,
+		NumFailed:           stats.NumFailed,
+		NumRequests:         stats.NumRequests,
+		NumRetried:          es.retried.Load(),
+		NumRetriesExhausted: es.retriesExhausted.Load(),
+		NumDeadLettered:     es.deadLettered.Load(),
+		NumCallbackPanics:   es.callbackPanics.Load(),
+		Workers:             int(es.numWorkers.Load()),
+		QueuedDocs:          es.queuedDocs.Load(),
+		QueuedBytes:         es.queuedBytes.Load(),
+	}
+}
+
+// documentID returns the ID a client gave the entry in _id or doc_id or,
+// with content hashing, a hash of the entry and account, so that a retried
+// batch cannot store an entry twice. _id is removed from the entry because
+// Elasticsearch rejects it inside a document.
+func (es *ElasticsearchStorage) documentID(tokenAccountID string, logEntry map[string]interface{}) string {
+	id := lookupField(logEntry, []string{"_id"})
+	delete(logEntry, "_id")
+	if id == "" {
+		id = lookupField(logEntry, []string{"doc_id"})
+	}
+	if id != "" || !es.contentHashIDs {
+		return id
+	}
+
+	body, err := json.Marshal(logEntry)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.New()
+	hash.Write([]byte(tokenAccountID))
+	hash.Write([]byte{0})
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// entryTimestamp returns the time in the entry's @timestamp, if it holds
+// an RFC 3339 one.
+func entryTimestamp(logEntry map[string]interface{}) (time.Time, bool) {
+	raw, ok := logEntry["@timestamp"].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, raw)
+	return t, err == nil
 }
 
 // extractAccountIdFromLog extracts account ID from log entry - handles string or number types
@@ -127,6 +597,57 @@ func extractAccountIdFromLog(logEntry map[string]interface{}) string {
 	return ""
 }
 
+// parseDocumentVersion accepts a client-supplied _version if it is a positive
+// integer, either as a JSON number or a numeric string.
+func parseDocumentVersion(raw interface{}) (int64, bool) {
+	switch v := raw.(type) {
+	case float64:
+		if v >= 1 && v == float64(int64(v)) {
+			return int64(v), true
+		}
+	case string:
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// lookupField follows a dotted field path, split into its parts, through
+// nested objects in the log entry and returns the value found there as a
+// string, or "" if it is missing.
+func lookupField(logEntry map[string]interface{}, path []string) string {
+	var current interface{} = logEntry
+	for _, key := range path {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		current = m[key]
+	}
+	switch v := current.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return ""
+}
+
+// ContainerNames returns the distinct container names found in logs, in the
+// order they first appear.
+func ContainerNames(logs []map[string]interface{}) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, logEntry := range logs {
+		if name := extractContainerName(logEntry); name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
 // extractContainerName extracts the container name from the log entry
 func extractContainerName(logEntry map[string]interface{}) string {
 	// Try top-level container_name first (Docker logs metadata)
@@ -142,14 +663,64 @@ func extractContainerName(logEntry map[string]interface{}) string {
 	return ""
 }
 
-func buildIndexName(containerName string) string {
+// extractRoute returns the value of the first of paths present in the log
+// entry, such as kubernetes.namespace_name, or "" when none is.
+func extractRoute(logEntry map[string]interface{}, paths [][]string) string {
+	for _, path := range paths {
+		if v := lookupField(logEntry, path); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// buildIndexName returns logs-containers-<container>, with the account and
+// route inserted before the container when they are set:
+// logs-containers-<account>-<route>-<container>.
+func buildIndexName(accountID, route, containerName string) string {
+	prefix := accountIndexPrefix(accountID)
+	if sanitized := sanitizeIndexName(route); sanitized != "" {
+		prefix += sanitized + "-"
+	}
 	if containerName != "" {
 		sanitized := sanitizeIndexName(containerName)
 		if sanitized != "" {
-			return fmt.Sprintf("logs-containers-%s", sanitized)
+			return prefix + sanitized
 		}
 	}
-	return "logs-containers-default"
+	return prefix + "default"
+}
+
+// accountIndexPrefix is the prefix shared by the indices of accountID, or
+// of all indices when it is empty.
+func accountIndexPrefix(accountID string) string {
+	if sanitized := sanitizeIndexName(accountID); sanitized != "" {
+		return "logs-containers-" + sanitized + "-"
+	}
+	return "logs-containers-"
+}
+
+// indexDateSuffix returns the suffix that dates the index of logs received
+// at t when indices are rotated "daily" or "weekly", e.g. -2024.06.01.
+// Weekly indices are dated with the Monday that starts the week.
+func indexDateSuffix(rotation string, t time.Time) string {
+	t = t.UTC()
+	switch rotation {
+	case "daily":
+	case "weekly":
+		t = t.AddDate(0, 0, -(int(t.Weekday())+6)%7)
+	default:
+		return ""
+	}
+	return t.Format("-2006.01.02")
+}
+
+// indexWildcard matches every index the storage writes to.
+func (es *ElasticsearchStorage) indexWildcard() string {
+	if es.indexPattern != nil {
+		return es.indexPattern.wildcard
+	}
+	return "logs-containers-*"
 }
 
 var invalidCharsRegex = regexp.MustCompile(`[^a-z0-9._-]`)
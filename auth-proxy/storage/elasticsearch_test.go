@@ -0,0 +1,444 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"auth-proxy/config"
+	"auth-proxy/logging"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+)
+
+// bulkAction is one action line of a bulk request with its document.
+type bulkAction struct {
+	Action   string
+	Meta     map[string]interface{}
+	Document map[string]interface{}
+}
+
+// fakeCluster answers bulk requests like Elasticsearch, recording every
+// action it is sent. status, when set, picks the status of each item by the
+// order it arrived in, from 0.
+type fakeCluster struct {
+	mu      sync.Mutex
+	actions []bulkAction
+	status  func(n int) int
+}
+
+func (f *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+		w.Write([]byte(`{"version":{"number":"8.19.0"}}`))
+		return
+	}
+
+	var items []map[string]interface{}
+	failed := false
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 1<<20), 1<<20)
+	for scanner.Scan() {
+		var header map[string]map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		scanner.Scan()
+		var document map[string]interface{}
+		json.Unmarshal(scanner.Bytes(), &document)
+		for action, meta := range header {
+			f.mu.Lock()
+			n := len(f.actions)
+			f.actions = append(f.actions, bulkAction{Action: action, Meta: meta, Document: document})
+			f.mu.Unlock()
+
+			status := http.StatusCreated
+			if f.status != nil {
+				status = f.status(n)
+			}
+			item := map[string]interface{}{"_index": meta["_index"], "_id": meta["_id"], "status": status}
+			if status >= 300 {
+				failed = true
+				item["error"] = map[string]interface{}{"type": "test_error", "reason": "rejected by the fake cluster"}
+			} else {
+				item["result"] = "created"
+			}
+			items = append(items, map[string]interface{}{action: item})
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"took": 1, "errors": failed, "items": items})
+}
+
+func (f *fakeCluster) received() []bulkAction {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]bulkAction{}, f.actions...)
+}
+
+// testConfig returns the settings NewElasticsearchStorage needs, flushing
+// quickly and managing no templates.
+func testConfig() *config.Config {
+	return &config.Config{
+		BulkWorkers:         1,
+		BulkFlushBytes:      1 << 20,
+		BulkFlushInterval:   10 * time.Millisecond,
+		BulkRetryBackoff:    time.Millisecond,
+		ShutdownTimeout:     5 * time.Second,
+		IndexRotation:       "none",
+		QueueFullRetryAfter: time.Second,
+	}
+}
+
+// newTestStorage returns storage writing to cluster. Tests close it to
+// flush what they stored.
+func newTestStorage(t *testing.T, cluster http.Handler, cfg *config.Config, deadLetters LogStorage) *ElasticsearchStorage {
+	t.Helper()
+	server := httptest.NewServer(cluster)
+	t.Cleanup(server.Close)
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return NewElasticsearchStorage(client, cfg, nil, deadLetters)
+}
+
+// storeAndFlush stores logs as account 1 and waits until the bulk indexer
+// has sent them.
+func storeAndFlush(t *testing.T, es *ElasticsearchStorage, logs ...map[string]interface{}) error {
+	t.Helper()
+	err := es.StoreLogs(context.Background(), "1", logs)
+	if closeErr := es.Close(); closeErr != nil {
+		t.Fatalf("Close() error = %v", closeErr)
+	}
+	return err
+}
+
+func TestStoreLogsVersioning(t *testing.T) {
+	cluster := &fakeCluster{}
+	cfg := testConfig()
+	cfg.ClientVersioning = true
+	es := newTestStorage(t, cluster, cfg, nil)
+
+	err := storeAndFlush(t, es,
+		map[string]interface{}{"container_name": "api", "_id": "doc-1", "_version": float64(3)},
+		map[string]interface{}{"container_name": "api", "_version": float64(4)},
+		map[string]interface{}{"container_name": "api", "_id": "doc-2", "_version": "zero"},
+		map[string]interface{}{"container_name": "api", "log": "unversioned"},
+	)
+
+	var skipped *SkippedEntriesError
+	if !errors.As(err, &skipped) {
+		t.Fatalf("StoreLogs() error = %v, want SkippedEntriesError", err)
+	}
+	if skipped.Skipped["version_without_id"] != 1 || skipped.Skipped["invalid_version"] != 1 {
+		t.Errorf("skipped = %v, want one version_without_id and one invalid_version", skipped.Skipped)
+	}
+
+	actions := cluster.received()
+	if len(actions) != 2 {
+		t.Fatalf("cluster received %d actions, want 2: %+v", len(actions), actions)
+	}
+	versioned := actions[0]
+	if versioned.Action != "index" || versioned.Meta["_id"] != "doc-1" ||
+		versioned.Meta["version"] != float64(3) || versioned.Meta["version_type"] != "external" {
+		t.Errorf("versioned action = %s %v, want an external index of doc-1 at version 3", versioned.Action, versioned.Meta)
+	}
+	if _, ok := versioned.Document["_version"]; ok {
+		t.Errorf("versioned document still carries _version: %v", versioned.Document)
+	}
+	if plain := actions[1]; plain.Action != "create" || plain.Meta["version"] != nil {
+		t.Errorf("unversioned action = %s %v, want a create without a version", plain.Action, plain.Meta)
+	}
+}
+
+func TestStoreLogsVersioningWithContentHashIDs(t *testing.T) {
+	cluster := &fakeCluster{}
+	cfg := testConfig()
+	cfg.ClientVersioning = true
+	cfg.ContentHashIDs = true
+	es := newTestStorage(t, cluster, cfg, nil)
+
+	if err := storeAndFlush(t, es, map[string]interface{}{"container_name": "api", "_version": float64(2)}); err != nil {
+		t.Fatalf("StoreLogs() error = %v", err)
+	}
+	actions := cluster.received()
+	if len(actions) != 1 || actions[0].Meta["_id"] == nil || actions[0].Meta["version"] != float64(2) {
+		t.Errorf("actions = %+v, want one versioned action with a hashed _id", actions)
+	}
+}
+
+func TestLookupField(t *testing.T) {
+	logEntry := map[string]interface{}{
+		"account": "top",
+		"kubernetes": map[string]interface{}{
+			"namespace_name": "payments",
+			"labels":         map[string]interface{}{"tenant": float64(42)},
+		},
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"account", "top"},
+		{"kubernetes.namespace_name", "payments"},
+		{"kubernetes.labels.tenant", "42"},
+		{"kubernetes.labels", ""},
+		{"kubernetes.missing", ""},
+		{"account.nested", ""},
+	}
+	for _, tt := range tests {
+		if got := lookupField(logEntry, strings.Split(tt.path, ".")); got != tt.want {
+			t.Errorf("lookupField(%s) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestServiceLogStorageUsesItsIndex(t *testing.T) {
+	cluster := &fakeCluster{}
+	es := newTestStorage(t, cluster, testConfig(), nil)
+	serviceLogs := NewServiceLogStorage(es, "logs-akto-ingestion")
+
+	if err := serviceLogs.StoreLogs(context.Background(), "", []map[string]interface{}{{"msg": "started"}}); err != nil {
+		t.Fatalf("StoreLogs() error = %v", err)
+	}
+	if err := storeAndFlush(t, es, map[string]interface{}{"message": "ingested"}); err != nil {
+		t.Fatalf("StoreLogs() error = %v", err)
+	}
+
+	actions := cluster.received()
+	if len(actions) != 2 {
+		t.Fatalf("cluster received %d actions, want 2", len(actions))
+	}
+	for _, action := range actions {
+		want := "logs-containers-default"
+		if action.Document["msg"] == "started" {
+			want = "logs-akto-ingestion"
+		}
+		if action.Meta["_index"] != want {
+			t.Errorf("document %v went to %v, want %s", action.Document, action.Meta["_index"], want)
+		}
+	}
+}
+
+func TestReplaceIndexerAfterClose(t *testing.T) {
+	cfg := testConfig()
+	cfg.AdaptiveFlushBytes = true
+	cfg.MinFlushBytes = 1 << 10
+	cfg.FlushRecoveryInterval = time.Hour
+	es := newTestStorage(t, &fakeCluster{}, cfg, nil)
+	if err := es.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	// Closing the indexers again would panic.
+	es.replaceIndexer(1 << 10)
+	if err := es.Close(); err != nil {
+		t.Fatalf("second Close() error = %v", err)
+	}
+	if err := es.StoreLogs(context.Background(), "1", []map[string]interface{}{{"message": "late"}}); err == nil {
+		t.Error("StoreLogs() after Close error = nil, want error")
+	}
+}
+
+func TestShippedServiceLogFailuresAreNotShippedAgain(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	var buf bytes.Buffer
+	if err := logging.Setup(&buf, "info", "json"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A read-only index rejects every document, so each shipped record
+	// fails and is logged as not indexed.
+	cluster := &fakeCluster{status: func(int) int { return http.StatusForbidden }}
+	es := newTestStorage(t, cluster, testConfig(), nil)
+	stop := logging.Ship(NewServiceLogStorage(es, "logs-akto-ingestion"), logging.ShipOptions{Rate: 100, FlushInterval: 5 * time.Millisecond})
+
+	slog.Info("service started")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(cluster.received()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Leave time for the failure to be shipped, were it to be.
+	time.Sleep(100 * time.Millisecond)
+	stop()
+	if err := es.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if received := cluster.received(); len(received) != 1 {
+		t.Errorf("cluster received %d documents, want only the shipped record", len(received))
+	}
+	if !strings.Contains(buf.String(), "log entry not indexed") {
+		t.Errorf("the failure was not logged: %s", buf.String())
+	}
+}
+
+// flakyIndexer is a bulk indexer whose Add fails when fail, given the
+// order of the call from 0, says so.
+type flakyIndexer struct {
+	mu    sync.Mutex
+	calls int
+	fail  func(n int) bool
+}
+
+var errIndexerFull = errors.New("bulk indexer queue is full")
+
+func (f *flakyIndexer) Add(ctx context.Context, item esutil.BulkIndexerItem) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := f.calls
+	f.calls++
+	if f.fail(n) {
+		return errIndexerFull
+	}
+	return nil
+}
+
+func (f *flakyIndexer) Close(ctx context.Context) error { return nil }
+func (f *flakyIndexer) Stats() esutil.BulkIndexerStats  { return esutil.BulkIndexerStats{} }
+func (f *flakyIndexer) attempts() int                   { f.mu.Lock(); defer f.mu.Unlock(); return f.calls }
+
+// withIndexer replaces the bulk indexers of es with indexer.
+func withIndexer(t *testing.T, es *ElasticsearchStorage, indexer esutil.BulkIndexer) {
+	t.Helper()
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	for pipeline, bi := range es.indexers {
+		if err := bi.Close(context.Background()); err != nil {
+			t.Fatalf("failed to close bulk indexer: %v", err)
+		}
+		es.indexers[pipeline] = indexer
+	}
+}
+
+func TestAddWithRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"first attempt succeeds", 0, 1, false},
+		{"succeeds after failures", 2, 3, false},
+		{"retries exhausted", 5, 4, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.EnqueueMaxRetries = 3
+			cfg.EnqueueRetryBackoff = time.Millisecond
+			es := newTestStorage(t, &fakeCluster{}, cfg, nil)
+			indexer := &flakyIndexer{fail: func(n int) bool { return n < tt.failures }}
+			withIndexer(t, es, indexer)
+			defer es.Close()
+
+			err := es.addWithRetry(context.Background(), "", esutil.BulkIndexerItem{Action: "create", Index: "logs-containers-api"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("addWithRetry() error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, errIndexerFull) {
+				t.Errorf("addWithRetry() error = %v, want the indexer's", err)
+			}
+			if got := indexer.attempts(); got != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestStoreLogsEnqueueRetriesExhausted(t *testing.T) {
+	cfg := testConfig()
+	cfg.EnqueueMaxRetries = 2
+	cfg.EnqueueRetryBackoff = time.Millisecond
+	es := newTestStorage(t, &fakeCluster{}, cfg, nil)
+	// The first two entries are added, then the indexer stays full.
+	withIndexer(t, es, &flakyIndexer{fail: func(n int) bool { return n >= 2 }})
+	defer es.Close()
+
+	logs := []map[string]interface{}{
+		{"container_name": "api", "n": 1},
+		{"container_name": "api", "n": 2},
+		{"container_name": "api", "n": 3},
+		{"container_name": "api", "n": 4},
+	}
+	err := es.StoreLogs(context.Background(), "1", logs)
+	if err == nil || !strings.Contains(err.Error(), "enqueued 2 of 4 log entries") {
+		t.Fatalf("StoreLogs() error = %v, want enqueued 2 of 4", err)
+	}
+	if !errors.Is(err, errIndexerFull) {
+		t.Errorf("StoreLogs() error = %v, want it to wrap the indexer's", err)
+	}
+	// The entry that was not added no longer counts as queued.
+	if queued := es.queuedDocs.Load(); queued != 2 {
+		t.Errorf("queued documents = %d, want 2", queued)
+	}
+}
+
+func TestStoreLogsSubAccountID(t *testing.T) {
+	tests := []struct {
+		name  string
+		field string
+		entry map[string]interface{}
+		want  interface{}
+	}{
+		{
+			name:  "field present",
+			field: "kubernetes.labels.account",
+			entry: map[string]interface{}{"container_name": "api", "kubernetes": map[string]interface{}{"labels": map[string]interface{}{"account": "team-a"}}},
+			want:  "team-a",
+		},
+		{
+			name:  "field absent",
+			field: "kubernetes.labels.account",
+			entry: map[string]interface{}{"container_name": "api", "kubernetes": map[string]interface{}{"labels": map[string]interface{}{"app": "web"}}},
+		},
+		{
+			name:  "field empty",
+			field: "kubernetes.labels.account",
+			entry: map[string]interface{}{"container_name": "api", "kubernetes": map[string]interface{}{"labels": map[string]interface{}{"account": ""}}},
+		},
+		{
+			name:  "sub-accounts disabled",
+			entry: map[string]interface{}{"container_name": "api", "kubernetes": map[string]interface{}{"labels": map[string]interface{}{"account": "team-a"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &fakeCluster{}
+			cfg := testConfig()
+			cfg.SubAccountField = tt.field
+			cfg.IndexPattern = "logs-{{.AccountID}}-{{.Container}}"
+			es := newTestStorage(t, cluster, cfg, nil)
+			if err := storeAndFlush(t, es, tt.entry); err != nil {
+				t.Fatalf("StoreLogs() error = %v", err)
+			}
+
+			actions := cluster.received()
+			if len(actions) != 1 {
+				t.Fatalf("cluster received %d actions, want 1", len(actions))
+			}
+			if got := actions[0].Document["sub_account_id"]; got != tt.want {
+				t.Errorf("sub_account_id = %v, want %v", got, tt.want)
+			}
+			// The sub-account never names the index.
+			if index := actions[0].Meta["_index"]; index != "logs-1-api" {
+				t.Errorf("_index = %v, want logs-1-api", index)
+			}
+		})
+	}
+
+	if _, err := parseIndexPattern("logs-{{.AccountID}}-{{.SubAccountID}}"); err == nil {
+		t.Error("parseIndexPattern() accepted {{.SubAccountID}}, which is no longer an index name field")
+	}
+}
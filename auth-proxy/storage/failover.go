@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FailoverConfig controls when a FailoverStorage switches clusters.
+type FailoverConfig struct {
+	// CheckInterval is how often the primary cluster's health is checked.
+	CheckInterval time.Duration
+	// FailoverAfter is how many consecutive failed checks switch traffic to
+	// the secondary; FailbackAfter is how many consecutive passed checks
+	// switch it back.
+	FailoverAfter int
+	FailbackAfter int
+}
+
+// FailoverStatusProvider is implemented by storage that switches between
+// clusters.
+type FailoverStatusProvider interface {
+	// OnSecondary reports whether traffic goes to the secondary cluster.
+	OnSecondary() bool
+	// Switches returns how many times traffic switched clusters.
+	Switches() uint64
+}
+
+// FailoverStorage writes to a primary Elasticsearch cluster and switches to
+// a standby cluster while the primary is unhealthy. A check fails when the
+// primary does not answer pings, or when bulk items failed since the last
+// check and none were flushed. Entries already queued for the primary when
+// it fails are not moved to the secondary.
+type FailoverStorage struct {
+	primary   *ElasticsearchStorage
+	secondary *ElasticsearchStorage
+	cfg       FailoverConfig
+
+	mu          sync.RWMutex
+	onSecondary bool
+	switches    atomic.Uint64
+
+	failed, passed int
+	lastStats      IndexerStats
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFailoverStorage starts health checks of primary, until Close. With
+// startOnSecondary set, traffic goes to secondary until primary passes
+// FailbackAfter checks.
+func NewFailoverStorage(primary, secondary *ElasticsearchStorage, cfg FailoverConfig, startOnSecondary bool) *FailoverStorage {
+	f := &FailoverStorage{
+		primary:     primary,
+		secondary:   secondary,
+		cfg:         cfg,
+		onSecondary: startOnSecondary,
+		done:        make(chan struct{}),
+	}
+	go f.monitor()
+	return f
+}
+
+func (f *FailoverStorage) active() *ElasticsearchStorage {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.onSecondary {
+		return f.secondary
+	}
+	return f.primary
+}
+
+func (f *FailoverStorage) StoreLogs(ctx context.Context, tokenAccountID string, logs []map[string]interface{}) error {
+	return f.active().StoreLogs(ctx, tokenAccountID, logs)
+}
+
+func (f *FailoverStorage) monitor() {
+	ticker := time.NewTicker(f.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+			f.check()
+		}
+	}
+}
+
+func (f *FailoverStorage) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), f.cfg.CheckInterval)
+	report := f.primary.Health(ctx)
+	cancel()
+
+	stats := report.Indexer
+	healthy := report.Elasticsearch == "up" &&
+		!(stats.NumFailed > f.lastStats.NumFailed && stats.NumFlushed == f.lastStats.NumFlushed)
+	f.lastStats = stats
+
+	if healthy {
+		f.failed = 0
+		f.passed++
+	} else {
+		f.passed = 0
+		f.failed++
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case !f.onSecondary && f.failed >= f.cfg.FailoverAfter:
+		f.onSecondary = true
+		f.switches.Add(1)
+		logger.Warn("elasticsearch failover, writing to the secondary cluster", "failed_checks", f.failed)
+	case f.onSecondary && f.passed >= f.cfg.FailbackAfter:
+		f.onSecondary = false
+		f.switches.Add(1)
+		logger.Info("elasticsearch failback, writing to the primary cluster", "passed_checks", f.passed)
+	}
+}
+
+// OnSecondary reports whether traffic goes to the secondary cluster.
+func (f *FailoverStorage) OnSecondary() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.onSecondary
+}
+
+// Switches returns how many times traffic failed over or back.
+func (f *FailoverStorage) Switches() uint64 {
+	return f.switches.Load()
+}
+
+// Samples returns the samples kept for index by the active cluster.
+func (f *FailoverStorage) Samples(index string) []Sample {
+	return f.active().Samples(index)
+}
+
+// Health reports the active cluster.
+func (f *FailoverStorage) Health(ctx context.Context) HealthReport {
+	return f.active().Health(ctx)
+}
+
+// IndexerStats sums the counters of both clusters, so they do not go back
+// when traffic switches.
+func (f *FailoverStorage) IndexerStats() IndexerStats {
+	return f.primary.IndexerStats().add(f.secondary.IndexerStats())
+}
+
+// Close stops the health checks and flushes both clusters' bulk indexers.
+func (f *FailoverStorage) Close() error {
+	f.closeOnce.Do(func() { close(f.done) })
+	err := f.primary.Close()
+	if secondaryErr := f.secondary.Close(); err == nil {
+		err = secondaryErr
+	}
+	return err
+}
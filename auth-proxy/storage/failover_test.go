@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pingableCluster fails pings with 503 while down is set and passes every
+// other request to next.
+type pingableCluster struct {
+	down atomic.Bool
+	next *fakeCluster
+}
+
+func (c *pingableCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead && r.URL.Path == "/" && c.down.Load() {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	c.next.ServeHTTP(w, r)
+}
+
+func TestFailoverStorageSwitches(t *testing.T) {
+	cluster := &pingableCluster{next: &fakeCluster{}}
+	primary := newTestStorage(t, cluster, testConfig(), nil)
+	secondary := newTestStorage(t, &fakeCluster{}, testConfig(), nil)
+	// The checks are driven by the test, not the ticker.
+	f := NewFailoverStorage(primary, secondary, FailoverConfig{CheckInterval: time.Hour, FailoverAfter: 2, FailbackAfter: 1}, false)
+
+	cluster.down.Store(true)
+	f.check()
+	if f.OnSecondary() || f.Switches() != 0 {
+		t.Fatalf("after one failed check: on secondary %v with %d switches, want still on primary", f.OnSecondary(), f.Switches())
+	}
+	f.check()
+	if !f.OnSecondary() || f.Switches() != 1 {
+		t.Fatalf("after two failed checks: on secondary %v with %d switches, want a failover", f.OnSecondary(), f.Switches())
+	}
+	cluster.down.Store(false)
+	f.check()
+	if f.OnSecondary() || f.Switches() != 2 {
+		t.Fatalf("after a passed check: on secondary %v with %d switches, want a failback", f.OnSecondary(), f.Switches())
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	select {
+	case <-f.done:
+	default:
+		t.Error("Close() did not stop the health checks")
+	}
+}
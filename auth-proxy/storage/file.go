@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"auth-proxy/filesink"
+)
+
+// fileMaintenanceInterval is how often idle files are rotated and expired
+// files removed.
+const fileMaintenanceInterval = time.Minute
+
+// FileStorage appends logs as NDJSON to size- and time-rotated files on
+// local disk, for deployments without a log database. Each batch is written
+// as a unit, so a batch never straddles two files.
+type FileStorage struct {
+	writer *filesink.Writer
+	done   chan struct{}
+}
+
+// NewFileStorage writes through a filesink writer configured by cfg and
+// starts rotating idle files and applying cfg.Retention in the background.
+func NewFileStorage(cfg filesink.Config) (*FileStorage, error) {
+	writer, err := filesink.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	f := &FileStorage{writer: writer, done: make(chan struct{})}
+	if err := writer.Cleanup(); err != nil {
+		logger.Warn("failed to remove expired log files", "error", err)
+	}
+	go f.maintain()
+	return f, nil
+}
+
+func (f *FileStorage) StoreLogs(ctx context.Context, tokenAccountID string, logs []map[string]interface{}) error {
+	timestamp := time.Now().UTC().Format(time.RFC3339)
+	skipped := make(map[string]int)
+
+	var batch bytes.Buffer
+	for _, logEntry := range logs {
+		logEntry["token_accountId"] = tokenAccountID
+		if _, ok := logEntry["@timestamp"]; !ok {
+			logEntry["@timestamp"] = timestamp
+		}
+		line, err := json.Marshal(logEntry)
+		if err != nil {
+			logger.WarnContext(ctx, "failed to marshal log entry for file storage", "account_id", tokenAccountID, "error", err)
+			skipped["marshal_failed"]++
+			continue
+		}
+		batch.Write(line)
+		batch.WriteByte('\n')
+	}
+
+	if batch.Len() > 0 {
+		if _, err := f.writer.Write(batch.Bytes()); err != nil {
+			return fmt.Errorf("failed to write logs to file: %w", err)
+		}
+	}
+	if len(skipped) > 0 {
+		return &SkippedEntriesError{Total: len(logs), Skipped: skipped}
+	}
+	return nil
+}
+
+func (f *FileStorage) maintain() {
+	ticker := time.NewTicker(fileMaintenanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+			if err := f.writer.RotateExpired(); err != nil {
+				logger.Warn("failed to rotate log file", "error", err)
+			}
+			if err := f.writer.Cleanup(); err != nil {
+				logger.Warn("failed to remove expired log files", "error", err)
+			}
+		}
+	}
+}
+
+// Close rotates out the current file.
+func (f *FileStorage) Close() error {
+	close(f.done)
+	return f.writer.Close()
+}
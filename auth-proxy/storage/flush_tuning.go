@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+)
+
+// flushTuning tracks the effective bulk flush size when it is being adapted to
+// the cluster's http.max_content_length.
+type flushTuning struct {
+	mu         sync.Mutex
+	current    int
+	max        int
+	min        int
+	lastShrink time.Time
+}
+
+func newFlushTuning(max, min int) *flushTuning {
+	if min > max {
+		min = max
+	}
+	return &flushTuning{current: max, max: max, min: min}
+}
+
+func (t *flushTuning) size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current
+}
+
+// shrink halves the flush size, down to the floor. from is the flush size of
+// the indexer that was rejected; stale rejections are ignored.
+func (t *flushTuning) shrink(from int) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if from != t.current || t.current <= t.min {
+		return t.current, false
+	}
+	t.current /= 2
+	if t.current < t.min {
+		t.current = t.min
+	}
+	t.lastShrink = time.Now()
+	return t.current, true
+}
+
+// grow doubles the flush size, up to the configured maximum, provided no
+// request has been rejected for at least quiet.
+func (t *flushTuning) grow(quiet time.Duration) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current >= t.max || time.Since(t.lastShrink) < quiet {
+		return t.current, false
+	}
+	t.current *= 2
+	if t.current > t.max {
+		t.current = t.max
+	}
+	return t.current, true
+}
+
+type flushStatusKey struct{}
+
+// flushStatus holds the HTTP status of the bulk request of a flush, which
+// the bulk indexer only passes to OnError as part of a message.
+type flushStatus struct {
+	code atomic.Int32
+}
+
+// withFlushStatus returns a copy of the flush context that records the
+// status of the flush's bulk request.
+func withFlushStatus(ctx context.Context) context.Context {
+	return context.WithValue(ctx, flushStatusKey{}, &flushStatus{})
+}
+
+// statusTransport records the status of every response in the flushStatus
+// of the request's context, if it has one.
+type statusTransport struct {
+	next esapi.Transport
+}
+
+func (t statusTransport) Perform(req *http.Request) (*http.Response, error) {
+	res, err := t.next.Perform(req)
+	if status, ok := req.Context().Value(flushStatusKey{}).(*flushStatus); ok && res != nil {
+		status.code.Store(int32(res.StatusCode))
+	}
+	return res, err
+}
+
+// isPayloadTooLarge reports whether the bulk request of the flush ctx
+// belongs to was answered with 413 Request Entity Too Large.
+func isPayloadTooLarge(ctx context.Context) bool {
+	status, ok := ctx.Value(flushStatusKey{}).(*flushStatus)
+	return ok && status.code.Load() == http.StatusRequestEntityTooLarge
+}
+
+// recoverFlushBytes periodically steps the flush size back up after it has
+// been reduced, until Close.
+func (es *ElasticsearchStorage) recoverFlushBytes(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-es.stop:
+			return
+		case <-ticker.C:
+			if size, ok := es.tuning.grow(interval); ok {
+				logger.Info("no oversized bulk requests, raising flush size", "interval", interval, "flush_bytes", size)
+				es.replaceIndexer(size)
+			}
+		}
+	}
+}
+
+// replaceIndexer swaps in bulk indexers using flushBytes and drains the old
+// ones in the background. It does nothing once the storage is closed, since
+// Close has already closed the indexers.
+func (es *ElasticsearchStorage) replaceIndexer(flushBytes int) {
+	indexers, err := es.newIndexers(flushBytes)
+	if err != nil {
+		logger.Error("failed to create bulk indexer", "flush_bytes", flushBytes, "error", err)
+		return
+	}
+
+	es.mu.Lock()
+	if es.closed {
+		es.mu.Unlock()
+		closeUnused(indexers)
+		return
+	}
+	old := es.indexers
+	es.indexers = indexers
+	es.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, bi := range old {
+		if err := bi.Close(ctx); err != nil {
+			logger.Warn("failed to close replaced bulk indexer", "error", err)
+		}
+	}
+
+	es.mu.Lock()
+	for _, bi := range old {
+		es.retired = addStats(es.retired, bi.Stats())
+	}
+	es.mu.Unlock()
+}
+
+// closeUnused closes indexers that were never given any items.
+func closeUnused(indexers map[string]esutil.BulkIndexer) {
+	for _, bi := range indexers {
+		if err := bi.Close(context.Background()); err != nil {
+			logger.Warn("failed to close unused bulk indexer", "error", err)
+		}
+	}
+}
+
+// indexerStats returns the counters of the current indexers plus those of
+// any indexers they replaced.
+func (es *ElasticsearchStorage) indexerStats() esutil.BulkIndexerStats {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	stats := es.retired
+	for _, bi := range es.indexers {
+		stats = addStats(stats, bi.Stats())
+	}
+	return stats
+}
+
+func addStats(a, b esutil.BulkIndexerStats) esutil.BulkIndexerStats {
+	return esutil.BulkIndexerStats{
+		NumAdded:     a.NumAdded + b.NumAdded,
+		NumFlushed:   a.NumFlushed + b.NumFlushed,
+		NumFailed:    a.NumFailed + b.NumFailed,
+		NumIndexed:   a.NumIndexed + b.NumIndexed,
+		NumCreated:   a.NumCreated + b.NumCreated,
+		NumUpdated:   a.NumUpdated + b.NumUpdated,
+		NumDeleted:   a.NumDeleted + b.NumDeleted,
+		NumRequests:  a.NumRequests + b.NumRequests,
+		FlushedBytes: a.FlushedBytes + b.FlushedBytes,
+	}
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// limitedCluster answers bulk requests over limit bytes with status, as a
+// cluster with a smaller http.max_content_length does with 413, and passes
+// the rest to next.
+type limitedCluster struct {
+	limit  int
+	status int
+	next   *fakeCluster
+}
+
+func (c *limitedCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/_bulk") {
+		body, _ := io.ReadAll(r.Body)
+		if len(body) > c.limit {
+			w.Header().Set("X-Elastic-Product", "Elasticsearch")
+			w.WriteHeader(c.status)
+			// The message mentions 413 whatever the status, so only the
+			// status can tell them apart.
+			w.Write([]byte(`{"error":"[413 Request Entity Too Large] from an upstream proxy"}`))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	c.next.ServeHTTP(w, r)
+}
+
+// storeOversized stores enough logs for a flush to exceed a 4096 byte
+// flush size.
+func storeOversized(t *testing.T, es *ElasticsearchStorage) {
+	t.Helper()
+	logs := make([]map[string]interface{}, 40)
+	for i := range logs {
+		logs[i] = map[string]interface{}{"container_name": "api", "message": strings.Repeat("x", 100)}
+	}
+	if err := es.StoreLogs(context.Background(), "1", logs); err != nil {
+		t.Fatalf("StoreLogs() error = %v", err)
+	}
+}
+
+func TestFlushBytesShrinkOn413(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		wantShrunk bool
+	}{
+		{"request entity too large", http.StatusRequestEntityTooLarge, true},
+		{"other failure", http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.BulkFlushBytes = 4096
+			cfg.BulkFlushInterval = time.Hour
+			cfg.AdaptiveFlushBytes = true
+			cfg.MinFlushBytes = 512
+			cfg.FlushRecoveryInterval = time.Hour
+			es := newTestStorage(t, &limitedCluster{limit: 2048, status: tt.status, next: &fakeCluster{}}, cfg, nil)
+			defer es.Close()
+
+			storeOversized(t, es)
+			deadline := time.Now().Add(2 * time.Second)
+			for es.currentFlushBytes() == 4096 && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			shrunk := es.currentFlushBytes() < 4096
+			if shrunk != tt.wantShrunk {
+				t.Errorf("flush size = %d after a %d, want shrunk %v", es.currentFlushBytes(), tt.status, tt.wantShrunk)
+			}
+		})
+	}
+}
+
+func TestFlushTuning(t *testing.T) {
+	tuning := newFlushTuning(4096, 1024)
+	if size, ok := tuning.shrink(4096); !ok || size != 2048 {
+		t.Errorf("shrink(4096) = %d, %v, want 2048", size, ok)
+	}
+	// A rejection by an indexer that was already replaced is stale.
+	if size, ok := tuning.shrink(4096); ok || size != 2048 {
+		t.Errorf("stale shrink(4096) = %d, %v, want 2048 unchanged", size, ok)
+	}
+	tuning.shrink(2048)
+	if size, ok := tuning.shrink(1024); ok || size != 1024 {
+		t.Errorf("shrink(1024) = %d, %v, want the 1024 floor", size, ok)
+	}
+	if _, ok := tuning.grow(time.Hour); ok {
+		t.Error("grow() right after a shrink raised the flush size")
+	}
+	tuning.lastShrink = time.Now().Add(-2 * time.Hour)
+	if size, ok := tuning.grow(time.Hour); !ok || size != 2048 {
+		t.Errorf("grow() = %d, %v, want 2048", size, ok)
+	}
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// LifecyclePolicy is the ILM policy attached to the logs index template.
+// Indices start in the hot phase, move to warm after WarmAfter and are
+// deleted after DeleteAfter; a zero age skips that phase. The ages count
+// from rollover for data streams and from creation for plain indices.
+type LifecyclePolicy struct {
+	Name string
+	// RolloverMaxAge and RolloverMaxSize roll a data stream over to a new
+	// backing index. They are ignored for plain indices, which cannot roll
+	// over.
+	RolloverMaxAge  time.Duration
+	RolloverMaxSize string
+	WarmAfter       time.Duration
+	DeleteAfter     time.Duration
+	// Accounts maps a numeric account ID to the policy of its own indices
+	// when indices are split by account.
+	Accounts map[int64]*LifecyclePolicy
+}
+
+// ensureLifecyclePolicy creates or updates the lifecycle policy when the
+// installed one differs from it.
+func (es *ElasticsearchStorage) ensureLifecyclePolicy(ctx context.Context, lifecyclePolicy *LifecyclePolicy) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	name := lifecyclePolicy.Name
+	policy := map[string]interface{}{"phases": lifecyclePolicy.phases(es.dataStreams)}
+	hash, err := stampHash(policy)
+	if err != nil {
+		return fmt.Errorf("failed to hash lifecycle policy %s: %w", name, err)
+	}
+	installedHash, err := es.installedPolicyHash(ctx, name)
+	if err != nil {
+		return err
+	}
+	if installedHash == hash {
+		return nil
+	}
+	body, err := json.Marshal(map[string]interface{}{"policy": policy})
+	if err != nil {
+		return fmt.Errorf("failed to encode lifecycle policy %s: %w", name, err)
+	}
+
+	client := es.elasticsearchClient
+	res, err := client.ILM.PutLifecycle(name,
+		client.ILM.PutLifecycle.WithBody(bytes.NewReader(body)),
+		client.ILM.PutLifecycle.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to put lifecycle policy %s: %w", name, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("failed to put lifecycle policy %s: status %d: %s", name, res.StatusCode, message)
+	}
+	logger.Info("installed lifecycle policy", "policy", name, "warm_after", lifecyclePolicy.WarmAfter, "delete_after", lifecyclePolicy.DeleteAfter)
+	return nil
+}
+
+// installedPolicyHash returns the hash the installed policy was built with,
+// or "" when it is missing or was not installed by this service.
+func (es *ElasticsearchStorage) installedPolicyHash(ctx context.Context, name string) (string, error) {
+	client := es.elasticsearchClient
+	res, err := client.ILM.GetLifecycle(
+		client.ILM.GetLifecycle.WithPolicy(name),
+		client.ILM.GetLifecycle.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("failed to get lifecycle policy %s: %w", name, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if res.IsError() {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return "", fmt.Errorf("failed to get lifecycle policy %s: status %d: %s", name, res.StatusCode, message)
+	}
+
+	var parsed map[string]struct {
+		Policy struct {
+			Meta struct {
+				Hash string `json:"hash"`
+			} `json:"_meta"`
+		} `json:"policy"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		return "", fmt.Errorf("failed to decode lifecycle policy %s: %w", name, err)
+	}
+	return parsed[name].Policy.Meta.Hash, nil
+}
+
+func (p *LifecyclePolicy) phases(dataStreams bool) map[string]interface{} {
+	hot := map[string]interface{}{
+		"set_priority": map[string]interface{}{"priority": 100},
+	}
+	if dataStreams {
+		rollover := make(map[string]interface{})
+		if p.RolloverMaxAge > 0 {
+			rollover["max_age"] = ilmAge(p.RolloverMaxAge)
+		}
+		if p.RolloverMaxSize != "" {
+			rollover["max_primary_shard_size"] = p.RolloverMaxSize
+		}
+		if len(rollover) > 0 {
+			hot["rollover"] = rollover
+		}
+	}
+	phases := map[string]interface{}{
+		"hot": map[string]interface{}{"min_age": "0ms", "actions": hot},
+	}
+	if p.WarmAfter > 0 {
+		phases["warm"] = map[string]interface{}{
+			"min_age": ilmAge(p.WarmAfter),
+			"actions": map[string]interface{}{
+				"set_priority": map[string]interface{}{"priority": 50},
+				"forcemerge":   map[string]interface{}{"max_num_segments": 1},
+			},
+		}
+	}
+	if p.DeleteAfter > 0 {
+		phases["delete"] = map[string]interface{}{
+			"min_age": ilmAge(p.DeleteAfter),
+			"actions": map[string]interface{}{"delete": map[string]interface{}{}},
+		}
+	}
+	return phases
+}
+
+// ilmAge formats d in the largest whole Elasticsearch time unit.
+func ilmAge(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return fmt.Sprintf("%ds", d/time.Second)
+}
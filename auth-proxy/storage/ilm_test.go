@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLifecyclePolicyPhases(t *testing.T) {
+	policy := &LifecyclePolicy{
+		RolloverMaxAge:  24 * time.Hour,
+		RolloverMaxSize: "50gb",
+		WarmAfter:       7 * 24 * time.Hour,
+		DeleteAfter:     30 * 24 * time.Hour,
+	}
+	tests := []struct {
+		name         string
+		policy       *LifecyclePolicy
+		dataStreams  bool
+		wantPhases   []string
+		wantRollover bool
+	}{
+		{"data streams", policy, true, []string{"hot", "warm", "delete"}, true},
+		{"plain indices", policy, false, []string{"hot", "warm", "delete"}, false},
+		{"hot only", &LifecyclePolicy{}, true, []string{"hot"}, false},
+		{"no warm phase", &LifecyclePolicy{DeleteAfter: time.Hour}, false, []string{"hot", "delete"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			phases := tt.policy.phases(tt.dataStreams)
+			if len(phases) != len(tt.wantPhases) {
+				t.Errorf("phases = %v, want %v", phases, tt.wantPhases)
+			}
+			for _, name := range tt.wantPhases {
+				if _, ok := phases[name]; !ok {
+					t.Errorf("phase %s missing from %v", name, phases)
+				}
+			}
+			hot := phases["hot"].(map[string]interface{})["actions"].(map[string]interface{})
+			if _, ok := hot["rollover"]; ok != tt.wantRollover {
+				t.Errorf("hot actions = %v, want rollover = %t", hot, tt.wantRollover)
+			}
+		})
+	}
+
+	phases := policy.phases(true)
+	if got := phases["delete"].(map[string]interface{})["min_age"]; got != "30d" {
+		t.Errorf("delete min_age = %v, want 30d", got)
+	}
+	rollover := phases["hot"].(map[string]interface{})["actions"].(map[string]interface{})["rollover"].(map[string]interface{})
+	if rollover["max_age"] != "1d" || rollover["max_primary_shard_size"] != "50gb" {
+		t.Errorf("rollover = %v, want max_age 1d and max_primary_shard_size 50gb", rollover)
+	}
+}
+
+func TestILMAge(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{48 * time.Hour, "2d"},
+		{36 * time.Hour, "36h"},
+		{90 * time.Minute, "90m"},
+		{45 * time.Second, "45s"},
+	}
+	for _, tt := range tests {
+		if got := ilmAge(tt.d); got != tt.want {
+			t.Errorf("ilmAge(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
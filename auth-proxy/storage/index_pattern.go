@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// IndexNameData is what an index pattern such as
+// logs-{{.AccountID}}-{{.Container}}-{{.Date}} is executed with. The
+// sub-account is left out: it is read from a log field, and every value a
+// client sends would otherwise create an index.
+type IndexNameData struct {
+	AccountID string
+	// Container is the sanitized container name, or "default".
+	Container string
+	// Namespace and Pod are the Kubernetes metadata added by Fluent Bit,
+	// and Route the first of the configured route fields found.
+	Namespace string
+	Pod       string
+	Route     string
+	// Date is the UTC day the log was received, e.g. 2024.06.01, and Week
+	// the Monday that starts its week.
+	Date string
+	Week string
+}
+
+// indexPattern names indices from a Go template. Its wildcard is the fixed
+// prefix of the pattern, so the index template covers every name it
+// produces.
+type indexPattern struct {
+	tmpl     *template.Template
+	wildcard string
+}
+
+var repeatedDashRegex = regexp.MustCompile(`-{2,}`)
+
+func parseIndexPattern(pattern string) (*indexPattern, error) {
+	tmpl, err := template.New("index").Option("missingkey=error").Parse(pattern)
+	if err != nil {
+		return nil, err
+	}
+	p := &indexPattern{tmpl: tmpl}
+	// Fail on unknown fields now rather than for every entry.
+	if _, err := p.name(IndexNameData{AccountID: "1", Container: "default"}); err != nil {
+		return nil, err
+	}
+
+	prefix, _, _ := strings.Cut(pattern, "{{")
+	p.wildcard = strings.ToLower(prefix) + "*"
+	return p, nil
+}
+
+func (p *indexPattern) name(data IndexNameData) (string, error) {
+	var name strings.Builder
+	if err := p.tmpl.Execute(&name, data); err != nil {
+		return "", err
+	}
+	// Empty fields would otherwise leave runs of separators behind.
+	sanitized := sanitizeIndexName(repeatedDashRegex.ReplaceAllString(name.String(), "-"))
+	if sanitized == "" {
+		return "", fmt.Errorf("index pattern produced an empty index name")
+	}
+	return sanitized, nil
+}
+
+func newIndexNameData(tokenAccountID string, logEntry map[string]interface{}, route, containerName string, now time.Time) IndexNameData {
+	data := IndexNameData{
+		AccountID: tokenAccountID,
+		Container: sanitizeIndexName(containerName),
+		Namespace: lookupField(logEntry, []string{"kubernetes", "namespace_name"}),
+		Pod:       lookupField(logEntry, []string{"kubernetes", "pod_name"}),
+		Route:     route,
+		Date:      indexDateSuffix("daily", now)[1:],
+		Week:      indexDateSuffix("weekly", now)[1:],
+	}
+	if data.Container == "" {
+		data.Container = "default"
+	}
+	return data
+}
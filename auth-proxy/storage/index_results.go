@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/elastic/go-elasticsearch/v8/esutil"
+)
+
+// IndexResult is the outcome of one entry of a batch stored with a context
+// from WithIndexResults.
+type IndexResult struct {
+	Status int         `json:"status"`
+	Result string      `json:"result,omitempty"`
+	Index  string      `json:"index,omitempty"`
+	ID     string      `json:"id,omitempty"`
+	Error  *IndexError `json:"error,omitempty"`
+}
+
+type IndexError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// IndexResults collects the outcome of every entry Elasticsearch storage
+// takes from a batch, in the order of the batch, for callers that wait
+// until their entries are indexed. Other backends do not report results.
+type IndexResults struct {
+	mu       sync.Mutex
+	results  []IndexResult
+	pending  int
+	resolved chan struct{}
+}
+
+type indexResultsKey struct{}
+
+// WithIndexResults returns a context that makes storage report the outcome
+// of the entries it is given to the returned IndexResults.
+func WithIndexResults(ctx context.Context) (context.Context, *IndexResults) {
+	results := &IndexResults{resolved: make(chan struct{}, 1)}
+	return context.WithValue(ctx, indexResultsKey{}, results), results
+}
+
+func indexResultsFrom(ctx context.Context) *IndexResults {
+	results, _ := ctx.Value(indexResultsKey{}).(*IndexResults)
+	return results
+}
+
+// withoutIndexResults hides the IndexResults of ctx, for storage that must
+// not report to them.
+func withoutIndexResults(ctx context.Context) context.Context {
+	if indexResultsFrom(ctx) == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, indexResultsKey{}, (*IndexResults)(nil))
+}
+
+// expect reserves the next position, to be resolved with set. The methods
+// storage calls do nothing on a nil IndexResults.
+func (r *IndexResults) expect() int {
+	if r == nil {
+		return -1
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results = append(r.results, IndexResult{})
+	r.pending++
+	return len(r.results) - 1
+}
+
+func (r *IndexResults) set(position int, result IndexResult) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results[position] = result
+	r.pending--
+	if r.pending == 0 {
+		select {
+		case r.resolved <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// skip resolves position as an entry storage dropped before indexing.
+func (r *IndexResults) skip(position int, reason string) {
+	r.set(position, IndexResult{
+		Status: http.StatusBadRequest,
+		Error:  &IndexError{Type: reason, Reason: "entry was skipped before indexing"},
+	})
+}
+
+// failedIndexResult describes an entry the bulk indexer gave up on: with
+// the item error Elasticsearch returned, or err when the whole bulk request
+// failed.
+func failedIndexResult(item esutil.BulkIndexerItem, resp esutil.BulkIndexerResponseItem, err error) IndexResult {
+	if err != nil {
+		return IndexResult{
+			Status: http.StatusBadGateway,
+			Index:  item.Index,
+			Error:  &IndexError{Type: "request_failed", Reason: err.Error()},
+		}
+	}
+	return IndexResult{
+		Status: resp.Status,
+		Index:  item.Index,
+		Error:  &IndexError{Type: resp.Error.Type, Reason: resp.Error.Reason},
+	}
+}
+
+// Wait returns the results once every entry reported so far is resolved,
+// or ctx.Err() when ctx is done first. Call it after StoreLogs returns.
+func (r *IndexResults) Wait(ctx context.Context) ([]IndexResult, error) {
+	for {
+		r.mu.Lock()
+		if r.pending == 0 {
+			results := append([]IndexResult{}, r.results...)
+			r.mu.Unlock()
+			return results, nil
+		}
+		r.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-r.resolved:
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"auth-proxy/kafka"
+)
+
+// KafkaStorage publishes each log entry as a JSON message so downstream
+// consumers such as SIEMs can subscribe without reading Elasticsearch.
+type KafkaStorage struct {
+	producer *kafka.Producer
+	// topic is a template where {account} and {container} are replaced by
+	// the entry's account ID and container name.
+	topic         string
+	accountHeader string
+}
+
+// NewKafkaStorage publishes through producer to the topics named by the
+// topic template, e.g. "logs.{account}" or "logs.{container}". The account
+// ID is also sent in accountHeader and used as the message key, so an
+// account's entries stay ordered within a topic.
+func NewKafkaStorage(producer *kafka.Producer, topic, accountHeader string) (*KafkaStorage, error) {
+	if topic == "" {
+		return nil, fmt.Errorf("kafka topic template must be provided")
+	}
+	return &KafkaStorage{producer: producer, topic: topic, accountHeader: accountHeader}, nil
+}
+
+func (k *KafkaStorage) StoreLogs(ctx context.Context, tokenAccountID string, logs []map[string]interface{}) error {
+	skipped := make(map[string]int)
+
+	messages := make([]kafka.Message, 0, len(logs))
+	for _, logEntry := range logs {
+		logEntry["token_accountId"] = tokenAccountID
+		value, err := json.Marshal(logEntry)
+		if err != nil {
+			logger.WarnContext(ctx, "failed to marshal log entry for Kafka", "account_id", tokenAccountID, "error", err)
+			skipped["marshal_failed"]++
+			continue
+		}
+		message := kafka.Message{
+			Topic: k.topicFor(tokenAccountID, extractContainerName(logEntry)),
+			Key:   []byte(tokenAccountID),
+			Value: value,
+		}
+		if k.accountHeader != "" {
+			message.Headers = map[string]string{k.accountHeader: tokenAccountID}
+		}
+		messages = append(messages, message)
+	}
+
+	if len(messages) > 0 {
+		if err := k.producer.Produce(ctx, messages); err != nil {
+			return err
+		}
+	}
+	if len(skipped) > 0 {
+		return &SkippedEntriesError{Total: len(logs), Skipped: skipped}
+	}
+	return nil
+}
+
+// topicFor fills in the topic template with characters Kafka allows in
+// topic names.
+func (k *KafkaStorage) topicFor(accountID, container string) string {
+	if container == "" {
+		container = "default"
+	}
+	return strings.NewReplacer(
+		"{account}", invalidKeyCharsRegex.ReplaceAllString(accountID, "-"),
+		"{container}", invalidKeyCharsRegex.ReplaceAllString(container, "-"),
+	).Replace(k.topic)
+}
+
+// Close flushes buffered messages and disconnects from the brokers.
+func (k *KafkaStorage) Close() error {
+	k.producer.Close()
+	return nil
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultLokiLabels maps Loki stream labels to the Kubernetes metadata added
+// by Fluent Bit.
+var DefaultLokiLabels = map[string]string{
+	"namespace": "kubernetes.namespace_name",
+	"pod":       "kubernetes.pod_name",
+	"app":       "kubernetes.labels.app",
+}
+
+// LokiConfig configures a LokiStorage.
+type LokiConfig struct {
+	// URL is the Loki base URL, e.g. http://loki:3100.
+	URL string
+	// TenantHeader carries the token account ID so each account is a
+	// separate Loki tenant.
+	TenantHeader string
+	// Labels maps a stream label to the dotted path of the log field it is
+	// read from. Entries without the field get no such label. The container
+	// label is always set from the container name unless Labels maps it.
+	Labels   map[string]string
+	Username string
+	Password string
+}
+
+// LokiStorage pushes logs to the Loki push API. Entries are grouped into
+// streams by their labels and sent as JSON log lines.
+type LokiStorage struct {
+	cfg    LokiConfig
+	client *http.Client
+	labels []lokiLabel
+}
+
+type lokiLabel struct {
+	name string
+	path []string
+}
+
+type lokiPush struct {
+	Streams []lokiStream `json:"streams"`
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+var lokiLabelNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func NewLokiStorage(cfg LokiConfig) (*LokiStorage, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("Loki URL must be provided")
+	}
+	labels := make([]lokiLabel, 0, len(cfg.Labels))
+	for name, path := range cfg.Labels {
+		if !lokiLabelNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid Loki label name %q", name)
+		}
+		labels = append(labels, lokiLabel{name: name, path: strings.Split(path, ".")})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+	return &LokiStorage{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 30 * time.Second},
+		labels: labels,
+	}, nil
+}
+
+func (l *LokiStorage) StoreLogs(ctx context.Context, tokenAccountID string, logs []map[string]interface{}) error {
+	now := time.Now().UTC()
+	skipped := make(map[string]int)
+
+	streams := make(map[string]*lokiStream)
+	var order []string
+	for _, logEntry := range logs {
+		logEntry["token_accountId"] = tokenAccountID
+		line, err := json.Marshal(logEntry)
+		if err != nil {
+			logger.WarnContext(ctx, "failed to marshal log entry for Loki", "account_id", tokenAccountID, "error", err)
+			skipped["marshal_failed"]++
+			continue
+		}
+
+		labels, key := l.streamLabels(logEntry)
+		stream, ok := streams[key]
+		if !ok {
+			stream = &lokiStream{Stream: labels}
+			streams[key] = stream
+			order = append(order, key)
+		}
+		timestamp := strconv.FormatInt(entryTime(logEntry, now).UnixNano(), 10)
+		stream.Values = append(stream.Values, [2]string{timestamp, string(line)})
+	}
+
+	if len(order) > 0 {
+		push := lokiPush{Streams: make([]lokiStream, 0, len(order))}
+		for _, key := range order {
+			push.Streams = append(push.Streams, *streams[key])
+		}
+		if err := l.push(ctx, tokenAccountID, push); err != nil {
+			return err
+		}
+	}
+	if len(skipped) > 0 {
+		return &SkippedEntriesError{Total: len(logs), Skipped: skipped}
+	}
+	return nil
+}
+
+// streamLabels returns the labels of logEntry and a key identifying its
+// stream. Loki requires at least one label, so unlabelled entries get
+// job="log-ingestion".
+func (l *LokiStorage) streamLabels(logEntry map[string]interface{}) (map[string]string, string) {
+	labels := make(map[string]string, len(l.labels))
+	var key strings.Builder
+	for _, label := range l.labels {
+		value := lookupField(logEntry, label.path)
+		if value == "" {
+			continue
+		}
+		labels[label.name] = value
+		fmt.Fprintf(&key, "%s=%q,", label.name, value)
+	}
+	if _, mapped := l.cfg.Labels["container"]; !mapped {
+		if container := extractContainerName(logEntry); container != "" {
+			labels["container"] = container
+			fmt.Fprintf(&key, "container=%q", container)
+		}
+	}
+	if len(labels) == 0 {
+		labels["job"] = "log-ingestion"
+	}
+	return labels, key.String()
+}
+
+func (l *LokiStorage) push(ctx context.Context, tenant string, push lokiPush) error {
+	body, err := json.Marshal(push)
+	if err != nil {
+		return fmt.Errorf("failed to encode Loki push request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(l.cfg.URL, "/")+"/loki/api/v1/push", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build Loki request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.cfg.TenantHeader != "" {
+		req.Header.Set(l.cfg.TenantHeader, tenant)
+	}
+	if l.cfg.Username != "" {
+		req.SetBasicAuth(l.cfg.Username, l.cfg.Password)
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Loki request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Loki returned status %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+	return nil
+}
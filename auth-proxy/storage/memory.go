@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryEntry is a log entry kept by MemoryStorage.
+type MemoryEntry struct {
+	ReceivedAt time.Time              `json:"received_at"`
+	AccountID  string                 `json:"account_id"`
+	Container  string                 `json:"container,omitempty"`
+	Entry      map[string]interface{} `json:"entry"`
+}
+
+// MemoryLogProvider is implemented by storages that keep recent logs in
+// memory.
+type MemoryLogProvider interface {
+	Recent(accountID, container string, limit int) []MemoryEntry
+}
+
+// MemoryStorage keeps the most recent logs in a fixed-size ring buffer. It
+// is meant for local development, where logs only need to be inspected.
+type MemoryStorage struct {
+	mu      sync.RWMutex
+	entries []MemoryEntry
+	next    int
+	full    bool
+}
+
+func NewMemoryStorage(capacity int) *MemoryStorage {
+	return &MemoryStorage{entries: make([]MemoryEntry, capacity)}
+}
+
+func (m *MemoryStorage) StoreLogs(ctx context.Context, tokenAccountID string, logs []map[string]interface{}) error {
+	now := time.Now().UTC()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, logEntry := range logs {
+		logEntry["token_accountId"] = tokenAccountID
+		m.entries[m.next] = MemoryEntry{
+			ReceivedAt: now,
+			AccountID:  tokenAccountID,
+			Container:  extractContainerName(logEntry),
+			Entry:      logEntry,
+		}
+		m.next = (m.next + 1) % len(m.entries)
+		m.full = m.full || m.next == 0
+	}
+	return nil
+}
+
+// Recent returns up to limit entries, newest first. Empty accountID and
+// container match every entry.
+func (m *MemoryStorage) Recent(accountID, container string, limit int) []MemoryEntry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	size := m.next
+	if m.full {
+		size = len(m.entries)
+	}
+	recent := []MemoryEntry{}
+	for i := 1; i <= size && len(recent) < limit; i++ {
+		entry := m.entries[(m.next-i+len(m.entries))%len(m.entries)]
+		if (accountID == "" || entry.AccountID == accountID) && (container == "" || entry.Container == container) {
+			recent = append(recent, entry)
+		}
+	}
+	return recent
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"auth-proxy/metrics"
+)
+
+// InstrumentedStorage records the size of every batch handed to the wrapped
+// storage, and how many of its entries were accepted or rejected per
+// account. A batch that failed part way is counted as rejected in full.
+type InstrumentedStorage struct {
+	next LogStorage
+}
+
+func NewInstrumentedStorage(next LogStorage) *InstrumentedStorage {
+	return &InstrumentedStorage{next: next}
+}
+
+func (s *InstrumentedStorage) StoreLogs(ctx context.Context, accountID string, logs []map[string]interface{}) error {
+	metrics.BatchEntries.Observe(float64(len(logs)))
+	err := s.next.StoreLogs(ctx, accountID, logs)
+
+	account := metrics.Account(accountID)
+	var skipped *SkippedEntriesError
+	switch {
+	case err == nil:
+		metrics.AccountDocuments.WithLabelValues(account).Add(float64(len(logs)))
+	case errors.As(err, &skipped):
+		accepted := len(logs)
+		for reason, n := range skipped.Skipped {
+			metrics.AccountRejections.WithLabelValues(account, reason).Add(float64(n))
+			accepted -= n
+		}
+		metrics.AccountDocuments.WithLabelValues(account).Add(float64(accepted))
+	default:
+		metrics.AccountRejections.WithLabelValues(account, rejectionReason(err)).Add(float64(len(logs)))
+	}
+	return err
+}
+
+// rejectionReason names why a whole batch was refused, from a small fixed
+// set so errors cannot create label values.
+func rejectionReason(err error) string {
+	var queueFull *QueueFullError
+	var tooLarge *BatchTooLargeError
+	var unavailable *UnavailableError
+	switch {
+	case errors.As(err, &queueFull):
+		return "queue_full"
+	case errors.As(err, &tooLarge):
+		return "batch_too_large"
+	case errors.As(err, &unavailable):
+		return "unavailable"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	default:
+		return "error"
+	}
+}
+
+// RegisterIndexerMetrics exports the bulk indexer counters of provider,
+// read at every scrape. A metric that cannot be registered is logged and
+// left out.
+func RegisterIndexerMetrics(provider IndexerStatsProvider) {
+	counters := []struct {
+		name, help string
+		value      func(IndexerStats) uint64
+	}{
+		{"bulk_added_total", "Documents added to the bulk indexers.", func(s IndexerStats) uint64 { return s.NumAdded }},
+		{"bulk_flushed_total", "Documents the bulk indexers stored.", func(s IndexerStats) uint64 { return s.NumFlushed }},
+		{"bulk_failed_total", "Documents the bulk indexers failed to store.", func(s IndexerStats) uint64 { return s.NumFailed }},
+		{"bulk_requests_total", "Bulk requests sent.", func(s IndexerStats) uint64 { return s.NumRequests }},
+		{"bulk_retried_total", "Rejected bulk items queued again.", func(s IndexerStats) uint64 { return s.NumRetried }},
+		{"bulk_retries_exhausted_total", "Rejected bulk items dropped once out of retries.", func(s IndexerStats) uint64 { return s.NumRetriesExhausted }},
+		{"bulk_dead_lettered_total", "Failed documents written to the dead-letter queue.", func(s IndexerStats) uint64 { return s.NumDeadLettered }},
+		{"bulk_callback_panics_total", "Bulk item callbacks that panicked.", func(s IndexerStats) uint64 { return s.NumCallbackPanics }},
+	}
+	for _, c := range counters {
+		value := c.value
+		err := metrics.RegisterCounterFunc(c.name, c.help, func() float64 {
+			return float64(value(provider.IndexerStats()))
+		})
+		if err != nil {
+			logger.Warn("failed to register metric", "metric", c.name, "error", err)
+		}
+	}
+
+	gauges := []struct {
+		name, help string
+		value      func(IndexerStats) int64
+	}{
+		{"bulk_workers", "Bulk indexer workers.", func(s IndexerStats) int64 { return int64(s.Workers) }},
+		{"bulk_queued_documents", "Documents queued but not yet stored.", func(s IndexerStats) int64 { return s.QueuedDocs }},
+		{"bulk_queued_bytes", "Bytes queued but not yet stored.", func(s IndexerStats) int64 { return s.QueuedBytes }},
+	}
+	for _, g := range gauges {
+		value := g.value
+		err := metrics.RegisterGaugeFunc(g.name, g.help, func() float64 {
+			return float64(value(provider.IndexerStats()))
+		})
+		if err != nil {
+			logger.Warn("failed to register metric", "metric", g.name, "error", err)
+		}
+	}
+}
+
+// RegisterFailoverMetrics exports whether provider writes to its secondary
+// cluster and how often it switched, read at every scrape.
+func RegisterFailoverMetrics(provider FailoverStatusProvider) {
+	if err := metrics.RegisterCounterFunc("elasticsearch_failover_switches_total", "Switches between the primary and secondary Elasticsearch clusters.", func() float64 {
+		return float64(provider.Switches())
+	}); err != nil {
+		logger.Warn("failed to register metric", "metric", "elasticsearch_failover_switches_total", "error", err)
+	}
+	if err := metrics.RegisterGaugeFunc("elasticsearch_failover_active", "1 while writing to the secondary Elasticsearch cluster.", func() float64 {
+		if provider.OnSecondary() {
+			return 1
+		}
+		return 0
+	}); err != nil {
+		logger.Warn("failed to register metric", "metric", "elasticsearch_failover_active", "error", err)
+	}
+}
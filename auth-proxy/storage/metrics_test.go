@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"auth-proxy/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatalf("failed to read counter: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestInstrumentedStorageCountsByAccount(t *testing.T) {
+	next := &stubStorage{}
+	s := NewInstrumentedStorage(next)
+	accepted := metrics.AccountDocuments.WithLabelValues("metrics-test")
+	rejected := metrics.AccountRejections.WithLabelValues("metrics-test", "unavailable")
+
+	logs := []map[string]interface{}{{"log": "a"}, {"log": "b"}}
+	if err := s.StoreLogs(context.Background(), "metrics-test", logs); err != nil {
+		t.Fatalf("StoreLogs() error = %v", err)
+	}
+	next.err = &UnavailableError{}
+	if err := s.StoreLogs(context.Background(), "metrics-test", logs[:1]); err == nil {
+		t.Fatal("StoreLogs() succeeded, want the wrapped storage's error")
+	}
+
+	if got := counterValue(t, accepted); got != 2 {
+		t.Errorf("accepted documents = %v, want 2", got)
+	}
+	if got := counterValue(t, rejected); got != 1 {
+		t.Errorf("unavailable rejections = %v, want 1", got)
+	}
+}
+
+func histogramCount(t *testing.T, h prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := h.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("failed to read histogram: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestIngestLatencyObserved(t *testing.T) {
+	cluster := &fakeCluster{status: func(n int) int {
+		if n == 1 {
+			return http.StatusBadRequest
+		}
+		return http.StatusCreated
+	}}
+	es := newTestStorage(t, cluster, testConfig(), nil)
+	indexed := metrics.AckLatency.WithLabelValues("indexed")
+	failed := metrics.AckLatency.WithLabelValues("failed")
+	enqueueBefore := histogramCount(t, metrics.EnqueueLatency)
+	indexedBefore, failedBefore := histogramCount(t, indexed), histogramCount(t, failed)
+
+	ctx := metrics.WithReceivedAt(context.Background(), time.Now())
+	logs := []map[string]interface{}{{"container_name": "api"}, {"container_name": "api"}}
+	if err := es.StoreLogs(ctx, "1", logs); err != nil {
+		t.Fatalf("StoreLogs() error = %v", err)
+	}
+	if err := es.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if got := histogramCount(t, metrics.EnqueueLatency) - enqueueBefore; got != 1 {
+		t.Errorf("enqueue latencies observed = %d, want 1 per batch", got)
+	}
+	if got := histogramCount(t, indexed) - indexedBefore; got != 1 {
+		t.Errorf("indexed ack latencies observed = %d, want 1", got)
+	}
+	if got := histogramCount(t, failed) - failedBefore; got != 1 {
+		t.Errorf("failed ack latencies observed = %d, want 1", got)
+	}
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Destination is one backend of a MultiStorage. A batch fails when a
+// required destination fails; failures of optional destinations, such as an
+// archive, are only logged and counted.
+type Destination struct {
+	Name     string
+	Storage  LogStorage
+	Optional bool
+}
+
+// DestinationStats counts the batches written to one destination.
+type DestinationStats struct {
+	Name        string    `json:"name"`
+	Optional    bool      `json:"optional"`
+	Batches     uint64    `json:"batches"`
+	Entries     uint64    `json:"entries"`
+	Failures    uint64    `json:"failures"`
+	Skipped     uint64    `json:"skipped"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+}
+
+// DestinationStatsProvider is implemented by storages that write to several
+// destinations.
+type DestinationStatsProvider interface {
+	DestinationStats() []DestinationStats
+}
+
+// MultiStorage tees every batch to all of its destinations concurrently.
+// Each destination gets its own copy of the entries' top-level fields, since
+// backends add fields such as token_accountId as they store them.
+type MultiStorage struct {
+	destinations []Destination
+
+	mu    sync.Mutex
+	stats []DestinationStats
+}
+
+func NewMultiStorage(destinations ...Destination) (*MultiStorage, error) {
+	required := false
+	for _, destination := range destinations {
+		required = required || !destination.Optional
+	}
+	if !required {
+		return nil, fmt.Errorf("at least one storage destination must be required")
+	}
+	m := &MultiStorage{
+		destinations: destinations,
+		stats:        make([]DestinationStats, len(destinations)),
+	}
+	for i, destination := range destinations {
+		m.stats[i] = DestinationStats{Name: destination.Name, Optional: destination.Optional}
+	}
+	return m, nil
+}
+
+// Destination returns the storage of the first destination named name, or
+// nil when there is none.
+func (m *MultiStorage) Destination(name string) LogStorage {
+	for _, destination := range m.destinations {
+		if destination.Name == name {
+			return destination.Storage
+		}
+	}
+	return nil
+}
+
+// StoreLogs returns the errors of the required destinations that failed.
+// When they all stored the batch, a SkippedEntriesError from the first
+// required destination is returned so clients still learn about skips.
+// Index results are reported by the first required destination only.
+func (m *MultiStorage) StoreLogs(ctx context.Context, tokenAccountID string, logs []map[string]interface{}) error {
+	errs := make([]error, len(m.destinations))
+	var wg sync.WaitGroup
+	reporting := -1
+	for i, destination := range m.destinations {
+		if !destination.Optional && reporting < 0 {
+			reporting = i
+		}
+		destinationCtx := ctx
+		if i != reporting {
+			destinationCtx = withoutIndexResults(ctx)
+		}
+		wg.Add(1)
+		go func(ctx context.Context, i int, destination Destination) {
+			defer wg.Done()
+			errs[i] = destination.Storage.StoreLogs(ctx, tokenAccountID, copyEntries(logs))
+			m.record(i, len(logs), errs[i])
+		}(destinationCtx, i, destination)
+	}
+	wg.Wait()
+
+	var failed []error
+	var skipped error
+	for i, destination := range m.destinations {
+		err := errs[i]
+		if err == nil {
+			continue
+		}
+		var skippedErr *SkippedEntriesError
+		if errors.As(err, &skippedErr) {
+			if !destination.Optional && skipped == nil {
+				skipped = err
+			}
+			continue
+		}
+		if destination.Optional {
+			logger.WarnContext(ctx, "optional storage destination failed to store log entries", "destination", destination.Name, "account_id", tokenAccountID, "entries", len(logs), "error", err)
+			continue
+		}
+		failed = append(failed, fmt.Errorf("storage destination %s: %w", destination.Name, err))
+	}
+	if len(failed) > 0 {
+		return errors.Join(failed...)
+	}
+	return skipped
+}
+
+func (m *MultiStorage) record(i, entries int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := &m.stats[i]
+	stats.Batches++
+	stats.Entries += uint64(entries)
+	var skippedErr *SkippedEntriesError
+	switch {
+	case err == nil:
+	case errors.As(err, &skippedErr):
+		stats.Skipped += uint64(skippedErr.Count())
+	default:
+		stats.Failures++
+		stats.LastError = err.Error()
+		stats.LastErrorAt = time.Now().UTC()
+	}
+}
+
+// copyEntries copies the top-level fields of every entry. Nested values are
+// shared, as backends only read them.
+func copyEntries(logs []map[string]interface{}) []map[string]interface{} {
+	copies := make([]map[string]interface{}, len(logs))
+	for i, logEntry := range logs {
+		entry := make(map[string]interface{}, len(logEntry)+2)
+		for key, value := range logEntry {
+			entry[key] = value
+		}
+		copies[i] = entry
+	}
+	return copies
+}
+
+func (m *MultiStorage) DestinationStats() []DestinationStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]DestinationStats(nil), m.stats...)
+}
+
+// Samples returns the samples of the first destination that keeps them.
+func (m *MultiStorage) Samples(index string) []Sample {
+	for _, destination := range m.destinations {
+		if provider, ok := destination.Storage.(SampleProvider); ok {
+			return provider.Samples(index)
+		}
+	}
+	return nil
+}
+
+// Health reports the first destination that can report its health, or
+// "unknown" when none can.
+func (m *MultiStorage) Health(ctx context.Context) HealthReport {
+	for _, destination := range m.destinations {
+		if reporter, ok := destination.Storage.(HealthReporter); ok {
+			return reporter.Health(ctx)
+		}
+	}
+	return HealthReport{Elasticsearch: "unknown"}
+}
+
+// IndexerStats reports the first destination that keeps indexer counters.
+func (m *MultiStorage) IndexerStats() IndexerStats {
+	for _, destination := range m.destinations {
+		if provider, ok := destination.Storage.(IndexerStatsProvider); ok {
+			return provider.IndexerStats()
+		}
+	}
+	return IndexerStats{}
+}
+
+// Close closes every destination that can be closed.
+func (m *MultiStorage) Close() error {
+	var errs []error
+	for _, destination := range m.destinations {
+		if closer, ok := destination.Storage.(interface{ Close() error }); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("storage destination %s: %w", destination.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
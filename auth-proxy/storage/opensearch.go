@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"net/http"
+	"strings"
+)
+
+// OpenSearchTransport adapts the go-elasticsearch client to OpenSearch,
+// which speaks the same document and bulk APIs. The client refuses any
+// cluster that does not answer with X-Elastic-Product: Elasticsearch, and
+// OpenSearch rejects the Elasticsearch compatibility media type, so
+// responses are tagged and compatibility headers are replaced with plain
+// JSON. A nil base uses http.DefaultTransport.
+func OpenSearchTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return openSearchTransport{base: base}
+}
+
+type openSearchTransport struct {
+	base http.RoundTripper
+}
+
+// compatibilityMediaTypes maps the Elasticsearch compatibility media types,
+// which may carry a compatible-with parameter, to the plain ones OpenSearch
+// accepts. Bulk requests use the NDJSON one.
+var compatibilityMediaTypes = map[string]string{
+	"application/vnd.elasticsearch+json":     "application/json",
+	"application/vnd.elasticsearch+x-ndjson": "application/x-ndjson",
+}
+
+func (t openSearchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cloned := false
+	for _, header := range []string{"Accept", "Content-Type"} {
+		mediaType, _, _ := strings.Cut(req.Header.Get(header), ";")
+		plain, ok := compatibilityMediaTypes[strings.TrimSpace(mediaType)]
+		if !ok {
+			continue
+		}
+		if !cloned {
+			req = req.Clone(req.Context())
+			cloned = true
+		}
+		req.Header.Set(header, plain)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Set("X-Elastic-Product", "Elasticsearch")
+	return resp, nil
+}
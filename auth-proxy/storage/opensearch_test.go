@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"net/http"
+	"testing"
+)
+
+// headerRecorder answers every request, recording the last one's headers.
+type headerRecorder struct {
+	header http.Header
+}
+
+func (r *headerRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.header = req.Header
+	return &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody}, nil
+}
+
+func TestOpenSearchTransportRewritesCompatibilityHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		sent string
+		want string
+	}{
+		{"json", "application/vnd.elasticsearch+json; compatible-with=8", "application/json"},
+		{"ndjson", "application/vnd.elasticsearch+x-ndjson; compatible-with=8", "application/x-ndjson"},
+		{"without parameter", "application/vnd.elasticsearch+json", "application/json"},
+		{"plain", "application/json", "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &headerRecorder{}
+			req, _ := http.NewRequest(http.MethodPost, "http://opensearch:9200/_bulk", nil)
+			req.Header.Set("Accept", tt.sent)
+			req.Header.Set("Content-Type", tt.sent)
+			resp, err := OpenSearchTransport(base).RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			for _, header := range []string{"Accept", "Content-Type"} {
+				if got := base.header.Get(header); got != tt.want {
+					t.Errorf("%s = %q, want %q", header, got, tt.want)
+				}
+			}
+			if req.Header.Get("Content-Type") != tt.sent {
+				t.Error("the caller's request was modified")
+			}
+			if resp.Header.Get("X-Elastic-Product") != "Elasticsearch" {
+				t.Error("response is not tagged as Elasticsearch")
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"sort"
+	"strconv"
+
+	"auth-proxy/auth"
+)
+
+// pipelineSelector picks the ingest pipeline a log entry is indexed through.
+// A container's pipeline takes precedence over its account's, which takes
+// precedence over the global one; "" indexes without a pipeline beyond the
+// index's default.
+type pipelineSelector struct {
+	global     string
+	containers map[string]string
+	// tenants is keyed by the formatted account ID StoreLogs receives.
+	tenants map[string]string
+}
+
+func (p pipelineSelector) pipelineFor(tokenAccountID, containerName string) string {
+	if pipeline, ok := p.containers[containerName]; ok && containerName != "" {
+		return pipeline
+	}
+	if pipeline, ok := p.tenants[tokenAccountID]; ok {
+		return pipeline
+	}
+	return p.global
+}
+
+// names returns every pipeline that can be selected, including the global
+// one.
+func (p pipelineSelector) names() []string {
+	seen := map[string]bool{p.global: true}
+	names := []string{p.global}
+	for _, pipelines := range []map[string]string{p.containers, p.tenants} {
+		for _, pipeline := range pipelines {
+			if !seen[pipeline] {
+				seen[pipeline] = true
+				names = append(names, pipeline)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// formatAccountKeys rekeys a map keyed by numeric account IDs, as the
+// TENANT_* settings are, by the IDs formatted with ACCOUNT_ID_FORMAT. Keys
+// that are not numeric were rejected by config.Load and are dropped.
+func formatAccountKeys(byAccount map[string]string) map[string]string {
+	formatted := make(map[string]string, len(byAccount))
+	for account, value := range byAccount {
+		if accountID, err := strconv.ParseInt(account, 10, 64); err == nil {
+			formatted[auth.FormatAccountID(accountID)] = value
+		}
+	}
+	return formatted
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"testing"
+
+	"auth-proxy/auth"
+)
+
+func TestPipelineFor(t *testing.T) {
+	if err := auth.SetAccountIDFormat("acct-%d"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { auth.SetAccountIDFormat("%d") })
+
+	selector := pipelineSelector{
+		global:     "global",
+		containers: map[string]string{"nginx": "nginx-pipeline"},
+		tenants:    formatAccountKeys(map[string]string{"42": "tenant-pipeline"}),
+	}
+	tests := []struct {
+		name      string
+		accountID string
+		container string
+		want      string
+	}{
+		{"global", "acct-7", "api", "global"},
+		{"tenant", "acct-42", "api", "tenant-pipeline"},
+		{"unformatted tenant", "42", "api", "global"},
+		{"container wins", "acct-42", "nginx", "nginx-pipeline"},
+		{"no container", "acct-42", "", "tenant-pipeline"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := selector.pipelineFor(tt.accountID, tt.container); got != tt.want {
+				t.Errorf("pipelineFor(%s, %s) = %q, want %q", tt.accountID, tt.container, got, tt.want)
+			}
+		})
+	}
+
+	names := selector.names()
+	want := []string{"global", "nginx-pipeline", "tenant-pipeline"}
+	if len(names) != len(want) {
+		t.Fatalf("names() = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("names() = %v, want %v", names, want)
+		}
+	}
+}
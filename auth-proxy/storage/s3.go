@@ -0,0 +1,306 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"auth-proxy/sigv4"
+)
+
+var errS3StorageClosed = errors.New("S3 storage is closed")
+
+const (
+	// s3UploadWorkers is how many objects are uploaded concurrently.
+	s3UploadWorkers = 4
+	// s3UploadAttempts is how many times an object upload is tried before
+	// its logs are dropped.
+	s3UploadAttempts = 5
+)
+
+// S3Config configures an S3Storage.
+type S3Config struct {
+	Bucket string
+	Region string
+	// Endpoint, when set, is an S3-compatible service such as MinIO that is
+	// addressed path-style. AWS is addressed virtual-hosted style otherwise.
+	Endpoint string
+	// Prefix is prepended to every object key.
+	Prefix string
+	// FlushBytes is the uncompressed size at which a partition's object is
+	// uploaded; FlushInterval is the longest a partition stays buffered.
+	FlushBytes    int
+	FlushInterval time.Duration
+	// MaxBufferedBytes bounds the logs held in memory, buffered or waiting
+	// for upload. StoreLogs fails once it is reached.
+	MaxBufferedBytes int64
+	Credentials      sigv4.Credentials
+}
+
+// S3Storage archives logs to S3 as gzip-compressed NDJSON objects under
+// <prefix>/<account>/<date>/<container>/, for cheap long-term retention.
+// Logs are buffered per partition and uploaded asynchronously, so a batch
+// is stored once it is buffered; uploads that keep failing are logged and
+// dropped.
+type S3Storage struct {
+	cfg    S3Config
+	client *http.Client
+
+	mu         sync.Mutex
+	closed     bool
+	partitions map[s3Partition]*s3Buffer
+	buffered   int64
+
+	// uploads is only closed once flushLoop has returned and no StoreLogs
+	// call is still enqueueing, which senders counts.
+	uploads   chan *s3Buffer
+	done      chan struct{}
+	flushDone chan struct{}
+	senders   sync.WaitGroup
+	wg        sync.WaitGroup
+}
+
+type s3Partition struct {
+	account   string
+	date      string
+	container string
+}
+
+type s3Buffer struct {
+	partition s3Partition
+	data      bytes.Buffer
+	gz        *gzip.Writer
+	rawBytes  int64
+	entries   int
+	openedAt  time.Time
+}
+
+func NewS3Storage(cfg S3Config) (*S3Storage, error) {
+	if cfg.Bucket == "" || cfg.Region == "" {
+		return nil, fmt.Errorf("S3 bucket and region must be provided")
+	}
+	if cfg.Endpoint != "" {
+		if _, err := url.Parse(cfg.Endpoint); err != nil {
+			return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+		}
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+
+	s := &S3Storage{
+		cfg:        cfg,
+		client:     &http.Client{Timeout: time.Minute},
+		partitions: make(map[s3Partition]*s3Buffer),
+		uploads:    make(chan *s3Buffer, s3UploadWorkers),
+		done:       make(chan struct{}),
+		flushDone:  make(chan struct{}),
+	}
+	for i := 0; i < s3UploadWorkers; i++ {
+		s.wg.Add(1)
+		go s.uploadLoop()
+	}
+	go s.flushLoop()
+	return s, nil
+}
+
+func (s *S3Storage) StoreLogs(ctx context.Context, tokenAccountID string, logs []map[string]interface{}) error {
+	now := time.Now().UTC()
+	timestamp := now.Format(time.RFC3339)
+	date := now.Format("2006-01-02")
+	skipped := make(map[string]int)
+
+	var full []*s3Buffer
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errS3StorageClosed
+	}
+	if s.buffered >= s.cfg.MaxBufferedBytes {
+		s.mu.Unlock()
+		return fmt.Errorf("S3 archive buffer is full with %d bytes awaiting upload", s.cfg.MaxBufferedBytes)
+	}
+	for _, logEntry := range logs {
+		logEntry["token_accountId"] = tokenAccountID
+		if _, ok := logEntry["@timestamp"]; !ok {
+			logEntry["@timestamp"] = timestamp
+		}
+		line, err := json.Marshal(logEntry)
+		if err != nil {
+			logger.WarnContext(ctx, "failed to marshal log entry for S3", "account_id", tokenAccountID, "error", err)
+			skipped["marshal_failed"]++
+			continue
+		}
+
+		partition := s3Partition{account: tokenAccountID, date: date, container: extractContainerName(logEntry)}
+		buf, ok := s.partitions[partition]
+		if !ok {
+			buf = &s3Buffer{partition: partition, openedAt: now}
+			buf.gz = gzip.NewWriter(&buf.data)
+			s.partitions[partition] = buf
+		}
+		buf.gz.Write(append(line, '\n'))
+		buf.rawBytes += int64(len(line) + 1)
+		buf.entries++
+		s.buffered += int64(len(line) + 1)
+		if buf.rawBytes >= int64(s.cfg.FlushBytes) {
+			delete(s.partitions, partition)
+			full = append(full, buf)
+		}
+	}
+	s.senders.Add(1)
+	s.mu.Unlock()
+
+	for _, buf := range full {
+		s.enqueue(buf)
+	}
+	s.senders.Done()
+	if len(skipped) > 0 {
+		return &SkippedEntriesError{Total: len(logs), Skipped: skipped}
+	}
+	return nil
+}
+
+// flushLoop uploads partitions that have been buffered for FlushInterval.
+func (s *S3Storage) flushLoop() {
+	defer close(s.flushDone)
+	ticker := time.NewTicker(min(s.cfg.FlushInterval, 10*time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			for _, buf := range s.takePartitions(func(buf *s3Buffer) bool {
+				return now.Sub(buf.openedAt) >= s.cfg.FlushInterval
+			}) {
+				s.enqueue(buf)
+			}
+		}
+	}
+}
+
+func (s *S3Storage) takePartitions(match func(*s3Buffer) bool) []*s3Buffer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var taken []*s3Buffer
+	for partition, buf := range s.partitions {
+		if match(buf) {
+			delete(s.partitions, partition)
+			taken = append(taken, buf)
+		}
+	}
+	return taken
+}
+
+func (s *S3Storage) enqueue(buf *s3Buffer) {
+	buf.gz.Close()
+	s.uploads <- buf
+}
+
+func (s *S3Storage) uploadLoop() {
+	defer s.wg.Done()
+	for buf := range s.uploads {
+		key := s.objectKey(buf)
+		backoff := time.Second
+		for attempt := 1; ; attempt++ {
+			err := s.putObject(key, buf.data.Bytes())
+			if err == nil {
+				break
+			}
+			if attempt == s3UploadAttempts {
+				logger.Error("dropped log entries after failing to upload to S3", "entries", buf.entries, "bucket", s.cfg.Bucket, "key", key, "error", err)
+				break
+			}
+			logger.Warn("S3 upload failed, retrying", "key", key, "backoff", backoff, "error", err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		s.mu.Lock()
+		s.buffered -= buf.rawBytes
+		s.mu.Unlock()
+	}
+}
+
+var invalidKeyCharsRegex = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// objectKey only uses characters that need no escaping, so the signed path
+// is the path S3 sees.
+func (s *S3Storage) objectKey(buf *s3Buffer) string {
+	container := sanitizeIndexName(buf.partition.container)
+	if container == "" {
+		container = "default"
+	}
+	suffix := make([]byte, 6)
+	rand.Read(suffix)
+	parts := []string{
+		invalidKeyCharsRegex.ReplaceAllString(buf.partition.account, "-"),
+		buf.partition.date,
+		container,
+		fmt.Sprintf("%s-%s.ndjson.gz", buf.openedAt.Format("150405"), hex.EncodeToString(suffix)),
+	}
+	if s.cfg.Prefix != "" {
+		parts = append([]string{s.cfg.Prefix}, parts...)
+	}
+	return strings.Join(parts, "/")
+}
+
+func (s *S3Storage) putObject(key string, body []byte) error {
+	var objectURL string
+	if s.cfg.Endpoint != "" {
+		objectURL = strings.TrimRight(s.cfg.Endpoint, "/") + "/" + s.cfg.Bucket + "/" + key
+	} else {
+		objectURL = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.cfg.Bucket, s.cfg.Region, key)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, objectURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build S3 request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	sigv4.Sign(req, sigv4.PayloadHash(body), s.cfg.Credentials, s.cfg.Region, "s3", time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("S3 request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("S3 returned status %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// Close uploads every buffered partition and waits for uploads to finish.
+// StoreLogs fails once Close has been called.
+func (s *S3Storage) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.done)
+	<-s.flushDone
+	s.senders.Wait()
+	for _, buf := range s.takePartitions(func(*s3Buffer) bool { return true }) {
+		s.enqueue(buf)
+	}
+	close(s.uploads)
+	s.wg.Wait()
+	return nil
+}
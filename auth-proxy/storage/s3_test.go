@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"auth-proxy/sigv4"
+)
+
+// fakeS3 accepts object uploads and keeps the NDJSON documents of each,
+// keyed by object path.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]map[string]interface{}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		http.Error(w, "unsigned or unexpected request", http.StatusBadRequest)
+		return
+	}
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var documents []map[string]interface{}
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		var document map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &document); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		documents = append(documents, document)
+	}
+	f.mu.Lock()
+	f.objects[r.URL.Path] = documents
+	f.mu.Unlock()
+}
+
+func (f *fakeS3) uploaded() map[string][]map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	objects := make(map[string][]map[string]interface{}, len(f.objects))
+	for key, documents := range f.objects {
+		objects[key] = documents
+	}
+	return objects
+}
+
+func newTestS3Storage(t *testing.T, flushBytes int) (*S3Storage, *fakeS3) {
+	t.Helper()
+	fake := &fakeS3{objects: make(map[string][]map[string]interface{})}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	s, err := NewS3Storage(S3Config{
+		Bucket:           "archive",
+		Region:           "us-east-1",
+		Endpoint:         server.URL,
+		Prefix:           "/logs/",
+		FlushBytes:       flushBytes,
+		FlushInterval:    time.Hour,
+		MaxBufferedBytes: 1 << 20,
+		Credentials:      sigv4.Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"},
+	})
+	if err != nil {
+		t.Fatalf("NewS3Storage() error = %v", err)
+	}
+	return s, fake
+}
+
+func TestS3StorageUploadsPartitionsOnClose(t *testing.T) {
+	s, fake := newTestS3Storage(t, 1<<20)
+	logs := []map[string]interface{}{
+		{"message": "one", "kubernetes": map[string]interface{}{"container_name": "web"}},
+		{"message": "two", "kubernetes": map[string]interface{}{"container_name": "web"}},
+		{"message": "three"},
+	}
+	if err := s.StoreLogs(context.Background(), "42", logs); err != nil {
+		t.Fatalf("StoreLogs() error = %v", err)
+	}
+	if objects := fake.uploaded(); len(objects) != 0 {
+		t.Fatalf("uploaded %d objects before Close, want none", len(objects))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	objects := fake.uploaded()
+	if len(objects) != 2 {
+		t.Fatalf("uploaded %d objects, want one per container: %v", len(objects), objects)
+	}
+	date := time.Now().UTC().Format("2006-01-02")
+	for key, documents := range objects {
+		prefix := "/archive/logs/42/" + date + "/"
+		if !strings.HasPrefix(key, prefix) || !strings.HasSuffix(key, ".ndjson.gz") {
+			t.Errorf("object key = %q, want %s<container>/<time>-<suffix>.ndjson.gz", key, prefix)
+		}
+		want := 1
+		if strings.HasPrefix(key, prefix+"web/") {
+			want = 2
+		}
+		if len(documents) != want {
+			t.Errorf("object %s holds %d documents, want %d", key, len(documents), want)
+		}
+		for _, document := range documents {
+			if document["token_accountId"] != "42" {
+				t.Errorf("document token_accountId = %v, want 42", document["token_accountId"])
+			}
+		}
+	}
+}
+
+func TestS3StorageUploadsFullPartitions(t *testing.T) {
+	s, fake := newTestS3Storage(t, 10)
+	if err := s.StoreLogs(context.Background(), "1", []map[string]interface{}{{"message": "larger than the flush size"}}); err != nil {
+		t.Fatalf("StoreLogs() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(fake.uploaded()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(fake.uploaded()) != 1 {
+		t.Fatal("full partition was not uploaded before Close")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+}
+
+func TestS3StorageRejectsLogsAfterClose(t *testing.T) {
+	s, _ := newTestS3Storage(t, 1<<20)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := s.StoreLogs(context.Background(), "1", []map[string]interface{}{{"message": "late"}}); err == nil {
+		t.Error("StoreLogs() after Close error = nil, want error")
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+}
+
+func TestS3StorageCloseWhileStoring(t *testing.T) {
+	s, _ := newTestS3Storage(t, 64)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				// Fails once Close has run; it must not panic.
+				s.StoreLogs(context.Background(), "1", []map[string]interface{}{{"message": "a log entry that fills the partition"}})
+			}
+		}()
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Sample is a document kept by the sampler together with the account that
+// sent it.
+type Sample struct {
+	AccountID string          `json:"accountId"`
+	Document  json.RawMessage `json:"document"`
+}
+
+// SampleProvider is implemented by storages that keep example documents per
+// index.
+type SampleProvider interface {
+	Samples(index string) []Sample
+}
+
+// Sampler keeps the most recent documents indexed per index, in a ring
+// buffer of size for each. The total size of retained documents across all
+// indices is capped at maxBytes.
+type Sampler struct {
+	size     int
+	maxBytes int64
+
+	mu         sync.Mutex
+	reservoirs map[string]*reservoir
+	totalBytes int64
+}
+
+// reservoir is a ring of samples: count of them, oldest at head.
+type reservoir struct {
+	samples []Sample
+	head    int
+	count   int
+	bytes   int64
+}
+
+func NewSampler(size int, maxBytes int64) *Sampler {
+	return &Sampler{
+		size:       size,
+		maxBytes:   maxBytes,
+		reservoirs: make(map[string]*reservoir),
+	}
+}
+
+// Add keeps a document in the index's ring, in place of the oldest one
+// when the ring is full, so samples always show what is sent now.
+func (s *Sampler) Add(index, accountID string, doc []byte) {
+	docBytes := int64(len(doc))
+	if docBytes > s.maxBytes {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.reservoirs[index]
+	if !ok {
+		r = &reservoir{samples: make([]Sample, s.size)}
+		s.reservoirs[index] = r
+	}
+	if r.count == s.size {
+		s.dropOldest(r)
+	}
+
+	for s.totalBytes+docBytes > s.maxBytes {
+		if !s.evictLargest() {
+			return
+		}
+	}
+
+	r.samples[(r.head+r.count)%s.size] = Sample{AccountID: accountID, Document: append(json.RawMessage(nil), doc...)}
+	r.count++
+	r.bytes += docBytes
+	s.totalBytes += docBytes
+}
+
+// Samples returns a copy of the documents currently held for index, oldest
+// first.
+func (s *Sampler) Samples(index string) []Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.reservoirs[index]
+	if !ok {
+		return nil
+	}
+	out := make([]Sample, r.count)
+	for i := range out {
+		out[i] = r.samples[(r.head+i)%s.size]
+	}
+	return out
+}
+
+// dropOldest drops the oldest sample of r, keeping the byte counters in
+// step.
+func (s *Sampler) dropOldest(r *reservoir) {
+	n := int64(len(r.samples[r.head].Document))
+	r.samples[r.head] = Sample{}
+	r.head = (r.head + 1) % s.size
+	r.count--
+	r.bytes -= n
+	s.totalBytes -= n
+}
+
+// evictLargest frees memory by dropping the oldest sample of the index that
+// currently holds the most bytes. It reports whether anything was evicted.
+func (s *Sampler) evictLargest() bool {
+	var largest *reservoir
+	for _, r := range s.reservoirs {
+		if r.count > 0 && (largest == nil || r.bytes > largest.bytes) {
+			largest = r
+		}
+	}
+	if largest == nil {
+		return false
+	}
+	s.dropOldest(largest)
+	return true
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func sampledDocuments(samples []Sample) []string {
+	docs := make([]string, len(samples))
+	for i, sample := range samples {
+		docs[i] = string(sample.Document)
+	}
+	return docs
+}
+
+func TestSamplerKeepsMostRecent(t *testing.T) {
+	sampler := NewSampler(3, 1<<20)
+	for i := 1; i <= 10; i++ {
+		sampler.Add("logs-a", "1", []byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+	sampler.Add("logs-b", "2", []byte(`{"n":0}`))
+
+	got := sampledDocuments(sampler.Samples("logs-a"))
+	want := []string{`{"n":8}`, `{"n":9}`, `{"n":10}`}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Samples(logs-a) = %v, want the last three %v", got, want)
+	}
+	if samples := sampler.Samples("logs-b"); len(samples) != 1 || samples[0].AccountID != "2" {
+		t.Errorf("Samples(logs-b) = %v, want the one document of account 2", samples)
+	}
+	if samples := sampler.Samples("logs-c"); samples != nil {
+		t.Errorf("Samples(logs-c) = %v, want none", samples)
+	}
+}
+
+func TestSamplerMemoryBound(t *testing.T) {
+	// Every document is 10 bytes, so 4 fit across all indices.
+	sampler := NewSampler(5, 40)
+	for i := 0; i < 5; i++ {
+		sampler.Add("logs-a", "1", []byte(fmt.Sprintf(`{"a":"%02d"}`, i)))
+	}
+	for i := 0; i < 2; i++ {
+		sampler.Add("logs-b", "1", []byte(fmt.Sprintf(`{"b":"%02d"}`, i)))
+	}
+	sampler.Add("logs-a", "1", []byte(`{"huge":"more than forty bytes, which never fits"}`))
+
+	if sampler.totalBytes > 40 {
+		t.Errorf("sampler holds %d bytes, want at most 40", sampler.totalBytes)
+	}
+	// Room for logs-b is made by dropping the oldest documents of logs-a,
+	// which holds the most.
+	gotA := sampledDocuments(sampler.Samples("logs-a"))
+	wantA := []string{`{"a":"03"}`, `{"a":"04"}`}
+	if fmt.Sprint(gotA) != fmt.Sprint(wantA) {
+		t.Errorf("Samples(logs-a) = %v, want %v", gotA, wantA)
+	}
+	if got := sampler.Samples("logs-b"); len(got) != 2 {
+		t.Errorf("Samples(logs-b) holds %d documents, want 2", len(got))
+	}
+}
@@ -0,0 +1,32 @@
+package storage
+
+import "context"
+
+type fixedIndexKey struct{}
+
+// withFixedIndex returns a copy of ctx that makes ElasticsearchStorage write
+// every entry to index instead of the one it would name.
+func withFixedIndex(ctx context.Context, index string) context.Context {
+	return context.WithValue(ctx, fixedIndexKey{}, index)
+}
+
+func fixedIndexFrom(ctx context.Context) string {
+	index, _ := ctx.Value(fixedIndexKey{}).(string)
+	return index
+}
+
+// ServiceLogStorage stores the proxy's own log records in a single index,
+// such as logs-akto-ingestion, through the bulk indexer of the wrapped
+// Elasticsearch storage, so they are searched alongside ingested logs.
+type ServiceLogStorage struct {
+	next  LogStorage
+	index string
+}
+
+func NewServiceLogStorage(next LogStorage, index string) *ServiceLogStorage {
+	return &ServiceLogStorage{next: next, index: index}
+}
+
+func (s *ServiceLogStorage) StoreLogs(ctx context.Context, accountID string, logs []map[string]interface{}) error {
+	return s.next.StoreLogs(withFixedIndex(ctx, s.index), accountID, logs)
+}
@@ -1,7 +1,109 @@
 package storage
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"auth-proxy/logging"
+)
+
+var logger = logging.Component("storage")
 
 type LogStorage interface {
 	StoreLogs(ctx context.Context, accountID string, logs []map[string]interface{}) error
 }
+
+// SkippedEntriesError is returned by StoreLogs when the rest of the batch was
+// accepted but some entries were dropped before being enqueued. Skipped maps a
+// reason, such as "marshal_failed", to the number of entries it affected.
+type SkippedEntriesError struct {
+	Total   int
+	Skipped map[string]int
+}
+
+func (e *SkippedEntriesError) Error() string {
+	return fmt.Sprintf("%d of %d log entries skipped: %s", e.Count(), e.Total, e.Summary())
+}
+
+// Count returns the number of skipped entries across all reasons.
+func (e *SkippedEntriesError) Count() int {
+	n := 0
+	for _, c := range e.Skipped {
+		n += c
+	}
+	return n
+}
+
+// Summary renders the skip counts as "reason=count" pairs in a stable order.
+func (e *SkippedEntriesError) Summary() string {
+	reasons := make([]string, 0, len(e.Skipped))
+	for reason := range e.Skipped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	parts := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		parts = append(parts, fmt.Sprintf("%s=%d", reason, e.Skipped[reason]))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// HealthReporter is implemented by storages that can report the state of the
+// backend they write to.
+type HealthReporter interface {
+	Health(ctx context.Context) HealthReport
+}
+
+// HealthReport describes the state of a storage backend and its indexer.
+// Template is "installed", "missing" or, when the proxy does not manage
+// it, "unmanaged"; Saturated is set while the indexer queue is full.
+type HealthReport struct {
+	Elasticsearch string       `json:"elasticsearch"`
+	Template      string       `json:"template,omitempty"`
+	Saturated     bool         `json:"saturated"`
+	Indexer       IndexerStats `json:"indexer"`
+}
+
+// IndexerStats mirrors the counters kept by the bulk indexer, plus how many
+// rejected items were retried, how many were dropped once out of retries
+// and how many failed documents went to the dead-letter queue, and how many
+// documents and bytes are queued but not yet stored by how many workers, and
+// how many callbacks panicked.
+type IndexerStats struct {
+	NumAdded            uint64 `json:"added"`
+	NumFlushed          uint64 `json:"flushed"`
+	NumFailed           uint64 `json:"failed"`
+	NumRequests         uint64 `json:"requests"`
+	NumRetried          uint64 `json:"retried"`
+	NumRetriesExhausted uint64 `json:"retries_exhausted"`
+	NumDeadLettered     uint64 `json:"dead_lettered"`
+	NumCallbackPanics   uint64 `json:"callback_panics"`
+	Workers             int    `json:"workers"`
+	QueuedDocs          int64  `json:"queued_docs"`
+	QueuedBytes         int64  `json:"queued_bytes"`
+}
+
+// IndexerStatsProvider is implemented by storages that keep bulk indexer
+// counters, which unlike Health can be read without contacting the cluster.
+type IndexerStatsProvider interface {
+	IndexerStats() IndexerStats
+}
+
+func (a IndexerStats) add(b IndexerStats) IndexerStats {
+	return IndexerStats{
+		NumAdded:            a.NumAdded + b.NumAdded,
+		NumFlushed:          a.NumFlushed + b.NumFlushed,
+		NumFailed:           a.NumFailed + b.NumFailed,
+		NumRequests:         a.NumRequests + b.NumRequests,
+		NumRetried:          a.NumRetried + b.NumRetried,
+		NumRetriesExhausted: a.NumRetriesExhausted + b.NumRetriesExhausted,
+		NumDeadLettered:     a.NumDeadLettered + b.NumDeadLettered,
+		NumCallbackPanics:   a.NumCallbackPanics + b.NumCallbackPanics,
+		Workers:             a.Workers + b.Workers,
+		QueuedDocs:          a.QueuedDocs + b.QueuedDocs,
+		QueuedBytes:         a.QueuedBytes + b.QueuedBytes,
+	}
+}
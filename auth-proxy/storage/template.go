@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"auth-proxy/auth"
+)
+
+// elasticsearchTemplateVersion is stamped on the installed index template.
+// Bump it whenever elasticsearchTemplateJSON changes so running clusters pick
+// up the new mappings.
+const elasticsearchTemplateVersion = 1
+
+// bootstrap installs the lifecycle policy, if any, and then the index
+// template that refers to it. Accounts with a policy of their own get a
+// template of higher priority for their indices.
+func (es *ElasticsearchStorage) bootstrap(ctx context.Context) error {
+	policy := es.lifecyclePolicy
+	if policy != nil {
+		if err := es.ensureLifecyclePolicy(ctx, policy); err != nil {
+			return err
+		}
+	}
+	if err := es.ensureIndexTemplate(ctx, elasticsearchTemplateName, es.indexWildcard(), 200, policy); err != nil {
+		return err
+	}
+	if policy == nil {
+		return nil
+	}
+
+	accountIDs := make([]int64, 0, len(policy.Accounts))
+	for accountID := range policy.Accounts {
+		accountIDs = append(accountIDs, accountID)
+	}
+	sort.Slice(accountIDs, func(i, j int) bool { return accountIDs[i] < accountIDs[j] })
+	for _, accountID := range accountIDs {
+		accountPolicy := policy.Accounts[accountID]
+		if err := es.ensureLifecyclePolicy(ctx, accountPolicy); err != nil {
+			return err
+		}
+		// Index names carry the account ID as StoreLogs receives it.
+		wildcard := accountIndexPrefix(auth.FormatAccountID(accountID)) + "*"
+		if err := es.ensureIndexTemplate(ctx, accountPolicy.Name, wildcard, 201, accountPolicy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryBootstrap installs the policy and template that startup could not,
+// and reports whether they are installed. It does not wait for a retry
+// another health check is running.
+func (es *ElasticsearchStorage) retryBootstrap(ctx context.Context) bool {
+	if !es.bootstrapMu.TryLock() {
+		return false
+	}
+	defer es.bootstrapMu.Unlock()
+	if es.templateInstalled.Load() {
+		return true
+	}
+	if err := es.bootstrap(ctx); err != nil {
+		logger.Warn("failed to install index template", "error", err)
+		return false
+	}
+	es.templateInstalled.Store(true)
+	logger.Info("index template installed after startup")
+	return true
+}
+
+// ensureIndexTemplate installs the logs index template unless the cluster
+// already has a newer version, or this version with the same settings. The
+// template only applies to indices created afterwards, so existing indices
+// keep their mappings.
+func (es *ElasticsearchStorage) ensureIndexTemplate(ctx context.Context, name, wildcard string, priority int, policy *LifecyclePolicy) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	body, hash, err := es.templateBody(name, wildcard, priority, policy)
+	if err != nil {
+		return err
+	}
+	installed, installedHash, err := es.installedTemplate(ctx, name)
+	if err != nil {
+		return err
+	}
+	if installed > elasticsearchTemplateVersion || (installed == elasticsearchTemplateVersion && installedHash == hash) {
+		return nil
+	}
+
+	client := es.elasticsearchClient
+	res, err := client.Indices.PutIndexTemplate(name, strings.NewReader(body),
+		client.Indices.PutIndexTemplate.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to put index template %s: %w", name, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("failed to put index template %s: status %d: %s", name, res.StatusCode, message)
+	}
+	logger.Info("installed index template", "template", name, "index", wildcard, "version", elasticsearchTemplateVersion, "previous_version", installed, "data_streams", es.dataStreams)
+	return nil
+}
+
+// installedTemplate returns the version of the installed template, 0 when it
+// is missing or unversioned, and the hash of the settings it was built with.
+func (es *ElasticsearchStorage) installedTemplate(ctx context.Context, name string) (int, string, error) {
+	client := es.elasticsearchClient
+	res, err := client.Indices.GetIndexTemplate(
+		client.Indices.GetIndexTemplate.WithName(name),
+		client.Indices.GetIndexTemplate.WithContext(ctx))
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to get index template %s: %w", name, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return 0, "", nil
+	}
+	if res.IsError() {
+		message, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return 0, "", fmt.Errorf("failed to get index template %s: status %d: %s", name, res.StatusCode, message)
+	}
+
+	var parsed struct {
+		IndexTemplates []struct {
+			IndexTemplate struct {
+				Version int `json:"version"`
+				Meta    struct {
+					Hash string `json:"hash"`
+				} `json:"_meta"`
+			} `json:"index_template"`
+		} `json:"index_templates"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		return 0, "", fmt.Errorf("failed to decode index template %s: %w", name, err)
+	}
+	if len(parsed.IndexTemplates) == 0 {
+		return 0, "", nil
+	}
+	template := parsed.IndexTemplates[0].IndexTemplate
+	return template.Version, template.Meta.Hash, nil
+}
+
+// templateBody stamps the template with its version and the hash of its
+// contents, which change with the data stream mode and lifecycle policy.
+// Outside data stream mode the data_stream section is dropped so plain
+// indices are created.
+func (es *ElasticsearchStorage) templateBody(name, wildcard string, priority int, policy *LifecyclePolicy) (string, string, error) {
+	var template map[string]interface{}
+	if err := json.Unmarshal([]byte(elasticsearchTemplateJSON), &template); err != nil {
+		return "", "", fmt.Errorf("invalid index template %s: %w", name, err)
+	}
+	template["version"] = elasticsearchTemplateVersion
+	template["index_patterns"] = []string{wildcard}
+	template["priority"] = priority
+	if !es.dataStreams {
+		delete(template, "data_stream")
+	}
+	if policy != nil {
+		settings := template["template"].(map[string]interface{})["settings"].(map[string]interface{})
+		settings["index.lifecycle.name"] = policy.Name
+	}
+	hash, err := stampHash(template)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to hash index template %s: %w", name, err)
+	}
+	body, err := json.Marshal(template)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encode index template %s: %w", name, err)
+	}
+	return string(body), hash, nil
+}
+
+// stampHash records a hash of body's contents in its _meta, so a definition
+// only needs to be replaced when the hash differs.
+func stampHash(body map[string]interface{}) (string, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	hash := hex.EncodeToString(sum[:8])
+	body["_meta"] = map[string]interface{}{"managed_by": "log-ingestion", "hash": hash}
+	return hash, nil
+}
+
+// warnPlainIndices logs the plain indices that match the template. Writes to
+// such a name keep going to the plain index rather than a data stream until
+// it is deleted or reindexed.
+func (es *ElasticsearchStorage) warnPlainIndices(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	client := es.elasticsearchClient
+	wildcard := es.indexWildcard()
+	res, err := client.Indices.ResolveIndex([]string{wildcard},
+		client.Indices.ResolveIndex.WithContext(ctx))
+	if err != nil {
+		logger.Warn("failed to resolve indices", "index", wildcard, "error", err)
+		return
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		logger.Warn("failed to resolve indices", "index", wildcard, "status", res.StatusCode)
+		return
+	}
+
+	var parsed struct {
+		Indices []struct {
+			Name       string `json:"name"`
+			DataStream string `json:"data_stream"`
+		} `json:"indices"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		logger.Warn("failed to decode resolved indices", "error", err)
+		return
+	}
+	for _, index := range parsed.Indices {
+		if index.DataStream == "" {
+			logger.Warn("plain index found, its logs are not written to a data stream until it is reindexed or deleted", "index", index.Name)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"auth-proxy/auth"
+)
+
+func TestTemplateBody(t *testing.T) {
+	policy := &LifecyclePolicy{Name: "logs-policy"}
+	tests := []struct {
+		name           string
+		dataStreams    bool
+		policy         *LifecyclePolicy
+		wantDataStream bool
+		wantLifecycle  string
+	}{
+		{"plain indices", false, nil, false, ""},
+		{"data streams", true, nil, true, ""},
+		{"data streams with policy", true, policy, true, "logs-policy"},
+		{"plain indices with policy", false, policy, false, "logs-policy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			es := &ElasticsearchStorage{dataStreams: tt.dataStreams}
+			body, hash, err := es.templateBody("logs", "logs-containers-*", 200, tt.policy)
+			if err != nil {
+				t.Fatalf("templateBody() error = %v", err)
+			}
+			var template struct {
+				IndexPatterns []string               `json:"index_patterns"`
+				Priority      int                    `json:"priority"`
+				Version       int                    `json:"version"`
+				DataStream    map[string]interface{} `json:"data_stream"`
+				Meta          struct {
+					Hash string `json:"hash"`
+				} `json:"_meta"`
+				Template struct {
+					Settings map[string]interface{} `json:"settings"`
+				} `json:"template"`
+			}
+			if err := json.Unmarshal([]byte(body), &template); err != nil {
+				t.Fatalf("templateBody() returned invalid JSON: %v", err)
+			}
+			if len(template.IndexPatterns) != 1 || template.IndexPatterns[0] != "logs-containers-*" ||
+				template.Priority != 200 || template.Version != elasticsearchTemplateVersion {
+				t.Errorf("template = %+v, want logs-containers-* at priority 200 and the current version", template)
+			}
+			if (template.DataStream != nil) != tt.wantDataStream {
+				t.Errorf("data_stream = %v, want present = %t", template.DataStream, tt.wantDataStream)
+			}
+			lifecycle, _ := template.Template.Settings["index.lifecycle.name"].(string)
+			if lifecycle != tt.wantLifecycle {
+				t.Errorf("index.lifecycle.name = %q, want %q", lifecycle, tt.wantLifecycle)
+			}
+			if template.Meta.Hash != hash {
+				t.Errorf("_meta.hash = %q, want the returned hash %q", template.Meta.Hash, hash)
+			}
+		})
+	}
+}
+
+func TestTemplateBodyHashTracksDataStreams(t *testing.T) {
+	plain := &ElasticsearchStorage{}
+	dataStreams := &ElasticsearchStorage{dataStreams: true}
+	_, plainHash, err := plain.templateBody("logs", "logs-containers-*", 200, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, again, _ := plain.templateBody("logs", "logs-containers-*", 200, nil)
+	_, dataStreamHash, _ := dataStreams.templateBody("logs", "logs-containers-*", 200, nil)
+	if plainHash != again {
+		t.Errorf("hash changed between identical templates: %s, %s", plainHash, again)
+	}
+	if plainHash == dataStreamHash {
+		t.Error("hash does not change with the data stream mode, so switching it would not reinstall the template")
+	}
+}
+
+// templateRecorder answers the template and policy APIs as an empty
+// cluster, recording the index patterns of the templates it is sent.
+type templateRecorder struct {
+	mu       sync.Mutex
+	patterns map[string][]string
+}
+
+func (r *templateRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	if req.Method == http.MethodGet {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{}`))
+		return
+	}
+	if name, ok := strings.CutPrefix(req.URL.Path, "/_index_template/"); ok && req.Method == http.MethodPut {
+		var template struct {
+			IndexPatterns []string `json:"index_patterns"`
+		}
+		json.NewDecoder(req.Body).Decode(&template)
+		r.mu.Lock()
+		r.patterns[name] = template.IndexPatterns
+		r.mu.Unlock()
+	}
+	w.Write([]byte(`{"acknowledged":true}`))
+}
+
+func TestBootstrapAccountTemplatesUseFormattedAccountIDs(t *testing.T) {
+	if err := auth.SetAccountIDFormat("acct-%d"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { auth.SetAccountIDFormat("%d") })
+
+	recorder := &templateRecorder{patterns: make(map[string][]string)}
+	es := newTestStorage(t, recorder, testConfig(), nil)
+	t.Cleanup(func() { es.Close() })
+	es.lifecyclePolicy = &LifecyclePolicy{
+		Name:     "logs-containers",
+		Accounts: map[int64]*LifecyclePolicy{42: {Name: "logs-containers-42"}},
+	}
+	if err := es.bootstrap(context.Background()); err != nil {
+		t.Fatalf("bootstrap() error = %v", err)
+	}
+	got := recorder.patterns["logs-containers-42"]
+	if len(got) != 1 || got[0] != "logs-containers-acct-42-*" {
+		t.Errorf("account template patterns = %v, want [logs-containers-acct-42-*]", got)
+	}
+}
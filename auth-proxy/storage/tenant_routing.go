@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"errors"
+
+	"auth-proxy/auth"
+)
+
+// TenantRoutedStorage sends the batches of accounts with a dedicated
+// cluster to that cluster's storage and every other batch to the shared
+// storage, which may itself fail over between clusters.
+type TenantRoutedStorage struct {
+	shared LogStorage
+	// tenants is keyed by the formatted account ID StoreLogs receives.
+	tenants map[string]*ElasticsearchStorage
+}
+
+// NewTenantRoutedStorage routes by token account ID, keyed by the numeric
+// ID so the routes do not depend on ACCOUNT_ID_FORMAT. Accounts may share a
+// dedicated storage, so each cluster keeps a single bulk indexer.
+func NewTenantRoutedStorage(shared LogStorage, tenants map[int64]*ElasticsearchStorage) *TenantRoutedStorage {
+	formatted := make(map[string]*ElasticsearchStorage, len(tenants))
+	for accountID, dedicated := range tenants {
+		formatted[auth.FormatAccountID(accountID)] = dedicated
+	}
+	return &TenantRoutedStorage{shared: shared, tenants: formatted}
+}
+
+func (t *TenantRoutedStorage) StoreLogs(ctx context.Context, tokenAccountID string, logs []map[string]interface{}) error {
+	if dedicated, ok := t.tenants[tokenAccountID]; ok {
+		return dedicated.StoreLogs(ctx, tokenAccountID, logs)
+	}
+	return t.shared.StoreLogs(ctx, tokenAccountID, logs)
+}
+
+// Samples returns the samples kept for index by every cluster.
+func (t *TenantRoutedStorage) Samples(index string) []Sample {
+	var samples []Sample
+	if provider, ok := t.shared.(SampleProvider); ok {
+		samples = provider.Samples(index)
+	}
+	for _, dedicated := range t.clusters() {
+		samples = append(samples, dedicated.Samples(index)...)
+	}
+	return samples
+}
+
+// Health reports the shared cluster.
+func (t *TenantRoutedStorage) Health(ctx context.Context) HealthReport {
+	if reporter, ok := t.shared.(HealthReporter); ok {
+		return reporter.Health(ctx)
+	}
+	return HealthReport{Elasticsearch: "unknown"}
+}
+
+// IndexerStats sums the counters of the shared and every dedicated cluster.
+func (t *TenantRoutedStorage) IndexerStats() IndexerStats {
+	var stats IndexerStats
+	if provider, ok := t.shared.(IndexerStatsProvider); ok {
+		stats = provider.IndexerStats()
+	}
+	for _, dedicated := range t.clusters() {
+		stats = stats.add(dedicated.IndexerStats())
+	}
+	return stats
+}
+
+// Close flushes the bulk indexers of every cluster.
+func (t *TenantRoutedStorage) Close() error {
+	var errs []error
+	if closer, ok := t.shared.(interface{ Close() error }); ok {
+		errs = append(errs, closer.Close())
+	}
+	for _, dedicated := range t.clusters() {
+		errs = append(errs, dedicated.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// clusters returns each dedicated storage once.
+func (t *TenantRoutedStorage) clusters() []*ElasticsearchStorage {
+	seen := make(map[*ElasticsearchStorage]bool)
+	var clusters []*ElasticsearchStorage
+	for _, dedicated := range t.tenants {
+		if !seen[dedicated] {
+			seen[dedicated] = true
+			clusters = append(clusters, dedicated)
+		}
+	}
+	return clusters
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"auth-proxy/auth"
+)
+
+// recordingStorage records the accounts it was asked to store logs for.
+type recordingStorage struct {
+	accounts []string
+}
+
+func (r *recordingStorage) StoreLogs(ctx context.Context, tokenAccountID string, logs []map[string]interface{}) error {
+	r.accounts = append(r.accounts, tokenAccountID)
+	return nil
+}
+
+func TestTenantRoutedStorageUsesNumericAccountIDs(t *testing.T) {
+	if err := auth.SetAccountIDFormat("acct-%06d"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { auth.SetAccountIDFormat("%d") })
+
+	cluster := &fakeCluster{}
+	dedicated := newTestStorage(t, cluster, testConfig(), nil)
+	shared := &recordingStorage{}
+	routed := NewTenantRoutedStorage(shared, map[int64]*ElasticsearchStorage{42: dedicated})
+
+	tests := []struct {
+		accountID     string
+		wantDedicated bool
+	}{
+		{"acct-000042", true},
+		{"42", false},
+		{"acct-000043", false},
+	}
+	for _, tt := range tests {
+		shared.accounts = nil
+		logs := []map[string]interface{}{{"container_name": "api"}}
+		if err := routed.StoreLogs(context.Background(), tt.accountID, logs); err != nil {
+			t.Fatalf("StoreLogs(%s) error = %v", tt.accountID, err)
+		}
+		if tt.wantDedicated == (len(shared.accounts) > 0) {
+			t.Errorf("StoreLogs(%s) routed to shared = %t, want dedicated = %t", tt.accountID, len(shared.accounts) > 0, tt.wantDedicated)
+		}
+	}
+	if err := dedicated.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := len(cluster.received()); got != 1 {
+		t.Errorf("dedicated cluster received %d actions, want 1", got)
+	}
+}
@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"auth-proxy/wal"
+)
+
+// walRetryInterval is how long the feeder waits after a failed store, and
+// how often it checks the health of a backend that is down.
+const walRetryInterval = 5 * time.Second
+
+// WALConfig describes the write-ahead log kept by a WALStorage. Batches are
+// rejected with QueueFullError, told to retry after RetryAfter, while the
+// log holds MaxBytes of batches not yet stored; zero is unlimited.
+type WALConfig struct {
+	Dir          string
+	SegmentBytes int64
+	MaxBytes     int64
+	Sync         bool
+	RetryAfter   time.Duration
+}
+
+// WALStorage appends each accepted batch to a write-ahead log on local disk
+// and feeds the wrapped storage from the log in the background, so batches
+// accepted while Elasticsearch is down, or before a restart, are stored
+// once it is back. Batches are fed in order and at least once: one fed just
+// before a restart is fed again after it. Entries the bulk indexer has
+// taken but fails to store later are not recovered from the log.
+type WALStorage struct {
+	next       LogStorage
+	reporter   HealthReporter
+	log        *wal.Log
+	maxBytes   int64
+	retryAfter time.Duration
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// Only the feeder touches the health check state.
+	checkedAt time.Time
+	healthy   bool
+}
+
+type walBatch struct {
+	AccountID string                   `json:"account_id"`
+	Logs      []map[string]interface{} `json:"logs"`
+	// Index and KeepTimestamps record how the batch asked to be stored,
+	// through its context, since it is stored with another one.
+	Index          string `json:"index,omitempty"`
+	KeepTimestamps bool   `json:"keep_timestamps,omitempty"`
+}
+
+// NewWALStorage opens the log in cfg.Dir and starts feeding next from it,
+// replaying any batches left by the previous run first. A non-nil reporter
+// pauses the feeder while it reports Elasticsearch down.
+func NewWALStorage(next LogStorage, reporter HealthReporter, cfg WALConfig) (*WALStorage, error) {
+	walLog, err := wal.Open(wal.Config{Dir: cfg.Dir, SegmentBytes: cfg.SegmentBytes, Sync: cfg.Sync})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &WALStorage{
+		next:       next,
+		reporter:   reporter,
+		log:        walLog,
+		maxBytes:   cfg.MaxBytes,
+		retryAfter: cfg.RetryAfter,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	go w.feed(ctx)
+	return w, nil
+}
+
+// StoreLogs returns once the batch is in the log, before it is stored.
+// Callers waiting for index results are passed straight to storage.
+func (w *WALStorage) StoreLogs(ctx context.Context, accountID string, logs []map[string]interface{}) error {
+	if indexResultsFrom(ctx) != nil {
+		return w.next.StoreLogs(ctx, accountID, logs)
+	}
+	if size := w.log.Size(); w.maxBytes > 0 && size >= w.maxBytes {
+		return &QueueFullError{QueuedBytes: size, RetryAfter: w.retryAfter}
+	}
+	payload, err := json.Marshal(walBatch{
+		AccountID:      accountID,
+		Logs:           logs,
+		Index:          fixedIndexFrom(ctx),
+		KeepTimestamps: originalTimestampsFrom(ctx),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode batch for the write-ahead log: %w", err)
+	}
+	if err := w.log.Append(payload); err != nil {
+		return fmt.Errorf("failed to write batch to the write-ahead log: %w", err)
+	}
+	return nil
+}
+
+func (w *WALStorage) feed(ctx context.Context) {
+	defer close(w.done)
+	for {
+		payload, err := w.log.Next(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Warn("failed to read the write-ahead log", "error", err)
+			if !w.wait(ctx, walRetryInterval) {
+				return
+			}
+			continue
+		}
+		if !w.deliver(ctx, payload) {
+			return
+		}
+	}
+}
+
+// deliver stores the batch in payload, retrying until it is stored, cannot
+// ever be, or ctx is done. It reports false when ctx is done first. The
+// batch is decoded for every attempt since storage modifies its entries.
+func (w *WALStorage) deliver(ctx context.Context, payload []byte) bool {
+	for {
+		if !w.backendUp(ctx) {
+			if !w.wait(ctx, walRetryInterval) {
+				return false
+			}
+			continue
+		}
+
+		var batch walBatch
+		if err := json.Unmarshal(payload, &batch); err != nil {
+			logger.Warn("dropping undecodable write-ahead log record", "error", err)
+			return true
+		}
+		batchCtx := ctx
+		if batch.Index != "" {
+			batchCtx = withFixedIndex(batchCtx, batch.Index)
+		}
+		if batch.KeepTimestamps {
+			batchCtx = withOriginalTimestamps(batchCtx)
+		}
+		err := w.next.StoreLogs(batchCtx, batch.AccountID, batch.Logs)
+		var skipped *SkippedEntriesError
+		var tooLarge *BatchTooLargeError
+		var queueFull *QueueFullError
+		var unavailable *UnavailableError
+		switch {
+		case err == nil:
+			return true
+		case errors.As(err, &skipped):
+			logger.Warn("stored logs from the write-ahead log with warnings", "account_id", batch.AccountID, "error", err)
+			return true
+		case errors.As(err, &tooLarge):
+			logger.Warn("dropping batch from the write-ahead log", "account_id", batch.AccountID, "error", err)
+			return true
+		case errors.As(err, &queueFull):
+			if !w.wait(ctx, queueFull.RetryAfter) {
+				return false
+			}
+		case errors.As(err, &unavailable):
+			if !w.wait(ctx, unavailable.RetryAfter) {
+				return false
+			}
+		default:
+			if ctx.Err() != nil {
+				return false
+			}
+			logger.Warn("failed to store logs from the write-ahead log, retrying", "account_id", batch.AccountID, "backoff", walRetryInterval, "error", err)
+			if !w.wait(ctx, walRetryInterval) {
+				return false
+			}
+		}
+	}
+}
+
+// backendUp reports whether the reporter last saw Elasticsearch up,
+// checking again once walRetryInterval has passed.
+func (w *WALStorage) backendUp(ctx context.Context) bool {
+	if w.reporter == nil {
+		return true
+	}
+	if time.Since(w.checkedAt) < walRetryInterval {
+		return w.healthy
+	}
+	checkCtx, cancel := context.WithTimeout(ctx, walRetryInterval)
+	report := w.reporter.Health(checkCtx)
+	cancel()
+
+	healthy := report.Elasticsearch == "up"
+	switch {
+	case !healthy && (w.healthy || w.checkedAt.IsZero()):
+		logger.Warn("elasticsearch is down, holding batches in the write-ahead log")
+	case healthy && !w.healthy && !w.checkedAt.IsZero():
+		logger.Info("elasticsearch is up, replaying the write-ahead log")
+	}
+	w.healthy = healthy
+	w.checkedAt = time.Now()
+	return healthy
+}
+
+// wait sleeps for d, and reports false if ctx is done first.
+func (w *WALStorage) wait(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// Close stops the feeder and closes the log. Batches not yet fed stay in
+// the log for the next start.
+func (w *WALStorage) Close() error {
+	w.cancel()
+	<-w.done
+	return w.log.Close()
+}
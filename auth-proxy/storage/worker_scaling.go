@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"auth-proxy/metrics"
+	"auth-proxy/tracing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type flushStartKey struct{}
+
+// onFlushStart and onFlushEnd time every bulk request for worker scaling
+// and the flush duration metric, and trace it in a span of its own, since a
+// bulk request carries the entries of many ingest requests.
+func (es *ElasticsearchStorage) onFlushStart(ctx context.Context) context.Context {
+	ctx, _ = tracing.Tracer("auth-proxy/storage").Start(ctx, "bulk flush", trace.WithNewRoot())
+	return context.WithValue(withFlushStatus(ctx), flushStartKey{}, time.Now())
+}
+
+func (es *ElasticsearchStorage) onFlushEnd(ctx context.Context) {
+	defer trace.SpanFromContext(ctx).End()
+	if start, ok := ctx.Value(flushStartKey{}).(time.Time); ok {
+		elapsed := time.Since(start)
+		es.flushes.Add(1)
+		es.flushNanos.Add(uint64(elapsed))
+		metrics.BulkFlushDuration.Observe(elapsed.Seconds())
+	}
+}
+
+// workerScaling adjusts the number of bulk workers between min and max.
+// Every interval, workers are halved when bulk requests took longer than
+// targetLatency on average or more than 1% of items were rejected with 429
+// or 503, and one is added when more bytes are queued than the workers can
+// send in one flush each. Counters are compared with the previous step.
+type workerScaling struct {
+	min, max      int
+	interval      time.Duration
+	targetLatency time.Duration
+
+	flushes, flushNanos, flushed, rejected uint64
+}
+
+func (es *ElasticsearchStorage) scaleWorkers(s *workerScaling) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-es.stop:
+			return
+		case <-ticker.C:
+			es.scaleStep(s)
+		}
+	}
+}
+
+func (es *ElasticsearchStorage) scaleStep(s *workerScaling) {
+	flushes, flushNanos := es.flushes.Load(), es.flushNanos.Load()
+	flushed := es.indexerStats().NumFlushed
+	rejected := es.retried.Load() + es.retriesExhausted.Load()
+
+	var latency time.Duration
+	if flushes > s.flushes {
+		latency = time.Duration((flushNanos - s.flushNanos) / (flushes - s.flushes))
+	}
+	newlyFlushed, newlyRejected := flushed-s.flushed, rejected-s.rejected
+	s.flushes, s.flushNanos, s.flushed, s.rejected = flushes, flushNanos, flushed, rejected
+
+	workers := int(es.numWorkers.Load())
+	flushBytes := es.currentFlushBytes()
+	backlogged := es.queuedBytes.Load() > int64(workers)*int64(flushBytes)
+
+	next := workers
+	var reason string
+	switch {
+	case newlyRejected > 0 && newlyRejected*100 > newlyFlushed+newlyRejected:
+		next = max(s.min, workers/2)
+		reason = "elasticsearch rejected bulk items"
+	case latency > s.targetLatency:
+		next = max(s.min, workers/2)
+		reason = "bulk requests took " + latency.Round(time.Millisecond).String() + " on average"
+	case backlogged:
+		next = min(s.max, workers+1)
+		reason = "more logs are queued than the workers can flush"
+	}
+	if next == workers {
+		return
+	}
+
+	logger.Info("scaling bulk workers", "from", workers, "to", next, "reason", reason)
+	es.numWorkers.Store(int64(next))
+	es.replaceIndexer(flushBytes)
+}
+
+// currentFlushBytes returns the flush size new indexers are created with.
+func (es *ElasticsearchStorage) currentFlushBytes() int {
+	if es.tuning == nil {
+		return es.flushBytes
+	}
+	return es.tuning.size()
+}
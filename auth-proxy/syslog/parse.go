@@ -0,0 +1,210 @@
+// Package syslog receives RFC 5424 and RFC 3164 syslog messages over TCP
+// and UDP and converts them into the log entries accepted by
+// storage.LogStorage.
+package syslog
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var facilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var severities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// defaultPriority is user.notice, which RFC 3164 relays assign to messages
+// that arrive without a PRI part.
+const defaultPriority = 13
+
+// Parse converts one syslog message into a log entry. Messages in neither
+// format are kept whole as the entry's message. now supplies the year for
+// RFC 3164 timestamps, which omit it.
+func Parse(data []byte, now time.Time) map[string]interface{} {
+	data = bytes.TrimRight(data, "\r\n\x00")
+	priority, rest, ok := parsePriority(data)
+	if !ok {
+		priority, rest = defaultPriority, data
+	}
+
+	entry := map[string]interface{}{
+		"facility":        facilityName(priority / 8),
+		"severity":        severities[priority%8],
+		"severity_number": priority % 8,
+	}
+	if ok && len(rest) > 1 && rest[0] == '1' && rest[1] == ' ' {
+		if parse5424(entry, rest[2:]) {
+			return entry
+		}
+	}
+	parse3164(entry, rest, now)
+	return entry
+}
+
+func parsePriority(data []byte) (int, []byte, bool) {
+	if len(data) < 3 || data[0] != '<' {
+		return 0, nil, false
+	}
+	end := bytes.IndexByte(data[:min(len(data), 5)], '>')
+	if end < 2 {
+		return 0, nil, false
+	}
+	priority, err := strconv.Atoi(string(data[1:end]))
+	if err != nil || priority < 0 || priority > 191 {
+		return 0, nil, false
+	}
+	return priority, data[end+1:], true
+}
+
+func facilityName(code int) string {
+	if code < len(facilities) {
+		return facilities[code]
+	}
+	return strconv.Itoa(code)
+}
+
+// parse5424 handles the part after "<PRI>1 ":
+// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parse5424(entry map[string]interface{}, data []byte) bool {
+	fields := make([]string, 0, 5)
+	for i := 0; i < 5; i++ {
+		end := bytes.IndexByte(data, ' ')
+		if end <= 0 {
+			return false
+		}
+		fields = append(fields, string(data[:end]))
+		data = data[end+1:]
+	}
+
+	if fields[0] != "-" {
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return false
+		}
+		entry["timestamp"] = t.UTC().Format(time.RFC3339Nano)
+	}
+	for i, key := range []string{"hostname", "app_name", "proc_id", "msg_id"} {
+		if value := fields[i+1]; value != "-" {
+			entry[key] = value
+		}
+	}
+
+	structured, rest, err := parseStructuredData(data)
+	if err != nil {
+		return false
+	}
+	if len(structured) > 0 {
+		entry["structured_data"] = structured
+	}
+	if len(rest) > 0 && rest[0] == ' ' {
+		rest = bytes.TrimPrefix(rest[1:], []byte("\xef\xbb\xbf"))
+		entry["message"] = toValidUTF8(rest)
+	}
+	return true
+}
+
+// parseStructuredData parses "-" or a run of [SD-ID PARAM="VALUE" ...]
+// elements, returning them keyed by SD-ID and the unparsed remainder.
+func parseStructuredData(data []byte) (map[string]interface{}, []byte, error) {
+	if len(data) > 0 && data[0] == '-' {
+		return nil, data[1:], nil
+	}
+	structured := make(map[string]interface{})
+	for len(data) > 0 && data[0] == '[' {
+		data = data[1:]
+		end := bytes.IndexAny(data, " ]")
+		if end <= 0 {
+			return nil, nil, fmt.Errorf("unterminated SD-ID")
+		}
+		id := string(data[:end])
+		params := make(map[string]interface{})
+		data = data[end:]
+		for len(data) > 0 && data[0] == ' ' {
+			data = data[1:]
+			eq := bytes.IndexByte(data, '=')
+			if eq <= 0 || len(data) < eq+2 || data[eq+1] != '"' {
+				return nil, nil, fmt.Errorf("malformed SD-PARAM in %s", id)
+			}
+			name := string(data[:eq])
+			value, n, err := parseParamValue(data[eq+2:])
+			if err != nil {
+				return nil, nil, fmt.Errorf("malformed SD-PARAM %s in %s: %w", name, id, err)
+			}
+			params[name] = value
+			data = data[eq+2+n:]
+		}
+		if len(data) == 0 || data[0] != ']' {
+			return nil, nil, fmt.Errorf("unterminated SD-ELEMENT %s", id)
+		}
+		data = data[1:]
+		structured[id] = params
+	}
+	if len(structured) == 0 {
+		return nil, nil, fmt.Errorf("missing STRUCTURED-DATA")
+	}
+	return structured, data, nil
+}
+
+// parseParamValue reads a quoted value up to its closing quote, undoing the
+// \" \\ and \] escapes, and returns the bytes consumed.
+func parseParamValue(data []byte) (string, int, error) {
+	var value []byte
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			if i+1 < len(data) && (data[i+1] == '"' || data[i+1] == '\\' || data[i+1] == ']') {
+				i++
+			}
+		case '"':
+			return toValidUTF8(value), i + 1, nil
+		}
+		value = append(value, data[i])
+	}
+	return "", 0, fmt.Errorf("unterminated value")
+}
+
+// parse3164 handles the BSD format: "Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG".
+// Parts that do not match are left in the message.
+func parse3164(entry map[string]interface{}, data []byte, now time.Time) {
+	if len(data) >= 16 && data[15] == ' ' {
+		if t, err := time.Parse(time.Stamp, string(data[:15])); err == nil {
+			t = time.Date(now.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+			// A December message received in January belongs to last year.
+			if t.After(now.Add(24 * time.Hour)) {
+				t = t.AddDate(-1, 0, 0)
+			}
+			entry["timestamp"] = t.Format(time.RFC3339Nano)
+			data = data[16:]
+
+			if end := bytes.IndexByte(data, ' '); end > 0 {
+				entry["hostname"] = string(data[:end])
+				data = data[end+1:]
+			}
+		}
+	}
+
+	if end := bytes.IndexByte(data, ':'); end > 0 && end <= 48 && !bytes.ContainsAny(data[:end], " ") {
+		tag := string(data[:end])
+		if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+			entry["proc_id"] = tag[open+1 : len(tag)-1]
+			tag = tag[:open]
+		}
+		entry["app_name"] = tag
+		data = bytes.TrimPrefix(data[end+1:], []byte(" "))
+	}
+	entry["message"] = toValidUTF8(data)
+}
+
+func toValidUTF8(data []byte) string {
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	return strings.ToValidUTF8(string(data), "�")
+}
@@ -0,0 +1,194 @@
+package syslog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"auth-proxy/auth"
+	"auth-proxy/logging"
+)
+
+var logger = logging.Component("syslog")
+
+// maxBatchEntries caps how many buffered TCP messages are handed to the
+// Handler at once.
+const maxBatchEntries = 500
+
+// idleTimeout closes TCP connections that send nothing for this long.
+const idleTimeout = 5 * time.Minute
+
+// Batch is a group of messages from one sender.
+type Batch struct {
+	Claims  *auth.Claims
+	Remote  net.Addr
+	Bytes   int64
+	Entries []map[string]interface{}
+}
+
+// Handler receives the parsed messages of an attributed sender.
+type Handler func(ctx context.Context, batch *Batch) error
+
+// Authenticator attributes a sender to an account, from its verified client
+// certificate when it connected over TLS or otherwise from its address.
+type Authenticator func(ctx context.Context, remote net.Addr, cert *x509.Certificate) (*auth.Claims, error)
+
+// Server accepts syslog messages over TCP, with octet-counting or newline
+// framing, and over UDP, one message per datagram.
+type Server struct {
+	authenticate    Authenticator
+	handler         Handler
+	maxMessageBytes int
+}
+
+// NewServer returns a Server that attributes senders with authenticate and
+// passes their messages to handler.
+func NewServer(authenticate Authenticator, handler Handler, maxMessageBytes int) *Server {
+	return &Server{authenticate: authenticate, handler: handler, maxMessageBytes: maxMessageBytes}
+}
+
+// ServeTCP accepts stream connections on listener until it is closed.
+// Wrap listener with tls.NewListener for RFC 5425 transport.
+func (s *Server) ServeTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.serveConn(conn); err != nil && !errors.Is(err, io.EOF) {
+				logger.Warn("closing syslog connection", "remote_addr", conn.RemoteAddr().String(), "error", err)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) error {
+	ctx := context.Background()
+	conn.SetDeadline(time.Now().Add(idleTimeout))
+
+	var cert *x509.Certificate
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		if chains := tlsConn.ConnectionState().VerifiedChains; len(chains) > 0 {
+			cert = chains[0][0]
+		}
+	}
+	claims, err := s.authenticate(ctx, conn.RemoteAddr(), cert)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(conn, 64<<10)
+	for {
+		conn.SetDeadline(time.Now().Add(idleTimeout))
+		batch := &Batch{Claims: claims, Remote: conn.RemoteAddr()}
+		for len(batch.Entries) < maxBatchEntries {
+			frame, err := s.readFrame(reader)
+			if err != nil {
+				if len(batch.Entries) > 0 {
+					if err := s.handler(ctx, batch); err != nil {
+						logger.Warn("dropped syslog batch", "remote_addr", conn.RemoteAddr().String(), "account_id", claims.GetAccountID(), "error", err)
+					}
+				}
+				return err
+			}
+			if len(frame) > 0 {
+				batch.Bytes += int64(len(frame))
+				batch.Entries = append(batch.Entries, Parse(frame, time.Now()))
+			}
+			if reader.Buffered() == 0 {
+				break
+			}
+		}
+		if len(batch.Entries) == 0 {
+			continue
+		}
+		if err := s.handler(ctx, batch); err != nil {
+			return err
+		}
+	}
+}
+
+// readFrame reads one message using octet-counting framing ("LEN SP MSG")
+// when the frame starts with a digit, and newline framing otherwise.
+func (s *Server) readFrame(reader *bufio.Reader) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] >= '1' && first[0] <= '9' {
+		prefix, err := reader.ReadSlice(' ')
+		if err != nil {
+			return nil, fmt.Errorf("invalid octet-counting frame: %w", err)
+		}
+		length, err := strconv.Atoi(string(prefix[:len(prefix)-1]))
+		if err != nil || length > s.maxMessageBytes {
+			return nil, fmt.Errorf("invalid octet-counting frame length %q", prefix[:len(prefix)-1])
+		}
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+
+	var frame []byte
+	for {
+		line, err := reader.ReadSlice('\n')
+		frame = append(frame, line...)
+		if len(frame) > s.maxMessageBytes {
+			return nil, fmt.Errorf("message exceeds %d bytes", s.maxMessageBytes)
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil && len(frame) == 0 {
+			return nil, err
+		}
+		return bytes.TrimRight(frame, "\r\n"), nil
+	}
+}
+
+// ServeUDP reads datagrams from conn until it is closed. Senders are
+// attributed by address only.
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	ctx := context.Background()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		if n > s.maxMessageBytes {
+			n = s.maxMessageBytes
+		}
+		claims, err := s.authenticate(ctx, addr, nil)
+		if err != nil {
+			continue
+		}
+		batch := &Batch{Claims: claims, Remote: addr, Bytes: int64(n), Entries: []map[string]interface{}{Parse(buf[:n], time.Now())}}
+		if err := s.handler(ctx, batch); err != nil {
+			logger.Warn("dropped syslog datagram", "remote_addr", addr.String(), "account_id", claims.GetAccountID(), "error", err)
+		}
+	}
+}
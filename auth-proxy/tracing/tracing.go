@@ -0,0 +1,53 @@
+// Package tracing sets up OpenTelemetry tracing of the ingest path. Spans
+// are exported over OTLP/gRPC; the exporter and sampler are configured by
+// the standard OTEL_EXPORTER_OTLP_* and OTEL_TRACES_SAMPLER* variables.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServiceName names the proxy in exported spans unless OTEL_SERVICE_NAME
+// overrides it.
+const ServiceName = "log-ingestion"
+
+// Setup installs a global tracer provider exporting to the OTLP collector.
+// Until it runs, Tracer returns tracers whose spans are dropped. The
+// returned function flushes pending spans and stops the exporter.
+func Setup(ctx context.Context) (func(ctx context.Context) error, error) {
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(ServiceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer for the named component of the proxy, such as
+// "auth-proxy/storage".
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer(name)
+}
@@ -0,0 +1,48 @@
+// Package version reports which build of the proxy is running. Commit and
+// BuildTime are set at link time:
+//
+//	go build -ldflags "-X auth-proxy/version.Commit=$(git rev-parse HEAD) -X auth-proxy/version.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+var (
+	// Commit is the git SHA the binary was built from.
+	Commit string
+	// BuildTime is when the binary was built, in RFC 3339.
+	BuildTime string
+)
+
+// Info describes the running build.
+type Info struct {
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the build information. Without ldflags, the commit and time
+// recorded by the go command in a git checkout are used instead, and
+// "unknown" when there are none.
+func Get() Info {
+	info := Info{Commit: Commit, BuildTime: BuildTime, GoVersion: runtime.Version()}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildTime == "":
+				info.BuildTime = setting.Value
+			}
+		}
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildTime == "" {
+		info.BuildTime = "unknown"
+	}
+	return info
+}
@@ -0,0 +1,439 @@
+package wal
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"auth-proxy/logging"
+)
+
+var logger = logging.Component("wal")
+
+// segmentSuffix names segment files, which are numbered in the order they
+// are written: 00000000000000000001.wal, 00000000000000000002.wal, ...
+const segmentSuffix = ".wal"
+
+// headerSize is the record header: the payload length and its CRC-32, both
+// big-endian uint32.
+const headerSize = 8
+
+// checkpointName is the file recording how far the consumer has got, as the
+// segment number and the offset of the first record it has not finished.
+const checkpointName = "checkpoint"
+
+// ErrClosed is returned by a closed Log.
+var ErrClosed = errors.New("write-ahead log is closed")
+
+// Config describes where a Log keeps its segments. A segment is rotated
+// once the next record would take it past SegmentBytes, so a record larger
+// than SegmentBytes gets a segment of its own. With Sync set, every record
+// is fsynced before Append returns.
+type Config struct {
+	Dir          string
+	SegmentBytes int64
+	Sync         bool
+}
+
+// Log is an append-only sequence of records kept in segment files under
+// Config.Dir, read back in order by a single consumer with Next. Asking for
+// the next record finishes the one before it: its position is saved as a
+// checkpoint and a segment is deleted once all of its records are finished,
+// so a record is only lost if the consumer loses it after Next returns it.
+// Appends start a new segment on every Open, and reading resumes at the
+// checkpoint, so only the record the consumer had not finished is read
+// again. It is safe for concurrent use.
+type Log struct {
+	cfg Config
+
+	mu       sync.Mutex
+	closed   bool
+	file     *os.File
+	writeSeq uint64
+	size     int64 // bytes of whole records in the write segment
+	total    int64 // bytes in all segments on disk
+	consumed int64 // bytes of finished records in the read segment
+	appended chan struct{}
+
+	// Only the consumer touches the read state. skipTo is the checkpoint
+	// offset reading resumes at when the first read segment is opened.
+	readSeq    uint64
+	readFile   *os.File
+	reader     *bufio.Reader
+	readOffset int64
+	skipTo     int64
+	saved      checkpoint
+}
+
+// checkpoint is the position of the first record the consumer has not
+// finished.
+type checkpoint struct {
+	seq    uint64
+	offset int64
+}
+
+// Open creates Config.Dir if needed and picks up the segments left in it.
+func Open(cfg Config) (*Log, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("write-ahead log directory must be provided")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create write-ahead log directory: %w", err)
+	}
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list write-ahead log directory: %w", err)
+	}
+
+	l := &Log{cfg: cfg, appended: make(chan struct{}, 1)}
+	var seqs []uint64
+	for _, entry := range entries {
+		seq, ok := parseSegmentName(entry.Name())
+		if !ok || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat write-ahead log segment: %w", err)
+		}
+		seqs = append(seqs, seq)
+		l.total += info.Size()
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	seqs = l.skipFinishedSegments(seqs)
+
+	l.writeSeq = 1
+	if len(seqs) > 0 {
+		l.readSeq = seqs[0]
+		l.writeSeq = seqs[len(seqs)-1] + 1
+		logger.Info("write-ahead log has segments to replay", "segments", len(seqs), "bytes", l.total-l.consumed)
+	} else {
+		l.readSeq = l.writeSeq
+	}
+	if err := l.openSegment(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// skipFinishedSegments applies the checkpoint to seqs, the segments on disk
+// in order: the segments before it are deleted, since a failed delete is
+// all that can have left them, and reading resumes at its offset. It
+// returns the segments left to read.
+func (l *Log) skipFinishedSegments(seqs []uint64) []uint64 {
+	saved, err := readCheckpoint(filepath.Join(l.cfg.Dir, checkpointName))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("failed to read checkpoint, replaying the whole write-ahead log", "error", err)
+		}
+		return seqs
+	}
+	l.saved = saved
+	for len(seqs) > 0 && seqs[0] < saved.seq {
+		path := l.segmentPath(seqs[0])
+		if info, err := os.Stat(path); err == nil {
+			if err := os.Remove(path); err != nil {
+				logger.Warn("failed to remove write-ahead log segment", "error", err)
+			} else {
+				l.total -= info.Size()
+			}
+		}
+		seqs = seqs[1:]
+	}
+	if len(seqs) > 0 && seqs[0] == saved.seq {
+		l.skipTo = saved.offset
+		l.consumed = saved.offset
+	}
+	return seqs
+}
+
+func readCheckpoint(path string) (checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return checkpoint{}, err
+	}
+	var saved checkpoint
+	if _, err := fmt.Sscanf(string(data), "%d %d\n", &saved.seq, &saved.offset); err != nil || saved.offset < 0 {
+		return checkpoint{}, fmt.Errorf("invalid write-ahead log checkpoint %q", data)
+	}
+	return saved, nil
+}
+
+// saveCheckpoint records that the consumer has finished the records before
+// the read position, replacing the checkpoint file atomically.
+func (l *Log) saveCheckpoint() error {
+	current := checkpoint{seq: l.readSeq, offset: l.readOffset}
+	if current == l.saved {
+		return nil
+	}
+	path := filepath.Join(l.cfg.Dir, checkpointName)
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to write write-ahead log checkpoint: %w", err)
+	}
+	_, err = fmt.Fprintf(file, "%d %d\n", current.seq, current.offset)
+	if err == nil && l.cfg.Sync {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write write-ahead log checkpoint: %w", err)
+	}
+	l.saved = current
+
+	l.mu.Lock()
+	l.consumed = current.offset
+	l.mu.Unlock()
+	return nil
+}
+
+func parseSegmentName(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, segmentSuffix) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+	return seq, err == nil
+}
+
+func (l *Log) segmentPath(seq uint64) string {
+	return filepath.Join(l.cfg.Dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// openSegment creates the write segment. Callers hold mu.
+func (l *Log) openSegment() error {
+	file, err := os.OpenFile(l.segmentPath(l.writeSeq), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to create write-ahead log segment: %w", err)
+	}
+	l.file = file
+	l.size = 0
+	return nil
+}
+
+// rotate closes the write segment and starts the next one. Callers hold mu.
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		logger.Warn("failed to close write-ahead log segment", "error", err)
+	}
+	l.writeSeq++
+	return l.openSegment()
+}
+
+// Append writes payload as one record.
+func (l *Log) Append(payload []byte) error {
+	record := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[headerSize:], payload)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if l.size > 0 && l.size+int64(len(record)) > l.cfg.SegmentBytes {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(record)
+	if err == nil && l.cfg.Sync {
+		err = l.file.Sync()
+	}
+	l.total += int64(n)
+	if err != nil {
+		// The segment may end in a partial record, which the consumer never
+		// reads past size; later records go to a new segment.
+		if rotateErr := l.rotate(); rotateErr != nil {
+			logger.Warn("failed to rotate write-ahead log segment", "error", rotateErr)
+		}
+		return fmt.Errorf("failed to write write-ahead log record: %w", err)
+	}
+	l.size += int64(n)
+
+	select {
+	case l.appended <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Size returns the bytes of the records on disk the consumer has not
+// finished, including the one it is working on.
+func (l *Log) Size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total - l.consumed
+}
+
+// Next finishes the record it last returned and returns the next one,
+// waiting for one to be appended if the consumer has read them all. It
+// returns ctx.Err() when ctx is done first. Records that fail their
+// checksum end their segment, and the rest of it is skipped.
+func (l *Log) Next(ctx context.Context) ([]byte, error) {
+	if l.readFile != nil {
+		if err := l.saveCheckpoint(); err != nil {
+			// The finished records are read again after a restart.
+			logger.Warn("failed to save write-ahead log checkpoint", "error", err)
+		}
+	}
+	for {
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return nil, ErrClosed
+		}
+		writing := l.readSeq == l.writeSeq
+		limit := l.size
+		l.mu.Unlock()
+
+		if writing && l.readOffset >= limit {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-l.appended:
+			}
+			continue
+		}
+
+		if l.readFile == nil {
+			file, err := os.Open(l.segmentPath(l.readSeq))
+			if errors.Is(err, os.ErrNotExist) && !writing {
+				l.readSeq++
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to open write-ahead log segment: %w", err)
+			}
+			l.readFile = file
+			l.reader = bufio.NewReader(file)
+			l.readOffset = 0
+			if l.skipTo > 0 {
+				if err := l.resume(); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		payload, err := l.readRecord()
+		if err == nil {
+			return payload, nil
+		}
+		if writing {
+			if err == io.EOF {
+				// The segment was rotated since writing was read.
+				continue
+			}
+			// Whole records below limit were written before it was read.
+			return nil, fmt.Errorf("failed to read write-ahead log segment: %w", err)
+		}
+		if err != io.EOF {
+			logger.Warn("discarding the rest of write-ahead log segment", "segment", l.readSeq, "error", err)
+		}
+		l.removeReadSegment()
+	}
+}
+
+func (l *Log) readRecord() ([]byte, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(l.reader, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("truncated record header")
+		}
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	info, err := l.readFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if l.readOffset+headerSize+int64(length) > info.Size() {
+		return nil, errors.New("truncated record")
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(l.reader, payload); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("record checksum mismatch")
+	}
+	l.readOffset += headerSize + int64(length)
+	return payload, nil
+}
+
+// resume moves the first read segment to the checkpoint offset. An offset
+// past its end means the checkpoint is not for this segment, so it is read
+// from the start.
+func (l *Log) resume() error {
+	offset := l.skipTo
+	l.skipTo = 0
+	info, err := l.readFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat write-ahead log segment: %w", err)
+	}
+	if offset > info.Size() {
+		logger.Warn("write-ahead log checkpoint is past the end of the segment, replaying all of it", "segment", l.readSeq)
+		l.mu.Lock()
+		l.consumed = 0
+		l.mu.Unlock()
+		return nil
+	}
+	if _, err := l.readFile.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek write-ahead log segment: %w", err)
+	}
+	l.reader.Reset(l.readFile)
+	l.readOffset = offset
+	return nil
+}
+
+// removeReadSegment deletes the segment the consumer has finished and moves
+// on to the next one.
+func (l *Log) removeReadSegment() {
+	path := l.segmentPath(l.readSeq)
+	info, statErr := l.readFile.Stat()
+	l.readFile.Close()
+	l.readFile, l.reader = nil, nil
+	removeErr := os.Remove(path)
+	if removeErr != nil {
+		logger.Warn("failed to remove write-ahead log segment", "error", removeErr)
+	}
+	l.mu.Lock()
+	if removeErr == nil && statErr == nil {
+		l.total -= info.Size()
+	}
+	l.consumed = 0
+	l.mu.Unlock()
+	l.readSeq++
+	l.readOffset = 0
+}
+
+// Close closes the segment files. It must not be called while Next runs.
+// Segments still on disk are read again by the next Open.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if l.readFile != nil {
+		l.readFile.Close()
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,197 @@
+package wal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openLog(t *testing.T, dir string, segmentBytes int64) *Log {
+	t.Helper()
+	l, err := Open(Config{Dir: dir, SegmentBytes: segmentBytes})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	return l
+}
+
+func appendAll(t *testing.T, l *Log, records ...string) {
+	t.Helper()
+	for _, record := range records {
+		if err := l.Append([]byte(record)); err != nil {
+			t.Fatalf("Append(%s) error = %v", record, err)
+		}
+	}
+}
+
+func next(t *testing.T, l *Log) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	payload, err := l.Next(ctx)
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	return string(payload)
+}
+
+// recordSize is the bytes a record of payload takes on disk.
+func recordSize(payload string) int64 {
+	return int64(headerSize + len(payload))
+}
+
+func TestLogReadsInOrder(t *testing.T) {
+	tests := []struct {
+		name         string
+		segmentBytes int64
+	}{
+		{"one segment", 1 << 20},
+		{"segment per record", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := openLog(t, t.TempDir(), tt.segmentBytes)
+			defer l.Close()
+			appendAll(t, l, "a", "b", "c")
+			for _, want := range []string{"a", "b", "c"} {
+				if got := next(t, l); got != want {
+					t.Errorf("Next() = %q, want %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLogResumesAtCheckpoint(t *testing.T) {
+	tests := []struct {
+		name         string
+		segmentBytes int64
+		finished     int
+	}{
+		{"nothing finished", 1 << 20, 0},
+		{"mid segment", 1 << 20, 2},
+		{"across segments", 1, 2},
+		{"everything finished", 1 << 20, 4},
+	}
+	records := []string{"first", "second", "third", "fourth"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l := openLog(t, dir, tt.segmentBytes)
+			appendAll(t, l, records...)
+			// Reading the record after the finished ones finishes them.
+			for i := 0; i <= tt.finished && i < len(records); i++ {
+				next(t, l)
+			}
+			if tt.finished == len(records) {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				l.Next(ctx)
+			}
+			l.Close()
+
+			l = openLog(t, dir, tt.segmentBytes)
+			defer l.Close()
+			var want int64
+			for _, record := range records[tt.finished:] {
+				want += recordSize(record)
+			}
+			if got := l.Size(); got != want {
+				t.Errorf("Size() after reopening = %d, want %d", got, want)
+			}
+			for _, record := range records[tt.finished:] {
+				if got := next(t, l); got != record {
+					t.Errorf("Next() = %q, want %q", got, record)
+				}
+			}
+		})
+	}
+}
+
+func TestLogSizeExcludesFinishedRecords(t *testing.T) {
+	l := openLog(t, t.TempDir(), 1<<20)
+	defer l.Close()
+	appendAll(t, l, "aaaa", "bb", "c")
+	total := recordSize("aaaa") + recordSize("bb") + recordSize("c")
+	tests := []struct {
+		read int
+		want int64
+	}{
+		{0, total},
+		// The record just returned is not finished yet.
+		{1, total},
+		{2, total - recordSize("aaaa")},
+		{3, recordSize("c")},
+	}
+	read := 0
+	for _, tt := range tests {
+		for ; read < tt.read; read++ {
+			next(t, l)
+		}
+		if got := l.Size(); got != tt.want {
+			t.Errorf("Size() after reading %d records = %d, want %d", tt.read, got, tt.want)
+		}
+	}
+}
+
+func TestLogSkipsCorruptRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		want    []string
+	}{
+		{"checksum mismatch", func(data []byte) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		}, []string{"good", "after"}},
+		{"truncated record", func(data []byte) []byte { return data[:len(data)-2] }, []string{"good", "after"}},
+		{"truncated header", func(data []byte) []byte { return append(data, 0, 0, 0) }, []string{"good", "last", "after"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			l := openLog(t, dir, 1<<20)
+			appendAll(t, l, "good", "last")
+			l.Close()
+
+			path := l.segmentPath(1)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, tt.corrupt(data), 0o640); err != nil {
+				t.Fatal(err)
+			}
+
+			l = openLog(t, dir, 1<<20)
+			defer l.Close()
+			appendAll(t, l, "after")
+			for _, want := range tt.want {
+				if got := next(t, l); got != want {
+					t.Errorf("Next() = %q, want %q", got, want)
+				}
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("corrupt segment was not removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestLogIgnoresInvalidCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	l := openLog(t, dir, 1<<20)
+	appendAll(t, l, "a", "b")
+	l.Close()
+	if err := os.WriteFile(filepath.Join(dir, checkpointName), []byte("garbage"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	l = openLog(t, dir, 1<<20)
+	defer l.Close()
+	if got := next(t, l); got != "a" {
+		t.Errorf("Next() = %q, want the log replayed from the start", got)
+	}
+}